@@ -54,23 +54,30 @@ func (endpoint *LinuxSocketEndpoint) dst6() *unix.SockaddrInet6 {
 	return (*unix.SockaddrInet6)(unsafe.Pointer(&endpoint.dst[0]))
 }
 
-// LinuxSocketBind uses sendmsg and recvmsg to implement a full bind with sticky sockets on Linux.
+// LinuxSocketBind uses sendmmsg and recvmmsg to implement a full bind with sticky sockets on Linux.
+// With offload, it also uses UDP GSO and GRO when the kernel supports them.
 type LinuxSocketBind struct {
+	gso4 uint32 // accessed atomically, cleared if the device can't segment
+	gso6 uint32 // accessed atomically
+
 	// mu guards sock4 and sock6 and the associated fds.
 	// As long as someone holds mu (read or write), the associated fds are valid.
 	mu         sync.RWMutex
 	fwmark     uint32
 	sock4      int
 	sock6      int
+	gro4       bool
+	gro6       bool
 	use4       bool
 	use6       bool
+	offload    bool
 	listen_ip4 [4]byte
 	listen_ip6 [16]byte
 }
 
 func NewLinuxSocketBind() Bind { return &LinuxSocketBind{sock4: -1, sock6: -1, use4: true, use6: true} }
-func NewLinuxSocketBindAf(use4 bool, use6 bool, listen_ip4 [4]byte, listen_ip6 [16]byte, fwmark uint32) Bind {
-	return &LinuxSocketBind{sock4: -1, sock6: -1, use4: use4, use6: use6, fwmark: fwmark, listen_ip4: listen_ip4, listen_ip6: listen_ip6}
+func NewLinuxSocketBindAf(use4 bool, use6 bool, listen_ip4 [4]byte, listen_ip6 [16]byte, fwmark uint32, offload bool) Bind {
+	return &LinuxSocketBind{sock4: -1, sock6: -1, use4: use4, use6: use6, fwmark: fwmark, offload: offload, listen_ip4: listen_ip4, listen_ip6: listen_ip6}
 }
 
 func NewDefaultBind(Af EnabledAf, bindmode string, fwmark uint32) Bind {
@@ -96,12 +103,16 @@ func NewDefaultBind(Af EnabledAf, bindmode string, fwmark uint32) Bind {
 	if bindmode == "std" {
 		return NewStdNetBindAf(Af.IPv4, Af.IPv6, ListenIP4.As4(), ListenIP6.As16(), fwmark)
 	}
-	return NewLinuxSocketBindAf(Af.IPv4, Af.IPv6, ListenIP4.As4(), ListenIP6.As16(), fwmark)
+	return NewLinuxSocketBindAf(Af.IPv4, Af.IPv6, ListenIP4.As4(), ListenIP6.As16(), fwmark, bindmode == "linux-offload")
 }
 
 var _ Endpoint = (*LinuxSocketEndpoint)(nil)
 var _ Bind = (*LinuxSocketBind)(nil)
 
+func (*LinuxSocketBind) BatchSize() int {
+	return IdealBatchSize
+}
+
 func (s *LinuxSocketBind) EnabledAf() EnabledAf {
 	return EnabledAf{
 		IPv4: s.use4,
@@ -199,11 +210,27 @@ again:
 	var fns []ReceiveFunc
 	if sock4 != -1 && bind.use4 {
 		bind.sock4 = sock4
-		fns = append(fns, bind.receiveIPv4)
+		bind.gso4, bind.gro4 = 0, false
+		if bind.offload {
+			gso, gro := setOffload(sock4)
+			if gso {
+				bind.gso4 = 1
+			}
+			bind.gro4 = gro
+		}
+		fns = append(fns, bind.makeReceiveIPv4())
 	}
 	if sock6 != -1 && bind.use6 {
 		bind.sock6 = sock6
-		fns = append(fns, bind.receiveIPv6)
+		bind.gso6, bind.gro6 = 0, false
+		if bind.offload {
+			gso, gro := setOffload(sock6)
+			if gso {
+				bind.gso6 = 1
+			}
+			bind.gro6 = gro
+		}
+		fns = append(fns, bind.makeReceiveIPv6())
 	}
 	if len(fns) == 0 {
 		return nil, 0, syscall.EAFNOSUPPORT
@@ -281,29 +308,33 @@ func (bind *LinuxSocketBind) Close() error {
 	return err2
 }
 
-func (bind *LinuxSocketBind) receiveIPv4(buf []byte) (int, Endpoint, error) {
-	bind.mu.RLock()
-	defer bind.mu.RUnlock()
-	if bind.sock4 == -1 {
-		return 0, nil, net.ErrClosed
+// Each ReceiveFunc is called by a single goroutine, so it keeps its own message headers.
+
+func (bind *LinuxSocketBind) makeReceiveIPv4() ReceiveFunc {
+	batch := newMmsgBatch(bind.BatchSize())
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		bind.mu.RLock()
+		defer bind.mu.RUnlock()
+		if bind.sock4 == -1 {
+			return 0, net.ErrClosed
+		}
+		return receiveBatch(bind.sock4, false, bind.gro4, batch, packets, sizes, eps)
 	}
-	var end LinuxSocketEndpoint
-	n, err := receive4(bind.sock4, buf, &end)
-	return n, &end, err
 }
 
-func (bind *LinuxSocketBind) receiveIPv6(buf []byte) (int, Endpoint, error) {
-	bind.mu.RLock()
-	defer bind.mu.RUnlock()
-	if bind.sock6 == -1 {
-		return 0, nil, net.ErrClosed
+func (bind *LinuxSocketBind) makeReceiveIPv6() ReceiveFunc {
+	batch := newMmsgBatch(bind.BatchSize())
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		bind.mu.RLock()
+		defer bind.mu.RUnlock()
+		if bind.sock6 == -1 {
+			return 0, net.ErrClosed
+		}
+		return receiveBatch(bind.sock6, true, bind.gro6, batch, packets, sizes, eps)
 	}
-	var end LinuxSocketEndpoint
-	n, err := receive6(bind.sock6, buf, &end)
-	return n, &end, err
 }
 
-func (bind *LinuxSocketBind) Send(buff []byte, end Endpoint) error {
+func (bind *LinuxSocketBind) Send(bufs [][]byte, end Endpoint) error {
 	nend, ok := end.(*LinuxSocketEndpoint)
 	if !ok {
 		return ErrWrongEndpointType
@@ -314,12 +345,12 @@ func (bind *LinuxSocketBind) Send(buff []byte, end Endpoint) error {
 		if bind.sock4 == -1 {
 			return net.ErrClosed
 		}
-		return send4(bind.sock4, nend, buff)
+		return sendBatch(bind.sock4, nend, bufs, &bind.gso4)
 	} else {
 		if bind.sock6 == -1 {
 			return net.ErrClosed
 		}
-		return send6(bind.sock6, nend, buff)
+		return sendBatch(bind.sock6, nend, bufs, &bind.gso6)
 	}
 }
 
@@ -426,6 +457,8 @@ func create4(listen_ip [4]byte, port uint16) (int, uint16, error) {
 			return err
 		}
 
+		setSocketBuffers(fd)
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -480,6 +513,8 @@ func create6(listen_ip [16]byte, port uint16) (int, uint16, error) {
 			return err
 		}
 
+		setSocketBuffers(fd)
+
 		return unix.Bind(fd, &addr)
 
 	}(); err != nil {
@@ -494,151 +529,3 @@ func create6(listen_ip [16]byte, port uint16) (int, uint16, error) {
 
 	return fd, uint16(addr.Port), err
 }
-
-func send4(sock int, end *LinuxSocketEndpoint, buff []byte) error {
-
-	// construct message header
-
-	cmsg := struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}{
-		unix.Cmsghdr{
-			Level: unix.IPPROTO_IP,
-			Type:  unix.IP_PKTINFO,
-			Len:   unix.SizeofInet4Pktinfo + unix.SizeofCmsghdr,
-		},
-		unix.Inet4Pktinfo{
-			Spec_dst: end.src4().Src,
-			Ifindex:  end.src4().Ifindex,
-		},
-	}
-
-	end.mu.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
-	end.mu.Unlock()
-
-	if err == nil {
-		return nil
-	}
-
-	// clear src and retry
-
-	if err == unix.EINVAL {
-		end.ClearSrc()
-		cmsg.pktinfo = unix.Inet4Pktinfo{}
-		end.mu.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
-		end.mu.Unlock()
-	}
-
-	return err
-}
-
-func send6(sock int, end *LinuxSocketEndpoint, buff []byte) error {
-
-	// construct message header
-
-	cmsg := struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}{
-		unix.Cmsghdr{
-			Level: unix.IPPROTO_IPV6,
-			Type:  unix.IPV6_PKTINFO,
-			Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
-		},
-		unix.Inet6Pktinfo{
-			Addr:    end.src6().src,
-			Ifindex: end.dst6().ZoneId,
-		},
-	}
-
-	if cmsg.pktinfo.Addr == [16]byte{} {
-		cmsg.pktinfo.Ifindex = 0
-	}
-
-	end.mu.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
-	end.mu.Unlock()
-
-	if err == nil {
-		return nil
-	}
-
-	// clear src and retry
-
-	if err == unix.EINVAL {
-		end.ClearSrc()
-		cmsg.pktinfo = unix.Inet6Pktinfo{}
-		end.mu.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
-		end.mu.Unlock()
-	}
-
-	return err
-}
-
-func receive4(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
-
-	// construct message header
-
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}
-
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
-
-	if err != nil {
-		return 0, err
-	}
-	end.isV6 = false
-
-	if newDst4, ok := newDst.(*unix.SockaddrInet4); ok {
-		*end.dst4() = *newDst4
-	}
-
-	// update source cache
-
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IP &&
-		cmsg.cmsghdr.Type == unix.IP_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
-		end.src4().Src = cmsg.pktinfo.Spec_dst
-		end.src4().Ifindex = cmsg.pktinfo.Ifindex
-	}
-
-	return size, nil
-}
-
-func receive6(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
-
-	// construct message header
-
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}
-
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
-
-	if err != nil {
-		return 0, err
-	}
-	end.isV6 = true
-
-	if newDst6, ok := newDst.(*unix.SockaddrInet6); ok {
-		*end.dst6() = *newDst6
-	}
-
-	// update source cache
-
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IPV6 &&
-		cmsg.cmsghdr.Type == unix.IPV6_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
-		end.src6().src = cmsg.pktinfo.Addr
-		end.dst6().ZoneId = cmsg.pktinfo.Ifindex
-	}
-
-	return size, nil
-}
@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func openLoopback(tb testing.TB, offload bool) (bind Bind, fn ReceiveFunc, port uint16) {
+	bind = NewLinuxSocketBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0, offload)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return bind, fns[0], port
+}
+
+func newBufs(count int) [][]byte {
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1<<16-1)
+	}
+	return bufs
+}
+
+// receiveLoop reads packets until the bind is closed, and returns the number received.
+func receiveLoop(fn ReceiveFunc, batchSize int, check func(packet []byte, ep Endpoint)) *uint64 {
+	var received uint64
+	go func() {
+		packets := newBufs(batchSize)
+		sizes := make([]int, batchSize)
+		eps := make([]Endpoint, batchSize)
+		for {
+			n, err := fn(packets, sizes, eps)
+			if err != nil {
+				return
+			}
+			for i := 0; i < n; i++ {
+				if sizes[i] == 0 {
+					continue
+				}
+				if check != nil {
+					check(packets[i][:sizes[i]], eps[i])
+				}
+				atomic.AddUint64(&received, 1)
+			}
+		}
+	}()
+	return &received
+}
+
+// waitReceived waits until want packets are received, or no packet arrives for a while.
+func waitReceived(received *uint64, want uint64) uint64 {
+	last := atomic.LoadUint64(received)
+	idle := time.Now()
+	for last < want && time.Since(idle) < 200*time.Millisecond {
+		time.Sleep(time.Millisecond)
+		if n := atomic.LoadUint64(received); n != last {
+			last = n
+			idle = time.Now()
+		}
+	}
+	return last
+}
+
+func TestLinuxSocketBindBatch(t *testing.T) {
+	// with 8 packets per read, the segments of a GRO datagram don't fit
+	for _, tt := range []struct {
+		offload   bool
+		batchSize int
+	}{{false, IdealBatchSize}, {true, IdealBatchSize}, {true, 8}} {
+		offload := tt.offload
+		rx, rxFn, rxPort := openLoopback(t, offload)
+		tx, _, txPort := openLoopback(t, offload)
+
+		// 64 packets of the same size, then smaller ones which end GSO datagrams
+		sizes := make([]int, 0, 100)
+		for i := 0; i < 64; i++ {
+			sizes = append(sizes, 1000)
+		}
+		for i := 0; i < 36; i++ {
+			sizes = append(sizes, 1000-i*10)
+		}
+		var bad uint64
+		received := receiveLoop(rxFn, tt.batchSize, func(packet []byte, ep Endpoint) {
+			index := binary.LittleEndian.Uint32(packet)
+			if int(index) >= len(sizes) || len(packet) != sizes[index] || packet[len(packet)-1] != byte(index) {
+				atomic.AddUint64(&bad, 1)
+			}
+			if ep.(*LinuxSocketEndpoint).dst4().Port != int(txPort) || ep.SrcIP().String() != "127.0.0.1" {
+				atomic.AddUint64(&bad, 1)
+			}
+		})
+
+		ep, err := tx.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(rxPort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufs := newBufs(len(sizes))
+		for i, size := range sizes {
+			bufs[i] = bufs[i][:size]
+			binary.LittleEndian.PutUint32(bufs[i], uint32(i))
+			bufs[i][size-1] = byte(i)
+		}
+		if err := tx.Send(bufs, ep); err != nil {
+			t.Fatal(err)
+		}
+		got := waitReceived(received, uint64(len(sizes)))
+		rx.Close()
+		tx.Close()
+		if got != uint64(len(sizes)) || atomic.LoadUint64(&bad) != 0 {
+			t.Fatalf("offload %v batch %v: received %d of %d packets, %d corrupted", offload, tt.batchSize, got, len(sizes), bad)
+		}
+	}
+}
+
+// benchmarkLinuxSocketBind sends batches of batchSize packets from each sender at the same time.
+func benchmarkLinuxSocketBind(b *testing.B, senders int, batchSize int, offload bool) {
+	rx, rxFn, rxPort := openLoopback(b, offload)
+	defer rx.Close()
+	received := receiveLoop(rxFn, rx.BatchSize(), nil)
+
+	// keep at most window packets in flight, so that the socket buffer doesn't overflow
+	const window = 4096
+	var sent int64
+	var wg sync.WaitGroup
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for i := 0; i < senders; i++ {
+		tx, _, _ := openLoopback(b, offload)
+		defer tx.Close()
+		ep, err := tx.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(rxPort)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		bufs := newBufs(batchSize)
+		for j := range bufs {
+			bufs[j] = bufs[j][:1400]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				start := atomic.AddInt64(&sent, int64(batchSize)) - int64(batchSize)
+				if start >= int64(b.N) {
+					return
+				}
+				if int64(b.N)-start < int64(batchSize) {
+					bufs = bufs[:int64(b.N)-start]
+				}
+				for start-int64(atomic.LoadUint64(received)) > window {
+					runtime.Gosched()
+				}
+				if err := tx.Send(bufs, ep); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	got := waitReceived(received, uint64(b.N))
+	b.StopTimer()
+	b.ReportMetric(float64(uint64(b.N)-got)/float64(b.N), "loss")
+}
+
+func BenchmarkLinuxSocketBind(b *testing.B) {
+	b.Run("batch=1", func(b *testing.B) { benchmarkLinuxSocketBind(b, 1, 1, false) })
+	b.Run("batch=128", func(b *testing.B) { benchmarkLinuxSocketBind(b, 1, IdealBatchSize, false) })
+	b.Run("batch=128,offload", func(b *testing.B) { benchmarkLinuxSocketBind(b, 1, IdealBatchSize, true) })
+	// GRO can't merge the small batches of many peers
+	b.Run("senders=32,batch=4", func(b *testing.B) { benchmarkLinuxSocketBind(b, 32, 4, false) })
+	b.Run("senders=32,batch=4,offload", func(b *testing.B) { benchmarkLinuxSocketBind(b, 32, 4, true) })
+}
@@ -178,25 +178,37 @@ func (bind *StdNetBind) Close() error {
 	return err2
 }
 
+// BatchSize is 1, the net package reads and writes one datagram per call.
+func (*StdNetBind) BatchSize() int {
+	return 1
+}
+
 func (*StdNetBind) makeReceiveIPv4(conn *net.UDPConn) ReceiveFunc {
-	return func(buff []byte) (int, Endpoint, error) {
-		n, endpoint, err := conn.ReadFromUDP(buff)
-		if endpoint != nil {
-			endpoint.IP = endpoint.IP.To4()
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, endpoint, err := conn.ReadFromUDP(packets[0])
+		if err != nil {
+			return 0, err
 		}
-		return n, (*StdNetEndpoint)(endpoint), err
+		endpoint.IP = endpoint.IP.To4()
+		sizes[0] = n
+		eps[0] = (*StdNetEndpoint)(endpoint)
+		return 1, nil
 	}
 }
 
 func (*StdNetBind) makeReceiveIPv6(conn *net.UDPConn) ReceiveFunc {
-	return func(buff []byte) (int, Endpoint, error) {
-		n, endpoint, err := conn.ReadFromUDP(buff)
-		return n, (*StdNetEndpoint)(endpoint), err
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, endpoint, err := conn.ReadFromUDP(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = (*StdNetEndpoint)(endpoint)
+		return 1, nil
 	}
 }
 
-func (bind *StdNetBind) Send(buff []byte, endpoint Endpoint) error {
-	var err error
+func (bind *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	nend, ok := endpoint.(*StdNetEndpoint)
 	if !ok {
 		return ErrWrongEndpointType
@@ -217,6 +229,10 @@ func (bind *StdNetBind) Send(buff []byte, endpoint Endpoint) error {
 	if conn == nil {
 		return syscall.EAFNOSUPPORT
 	}
-	_, err = conn.WriteToUDP(buff, (*net.UDPAddr)(nend))
-	return err
+	for _, buff := range bufs {
+		if _, err := conn.WriteToUDP(buff, (*net.UDPAddr)(nend)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
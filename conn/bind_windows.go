@@ -411,16 +411,32 @@ retry:
 	return n, &ep, nil
 }
 
-func (bind *WinRingBind) receiveIPv4(buf []byte) (int, Endpoint, error) {
+func (*WinRingBind) BatchSize() int {
+	return 1
+}
+
+func (bind *WinRingBind) receiveIPv4(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	return bind.v4.Receive(buf, &bind.isOpen)
+	n, ep, err := bind.v4.Receive(packets[0], &bind.isOpen)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	eps[0] = ep
+	return 1, nil
 }
 
-func (bind *WinRingBind) receiveIPv6(buf []byte) (int, Endpoint, error) {
+func (bind *WinRingBind) receiveIPv6(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	return bind.v6.Receive(buf, &bind.isOpen)
+	n, ep, err := bind.v6.Receive(packets[0], &bind.isOpen)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	eps[0] = ep
+	return 1, nil
 }
 
 func (bind *afWinRingBind) Send(buf []byte, nend *WinRingEndpoint, isOpen *uint32) error {
@@ -475,24 +491,29 @@ func (bind *afWinRingBind) Send(buf []byte, nend *WinRingEndpoint, isOpen *uint3
 	return winrio.SendEx(bind.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, 0, 0)
 }
 
-func (bind *WinRingBind) Send(buf []byte, endpoint Endpoint) error {
+func (bind *WinRingBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	nend, ok := endpoint.(*WinRingEndpoint)
 	if !ok {
 		return ErrWrongEndpointType
 	}
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
+	var af *afWinRingBind
 	switch nend.family {
 	case windows.AF_INET:
-		if bind.v4.blackhole {
-			return nil
-		}
-		return bind.v4.Send(buf, nend, &bind.isOpen)
+		af = &bind.v4
 	case windows.AF_INET6:
-		if bind.v6.blackhole {
-			return nil
+		af = &bind.v6
+	default:
+		return nil
+	}
+	if af.blackhole {
+		return nil
+	}
+	for _, buf := range bufs {
+		if err := af.Send(buf, nend, &bind.isOpen); err != nil {
+			return err
 		}
-		return bind.v6.Send(buf, nend, &bind.isOpen)
 	}
 	return nil
 }
@@ -11,16 +11,23 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 )
 
 type ChannelBind struct {
+	dropped          uint64 // accessed atomically, first for 64-bit alignment
 	rx4, tx4         *chan []byte
 	rx6, tx6         *chan []byte
 	closeSignal      chan bool
 	source4, source6 ChannelEndpoint
 	target4, target6 ChannelEndpoint
+
+	lossLock sync.Mutex
+	loss     float64
+	lossRand *rand.Rand
 }
 
 type ChannelEndpoint uint16
@@ -53,6 +60,38 @@ func NewChannelBinds() [2]conn.Bind {
 	return [2]conn.Bind{&binds[0], &binds[1]}
 }
 
+// NewLossyChannelBinds is like NewChannelBinds, but every bind drops the packets it sends with probability loss.
+// The drops are reproducible for a given seed.
+func NewLossyChannelBinds(loss float64, seed int64) [2]conn.Bind {
+	binds := NewChannelBinds()
+	for i, bind := range binds {
+		bind.(*ChannelBind).SetLoss(loss, seed+int64(i))
+	}
+	return binds
+}
+
+func (c *ChannelBind) SetLoss(loss float64, seed int64) {
+	c.lossLock.Lock()
+	defer c.lossLock.Unlock()
+	c.loss = loss
+	c.lossRand = rand.New(rand.NewSource(seed))
+}
+
+// Dropped returns the number of packets dropped by Send.
+func (c *ChannelBind) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *ChannelBind) drop() bool {
+	c.lossLock.Lock()
+	defer c.lossLock.Unlock()
+	if c.loss <= 0 || c.lossRand.Float64() >= c.loss {
+		return false
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return true
+}
+
 func (s *ChannelBind) EnabledAf() conn.EnabledAf {
 	return conn.EnabledAf{
 		IPv4: true,
@@ -96,30 +135,49 @@ func (c *ChannelBind) Close() error {
 
 func (c *ChannelBind) SetMark(mark uint32) error { return nil }
 
+func (c *ChannelBind) BatchSize() int { return conn.IdealBatchSize }
+
+// makeReceiveFunc waits for the first packet, then takes the queued ones up to the batch size.
 func (c *ChannelBind) makeReceiveFunc(ch chan []byte) conn.ReceiveFunc {
-	return func(b []byte) (n int, ep conn.Endpoint, err error) {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
 		select {
 		case <-c.closeSignal:
-			return 0, nil, net.ErrClosed
+			return 0, net.ErrClosed
 		case rx := <-ch:
-			return copy(b, rx), c.target6, nil
+			sizes[0] = copy(packets[0], rx)
+			eps[0] = c.target6
 		}
+		for n = 1; n < len(packets); n++ {
+			select {
+			case rx := <-ch:
+				sizes[n] = copy(packets[n], rx)
+				eps[n] = c.target6
+			default:
+				return n, nil
+			}
+		}
+		return n, nil
 	}
 }
 
-func (c *ChannelBind) Send(b []byte, ep conn.Endpoint) error {
-	select {
-	case <-c.closeSignal:
-		return net.ErrClosed
-	default:
-		bc := make([]byte, len(b))
-		copy(bc, b)
-		if ep.(ChannelEndpoint) == c.target4 {
-			*c.tx4 <- bc
-		} else if ep.(ChannelEndpoint) == c.target6 {
-			*c.tx6 <- bc
-		} else {
-			return os.ErrInvalid
+func (c *ChannelBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, b := range bufs {
+		select {
+		case <-c.closeSignal:
+			return net.ErrClosed
+		default:
+			if c.drop() {
+				continue
+			}
+			bc := make([]byte, len(b))
+			copy(bc, b)
+			if ep.(ChannelEndpoint) == c.target4 {
+				*c.tx4 <- bc
+			} else if ep.(ChannelEndpoint) == c.target6 {
+				*c.tx6 <- bc
+			} else {
+				return os.ErrInvalid
+			}
 		}
 	}
 	return nil
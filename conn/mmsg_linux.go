@@ -0,0 +1,420 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	udpSegmentMaxDatagrams = 64 // UDP_MAX_SEGMENTS, also the most segments GRO merges into one datagram
+	maxIPv4PayloadLen      = 1<<16 - 1 - 20 - 8
+	maxIPv6PayloadLen      = 1<<16 - 1 - 8
+	socketBufferSize       = 7 << 20 // holds a few batches of every peer at 10G
+)
+
+// controlSize fits IP_PKTINFO or IPV6_PKTINFO, followed by UDP_SEGMENT or UDP_GRO
+var controlSize = unix.CmsgSpace(unix.SizeofInet6Pktinfo) + unix.CmsgSpace(4)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2)
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgBatch holds the message headers of a recvmmsg or sendmmsg call, reused across calls.
+type mmsgBatch struct {
+	msgs    []mmsghdr
+	iovecs  []unix.Iovec
+	names   []unix.RawSockaddrInet6 // large enough for both families
+	control [][]byte
+
+	// receive only
+	ends          []*LinuxSocketEndpoint
+	segments      []int // GRO segment size of each message
+	avgSegments   int   // segments per datagram of the last read, to size the next one
+	scratch       []byte
+	remainders    []groRemainder
+	nextRemainder int
+}
+
+// groRemainder is a segment of a GRO datagram which didn't fit in the packets of a receiveBatch call.
+type groRemainder struct {
+	start, stop int // in the scratch area
+	end         *LinuxSocketEndpoint
+}
+
+func newMmsgBatch(size int) *mmsgBatch {
+	b := &mmsgBatch{
+		msgs:    make([]mmsghdr, size),
+		iovecs:  make([]unix.Iovec, size),
+		names:   make([]unix.RawSockaddrInet6, size),
+		control: make([][]byte, size),
+	}
+	for i := range b.msgs {
+		b.control[i] = make([]byte, controlSize)
+		b.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.msgs[i].hdr.Iov = &b.iovecs[i]
+		b.msgs[i].hdr.SetIovlen(1)
+		b.msgs[i].hdr.Control = &b.control[i][0]
+	}
+	return b
+}
+
+var sendBatches = sync.Pool{
+	New: func() interface{} {
+		return newMmsgBatch(IdealBatchSize)
+	},
+}
+
+func (b *mmsgBatch) setBuffer(i int, buf []byte) {
+	b.iovecs[i].Base = &buf[0]
+	b.iovecs[i].SetLen(len(buf))
+}
+
+func recvmmsg(fd int, msgs []mmsghdr) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), unix.MSG_WAITFORONE, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+func sendmmsg(fd int, msgs []mmsghdr) error {
+	for len(msgs) > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+func htons(port int) uint16 {
+	var b [2]byte
+	b[0] = byte(port >> 8)
+	b[1] = byte(port)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+// setSocketBuffers enlarges the socket buffers, above net.core.rmem_max and wmem_max if we have CAP_NET_ADMIN.
+func setSocketBuffers(fd int) {
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, socketBufferSize) != nil {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, socketBufferSize)
+	}
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, socketBufferSize) != nil {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, socketBufferSize)
+	}
+}
+
+// setOffload enables UDP_GRO on the socket, and reports whether UDP_SEGMENT and UDP_GRO are supported.
+func setOffload(fd int) (gso bool, gro bool) {
+	_, err := unix.GetsockoptInt(fd, unix.SOL_UDP, unix.UDP_SEGMENT)
+	gso = err == nil
+	gro = unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_GRO, 1) == nil
+	return
+}
+
+// parseControl updates the source cache of the endpoint, and returns the segment size of a GRO datagram.
+func parseControl(control []byte, end *LinuxSocketEndpoint) (segment int) {
+	for len(control) >= unix.CmsgLen(0) {
+		hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		if int(hdr.Len) < unix.CmsgLen(0) || int(hdr.Len) > len(control) {
+			return
+		}
+		data := control[unix.CmsgLen(0):hdr.Len]
+		switch {
+		case hdr.Level == unix.IPPROTO_IP && hdr.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src4().Src = pktinfo.Spec_dst
+			end.src4().Ifindex = pktinfo.Ifindex
+		case hdr.Level == unix.IPPROTO_IPV6 && hdr.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src6().src = pktinfo.Addr
+			end.dst6().ZoneId = pktinfo.Ifindex
+		case hdr.Level == unix.SOL_UDP && hdr.Type == unix.UDP_GRO && len(data) >= 4:
+			segment = int(*(*int32)(unsafe.Pointer(&data[0])))
+		}
+		next := unix.CmsgSpace(int(hdr.Len) - unix.CmsgLen(0))
+		if next > len(control) {
+			return
+		}
+		control = control[next:]
+	}
+	return
+}
+
+// receiveBatch reads datagrams from the socket with recvmmsg, into every packet.
+// With GRO, the merged datagrams are split into the packets after them. The segments which don't fit
+// are kept in the scratch area of the batch, and the next call returns them without reading.
+func receiveBatch(sock int, isV6 bool, gro bool, batch *mmsgBatch, packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	if batch.nextRemainder < len(batch.remainders) {
+		return batch.popRemainders(packets, sizes, eps), nil
+	}
+	reads := len(packets)
+	if gro && batch.avgSegments > 1 {
+		// leave room for the segments, a few more than room go to the scratch area
+		reads = (len(packets) + batch.avgSegments - 1) / batch.avgSegments
+	}
+	if reads > len(batch.msgs) {
+		reads = len(batch.msgs)
+	}
+	msgs := batch.msgs[:reads]
+	for i := range msgs {
+		batch.setBuffer(i, packets[i])
+		msgs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		msgs[i].hdr.SetControllen(len(batch.control[i]))
+		msgs[i].hdr.Flags = 0
+		msgs[i].len = 0
+	}
+	n, err := recvmmsg(sock, msgs)
+	if err != nil {
+		return 0, err
+	}
+	if len(batch.ends) < n {
+		batch.ends = make([]*LinuxSocketEndpoint, len(batch.msgs))
+		batch.segments = make([]int, len(batch.msgs))
+	}
+
+	total := 0
+	for i := 0; i < n; i++ {
+		end := &LinuxSocketEndpoint{isV6: isV6}
+		if isV6 {
+			raw := &batch.names[i]
+			*end.dst6() = unix.SockaddrInet6{Port: ntohs(raw.Port), ZoneId: raw.Scope_id, Addr: raw.Addr}
+		} else {
+			raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&batch.names[i]))
+			*end.dst4() = unix.SockaddrInet4{Port: ntohs(raw.Port), Addr: raw.Addr}
+		}
+		control := batch.control[i][:msgs[i].hdr.Controllen]
+		segment := parseControl(control, end)
+		if length := int(msgs[i].len); segment <= 0 || segment > length {
+			segment = length
+		}
+		batch.ends[i], batch.segments[i] = end, segment
+		total += segmentCount(int(msgs[i].len), segment)
+	}
+	batch.avgSegments = (total + n - 1) / n
+
+	// the segments after the last packet go to the scratch area, before any packet is written
+	pos := 0
+	for i := 0; i < n; i++ {
+		packet := packets[i][:msgs[i].len]
+		forSegments(len(packet), batch.segments[i], func(start, stop int) {
+			if pos >= len(packets) {
+				batch.remainders = append(batch.remainders, groRemainder{len(batch.scratch), len(batch.scratch) + stop - start, batch.ends[i]})
+				batch.scratch = append(batch.scratch, packet[start:stop]...)
+			}
+			pos++
+		})
+	}
+	// the segments of a datagram go to its own packet and the ones after it, which are
+	// free once the datagrams after it are split, so split from the last one
+	for i := n - 1; i >= 0; i-- {
+		packet := packets[i][:msgs[i].len]
+		pos -= segmentCount(len(packet), batch.segments[i])
+		dst := pos
+		forSegments(len(packet), batch.segments[i], func(start, stop int) {
+			if dst == i {
+				sizes[dst] = stop
+			} else if dst < len(packets) {
+				sizes[dst] = copy(packets[dst], packet[start:stop])
+			}
+			if dst < len(packets) {
+				eps[dst] = batch.ends[i]
+			}
+			dst++
+		})
+	}
+	if total > len(packets) {
+		total = len(packets)
+	}
+	return total, nil
+}
+
+// popRemainders returns the segments kept in the scratch area by the last receiveBatch.
+func (b *mmsgBatch) popRemainders(packets [][]byte, sizes []int, eps []Endpoint) int {
+	count := 0
+	for ; count < len(packets) && b.nextRemainder < len(b.remainders); count++ {
+		r := b.remainders[b.nextRemainder]
+		sizes[count] = copy(packets[count], b.scratch[r.start:r.stop])
+		eps[count] = r.end
+		b.nextRemainder++
+	}
+	if b.nextRemainder == len(b.remainders) {
+		b.remainders, b.nextRemainder, b.scratch = b.remainders[:0], 0, b.scratch[:0]
+	}
+	return count
+}
+
+// segmentCount returns the number of segments of a datagram, an empty one is a segment too.
+func segmentCount(length int, segment int) int {
+	if length == 0 {
+		return 1
+	}
+	return (length + segment - 1) / segment
+}
+
+func forSegments(length int, segment int, fn func(start, stop int)) {
+	for start := 0; ; start += segment {
+		stop := start + segment
+		if stop > length {
+			stop = length
+		}
+		fn(start, stop)
+		if stop == length {
+			return
+		}
+	}
+}
+
+// prepareSend fills the message headers to send bufs to end, and returns the number of messages.
+// With gso, consecutive packets of the same size (the last one may be smaller) are sent as one datagram,
+// appended in the spare capacity of the first one.
+func (b *mmsgBatch) prepareSend(end *LinuxSocketEndpoint, bufs [][]byte, gso bool) int {
+	end.mu.Lock()
+	var name unix.RawSockaddrInet6
+	var namelen uint32
+	var pktinfo []byte
+	maxLen := maxIPv4PayloadLen
+	if !end.isV6 {
+		raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&name))
+		raw.Family = unix.AF_INET
+		raw.Port = htons(end.dst4().Port)
+		raw.Addr = end.dst4().Addr
+		namelen = unix.SizeofSockaddrInet4
+		cmsg := struct {
+			cmsghdr unix.Cmsghdr
+			pktinfo unix.Inet4Pktinfo
+		}{
+			unix.Cmsghdr{
+				Level: unix.IPPROTO_IP,
+				Type:  unix.IP_PKTINFO,
+			},
+			unix.Inet4Pktinfo{
+				Spec_dst: end.src4().Src,
+				Ifindex:  end.src4().Ifindex,
+			},
+		}
+		cmsg.cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		pktinfo = (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	} else {
+		maxLen = maxIPv6PayloadLen
+		name.Family = unix.AF_INET6
+		name.Port = htons(end.dst6().Port)
+		name.Addr = end.dst6().Addr
+		name.Scope_id = end.dst6().ZoneId
+		namelen = unix.SizeofSockaddrInet6
+		cmsg := struct {
+			cmsghdr unix.Cmsghdr
+			pktinfo unix.Inet6Pktinfo
+		}{
+			unix.Cmsghdr{
+				Level: unix.IPPROTO_IPV6,
+				Type:  unix.IPV6_PKTINFO,
+			},
+			unix.Inet6Pktinfo{
+				Addr:    end.src6().src,
+				Ifindex: end.dst6().ZoneId,
+			},
+		}
+		if cmsg.pktinfo.Addr == [16]byte{} {
+			cmsg.pktinfo.Ifindex = 0
+		}
+		cmsg.cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+		pktinfo = (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	}
+	end.mu.Unlock()
+
+	n := 0
+	for i := 0; i < len(bufs); n++ {
+		buf := bufs[i]
+		size := len(buf)
+		segments := 1
+		for i++; gso && i < len(bufs) && segments < udpSegmentMaxDatagrams; i++ {
+			next := bufs[i]
+			if len(next) > size || len(buf)+len(next) > maxLen || len(buf)+len(next) > cap(buf) {
+				break
+			}
+			buf = append(buf, next...)
+			segments++
+			if len(next) < size {
+				i++
+				break
+			}
+		}
+
+		b.names[n] = name
+		b.msgs[n].hdr.Namelen = namelen
+		b.setBuffer(n, buf)
+		control := b.control[n]
+		length := copy(control, pktinfo)
+		if segments > 1 {
+			hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[length]))
+			hdr.Level = unix.SOL_UDP
+			hdr.Type = unix.UDP_SEGMENT
+			hdr.SetLen(unix.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&control[length+unix.CmsgLen(0)])) = uint16(size)
+			length += unix.CmsgSpace(2)
+		}
+		b.msgs[n].hdr.SetControllen(length)
+		b.msgs[n].hdr.Flags = 0
+	}
+	return n
+}
+
+// sendBatch writes bufs to the socket with sendmmsg.
+// A failed batch is sent again from the start, duplicates are dropped by the replay filter of the receiver.
+func sendBatch(sock int, end *LinuxSocketEndpoint, bufs [][]byte, gso *uint32) error {
+	batch := sendBatches.Get().(*mmsgBatch)
+	defer sendBatches.Put(batch)
+	if len(bufs) > len(batch.msgs) {
+		batch = newMmsgBatch(len(bufs))
+	}
+
+	useGSO := atomic.LoadUint32(gso) != 0
+	n := batch.prepareSend(end, bufs, useGSO)
+	err := sendmmsg(sock, batch.msgs[:n])
+	if err == nil {
+		return nil
+	}
+
+	// the device can't segment, send the packets one by one from now on
+	if useGSO && err == unix.EIO {
+		atomic.StoreUint32(gso, 0)
+		useGSO = false
+		n = batch.prepareSend(end, bufs, useGSO)
+		err = sendmmsg(sock, batch.msgs[:n])
+	}
+
+	// clear src and retry
+
+	if err == unix.EINVAL {
+		end.ClearSrc()
+		n = batch.prepareSend(end, bufs, useGSO)
+		err = sendmmsg(sock, batch.msgs[:n])
+	}
+
+	return err
+}
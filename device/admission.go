@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// In P2P mode every node adds the peers its neighbors announce. The admission mode decides which of them we add:
+// any (open), the PubKeys listed for their NodeID in our config (allowlist), or the ones with a certificate
+// signed by the network CA (ca). Nodes send their certificate in their pings, and their neighbors pass it on
+// in their announcements. A peer admitted by its certificate is removed once the certificate expires, unless
+// it sent us a renewed one, and it is never saved to the config file.
+//
+//	NodeID (2) | PubKey (32) | expiry, unix seconds (8) | ed25519 signature of the CA (64)
+
+const (
+	PeerCertOffsetNodeID    = 0
+	PeerCertOffsetPubKey    = 2
+	PeerCertOffsetExpiry    = 34
+	PeerCertOffsetSignature = 42
+	PeerCertLen             = PeerCertOffsetSignature + ed25519.SignatureSize
+
+	AdmissionOpen      = "open"
+	AdmissionAllowlist = "allowlist"
+	AdmissionCA        = "ca"
+)
+
+var peerCertLabel = []byte("EtherGuard peer certificate")
+
+type admissionState struct {
+	mode        string
+	allowed     map[mtypes.Vertex][]NoisePublicKey
+	ca          ed25519.PublicKey
+	certificate []byte
+}
+
+func peerCertMessage(cert []byte) []byte {
+	return append(append([]byte(nil), peerCertLabel...), cert[:PeerCertOffsetSignature]...)
+}
+
+// SignPeerCertificate certifies that id uses pk until expiry.
+func SignPeerCertificate(ca ed25519.PrivateKey, id mtypes.Vertex, pk NoisePublicKey, expiry time.Time) []byte {
+	cert := make([]byte, PeerCertLen)
+	binary.LittleEndian.PutUint16(cert[PeerCertOffsetNodeID:], uint16(id))
+	copy(cert[PeerCertOffsetPubKey:], pk[:])
+	binary.LittleEndian.PutUint64(cert[PeerCertOffsetExpiry:], uint64(expiry.Unix()))
+	copy(cert[PeerCertOffsetSignature:], ed25519.Sign(ca, peerCertMessage(cert)))
+	return cert
+}
+
+// VerifyPeerCertificate checks that cert is signed by ca, certifies id and pk and has not expired.
+func VerifyPeerCertificate(ca ed25519.PublicKey, cert []byte, id mtypes.Vertex, pk NoisePublicKey, now time.Time) error {
+	if len(cert) == 0 {
+		return errors.New("no certificate")
+	}
+	if len(cert) != PeerCertLen {
+		return fmt.Errorf("certificate of %v bytes", len(cert))
+	}
+	if !ed25519.Verify(ca, peerCertMessage(cert), cert[PeerCertOffsetSignature:]) {
+		return errors.New("certificate not signed by the CA")
+	}
+	if cert_id := mtypes.Vertex(binary.LittleEndian.Uint16(cert[PeerCertOffsetNodeID:])); cert_id != id {
+		return fmt.Errorf("certificate is for NodeID %v", cert_id)
+	}
+	if !pk.Equals(mtypes.ByteSlice2Byte32(cert[PeerCertOffsetPubKey:PeerCertOffsetExpiry])) {
+		return errors.New("certificate is for another PubKey")
+	}
+	if expiry := peerCertExpiry(cert); now.After(expiry) {
+		return fmt.Errorf("certificate expired at %v", expiry)
+	}
+	return nil
+}
+
+func peerCertExpiry(cert []byte) time.Time {
+	return time.Unix(int64(binary.LittleEndian.Uint64(cert[PeerCertOffsetExpiry:])), 0)
+}
+
+// SetAdmission parses the admission config. Our own certificate is checked against our NodeID and private key,
+// so the private key must be set first.
+func (device *Device) SetAdmission(conf mtypes.AdmissionInfo) error {
+	state := admissionState{mode: conf.Mode}
+	switch conf.Mode {
+	case "", AdmissionOpen:
+		state.mode = AdmissionOpen
+	case AdmissionAllowlist:
+		state.allowed = make(map[mtypes.Vertex][]NoisePublicKey)
+		for id, keys := range conf.AllowedKeys {
+			for _, key := range keys {
+				pk, err := Str2PubKey(key)
+				if err != nil {
+					return fmt.Errorf("AllowedKeys of %v: %v", id, err)
+				}
+				state.allowed[id] = append(state.allowed[id], pk)
+			}
+		}
+	case AdmissionCA:
+		ca, err := base64.StdEncoding.DecodeString(conf.CAPubKey)
+		if err != nil || len(ca) != ed25519.PublicKeySize {
+			return errors.New("CAPubKey is not a base64 encoded ed25519 public key")
+		}
+		state.ca = ed25519.PublicKey(ca)
+		state.certificate, err = base64.StdEncoding.DecodeString(conf.Certificate)
+		if err != nil {
+			return fmt.Errorf("Certificate: %v", err)
+		}
+		device.staticIdentity.RLock()
+		pk := device.staticIdentity.publicKey
+		device.staticIdentity.RUnlock()
+		if err := VerifyPeerCertificate(state.ca, state.certificate, device.ID, pk, time.Now()); err != nil {
+			return fmt.Errorf("Certificate: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown admission mode: %v", conf.Mode)
+	}
+	device.admission = state
+	return nil
+}
+
+// AdmissionRequired reports whether announced peers are checked before we add them.
+func (device *Device) AdmissionRequired() bool {
+	return device.admission.mode != "" && device.admission.mode != AdmissionOpen
+}
+
+// AdmitPeer reports why a peer announced with id, pk and cert must not be added, if it must not.
+func (device *Device) AdmitPeer(id mtypes.Vertex, pk NoisePublicKey, cert []byte) error {
+	switch device.admission.mode {
+	case AdmissionAllowlist:
+		for _, allowed := range device.admission.allowed[id] {
+			if allowed.Equals(pk) {
+				return nil
+			}
+		}
+		return errors.New("PubKey not in AllowedKeys")
+	case AdmissionCA:
+		return VerifyPeerCertificate(device.admission.ca, cert, id, pk, time.Now())
+	}
+	return nil
+}
+
+// certExpired reports whether the peer was admitted by a certificate which expired before now.
+func (peer *Peer) certExpired(now time.Time) bool {
+	if !peer.certAdmitted.Get() {
+		return false
+	}
+	cert, _ := peer.certificate.Load().([]byte)
+	return len(cert) != PeerCertLen || now.After(peerCertExpiry(cert))
+}
+
+// expiredPeers returns the peers admitted by a certificate which expired before now.
+func (device *Device) expiredPeers(now time.Time) (expired []*Peer) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.IDMap {
+		if peer.certExpired(now) {
+			expired = append(expired, peer)
+		}
+	}
+	return expired
+}
+
+// removeExpiredPeers removes the peers admitted by a certificate which has expired.
+func (device *Device) removeExpiredPeers() {
+	if device.admission.mode != AdmissionCA {
+		return
+	}
+	for _, peer := range device.expiredPeers(time.Now()) {
+		peer.handshake.mutex.RLock()
+		pk := peer.handshake.remoteStatic
+		peer.handshake.mutex.RUnlock()
+		device.slog.Errorf(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Remove peer: certificate expired")
+		device.RemovePeer(pk)
+	}
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPeerCertificate(t *testing.T) {
+	capub, ca, _ := ed25519.GenerateKey(nil)
+	otherpub, _, _ := ed25519.GenerateKey(nil)
+	_, pk := RandomKeyPair()
+	_, otherpk := RandomKeyPair()
+	now := time.Now()
+	cert := SignPeerCertificate(ca, 3, pk, now.Add(time.Hour))
+	if len(cert) != PeerCertLen {
+		t.Fatalf("certificate of %v bytes", len(cert))
+	}
+	if err := VerifyPeerCertificate(capub, cert, 3, pk, now); err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte(nil), cert...)
+	changed[PeerCertOffsetExpiry]++
+	for name, err := range map[string]error{
+		"another NodeID": VerifyPeerCertificate(capub, cert, 4, pk, now),
+		"another PubKey": VerifyPeerCertificate(capub, cert, 3, otherpk, now),
+		"another CA":     VerifyPeerCertificate(otherpub, cert, 3, pk, now),
+		"expired":        VerifyPeerCertificate(capub, cert, 3, pk, now.Add(2*time.Hour)),
+		"changed":        VerifyPeerCertificate(capub, changed, 3, pk, now),
+		"truncated":      VerifyPeerCertificate(capub, cert[:PeerCertLen-1], 3, pk, now),
+		"no certificate": VerifyPeerCertificate(capub, nil, 3, pk, now),
+	} {
+		if err == nil {
+			t.Errorf("certificate of %v accepted", name)
+		}
+	}
+}
+
+func TestAdmitPeer(t *testing.T) {
+	device := newForwardTestDevice(t)
+	_, pk := RandomKeyPair()
+	_, otherpk := RandomKeyPair()
+
+	if err := device.SetAdmission(mtypes.AdmissionInfo{}); err != nil || device.AdmissionRequired() {
+		t.Fatalf("default mode isn't open: %v", err)
+	}
+	if err := device.AdmitPeer(3, pk, nil); err != nil {
+		t.Errorf("open mode rejected a peer: %v", err)
+	}
+
+	err := device.SetAdmission(mtypes.AdmissionInfo{Mode: AdmissionAllowlist, AllowedKeys: map[mtypes.Vertex][]string{3: {pk.ToString()}}})
+	if err != nil || !device.AdmissionRequired() {
+		t.Fatal(err)
+	}
+	if err := device.AdmitPeer(3, pk, nil); err != nil {
+		t.Errorf("allowed key rejected: %v", err)
+	}
+	if device.AdmitPeer(3, otherpk, nil) == nil || device.AdmitPeer(4, pk, nil) == nil {
+		t.Error("key not allowed for the NodeID accepted")
+	}
+
+	capub, ca, _ := ed25519.GenerateKey(nil)
+	_, device.staticIdentity.publicKey = RandomKeyPair()
+	conf := mtypes.AdmissionInfo{
+		Mode:        AdmissionCA,
+		CAPubKey:    base64.StdEncoding.EncodeToString(capub),
+		Certificate: base64.StdEncoding.EncodeToString(SignPeerCertificate(ca, 1, device.staticIdentity.publicKey, time.Now().Add(time.Hour))),
+	}
+	if err := device.SetAdmission(conf); err == nil {
+		t.Error("certificate of another NodeID accepted as ours")
+	}
+	device.ID = 1
+	if err := device.SetAdmission(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.AdmitPeer(3, pk, SignPeerCertificate(ca, 3, pk, time.Now().Add(time.Hour))); err != nil {
+		t.Errorf("certified peer rejected: %v", err)
+	}
+	if device.AdmitPeer(3, otherpk, SignPeerCertificate(ca, 3, pk, time.Now().Add(time.Hour))) == nil {
+		t.Error("peer with the certificate of another PubKey accepted")
+	}
+	if device.AdmitPeer(3, pk, nil) == nil {
+		t.Error("peer without certificate accepted")
+	}
+
+	if device.SetAdmission(mtypes.AdmissionInfo{Mode: "closed"}) == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestExpiredPeers(t *testing.T) {
+	device := newForwardTestDevice(t)
+	_, ca, _ := ed25519.GenerateKey(nil)
+	_, pk := RandomKeyPair()
+	now := time.Now()
+	peer1, peer3 := device.peers.IDMap[1], device.peers.IDMap[3]
+	peer1.certificate.Store(SignPeerCertificate(ca, 1, pk, now.Add(-time.Second)))
+	peer3.certificate.Store(SignPeerCertificate(ca, 3, pk, now.Add(-time.Second)))
+	peer3.certAdmitted.Set(true)
+	if expired := device.expiredPeers(now); len(expired) != 1 || expired[0] != peer3 {
+		t.Fatalf("expired peers %v, want only the admitted peer 3", peerIDs(expired))
+	}
+
+	// a renewed certificate keeps the peer
+	peer3.certificate.Store(SignPeerCertificate(ca, 3, pk, now.Add(time.Hour)))
+	if expired := device.expiredPeers(now); len(expired) != 0 {
+		t.Errorf("peers %v with a renewed certificate expired", peerIDs(expired))
+	}
+}
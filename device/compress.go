@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// LocalFeatures returns the features advertised in ping and pong.
+func (device *Device) LocalFeatures() mtypes.Features {
+	features := mtypes.FeatureCompression | mtypes.FeatureDuplicate | mtypes.FeatureFragment | mtypes.FeatureSequence | mtypes.FeatureWireFormat | mtypes.FeatureExtHeader | mtypes.FeatureSourceAuth | mtypes.FeatureE2E
+	if device.EdgeConfig().FEC.Enabled {
+		features |= mtypes.FeatureFEC
+	}
+	return features
+}
+
+func (device *Device) SetNodeFeatures(id mtypes.Vertex, features mtypes.Features) {
+	if id >= mtypes.NodeID_Special && id != mtypes.NodeID_SuperNode {
+		return
+	}
+	old, loaded := device.node_features.Swap(id, features)
+	if (!loaded || old.(mtypes.Features) != features) && device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": id.ToString()}, "Features: %v", features.ToString())
+	}
+}
+
+// AddNodeFeatures adds features we learned a node supports without it telling us.
+func (device *Device) AddNodeFeatures(id mtypes.Vertex, features mtypes.Features) {
+	if id >= mtypes.NodeID_Special && id != mtypes.NodeID_SuperNode || id == device.ID {
+		return
+	}
+	for {
+		old, loaded := device.node_features.LoadOrStore(id, features)
+		if !loaded || old.(mtypes.Features).Has(features) || device.node_features.CompareAndSwap(id, old, old.(mtypes.Features)|features) {
+			return
+		}
+	}
+}
+
+func (device *Device) NodeFeatures(id mtypes.Vertex) mtypes.Features {
+	if id == device.ID {
+		return device.LocalFeatures()
+	}
+	val, ok := device.node_features.Load(id)
+	if !ok {
+		return 0
+	}
+	return val.(mtypes.Features)
+}
+
+// PathSupports reports whether the destination and every node on the way to it support the features.
+func (device *Device) PathSupports(dst_nodeID mtypes.Vertex, features mtypes.Features) bool {
+	if dst_nodeID >= mtypes.NodeID_Special {
+		return false
+	}
+	current := device.ID
+	for hops := 0; current != dst_nodeID; hops++ {
+		if hops > int(device.EdgeConfig().DefaultTTL) {
+			return false
+		}
+		current = device.graph.Next(current, dst_nodeID)
+		if current == mtypes.NodeID_Invalid || !device.NodeFeatures(current).Has(features) {
+			return false
+		}
+	}
+	return true
+}
+
+// CompressTo compresses the packet if compression is enabled and counts the saved bytes for the destination.
+func (device *Device) CompressTo(c *compressor, elem *QueueOutboundElement, dst_nodeID mtypes.Vertex) {
+	if c == nil {
+		return
+	}
+	if saved := c.CompressPacket(elem, device.EdgeConfig().Compression.MinSize); saved > 0 {
+		device.peers.RLock()
+		dst_peer := device.peers.IDMap[dst_nodeID]
+		device.peers.RUnlock()
+		if dst_peer != nil {
+			atomic.AddUint64(&dst_peer.stats.txCompressSaved, uint64(saved))
+		}
+	}
+}
+
+// A compressor is owned by a single goroutine.
+type compressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newCompressor(level int) (*compressor, error) {
+	c := &compressor{}
+	w, err := flate.NewWriter(&c.buf, level)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// CompressPacket compresses the payload after the EgHeader in place.
+// Frames that are too small or don't shrink are left untouched.
+func (c *compressor) CompressPacket(elem *QueueOutboundElement, minsize int) (saved int) {
+	payload := elem.packet[path.EgHeaderLen:]
+	if len(payload) < minsize {
+		return 0
+	}
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(payload); err != nil {
+		return 0
+	}
+	if err := c.w.Close(); err != nil {
+		return 0
+	}
+	if c.buf.Len() >= len(payload) {
+		return 0
+	}
+	saved = len(payload) - c.buf.Len()
+	copy(payload, c.buf.Bytes())
+	elem.packet = elem.packet[:path.EgHeaderLen+c.buf.Len()]
+	elem.Flags |= path.FlagCompressed
+	return
+}
+
+var errDecompressTooLarge = errors.New("decompressed packet too large")
+
+// A decompressor is owned by a single goroutine.
+type decompressor struct {
+	src bytes.Reader
+	r   io.ReadCloser
+}
+
+// Decompress decompresses src into dst and returns the decompressed length.
+func (d *decompressor) Decompress(dst []byte, src []byte) (int, error) {
+	d.src.Reset(src)
+	if d.r == nil {
+		d.r = flate.NewReader(&d.src)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return 0, err
+	}
+	// only a clean io.EOF ends the stream, flate returns io.ErrUnexpectedEOF for a truncated one
+	n := 0
+	for n < len(dst) {
+		m, err := d.r.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	var probe [1]byte
+	m, err := d.r.Read(probe[:])
+	if m > 0 {
+		return 0, errDecompressTooLarge
+	} else if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DecompressPacket replaces the compressed payload of elem with the decompressed one.
+func (device *Device) DecompressPacket(d *decompressor, elem *QueueInboundElement, src_nodeID mtypes.Vertex) error {
+	buffer := device.GetMessageBuffer()
+	payload_offset := MessageTransportOffsetContent + path.EgHeaderLen
+	n, err := d.Decompress(buffer[payload_offset:], elem.packet[path.EgHeaderLen:])
+	if err != nil {
+		device.PutMessageBuffer(buffer)
+		return err
+	}
+	copy(buffer[MessageTransportOffsetContent:payload_offset], elem.packet[:path.EgHeaderLen])
+	device.peers.RLock()
+	src_peer := device.peers.IDMap[src_nodeID]
+	device.peers.RUnlock()
+	if src_peer != nil && n > len(elem.packet)-path.EgHeaderLen {
+		atomic.AddUint64(&src_peer.stats.rxCompressSaved, uint64(n-(len(elem.packet)-path.EgHeaderLen)))
+	}
+	device.PutMessageBuffer(elem.buffer)
+	elem.buffer = buffer
+	elem.packet = buffer[MessageTransportOffsetContent : payload_offset+n]
+	elem.Flags &^= path.FlagCompressed
+	return nil
+}
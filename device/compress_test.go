@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	c, err := newCompressor(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d decompressor
+	var buffer [MaxMessageSize]byte
+	var out [MaxMessageSize]byte
+
+	payload := bytes.Repeat([]byte("telemetry=42;"), 100)
+	elem := &QueueOutboundElement{buffer: &buffer}
+	elem.packet = buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+path.EgHeaderLen+len(payload)]
+	copy(elem.packet[path.EgHeaderLen:], payload)
+
+	saved := c.CompressPacket(elem, 128)
+	if saved <= 0 || !elem.Flags.Has(path.FlagCompressed) {
+		t.Fatalf("compressible payload not compressed: saved %d flags %v", saved, elem.Flags)
+	}
+	if len(elem.packet) != path.EgHeaderLen+len(payload)-saved {
+		t.Fatalf("packet length %d does not match saved %d", len(elem.packet), saved)
+	}
+	n, err := d.Decompress(out[:], elem.packet[path.EgHeaderLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[:n], payload) {
+		t.Fatal("decompressed payload mismatch")
+	}
+
+	// the decompressor must be reusable
+	n, err = d.Decompress(out[:], elem.packet[path.EgHeaderLen:])
+	if err != nil || !bytes.Equal(out[:n], payload) {
+		t.Fatalf("reused decompressor failed: %v", err)
+	}
+	if _, err = d.Decompress(out[:10], elem.packet[path.EgHeaderLen:]); err != errDecompressTooLarge {
+		t.Fatalf("expected errDecompressTooLarge, got %v", err)
+	}
+	compressed := elem.packet[path.EgHeaderLen:]
+	if _, err = d.Decompress(out[:], compressed[:len(compressed)-2]); err == nil {
+		t.Fatal("truncated payload decompressed without an error")
+	}
+}
+
+func TestCompressSkipsIncompressible(t *testing.T) {
+	c, err := newCompressor(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer [MaxMessageSize]byte
+	payload := make([]byte, 1400)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	elem := &QueueOutboundElement{buffer: &buffer}
+	elem.packet = buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+path.EgHeaderLen+len(payload)]
+	copy(elem.packet[path.EgHeaderLen:], payload)
+	if saved := c.CompressPacket(elem, 128); saved != 0 || elem.Flags != 0 {
+		t.Fatalf("random payload should not be compressed: saved %d flags %v", saved, elem.Flags)
+	}
+	if !bytes.Equal(elem.packet[path.EgHeaderLen:], payload) {
+		t.Fatal("payload modified")
+	}
+
+	elem.packet = elem.packet[:path.EgHeaderLen+64]
+	if saved := c.CompressPacket(elem, 128); saved != 0 {
+		t.Fatal("payload below MinSize should not be compressed")
+	}
+}
+
+func TestUsageFlags(t *testing.T) {
+	b := path.JoinUsageFlags(path.NormalPacket, path.FlagCompressed)
+	usage, flags := path.SplitUsageFlags(b)
+	if usage != path.NormalPacket || !flags.Has(path.FlagCompressed) {
+		t.Fatalf("split %x: usage %v flags %v", b, usage, flags)
+	}
+	if !usage.IsValid_EgType() {
+		t.Fatal("usage should be valid after removing flags")
+	}
+	if path.Usage(b).IsValid_EgType() {
+		t.Fatal("flagged usage byte must be invalid for old versions")
+	}
+}
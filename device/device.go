@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os/exec"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -23,6 +24,8 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 	fixed_time_cache "github.com/KusakabeSi/go-cache"
+	"github.com/google/shlex"
+	"golang.org/x/crypto/blake2s"
 )
 
 type Device struct {
@@ -56,8 +59,10 @@ type Device struct {
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
-		publicKey  NoisePublicKey
+		privateKey    NoisePrivateKey
+		publicKey     NoisePublicKey
+		privateKeyAlt NoisePrivateKey // accepted as well while we rotate our key
+		publicKeyAlt  NoisePublicKey
 	}
 
 	rate struct {
@@ -68,19 +73,30 @@ type Device struct {
 	peers struct {
 		sync.RWMutex // protects keyMap
 		keyMap       map[NoisePublicKey]*Peer
+		keyMapAlt    map[NoisePublicKey]*Peer // the other key of peers rotating theirs
 		IDMap        map[mtypes.Vertex]*Peer
 		SuperPeer    map[NoisePublicKey]*Peer
 		LocalV4      net.IP
 		LocalV6      net.IP
+
+		version uint32 // accessed atomically, bumped whenever IDMap changes
+	}
+
+	forward struct {
+		sync.Mutex              // serializes rebuilding the table
+		table      atomic.Value // *forwardTable
 	}
 
 	state_hashes mtypes.StateHash
+	psk_version  atomic.Value // uint64, version of the PSKs from the supernode
 
 	event_tryendpoint chan struct{}
-	chan_send_packet  chan *packet_send_params
+	chan_send_packet  []chan *QueueOutboundElement // one per RoutineSendPacket, picked by peer
 
 	EdgeConfigPath  string
-	EdgeConfig      *mtypes.EdgeConfig
+	edgeConfig      atomic.Value // *mtypes.EdgeConfig, see EdgeConfig
+	edgeConfigLock  sync.Mutex   // held while EdgeConfig is written to EdgeConfigPath
+	edgeConfigMu    sync.Mutex   // held while a changed copy of EdgeConfig is made, see updateEdgeConfig
 	SuperConfigPath string
 	SuperConfig     *mtypes.SuperConfig
 	enabledAf       conn.EnabledAf
@@ -93,8 +109,10 @@ type Device struct {
 	Chan_SendRegisterStart  chan struct{}
 	Chan_HttpPostStart      chan struct{}
 
-	indexTable    IndexTable
-	cookieChecker CookieChecker
+	indexTable       IndexTable
+	cookieChecker    CookieChecker
+	cookieCheckerAlt CookieChecker // for privateKeyAlt
+	keyRotation      keyRotationState
 
 	IsSuperNode bool
 	ID          mtypes.Vertex
@@ -104,13 +122,24 @@ type Device struct {
 	DupData     fixed_time_cache.Cache
 	Version     string
 
+	node_features sync.Map // mtypes.Vertex -> mtypes.Features advertised by other nodes
+	dup           dupState
+	frag          fragState
+	seq           seqState
+	loop          loopState
+	auth          authState
+	e2e           e2eState
+	admission     admissionState
+
 	HttpPostCount uint64
 	JWTSecret     mtypes.JWTSecret
 
 	pool struct {
-		messageBuffers   *WaitPool
-		inboundElements  *WaitPool
-		outboundElements *WaitPool
+		messageBuffers             *WaitPool
+		inboundElements            *WaitPool
+		outboundElements           *WaitPool
+		inboundElementsContainers  *WaitPool
+		outboundElementsContainers *WaitPool
 	}
 
 	queue struct {
@@ -127,11 +156,7 @@ type Device struct {
 	ipcMutex sync.RWMutex
 	closed   chan int
 	log      *Logger
-}
-
-type IdAndTime struct {
-	ID   mtypes.Vertex
-	Time time.Time
+	slog     *mtypes.Logger
 }
 
 // deviceState represents the state of a Device.
@@ -150,6 +175,26 @@ const (
 	deviceStateClosed
 )
 
+// EdgeConfig returns the config of the edge. It is never written in place, a change stores a changed copy,
+// so the data path reads a consistent snapshot without locks.
+func (device *Device) EdgeConfig() *mtypes.EdgeConfig {
+	econfig, _ := device.edgeConfig.Load().(*mtypes.EdgeConfig)
+	return econfig
+}
+
+// updateEdgeConfig stores a copy of the config changed by fn, unless fn fails.
+// The copy shares the maps and slices of the config, fn replaces them instead of writing to them.
+func (device *Device) updateEdgeConfig(fn func(econfig *mtypes.EdgeConfig) error) error {
+	device.edgeConfigMu.Lock()
+	defer device.edgeConfigMu.Unlock()
+	econfig := *device.EdgeConfig()
+	if err := fn(&econfig); err != nil {
+		return err
+	}
+	device.edgeConfig.Store(&econfig)
+	return nil
+}
+
 // deviceState returns device.state.state as a deviceState
 // See those docs for how to interpret this value.
 func (device *Device) deviceState() deviceState {
@@ -176,10 +221,16 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// remove from peer map
 	id := peer.ID
 	delete(device.peers.keyMap, key)
+	for alt, altpeer := range device.peers.keyMapAlt {
+		if altpeer == peer {
+			delete(device.peers.keyMapAlt, alt)
+		}
+	}
 	if id == mtypes.NodeID_SuperNode {
 		delete(device.peers.SuperPeer, key)
 	} else {
 		delete(device.peers.IDMap, id)
+		atomic.AddUint32(&device.peers.version, 1)
 	}
 }
 
@@ -329,6 +380,7 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	device.state.state = uint32(deviceStateDown)
 	device.closed = make(chan int)
 	device.log = logger
+	device.slog = logger.Structured
 	device.net.bind = bind
 	device.tap.device = tapDevice
 	mtu, err := device.tap.device.MTU()
@@ -338,6 +390,7 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	}
 	device.tap.mtu = int32(mtu)
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.keyMapAlt = make(map[NoisePublicKey]*Peer)
 	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
 	device.peers.SuperPeer = make(map[NoisePublicKey]*Peer)
 	device.IsSuperNode = IsSuperNode
@@ -350,40 +403,47 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	device.state_hashes.NhTable.Store("")
 	device.state_hashes.Peer.Store("")
 	device.state_hashes.SuperParam.Store("")
+	device.psk_version.Store(uint64(0))
 
 	device.rate.limiter.Init()
 	device.indexTable.Init()
+	device.dup.session, _ = randUint32()
+	device.seq.session = newSession()
+	device.loop.session, _ = randUint32()
+	device.auth.session = newSession()
+	device.e2e.session = newSession()
 	device.PopulatePools()
 	device.Chan_Device_Initialized = make(chan struct{}, 1<<5)
-	device.chan_send_packet = make(chan *packet_send_params, 1<<15)
 	if IsSuperNode {
 		device.SuperConfigPath = configpath
 		device.SuperConfig = sconfig
-		device.EdgeConfig = &mtypes.EdgeConfig{}
-		device.EdgeConfig.Interface.MTU = DefaultMTU
-		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = device.SuperConfig.PeerAliveTimeout
+		econfig := &mtypes.EdgeConfig{}
+		econfig.Interface.MTU = DefaultMTU
+		econfig.DynamicRoute.PeerAliveTimeout = device.SuperConfig.PeerAliveTimeout
+		device.edgeConfig.Store(econfig)
 		device.Chan_server_pong = superevents.Event_server_pong
 		device.Chan_server_register = superevents.Event_server_register
 		device.LogLevel = sconfig.LogLevel
 	} else {
 		device.EdgeConfigPath = configpath
-		device.EdgeConfig = econfig
+		device.edgeConfig.Store(econfig)
 		device.SuperConfig = &mtypes.SuperConfig{}
 		device.DupData = *fixed_time_cache.NewCache(mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout), false, mtypes.S2TD(1))
+		device.loop.key = blake2s.Sum256([]byte(econfig.LoopDetect.Key))
 		device.event_tryendpoint = make(chan struct{}, 1<<6)
 		device.Chan_save_config = make(chan struct{}, 1<<5)
 		device.Chan_SendPingStart = make(chan struct{}, 1<<5)
 		device.Chan_SendRegisterStart = make(chan struct{}, 1<<5)
 		device.Chan_HttpPostStart = make(chan struct{}, 1<<5)
 		device.LogLevel = econfig.LogLevel
-		device.SuperConfig.DampingFilterRadius = device.EdgeConfig.DynamicRoute.DampingFilterRadius
+		device.SuperConfig.DampingFilterRadius = econfig.DynamicRoute.DampingFilterRadius
 
 	}
-	go device.RoutineSendPacket()
+	device.startSendPipeline()
 	go func() {
 		<-device.Chan_Device_Initialized
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: initialized, start background loops\n")
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatInternal, nil, "initialized, start background loops")
 		}
 		if IsSuperNode {
 			go device.RoutineResetEndpoint()
@@ -395,6 +455,7 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 			go device.RoutineSpreadAllMyNeighbor()
 			go device.RoutineResetEndpoint()
 			go device.RoutineClearL2FIB()
+			go device.RoutineLoopDetect()
 			go device.RoutineRecalculateNhTable()
 			go device.RoutinePostPeerInfo(device.Chan_HttpPostStart)
 		}
@@ -417,9 +478,15 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		go device.RoutineHandshake(i + 1)
 	}
 
-	device.state.stopping.Add(1)      // RoutineReadFromTUN
-	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
-	go device.RoutineReadFromTUN()
+	queues := 1
+	if batch, ok := tapDevice.(tap.BatchDevice); ok {
+		queues = batch.Queues()
+	}
+	device.state.stopping.Add(queues)      // RoutineReadFromTUN
+	device.queue.encryption.wg.Add(queues) // RoutineReadFromTUN
+	for i := 0; i < queues; i++ {
+		go device.RoutineReadFromTUN(i)
+	}
 	go device.RoutineTUNEventReader()
 
 	return device
@@ -440,10 +507,10 @@ func (device *Device) LookupPeerIDAtConfig(pk NoisePublicKey) (ID mtypes.Vertex,
 		}
 	} else {
 		var peerlist []mtypes.PeerInfo
-		if device.EdgeConfig == nil {
+		if device.EdgeConfig() == nil {
 			return 0, errors.New("edgeconfig is nil")
 		}
-		peerlist = device.EdgeConfig.Peers
+		peerlist = device.EdgeConfig().Peers
 		pkstr := pk.ToString()
 		for _, peerinfo := range peerlist {
 			if peerinfo.PubKey == pkstr {
@@ -455,46 +522,14 @@ func (device *Device) LookupPeerIDAtConfig(pk NoisePublicKey) (ID mtypes.Vertex,
 	return 0, errors.New("peer not found in the config file")
 }
 
-type VPair struct {
-	s mtypes.Vertex
-	d mtypes.Vertex
-}
-type PSKDB struct {
-	db sync.Map
-}
-
-func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
-	if s > d {
-		s, d = d, s
-	}
-	vp := VPair{
-		s: s,
-		d: d,
-	}
-	pski, ok := D.db.Load(vp)
-	if !ok {
-		psk = RandomPSK()
-		pski, _ = D.db.LoadOrStore(vp, psk)
-		return pski.(NoisePresharedKey)
-	}
-	return pski.(NoisePresharedKey)
-}
-
-func (D *PSKDB) DelNode(n mtypes.Vertex) {
-	D.db.Range(func(key, value interface{}) bool {
-		vp := key.(VPair)
-		if vp.s == n || vp.d == n {
-			D.db.Delete(vp)
-		}
-		return true
-	})
-}
-
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	device.peers.RLock()
 	defer device.peers.RUnlock()
 
-	return device.peers.keyMap[pk]
+	if peer, ok := device.peers.keyMap[pk]; ok {
+		return peer
+	}
+	return device.peers.keyMapAlt[pk]
 }
 
 func (device *Device) LookupPeerByStr(pks string) *Peer {
@@ -601,7 +636,9 @@ func (device *Device) RemoveAllPeers() {
 	}
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.keyMapAlt = make(map[NoisePublicKey]*Peer)
 	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
+	atomic.AddUint32(&device.peers.version, 1)
 }
 
 func (device *Device) Close() {
@@ -707,6 +744,12 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+// BatchSize returns the number of packets the bind reads or writes at once.
+// The bind is set once by NewDevice.
+func (device *Device) BatchSize() int {
+	return device.net.bind.BatchSize()
+}
+
 func (device *Device) BindUpdate() error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -760,8 +803,9 @@ func (device *Device) BindUpdate() error {
 	device.net.stopping.Add(len(recvFns))
 	device.queue.decryption.wg.Add(len(recvFns)) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
 	device.queue.handshake.wg.Add(len(recvFns))  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
+	batchSize := netc.bind.BatchSize()
 	for _, fn := range recvFns {
-		go device.RoutineReceiveIncoming(fn)
+		go device.RoutineReceiveIncoming(batchSize, fn)
 	}
 
 	device.log.Verbosef("UDP bind has been updated")
@@ -774,3 +818,19 @@ func (device *Device) BindClose() error {
 	device.net.Unlock()
 	return err
 }
+
+// runScript runs script with args appended in the background. name is the config key of the script.
+func (device *Device) runScript(name string, script string, args ...string) {
+	cmdarg, err := shlex.Split(script)
+	if err != nil || len(cmdarg) == 0 {
+		device.log.Errorf("Error parse %v %v: %v", name, script, err)
+		return
+	}
+	cmdarg = append(cmdarg, args...)
+	go func() {
+		out, err := exec.Command(cmdarg[0], cmdarg[1:]...).CombinedOutput()
+		if err != nil {
+			device.log.Errorf("exec.Command(%v) failed with %v: %s", cmdarg, err, out)
+		}
+	}()
+}
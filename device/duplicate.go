@@ -0,0 +1,282 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/replay"
+)
+
+// Frames matching a duplication rule are sent twice, over the two node-disjoint paths
+// computed by path.IG. Transit nodes can't follow the second path with their own next hop
+// table, so both copies carry their route in a DupHeader after the EgHeader.
+// The destination keeps the first copy of every sequence number.
+
+const (
+	DupHeaderOffsetSession = 0
+	DupHeaderOffsetSeq     = 4
+	DupHeaderOffsetCopy    = 12
+	DupHeaderOffsetHops    = 13
+	DupHeaderOffsetRoute   = 14 // hops node IDs after the source, the last one is the destination
+)
+
+const DupRouteCacheTime = 2 * time.Second
+
+func DupHeaderLen(hops int) int {
+	return DupHeaderOffsetRoute + 2*hops
+}
+
+type dupRoute struct {
+	paths  [2][]mtypes.Vertex
+	ok     bool
+	expire time.Time
+}
+
+type dupFilter struct {
+	session uint32
+	filter  replay.Filter
+}
+
+type dupState struct {
+	session uint32 // random per start, so that the destination resets its filter
+
+	sendLock sync.Mutex
+	seq      map[mtypes.Vertex]uint64
+	routes   map[mtypes.Vertex]*dupRoute
+
+	recvLock sync.Mutex
+	filters  map[mtypes.Vertex]*dupFilter
+}
+
+func matchPort(rule mtypes.DuplicateRule, ports ...uint16) bool {
+	if rule.PortMin == 0 && rule.PortMax == 0 {
+		return true
+	}
+	for _, port := range ports {
+		if port >= rule.PortMin && port <= rule.PortMax {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDuplicateRule reports whether the ethernet frame matches a duplication rule.
+func (device *Device) MatchDuplicateRule(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	if etherType == 0x8100 && len(l3) >= 4 { // 802.1Q
+		etherType = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	var proto, dscp uint8
+	var l4 []byte
+	switch etherType {
+	case 0x0800:
+		if len(l3) >= 20 {
+			ihl := int(l3[0]&0x0f) * 4
+			proto = l3[9]
+			dscp = l3[1] >> 2
+			if binary.BigEndian.Uint16(l3[6:8])&0x1fff == 0 && ihl >= 20 && len(l3) >= ihl {
+				l4 = l3[ihl:]
+			}
+		}
+	case 0x86DD:
+		if len(l3) >= 40 {
+			proto = l3[6]
+			dscp = ((l3[0]&0x0f)<<4 | l3[1]>>4) >> 2
+			l4 = l3[40:]
+		}
+	}
+	var ports []uint16
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		ports = []uint16{binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])}
+	}
+	for _, rule := range device.EdgeConfig().Duplication.Rules {
+		if rule.EtherType != 0 && rule.EtherType != etherType {
+			continue
+		}
+		if rule.IPProto != 0 && rule.IPProto != proto {
+			continue
+		}
+		if rule.DSCP != 0 && rule.DSCP != dscp {
+			continue
+		}
+		if !matchPort(rule, ports...) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// RouteSupports reports whether every node of the route after us supports the features.
+func (device *Device) RouteSupports(route []mtypes.Vertex, features mtypes.Features) bool {
+	for _, id := range route[1:] {
+		if !device.NodeFeatures(id).Has(features) {
+			return false
+		}
+	}
+	return true
+}
+
+// DuplicatePaths returns the two node-disjoint paths to the destination,
+// if they exist and every node on them can forward duplicated packets.
+func (device *Device) DuplicatePaths(dst_nodeID mtypes.Vertex) ([2][]mtypes.Vertex, bool) {
+	device.dup.sendLock.Lock()
+	defer device.dup.sendLock.Unlock()
+	if device.dup.routes == nil {
+		device.dup.routes = make(map[mtypes.Vertex]*dupRoute)
+	}
+	route, ok := device.dup.routes[dst_nodeID]
+	if ok && time.Now().Before(route.expire) {
+		return route.paths, route.ok
+	}
+	route = &dupRoute{expire: time.Now().Add(DupRouteCacheTime)}
+	device.dup.routes[dst_nodeID] = route
+	paths, err := device.graph.DisjointPaths(device.ID, dst_nodeID)
+	if err != nil {
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelDebug) {
+			device.slog.Debugf(mtypes.LogCatInternal, mtypes.LogFields{"dst": dst_nodeID.ToString()}, "Duplication disabled: %v", err)
+		}
+		return route.paths, false
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, p := range paths {
+		if len(p)-1 > int(device.EdgeConfig().DefaultTTL) || len(p)-1 > math.MaxUint8 || device.peers.IDMap[p[1]] == nil || !device.RouteSupports(p, mtypes.FeatureDuplicate) {
+			return route.paths, false
+		}
+	}
+	route.paths = paths
+	route.ok = true
+	if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelDebug) {
+		device.slog.Debugf(mtypes.LogCatInternal, mtypes.LogFields{"dst": dst_nodeID.ToString()}, "Duplication paths: %v %v", paths[0], paths[1])
+	}
+	return route.paths, true
+}
+
+// SendDuplicated sends a copy of the packet over each path.
+func (device *Device) SendDuplicated(usage path.Usage, flags path.HeaderFlags, ttl uint8, packet []byte, paths [2][]mtypes.Vertex) {
+	dst_nodeID := paths[0][len(paths[0])-1]
+	device.dup.sendLock.Lock()
+	if device.dup.seq == nil {
+		device.dup.seq = make(map[mtypes.Vertex]uint64)
+	}
+	seq := device.dup.seq[dst_nodeID]
+	device.dup.seq[dst_nodeID] = seq + 1
+	device.dup.sendLock.Unlock()
+
+	device.peers.RLock()
+	dst_peer := device.peers.IDMap[dst_nodeID]
+	device.peers.RUnlock()
+	for copyIndex, route := range paths {
+		buf := newDupPacket(packet, device.dup.session, seq, copyIndex, route[1:])
+		device.peers.RLock()
+		peer_out := device.peers.IDMap[route[1]]
+		device.peers.RUnlock()
+		device.SendPacketFlags(peer_out, usage, flags|path.FlagDuplicate, ttl, buf, MessageTransportOffsetContent)
+	}
+	if dst_peer != nil {
+		atomic.AddUint64(&dst_peer.stats.dupSent, 1)
+	}
+}
+
+// newDupPacket inserts a DupHeader after the EgHeader of the packet.
+func newDupPacket(packet []byte, session uint32, seq uint64, copyIndex int, hops []mtypes.Vertex) []byte {
+	dupLen := DupHeaderLen(len(hops))
+	buf := make([]byte, len(packet)+dupLen)
+	copy(buf[:path.EgHeaderLen], packet[:path.EgHeaderLen])
+	header := buf[path.EgHeaderLen : path.EgHeaderLen+dupLen]
+	binary.LittleEndian.PutUint32(header[DupHeaderOffsetSession:DupHeaderOffsetSeq], session)
+	binary.LittleEndian.PutUint64(header[DupHeaderOffsetSeq:DupHeaderOffsetCopy], seq)
+	header[DupHeaderOffsetCopy] = uint8(copyIndex)
+	header[DupHeaderOffsetHops] = uint8(len(hops))
+	for i, id := range hops {
+		binary.LittleEndian.PutUint16(header[DupHeaderOffsetRoute+2*i:], uint16(id))
+	}
+	copy(buf[path.EgHeaderLen+dupLen:], packet[path.EgHeaderLen:])
+	return buf
+}
+
+func parseDupHeader(packet []byte) (header []byte, route []byte, ok bool) {
+	body := packet[path.EgHeaderLen:]
+	if len(body) < DupHeaderOffsetRoute {
+		return nil, nil, false
+	}
+	dupLen := DupHeaderLen(int(body[DupHeaderOffsetHops]))
+	if len(body) < dupLen || body[DupHeaderOffsetCopy] > 1 {
+		return nil, nil, false
+	}
+	return body[:dupLen], body[DupHeaderOffsetRoute:dupLen], true
+}
+
+// DupNextHop returns the node after us in the route of a duplicated packet.
+func (device *Device) DupNextHop(packet []byte) mtypes.Vertex {
+	_, route, ok := parseDupHeader(packet)
+	if !ok {
+		return mtypes.NodeID_Invalid
+	}
+	for i := 0; i+4 <= len(route); i += 2 {
+		if mtypes.Vertex(binary.LittleEndian.Uint16(route[i:])) == device.ID {
+			return mtypes.Vertex(binary.LittleEndian.Uint16(route[i+2:]))
+		}
+	}
+	return mtypes.NodeID_Invalid
+}
+
+// ReceiveDuplicated drops the copies we already received, and removes the DupHeader from the first one.
+func (device *Device) ReceiveDuplicated(elem *QueueInboundElement, src_nodeID mtypes.Vertex) bool {
+	header, _, ok := parseDupHeader(elem.packet)
+	if !ok {
+		return false
+	}
+	session := binary.LittleEndian.Uint32(header[DupHeaderOffsetSession:DupHeaderOffsetSeq])
+	seq := binary.LittleEndian.Uint64(header[DupHeaderOffsetSeq:DupHeaderOffsetCopy])
+	copyIndex := header[DupHeaderOffsetCopy]
+
+	device.dup.recvLock.Lock()
+	if device.dup.filters == nil {
+		device.dup.filters = make(map[mtypes.Vertex]*dupFilter)
+	}
+	f, ok := device.dup.filters[src_nodeID]
+	if !ok {
+		f = &dupFilter{session: session}
+		device.dup.filters[src_nodeID] = f
+	} else if f.session != session {
+		f.session = session
+		f.filter.Reset()
+	}
+	first := f.filter.ValidateCounter(seq, math.MaxUint64)
+	device.dup.recvLock.Unlock()
+
+	device.peers.RLock()
+	src_peer := device.peers.IDMap[src_nodeID]
+	device.peers.RUnlock()
+	if !first {
+		if src_peer != nil {
+			atomic.AddUint64(&src_peer.stats.dupDiscarded, 1)
+		}
+		return false
+	}
+	if src_peer != nil {
+		atomic.AddUint64(&src_peer.stats.dupWon[copyIndex], 1)
+	}
+	dupLen := len(header)
+	copy(elem.packet[path.EgHeaderLen:], elem.packet[path.EgHeaderLen+dupLen:])
+	elem.packet = elem.packet[:len(elem.packet)-dupLen]
+	elem.Flags &^= path.FlagDuplicate
+	return true
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func udpFrame(tos uint8, dstPort uint16) []byte {
+	frame := make([]byte, 14+20+8+4)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[1] = tos
+	ip[9] = 17
+	binary.BigEndian.PutUint16(ip[20:22], 40000)
+	binary.BigEndian.PutUint16(ip[22:24], dstPort)
+	return frame
+}
+
+func TestMatchDuplicateRule(t *testing.T) {
+	device := &Device{}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	device.EdgeConfig().Duplication.Rules = []mtypes.DuplicateRule{
+		{EtherType: 0x0800, IPProto: 17, PortMin: 5060, PortMax: 5061},
+		{DSCP: 46},
+	}
+	for _, tc := range []struct {
+		frame []byte
+		match bool
+	}{
+		{udpFrame(0, 5060), true},
+		{udpFrame(0, 5062), false},
+		{udpFrame(46<<2, 53), true},
+		{udpFrame(0, 53), false},
+		{make([]byte, 10), false},
+	} {
+		if device.MatchDuplicateRule(tc.frame) != tc.match {
+			t.Fatalf("frame %x: expected match %v", tc.frame, tc.match)
+		}
+	}
+}
+
+func TestDuplicateReceive(t *testing.T) {
+	// node 1 sends to node 4 over 1-2-4 and 1-3-4
+	packet := make([]byte, path.EgHeaderLen+60)
+	header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], 1400)
+	header.SetSrc(1)
+	header.SetDst(4)
+	copy(packet[path.EgHeaderLen:], udpFrame(0, 5060))
+	copies := [2][]byte{
+		newDupPacket(packet, 42, 0, 0, []mtypes.Vertex{2, 4}),
+		newDupPacket(packet, 42, 0, 1, []mtypes.Vertex{3, 4}),
+	}
+
+	transit := &Device{ID: 3}
+	if next := transit.DupNextHop(copies[1]); next != 4 {
+		t.Fatalf("next hop %v, want 4", next)
+	}
+	if next := transit.DupNextHop(copies[0]); next != mtypes.NodeID_Invalid {
+		t.Fatalf("node 3 is not on the route of copy 0, got next hop %v", next)
+	}
+
+	dst := &Device{ID: 4}
+	src := &Peer{ID: 1}
+	dst.peers.IDMap = map[mtypes.Vertex]*Peer{1: src}
+	receive := func(buf []byte) (*QueueInboundElement, bool) {
+		elem := &QueueInboundElement{packet: append([]byte(nil), buf...), Flags: path.FlagDuplicate}
+		return elem, dst.ReceiveDuplicated(elem, 1)
+	}
+	elem, ok := receive(copies[1])
+	if !ok {
+		t.Fatal("first copy dropped")
+	}
+	if !bytes.Equal(elem.packet, packet) || elem.Flags != 0 {
+		t.Fatal("DupHeader not removed")
+	}
+	if _, ok = receive(copies[0]); ok {
+		t.Fatal("second copy accepted")
+	}
+	if src.stats.dupWon[1] != 1 || src.stats.dupDiscarded != 1 {
+		t.Fatalf("unexpected stats won %v discarded %v", src.stats.dupWon, src.stats.dupDiscarded)
+	}
+
+	// a restarted sender uses a new session
+	if _, ok = receive(newDupPacket(packet, 43, 0, 0, []mtypes.Vertex{2, 4})); !ok {
+		t.Fatal("packet of a new session dropped")
+	}
+}
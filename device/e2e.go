@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Every transit node decrypts the packets it forwards and sees the frames of other nodes.
+// The source encrypts the body of unicast data frames once more, for the destination only,
+// with XChaCha20-Poly1305 and a key derived from the PSK of the two nodes. The E2EHeader follows the EgHeader,
+// the DupHeader and FragHeader are inserted before it. The length excludes the padding which every hop may add.
+//
+//	session (8) | counter (8) | length of the encrypted body (2)
+//
+// The nonce is the session, the counter and the source node ID, the EgHeader and the E2EHeader are authenticated.
+// A frame to an E2E destination which can't be encrypted, since a node on its path doesn't support it or
+// its features aren't known yet, is dropped. Broadcast frames go to every node and are never encrypted.
+
+const (
+	E2EHeaderOffsetSession = 0
+	E2EHeaderOffsetCounter = 8
+	E2EHeaderOffsetLength  = 16
+	E2EHeaderLen           = 18
+)
+
+const E2EFeatures = mtypes.FeatureExtHeader | mtypes.FeatureE2E
+
+var e2eLabel = []byte("EtherGuard end-to-end encryption")
+
+var errE2EUnsupported = errors.New("a node on the path doesn't support it")
+
+type e2eState struct {
+	session uint64 // see newSession, so that nonces are never reused
+
+	sendLock sync.Mutex
+	counter  uint64
+
+	recvLock sync.Mutex
+	filters  map[mtypes.Vertex]*sessionFilter
+}
+
+func e2eNonce(header []byte, src_nodeID mtypes.Vertex) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, header[:E2EHeaderOffsetLength])
+	binary.LittleEndian.PutUint16(nonce[E2EHeaderOffsetLength:], uint16(src_nodeID))
+	return nonce
+}
+
+func e2eAdditionalData(usage path.Usage, flags path.HeaderFlags, EgHeader []byte, header []byte) []byte {
+	ad := []byte{uint8(usage), uint8(flags)}
+	ad = append(ad, EgHeader...)
+	return append(ad, header[:E2EHeaderOffsetLength]...)
+}
+
+// E2EEnabled reports whether frames to dst_nodeID are encrypted for it.
+func (device *Device) E2EEnabled(dst_nodeID mtypes.Vertex) bool {
+	conf := device.EdgeConfig().E2EEncryption
+	if !conf.Enabled {
+		return false
+	}
+	if len(conf.Destinations) == 0 {
+		return true
+	}
+	for _, id := range conf.Destinations {
+		if id == dst_nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// EncryptPacket encrypts the body of a unicast data frame we send to dst_nodeID in place.
+// elem.packet must have the capacity for the E2EHeader and the tag.
+func (device *Device) EncryptPacket(elem *QueueOutboundElement, dst_nodeID mtypes.Vertex) error {
+	size := len(elem.packet) - path.EgHeaderLen
+	if len(elem.packet)+E2EHeaderLen+chacha20poly1305.Overhead > cap(elem.packet) || size+chacha20poly1305.Overhead > math.MaxUint16 {
+		return errors.New("packet too large")
+	}
+	key, ok := device.pairKey(dst_nodeID, e2eLabel)
+	if !ok {
+		return errors.New("no PSK shared with the destination")
+	}
+	aead, _ := chacha20poly1305.NewX(key[:])
+
+	device.e2e.sendLock.Lock()
+	counter := device.e2e.counter
+	device.e2e.counter++
+	device.e2e.sendLock.Unlock()
+
+	packet := elem.packet[:len(elem.packet)+E2EHeaderLen]
+	copy(packet[path.EgHeaderLen+E2EHeaderLen:], packet[path.EgHeaderLen:path.EgHeaderLen+size])
+	header := packet[path.EgHeaderLen : path.EgHeaderLen+E2EHeaderLen]
+	binary.LittleEndian.PutUint64(header[E2EHeaderOffsetSession:], device.e2e.session)
+	binary.LittleEndian.PutUint64(header[E2EHeaderOffsetCounter:], counter)
+	binary.LittleEndian.PutUint16(header[E2EHeaderOffsetLength:], uint16(size+chacha20poly1305.Overhead))
+	elem.Flags |= path.FlagEncrypted
+
+	body := packet[path.EgHeaderLen+E2EHeaderLen:]
+	sealed := aead.Seal(body[:0], e2eNonce(header, device.ID), body, e2eAdditionalData(elem.Type, elem.Flags, packet[:path.EgHeaderLen], header))
+	elem.packet = packet[:path.EgHeaderLen+E2EHeaderLen+len(sealed)]
+	return nil
+}
+
+// e2eDropped counts a frame to dst_nodeID we dropped since we couldn't encrypt it.
+func (device *Device) e2eDropped(dst_nodeID mtypes.Vertex, err error) {
+	device.peers.RLock()
+	dst_peer := device.peers.IDMap[dst_nodeID]
+	device.peers.RUnlock()
+	if dst_peer != nil {
+		atomic.AddUint64(&dst_peer.stats.e2eDropped, 1)
+	}
+	if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelError) {
+		device.slog.Errorf(mtypes.LogCatNormal, mtypes.LogFields{"dst": dst_nodeID.ToString()}, "Failed to encrypt packet, dropped: %v", err)
+	}
+}
+
+// DecryptPacket decrypts a unicast data frame from src_nodeID in place and removes the E2EHeader.
+func (device *Device) DecryptPacket(elem *QueueInboundElement, src_nodeID mtypes.Vertex) error {
+	packet := elem.packet
+	if len(packet) < path.EgHeaderLen+E2EHeaderLen {
+		return errors.New("E2EHeader truncated")
+	}
+	header := packet[path.EgHeaderLen : path.EgHeaderLen+E2EHeaderLen]
+	length := int(binary.LittleEndian.Uint16(header[E2EHeaderOffsetLength:]))
+	if len(packet) < path.EgHeaderLen+E2EHeaderLen+length {
+		return errors.New("body truncated")
+	}
+	keys := device.pairKeys(src_nodeID, e2eLabel)
+	if len(keys) == 0 {
+		return errors.New("no PSK shared with the source")
+	}
+	body := packet[path.EgHeaderLen+E2EHeaderLen : path.EgHeaderLen+E2EHeaderLen+length]
+	var plain []byte
+	var err error
+	for i, key := range keys {
+		aead, _ := chacha20poly1305.NewX(key[:])
+		// a failed Open clears its output, so only the last attempt decrypts in place
+		dst := body[:0]
+		if i < len(keys)-1 {
+			dst = nil
+		}
+		if plain, err = aead.Open(dst, e2eNonce(header, src_nodeID), body, e2eAdditionalData(elem.Type, elem.Flags, packet[:path.EgHeaderLen], header)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	session := binary.LittleEndian.Uint64(header[E2EHeaderOffsetSession:])
+	counter := binary.LittleEndian.Uint64(header[E2EHeaderOffsetCounter:])
+	if !device.checkE2ECounter(src_nodeID, session, counter) {
+		return errors.New("replayed")
+	}
+	copy(packet[path.EgHeaderLen:], plain)
+	elem.packet = packet[:path.EgHeaderLen+len(plain)]
+	elem.Flags &^= path.FlagEncrypted
+	return nil
+}
+
+func (device *Device) checkE2ECounter(src_nodeID mtypes.Vertex, session uint64, counter uint64) bool {
+	device.e2e.recvLock.Lock()
+	defer device.e2e.recvLock.Unlock()
+	if device.e2e.filters == nil {
+		device.e2e.filters = make(map[mtypes.Vertex]*sessionFilter)
+	}
+	f, ok := device.e2e.filters[src_nodeID]
+	if !ok {
+		f = &sessionFilter{}
+		device.e2e.filters[src_nodeID] = f
+	}
+	return f.validate(session, counter)
+}
+
+// E2ERequired reports whether an unencrypted frame from src_nodeID to dst_nodeID must be dropped.
+// Frames which come directly from their source are encrypted by the session with the peer already.
+func (device *Device) E2ERequired(peer_id mtypes.Vertex, src_nodeID mtypes.Vertex, dst_nodeID mtypes.Vertex) bool {
+	if !device.EdgeConfig().E2EEncryption.Require || src_nodeID == peer_id || dst_nodeID != device.ID {
+		return false
+	}
+	return device.E2EEnabled(src_nodeID)
+}
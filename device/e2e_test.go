@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestE2EEncryption(t *testing.T) {
+	node1, node3 := newAuthTestDevice(t, 1), newAuthTestDevice(t, 3)
+	for _, node := range []*Device{node1, node3} {
+		node.EdgeConfig().E2EEncryption = mtypes.E2EInfo{Enabled: true, Destinations: []mtypes.Vertex{1, 3}, Require: true}
+	}
+	if !node1.E2EEnabled(3) || node1.E2EEnabled(2) {
+		t.Error("Destinations ignored")
+	}
+
+	frame := broadcastPacket(1, 3, []byte("secret ethernet frame of node 1"))
+	encrypt := func() []byte {
+		buf := make([]byte, MaxMessageSize)
+		elem := &QueueOutboundElement{Type: path.NormalPacket, Flags: path.FlagCompressed, packet: buf[:copy(buf, frame)]}
+		if err := node1.EncryptPacket(elem, 3); err != nil {
+			t.Fatal(err)
+		}
+		if elem.Flags != path.FlagCompressed|path.FlagEncrypted || bytes.Contains(elem.packet, []byte("secret")) {
+			t.Fatalf("flags %v packet %x", elem.Flags, elem.packet)
+		}
+		return elem.packet
+	}
+	// node 3 receives it through node 2, which may pad it
+	decrypt := func(packet []byte, src mtypes.Vertex) (*QueueInboundElement, error) {
+		elem := &QueueInboundElement{Type: path.NormalPacket, Flags: path.FlagCompressed | path.FlagEncrypted, packet: append(append([]byte(nil), packet...), make([]byte, 11)...)}
+		return elem, node3.DecryptPacket(elem, src)
+	}
+
+	packet := encrypt()
+	if elem, err := decrypt(packet, 1); err != nil || elem.Flags != path.FlagCompressed || !bytes.Equal(elem.packet, frame) {
+		t.Fatalf("decrypted %x flags %v: %v", elem.packet, elem.Flags, err)
+	}
+	if _, err := decrypt(packet, 1); err == nil {
+		t.Error("replayed frame accepted")
+	}
+	// node 1 restarts, its frames of the session before are replays
+	older := encrypt()
+	node1.e2e.session, node1.e2e.counter = node1.e2e.session+1, 0
+	if _, err := decrypt(encrypt(), 1); err != nil {
+		t.Errorf("frame of the new session dropped: %v", err)
+	}
+	if _, err := decrypt(older, 1); err == nil {
+		t.Error("frame of the session before accepted")
+	}
+	packet = encrypt()
+	if _, err := decrypt(packet, 2); err == nil {
+		t.Error("frame of another source accepted")
+	}
+	EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], DefaultMTU)
+	EgHeader.SetDst(2)
+	if _, err := decrypt(packet, 1); err == nil {
+		t.Error("frame with a changed EgHeader accepted")
+	}
+
+	if !node3.E2ERequired(2, 1, 3) || node3.E2ERequired(1, 1, 3) || node3.E2ERequired(2, 1, mtypes.NodeID_Broadcast) {
+		t.Error("Require applied to the wrong frames")
+	}
+	node3.EdgeConfig().E2EEncryption.Require = false
+	if node3.E2ERequired(2, 1, 3) {
+		t.Error("unencrypted frame dropped without Require")
+	}
+}
@@ -0,0 +1,351 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/fec"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Forward error correction works hop by hop on the encrypted transport packets.
+// Packets sent to a peer are grouped by the consecutive counters of the keypair,
+// and K parity packets are sent after every group of DataShards packets.
+// Parity packets are not encrypted, but authenticated by the keypair with a tag over the whole packet.
+// Only packets which decrypted are recorded, so forged packets can't spoil a recovery or evict the groups.
+// Recovered packets are authenticated by the keypair again, and duplicates are dropped by the replay filter.
+// K adapts to the loss rate the peer measured on our pings.
+
+const (
+	MessageFECOffsetReceiver = 2
+	MessageFECOffsetBase     = 6
+	MessageFECOffsetN        = 14
+	MessageFECOffsetK        = 15
+	MessageFECOffsetIndex    = 16
+	MessageFECOffsetShard    = 18
+	MessageFECHeaderSize     = MessageFECOffsetShard
+	MessageFECTagSize        = chacha20poly1305.Overhead
+)
+
+const (
+	FECDecoderPackets = 512 // received packets kept for recovery, per peer
+	FECDecoderGroups  = 64  // groups waiting for recovery, per peer
+)
+
+type peerFEC struct {
+	sendLock   sync.Mutex
+	encoder    fec.Encoder
+	flushTimer *time.Timer
+
+	recvLock sync.Mutex
+	decoder  *fec.Decoder
+
+	txLoss atomic.Value // float64, loss rate of our packets reported by the peer
+	rxLoss lossMeter    // loss rate of the pings from the peer
+
+	pingID uint32 // accessed atomically
+}
+
+func (f *peerFEC) NextPingID() uint32 {
+	return atomic.AddUint32(&f.pingID, 1)
+}
+
+func (f *peerFEC) TxLoss() float64 {
+	loss, _ := f.txLoss.Load().(float64)
+	return loss
+}
+
+// A lossMeter estimates the loss rate from the gaps of the sequence numbers.
+type lossMeter struct {
+	sync.Mutex
+	last uint32
+	loss float64
+}
+
+const (
+	lossMeterWeight  = 16   // weight of the history in the moving average
+	lossMeterMaxGap  = 1000 // larger gaps are outages, not losses
+	lossMeterReorder = 16   // older sequence numbers mean the peer restarted
+)
+
+func (m *lossMeter) Push(seq uint32) {
+	if seq == 0 {
+		return // old versions don't number their pings
+	}
+	m.Lock()
+	defer m.Unlock()
+	if seq <= m.last && m.last-seq <= lossMeterReorder {
+		return // reordered or duplicated
+	}
+	if m.last == 0 || seq < m.last || seq-m.last > lossMeterMaxGap {
+		m.last = seq
+		return
+	}
+	for lost := seq - m.last - 1; lost > 0; lost-- {
+		m.loss += (1 - m.loss) / lossMeterWeight
+	}
+	m.loss -= m.loss / lossMeterWeight
+	m.last = seq
+}
+
+func (m *lossMeter) Loss() float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.loss
+}
+
+// FECActive reports whether FEC is used with the peer.
+func (device *Device) FECActive(peer *Peer) bool {
+	return device.EdgeConfig().FEC.Enabled && device.NodeFeatures(peer.ID).Has(mtypes.FeatureFEC)
+}
+
+func (device *Device) SetFECTxLoss(peer *Peer, loss float64) {
+	if math.IsNaN(loss) || loss < 0 {
+		loss = 0
+	} else if loss > 1 {
+		loss = 1
+	}
+	old := peer.fec.TxLoss()
+	peer.fec.txLoss.Store(loss)
+	if math.Abs(old-loss) >= 0.01 && device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelDebug) {
+		device.slog.Debugf(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "FEC loss rate: %.3f", loss)
+	}
+}
+
+func (device *Device) fecDataShards() int {
+	n := device.EdgeConfig().FEC.DataShards
+	if n < 1 {
+		return 1
+	} else if n > fec.MaxDataShards {
+		return fec.MaxDataShards
+	}
+	return n
+}
+
+// fecParityCount returns the number of parity packets for a group of n packets.
+// It covers the expected losses plus three standard deviations, clamped to the configured range.
+func (device *Device) fecParityCount(peer *Peer, n int) int {
+	loss := peer.fec.TxLoss()
+	mean := float64(n) * loss
+	k := int(math.Ceil(mean + 3*math.Sqrt(mean*(1-loss))))
+	if k < device.EdgeConfig().FEC.MinParityShards {
+		k = device.EdgeConfig().FEC.MinParityShards
+	}
+	if k > device.EdgeConfig().FEC.MaxParityShards {
+		k = device.EdgeConfig().FEC.MaxParityShards
+	}
+	if k > fec.MaxParityShards {
+		k = fec.MaxParityShards
+	}
+	return k
+}
+
+// FECSent adds a sent transport packet to the current group of the peer.
+func (peer *Peer) FECSent(packet []byte) {
+	device := peer.device
+	if len(packet) <= MessageKeepaliveSize || !device.FECActive(peer) {
+		return
+	}
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	counter := binary.LittleEndian.Uint64(packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+
+	peer.fec.sendLock.Lock()
+	defer peer.fec.sendLock.Unlock()
+	if !peer.fec.encoder.Add(receiver, counter, packet) {
+		peer.fecFlushLocked()
+		peer.fec.encoder.Add(receiver, counter, packet)
+	}
+	if peer.fec.encoder.Len() >= device.fecDataShards() {
+		peer.fecFlushLocked()
+		return
+	}
+	if peer.fec.encoder.Len() == 1 {
+		timeout := mtypes.S2TD(device.EdgeConfig().FEC.FlushTimeout)
+		if peer.fec.flushTimer == nil {
+			peer.fec.flushTimer = time.AfterFunc(timeout, peer.fecFlush)
+		} else {
+			peer.fec.flushTimer.Reset(timeout)
+		}
+	}
+}
+
+func (peer *Peer) fecFlush() {
+	peer.fec.sendLock.Lock()
+	defer peer.fec.sendLock.Unlock()
+	peer.fecFlushLocked()
+}
+
+// fecNonce is the nonce of the tag of a parity packet. Transport packets use nonces with the first 4 bytes zero,
+// and the base of a group is the counter of its first packet, so it is never reused.
+func fecNonce(base uint64, index int) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	nonce[0] = 1
+	nonce[1] = uint8(index)
+	binary.LittleEndian.PutUint64(nonce[4:], base)
+	return nonce
+}
+
+// fecKeypair returns the keypair we sent the packets to the receiver index with, nil if we dropped it.
+func (peer *Peer) fecKeypair(receiver uint32) *Keypair {
+	peer.keypairs.RLock()
+	defer peer.keypairs.RUnlock()
+	for _, keypair := range []*Keypair{peer.keypairs.current, peer.keypairs.previous} {
+		if keypair != nil && keypair.remoteIndex == receiver {
+			return keypair
+		}
+	}
+	return nil
+}
+
+func (peer *Peer) fecFlushLocked() {
+	device := peer.device
+	if peer.fec.encoder.Len() == 0 {
+		return
+	}
+	k := device.fecParityCount(peer, peer.fec.encoder.Len())
+	receiver, base, n, parity, err := peer.fec.encoder.Flush(k)
+	if err != nil {
+		device.log.Errorf("%v - Failed to encode FEC parity: %v", peer, err)
+		return
+	}
+	keypair := peer.fecKeypair(receiver)
+	if keypair == nil {
+		return
+	}
+	for index, shard := range parity {
+		if MessageFECHeaderSize+len(shard)+MessageFECTagSize > MaxMessageSize {
+			return
+		}
+		packet := make([]byte, MessageFECHeaderSize+len(shard), MessageFECHeaderSize+len(shard)+MessageFECTagSize)
+		packet[0] = uint8(path.FECParity)
+		binary.LittleEndian.PutUint32(packet[MessageFECOffsetReceiver:MessageFECOffsetBase], receiver)
+		binary.LittleEndian.PutUint64(packet[MessageFECOffsetBase:MessageFECOffsetN], base)
+		packet[MessageFECOffsetN] = uint8(n)
+		packet[MessageFECOffsetK] = uint8(len(parity))
+		packet[MessageFECOffsetIndex] = uint8(index)
+		copy(packet[MessageFECOffsetShard:], shard)
+		packet = keypair.send.Seal(packet, fecNonce(base, index), nil, packet)
+		if err := peer.SendBuffer(packet); err != nil {
+			device.log.Errorf("%v - Failed to send FEC parity: %v", peer, err)
+			return
+		}
+		atomic.AddUint64(&peer.stats.fecParitySent, 1)
+	}
+}
+
+func (peer *Peer) fecStop() {
+	peer.fec.sendLock.Lock()
+	defer peer.fec.sendLock.Unlock()
+	if peer.fec.flushTimer != nil {
+		peer.fec.flushTimer.Stop()
+	}
+	peer.fec.encoder.Flush(0)
+}
+
+// fecReceived records a transport packet which decrypted and returns the packets recovered thanks to it.
+// packet is the copy from before it was decrypted in place.
+func (peer *Peer) fecReceived(packet []byte) [][]byte {
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	counter := binary.LittleEndian.Uint64(packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	peer.fec.recvLock.Lock()
+	defer peer.fec.recvLock.Unlock()
+	if peer.fec.decoder == nil {
+		peer.fec.decoder = fec.NewDecoder(FECDecoderPackets, FECDecoderGroups)
+	}
+	return peer.fec.decoder.AddData(receiver, counter, packet)
+}
+
+func (device *Device) ReceiveFECParity(packet []byte, endpoint conn.Endpoint, batch inboundBatch) {
+	if len(packet) <= MessageFECHeaderSize+MessageFECTagSize {
+		return
+	}
+	receiver := binary.LittleEndian.Uint32(packet[MessageFECOffsetReceiver:MessageFECOffsetBase])
+	value := device.indexTable.Lookup(receiver)
+	peer := value.peer
+	if value.keypair == nil || peer == nil || !peer.isRunning.Get() || !device.FECActive(peer) {
+		return
+	}
+	base := binary.LittleEndian.Uint64(packet[MessageFECOffsetBase:MessageFECOffsetN])
+	n := int(packet[MessageFECOffsetN])
+	k := int(packet[MessageFECOffsetK])
+	index := int(packet[MessageFECOffsetIndex])
+	tag := len(packet) - MessageFECTagSize
+	if _, err := value.keypair.receive.Open(nil, fecNonce(base, index), packet[tag:], packet[:tag]); err != nil {
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelDebug) {
+			device.slog.Debugf(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peer.ID.ToString(), "endpoint": endpoint.DstToString()}, "Invalid FEC parity: %v", err)
+		}
+		return
+	}
+
+	peer.fec.recvLock.Lock()
+	if peer.fec.decoder == nil {
+		peer.fec.decoder = fec.NewDecoder(FECDecoderPackets, FECDecoderGroups)
+	}
+	recovered, err := peer.fec.decoder.AddParity(receiver, base, n, k, index, packet[MessageFECOffsetShard:tag])
+	peer.fec.recvLock.Unlock()
+	if err != nil {
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelDebug) {
+			device.slog.Debugf(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peer.ID.ToString(), "endpoint": endpoint.DstToString()}, "Invalid FEC parity: %v", err)
+		}
+		return
+	}
+	atomic.AddUint64(&peer.stats.fecParityReceived, 1)
+	device.receiveFECRecovered(peer, recovered, endpoint, batch)
+}
+
+// fecValidRecovered reports whether a recovered packet looks like a transport packet.
+func fecValidRecovered(packet []byte) bool {
+	if len(packet) < MessageTransportSize || len(packet) > MaxMessageSize {
+		return false
+	}
+	usage, _ := path.SplitUsageFlags(packet[0])
+	return usage >= path.MessageTransportType && usage != path.FECParity
+}
+
+// receiveFECRecovered puts the recovered transport packets back in the receive batch.
+func (device *Device) receiveFECRecovered(peer *Peer, recovered [][]byte, endpoint conn.Endpoint, batch inboundBatch) {
+	for _, packet := range recovered {
+		if !fecValidRecovered(packet) {
+			continue
+		}
+		atomic.AddUint64(&peer.stats.fecRecovered, 1)
+		buffer := device.GetMessageBuffer()
+		size := copy(buffer[:], packet)
+		if !device.queueInboundTransport(buffer, buffer[:size], endpoint, false, batch) {
+			device.PutMessageBuffer(buffer)
+		}
+	}
+}
+
+// fecRecovered appends the packets recovered thanks to elem, which just decrypted, to elems.
+// They are packets of the same keypair, the decryption worker decrypts them next.
+func (device *Device) fecRecovered(elem *QueueInboundElement, recovered [][]byte, elems []*QueueInboundElement) []*QueueInboundElement {
+	for _, packet := range recovered {
+		if !fecValidRecovered(packet) {
+			continue
+		}
+		atomic.AddUint64(&elem.fecPeer.stats.fecRecovered, 1)
+		buffer := device.GetMessageBuffer()
+		recoveredElem := device.GetInboundElement()
+		recoveredElem.Type, recoveredElem.Flags = path.SplitUsageFlags(packet[0])
+		recoveredElem.TTL = packet[1]
+		recoveredElem.buffer = buffer
+		recoveredElem.packet = buffer[:copy(buffer[:], packet)]
+		recoveredElem.keypair = elem.keypair
+		recoveredElem.endpoint = elem.endpoint
+		recoveredElem.counter = 0
+		elems = append(elems, recoveredElem)
+	}
+	return elems
+}
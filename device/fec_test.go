@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newFECTestDevice(id mtypes.Vertex, bind conn.Bind) *Device {
+	device := &Device{
+		ID:  id,
+		log: NewLogger(LogLevelError, ""),
+	}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{
+		FEC: mtypes.FECInfo{
+			Enabled:         true,
+			DataShards:      8,
+			MinParityShards: 1,
+			MaxParityShards: 4,
+			FlushTimeout:    10,
+		},
+	})
+	device.net.bind = bind
+	device.indexTable.Init()
+	device.PopulatePools()
+	return device
+}
+
+func TestFECLossyBind(t *testing.T) {
+	const (
+		packets  = 2000
+		receiver = 7
+		loss     = 0.05
+	)
+	binds := bindtest.NewLossyChannelBinds(loss, 1)
+	recvFns, _, err := binds[1].Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binds[1].Close()
+	if _, _, err = binds[0].Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer binds[0].Close()
+
+	var key [chacha20poly1305.KeySize]byte
+	rand.New(rand.NewSource(1)).Read(key[:])
+	aead, _ := chacha20poly1305.New(key[:])
+
+	// sender: node 1, sending to peer 2
+	sender := newFECTestDevice(1, binds[0])
+	sender.node_features.Store(mtypes.Vertex(2), mtypes.FeatureFEC)
+	endpoint, _ := binds[0].ParseEndpoint("127.0.0.1:1")
+	peerOut := &Peer{device: sender, ID: 2, endpoint: endpoint}
+	peerOut.keypairs.current = &Keypair{send: aead, remoteIndex: receiver}
+	sender.SetFECTxLoss(peerOut, loss)
+
+	// receiver: node 2, receiving from peer 1
+	recv := newFECTestDevice(2, binds[1])
+	recv.node_features.Store(mtypes.Vertex(1), mtypes.FeatureFEC)
+	// a short decryption queue slows the sender down, like the decryption workers of a device
+	recv.queue.decryption = &inboundQueue{c: make(chan *QueueInboundElementsContainer, 64)}
+	peerIn := &Peer{device: recv, ID: 1}
+	peerIn.isRunning.Set(true)
+	peerIn.queue.inbound = &autodrainingInboundQueue{c: make(chan *QueueInboundElementsContainer, 4*packets)}
+	recv.indexTable.table[receiver] = IndexTableEntry{peer: peerIn, keypair: &Keypair{receive: aead, created: time.Now()}}
+	go recv.RoutineDecryption(0)
+	defer close(recv.queue.decryption.c)
+
+	var processed uint64
+	go func() {
+		buffer := recv.GetMessageBuffer()
+		sizes := make([]int, 1)
+		eps := make([]conn.Endpoint, 1)
+		batch := make(inboundBatch)
+		for {
+			if _, err := recvFns[0]([][]byte{buffer[:]}, sizes, eps); err != nil {
+				return
+			}
+			if recv.receiveIncoming(buffer, buffer[:sizes[0]], eps[0], batch) {
+				buffer = recv.GetMessageBuffer()
+			}
+			recv.flushInboundBatch(batch)
+			atomic.AddUint64(&processed, 1)
+		}
+	}()
+
+	// an attacker sends forged parity and packets ahead of ours, which must not spoil the recovery
+	r := rand.New(rand.NewSource(2))
+	forged := uint64(0)
+	send := func(packet []byte) {
+		if err := peerOut.SendBuffer(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < packets; i++ {
+		if i%sender.fecDataShards() == 0 {
+			for index := 0; index < sender.fecParityCount(peerOut, sender.fecDataShards()); index++ {
+				parity := make([]byte, MessageFECHeaderSize+1400+MessageFECTagSize)
+				r.Read(parity)
+				parity[0] = uint8(path.FECParity)
+				binary.LittleEndian.PutUint32(parity[MessageFECOffsetReceiver:], receiver)
+				binary.LittleEndian.PutUint64(parity[MessageFECOffsetBase:], uint64(i))
+				parity[MessageFECOffsetN] = uint8(sender.fecDataShards())
+				parity[MessageFECOffsetK] = uint8(sender.fecParityCount(peerOut, sender.fecDataShards()))
+				parity[MessageFECOffsetIndex] = uint8(index)
+				send(parity)
+				forged++
+			}
+		}
+		header := make([]byte, MessageTransportHeaderSize)
+		header[0] = uint8(path.NormalPacket)
+		binary.LittleEndian.PutUint32(header[MessageTransportOffsetReceiver:], receiver)
+		binary.LittleEndian.PutUint64(header[MessageTransportOffsetCounter:], uint64(i))
+		body := make([]byte, r.Intn(1400))
+		r.Read(body)
+
+		forgedPacket := append(append([]byte(nil), header...), make([]byte, len(body)+chacha20poly1305.Overhead)...)
+		r.Read(forgedPacket[MessageTransportHeaderSize:])
+		send(forgedPacket)
+		forged++
+
+		var nonce [chacha20poly1305.NonceSize]byte
+		binary.LittleEndian.PutUint64(nonce[4:], uint64(i))
+		packet := aead.Seal(header, nonce[:], body, nil)
+		send(packet)
+		peerOut.FECSent(packet)
+	}
+	peerOut.fecFlush()
+
+	sent := packets + forged + atomic.LoadUint64(&peerOut.stats.fecParitySent)
+	delivered := sent - binds[0].(*bindtest.ChannelBind).Dropped()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&processed) < delivered {
+		if time.Now().After(deadline) {
+			t.Fatalf("processed %d of %d packets", atomic.LoadUint64(&processed), delivered)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	received := make(map[uint64]bool)
+	for len(peerIn.queue.inbound.c) > 0 {
+		elemsContainer := <-peerIn.queue.inbound.c
+		elemsContainer.Lock()
+		for _, elem := range elemsContainer.elems {
+			if elem.packet != nil {
+				received[elem.counter] = true
+			}
+		}
+	}
+	if parity := atomic.LoadUint64(&peerIn.stats.fecParityReceived); parity > atomic.LoadUint64(&peerOut.stats.fecParitySent) {
+		t.Errorf("%d parity packets accepted, %d sent", parity, atomic.LoadUint64(&peerOut.stats.fecParitySent))
+	}
+	recovered := atomic.LoadUint64(&peerIn.stats.fecRecovered)
+	if recovered == 0 {
+		t.Fatal("no packet recovered")
+	}
+	if lost := packets - len(received); lost > packets/200 {
+		t.Fatalf("%d packets lost after FEC, %d recovered", lost, recovered)
+	}
+}
+
+func TestLossMeter(t *testing.T) {
+	var m lossMeter
+	for seq := uint32(1); seq <= 1000; seq++ {
+		if seq%10 != 0 {
+			m.Push(seq)
+		}
+	}
+	if loss := m.Loss(); loss < 0.05 || loss > 0.15 {
+		t.Fatalf("loss %.3f, expected about 0.1", loss)
+	}
+	// a restarted peer numbers its pings from 1 again
+	m.Push(1)
+	m.Push(2)
+	if loss := m.Loss(); loss > 0.15 {
+		t.Fatalf("restart counted as loss: %.3f", loss)
+	}
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// forwardTable is an immutable snapshot of where packets go, so that the data path takes no locks.
+// It is rebuilt whenever the next hop table of the graph or the peer set changes.
+type forwardTable struct {
+	graphVersion uint32
+	peersVersion uint32
+
+	peers     map[mtypes.Vertex]*Peer // copy of device.peers.IDMap
+	next      map[mtypes.Vertex]*Peer // next hop peer for every routable destination, nil if it is not a peer yet
+	broadcast []*Peer                 // next hops of all destinations, which our own broadcast goes to
+
+	// Broadcast from a source is forwarded to the next hops whose path from the source goes through us.
+	// The peer it came in from is skipped when sending.
+	through     map[mtypes.Vertex][]*Peer
+	throughErrs map[mtypes.Vertex][]error
+}
+
+// forwarding returns the current forwarding table, rebuilding it first if it is stale.
+func (device *Device) forwarding() *forwardTable {
+	fwd, _ := device.forward.table.Load().(*forwardTable)
+	if fwd != nil && fwd.graphVersion == device.graph.NhTableVersion() && fwd.peersVersion == atomic.LoadUint32(&device.peers.version) {
+		return fwd
+	}
+	device.forward.Lock()
+	defer device.forward.Unlock()
+	fwd, _ = device.forward.table.Load().(*forwardTable)
+	if fwd != nil && fwd.graphVersion == device.graph.NhTableVersion() && fwd.peersVersion == atomic.LoadUint32(&device.peers.version) {
+		return fwd
+	}
+	fwd = device.buildForwardTable()
+	device.forward.table.Store(fwd)
+	return fwd
+}
+
+func (device *Device) buildForwardTable() *forwardTable {
+	// read the versions first, a change while building makes the next lookup rebuild again
+	fwd := &forwardTable{
+		graphVersion: device.graph.NhTableVersion(),
+		peersVersion: atomic.LoadUint32(&device.peers.version),
+		next:         make(map[mtypes.Vertex]*Peer),
+		through:      make(map[mtypes.Vertex][]*Peer),
+		throughErrs:  make(map[mtypes.Vertex][]error),
+	}
+	device.peers.RLock()
+	fwd.peers = make(map[mtypes.Vertex]*Peer, len(device.peers.IDMap))
+	for id, peer := range device.peers.IDMap {
+		fwd.peers[id] = peer
+	}
+	device.peers.RUnlock()
+
+	nhTable := device.graph.GetNHTable(false)
+	for dst, next_id := range nhTable[device.ID] {
+		fwd.next[dst] = fwd.peers[next_id]
+	}
+	for next_id := range device.graph.GetBoardcastList(device.ID) {
+		if peer := fwd.peers[next_id]; peer != nil {
+			fwd.broadcast = append(fwd.broadcast, peer)
+		}
+	}
+	for src := range nhTable {
+		var through []*Peer
+		for _, peer := range fwd.broadcast {
+			path, err := device.graph.Path(src, peer.ID)
+			if err != nil {
+				fwd.throughErrs[src] = append(fwd.throughErrs[src], err)
+				continue
+			}
+			for _, path_node := range path {
+				if path_node == device.ID {
+					through = append(through, peer)
+					break
+				}
+			}
+		}
+		fwd.through[src] = through
+	}
+	return fwd
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// newForwardTestDevice is node 2 of the line 1 - 2 - 3
+func newForwardTestDevice(tb testing.TB) *Device {
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{StaticMode: true}, mtypes.NTPInfo{}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	graph.SetNHTable(mtypes.NextHopTable{
+		1: {2: 2, 3: 2},
+		2: {1: 1, 3: 3},
+		3: {1: 2, 2: 2},
+	})
+	device := &Device{ID: 2, graph: graph}
+	device.peers.IDMap = map[mtypes.Vertex]*Peer{1: {ID: 1}, 3: {ID: 3}}
+	return device
+}
+
+func peerIDs(peers []*Peer) map[mtypes.Vertex]bool {
+	ids := make(map[mtypes.Vertex]bool)
+	for _, peer := range peers {
+		ids[peer.ID] = true
+	}
+	return ids
+}
+
+func TestForwardTable(t *testing.T) {
+	device := newForwardTestDevice(t)
+	peer1, peer3 := device.peers.IDMap[1], device.peers.IDMap[3]
+
+	fwd := device.forwarding()
+	if fwd.next[1] != peer1 || fwd.next[3] != peer3 {
+		t.Fatalf("next hops %v", fwd.next)
+	}
+	if _, ok := fwd.next[4]; ok {
+		t.Errorf("unknown destination 4 is routable")
+	}
+	if ids := peerIDs(fwd.broadcast); len(ids) != 2 || !ids[1] || !ids[3] {
+		t.Errorf("broadcast to %v", ids)
+	}
+	// broadcast from 1 is forwarded to 3 only, and the other way around
+	if ids := peerIDs(fwd.through[1]); len(ids) != 1 || !ids[3] {
+		t.Errorf("broadcast from 1 forwarded to %v", ids)
+	}
+	if ids := peerIDs(fwd.through[3]); len(ids) != 1 || !ids[1] {
+		t.Errorf("broadcast from 3 forwarded to %v", ids)
+	}
+	if device.forwarding() != fwd {
+		t.Errorf("rebuilt without a change")
+	}
+
+	// 3 moves behind 1
+	device.graph.SetNHTable(mtypes.NextHopTable{
+		1: {2: 2, 3: 3},
+		2: {1: 1, 3: 1},
+		3: {1: 1, 2: 1},
+	})
+	fwd = device.forwarding()
+	if fwd.next[3] != peer1 {
+		t.Errorf("next hop to 3 is %v after the next hop table changed", fwd.next[3])
+	}
+	if ids := peerIDs(fwd.through[3]); len(ids) != 0 {
+		t.Errorf("broadcast from 3 forwarded to %v, but we are a leaf now", ids)
+	}
+
+	device.peers.Lock()
+	delete(device.peers.IDMap, 1)
+	atomic.AddUint32(&device.peers.version, 1)
+	device.peers.Unlock()
+	fwd = device.forwarding()
+	if fwd.next[3] != nil || fwd.peers[1] != nil || len(fwd.broadcast) != 0 {
+		t.Errorf("removed peer 1 still forwarded to")
+	}
+}
+
+func BenchmarkForwardTable(b *testing.B) {
+	device := newForwardTestDevice(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if device.forwarding().next[3] == nil {
+				b.Fatal("no route")
+			}
+		}
+	})
+}
@@ -0,0 +1,219 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Frames which don't fit in the path MTU are split by the source into fragments,
+// each one with a FragHeader after the EgHeader (and after the DupHeader, if duplicated).
+// Transit nodes forward fragments as-is, the destination reassembles them.
+
+const (
+	FragHeaderOffsetID    = 0
+	FragHeaderOffsetIndex = 4
+	FragHeaderOffsetCount = 5
+	FragHeaderLen         = 6
+)
+
+const (
+	MinFragmentSize = 64 // smaller path MTUs disable fragmentation
+
+	// used when ReassemblyTimeout or ReassemblyMemory is not set, since we always accept fragments
+	DefaultReassemblyTimeout = time.Second
+	DefaultReassemblyMemory  = 4 << 20
+)
+
+type fragKey struct {
+	src mtypes.Vertex
+	id  uint32
+}
+
+type fragGroup struct {
+	key      fragKey
+	created  time.Time
+	pieces   [][]byte
+	received int
+	size     int
+}
+
+type fragState struct {
+	id uint32 // accessed atomically
+
+	sync.Mutex
+	groups map[fragKey]*fragGroup
+	order  []*fragGroup // by creation time, for timeouts and eviction
+	size   int
+}
+
+// FragmentSize returns the largest payload of a fragment, after the EgHeader and FragHeader.
+// extra is the size of the other headers in the packet.
+func (device *Device) FragmentSize(extra int) int {
+	size := device.EdgeConfig().Fragmentation.PathMTU - MessageTransportSize - (PaddingMultiple - 1) - path.EgHeaderLen - FragHeaderLen - extra
+	if size < MinFragmentSize {
+		return 0
+	}
+	return size
+}
+
+// Fragment splits the packet into fragments of at most size bytes of payload.
+// It returns nil if the packet doesn't need fragmentation, or can't be fragmented.
+func (device *Device) Fragment(packet []byte, size int) [][]byte {
+	payload := packet[path.EgHeaderLen:]
+	if size <= 0 || len(payload) <= size+FragHeaderLen {
+		return nil
+	}
+	count := (len(payload) + size - 1) / size
+	if count > 255 {
+		return nil
+	}
+	id := atomic.AddUint32(&device.frag.id, 1)
+	fragments := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		piece := payload[index*size:]
+		if len(piece) > size {
+			piece = piece[:size]
+		}
+		buf := make([]byte, path.EgHeaderLen+FragHeaderLen+len(piece))
+		copy(buf, packet[:path.EgHeaderLen])
+		header := buf[path.EgHeaderLen : path.EgHeaderLen+FragHeaderLen]
+		binary.LittleEndian.PutUint32(header[FragHeaderOffsetID:FragHeaderOffsetIndex], id)
+		header[FragHeaderOffsetIndex] = uint8(index)
+		header[FragHeaderOffsetCount] = uint8(count)
+		copy(buf[path.EgHeaderLen+FragHeaderLen:], piece)
+		fragments = append(fragments, buf)
+	}
+	return fragments
+}
+
+func (device *Device) fragDropped(src_nodeID mtypes.Vertex) {
+	device.peers.RLock()
+	src_peer := device.peers.IDMap[src_nodeID]
+	device.peers.RUnlock()
+	if src_peer != nil {
+		atomic.AddUint64(&src_peer.stats.fragDropped, 1)
+	}
+}
+
+func (device *Device) reassemblyLimits() (timeout time.Duration, memory int) {
+	timeout = mtypes.S2TD(device.EdgeConfig().Fragmentation.ReassemblyTimeout)
+	if timeout <= 0 {
+		timeout = DefaultReassemblyTimeout
+	}
+	memory = device.EdgeConfig().Fragmentation.ReassemblyMemory
+	if memory <= 0 {
+		memory = DefaultReassemblyMemory
+	}
+	return
+}
+
+func (f *fragState) removeGroupLocked(g *fragGroup) {
+	if f.groups[g.key] == g {
+		delete(f.groups, g.key)
+		f.size -= g.size
+	}
+}
+
+// fragExpireLocked removes the timed out groups, and the oldest groups until size more bytes fit in the memory limit.
+func (device *Device) fragExpireLocked(size int) {
+	f := &device.frag
+	timeout, memory := device.reassemblyLimits()
+	now := time.Now()
+	for len(f.order) > 0 {
+		g := f.order[0]
+		if f.groups[g.key] == g {
+			if now.Sub(g.created) < timeout && f.size+size <= memory {
+				break
+			}
+			f.removeGroupLocked(g)
+			device.fragDropped(g.key.src)
+		}
+		f.order[0] = nil
+		f.order = f.order[1:]
+	}
+}
+
+// ReassembleFragment stores a fragment. When the frame is complete, elem is replaced by it and true is returned.
+func (device *Device) ReassembleFragment(elem *QueueInboundElement, src_nodeID mtypes.Vertex) bool {
+	if len(elem.packet) <= path.EgHeaderLen+FragHeaderLen {
+		return false
+	}
+	header := elem.packet[path.EgHeaderLen : path.EgHeaderLen+FragHeaderLen]
+	piece := elem.packet[path.EgHeaderLen+FragHeaderLen:]
+	key := fragKey{src: src_nodeID, id: binary.LittleEndian.Uint32(header[FragHeaderOffsetID:FragHeaderOffsetIndex])}
+	index := int(header[FragHeaderOffsetIndex])
+	count := int(header[FragHeaderOffsetCount])
+	if index >= count {
+		return false
+	}
+
+	f := &device.frag
+	f.Lock()
+	device.fragExpireLocked(len(piece))
+	if _, memory := device.reassemblyLimits(); f.size+len(piece) > memory {
+		f.Unlock()
+		device.fragDropped(src_nodeID)
+		return false
+	}
+	if f.groups == nil {
+		f.groups = make(map[fragKey]*fragGroup)
+	}
+	g, ok := f.groups[key]
+	if !ok {
+		g = &fragGroup{
+			key:     key,
+			created: time.Now(),
+			pieces:  make([][]byte, count),
+		}
+		f.groups[key] = g
+		f.order = append(f.order, g)
+	}
+	if len(g.pieces) != count || g.pieces[index] != nil {
+		f.Unlock()
+		return false
+	}
+	g.pieces[index] = append([]byte(nil), piece...)
+	g.received++
+	g.size += len(piece)
+	f.size += len(piece)
+	if g.received < count {
+		f.Unlock()
+		return false
+	}
+	f.removeGroupLocked(g)
+	f.Unlock()
+
+	payload_offset := MessageTransportOffsetContent + path.EgHeaderLen
+	if payload_offset+g.size > MaxMessageSize {
+		device.fragDropped(src_nodeID)
+		return false
+	}
+	buffer := device.GetMessageBuffer()
+	copy(buffer[MessageTransportOffsetContent:payload_offset], elem.packet[:path.EgHeaderLen])
+	n := payload_offset
+	for _, p := range g.pieces {
+		n += copy(buffer[n:], p)
+	}
+	device.PutMessageBuffer(elem.buffer)
+	elem.buffer = buffer
+	elem.packet = buffer[MessageTransportOffsetContent:n]
+	elem.Flags &^= path.FlagFragment
+
+	device.peers.RLock()
+	src_peer := device.peers.IDMap[src_nodeID]
+	device.peers.RUnlock()
+	if src_peer != nil {
+		atomic.AddUint64(&src_peer.stats.fragReassembled, 1)
+	}
+	return true
+}
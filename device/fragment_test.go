@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func newFragTestDevice(pathMTU int, memory int) *Device {
+	device := &Device{ID: 2}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{
+		Fragmentation: mtypes.FragmentInfo{
+			Enabled:           true,
+			PathMTU:           pathMTU,
+			ReassemblyTimeout: 0.05,
+			ReassemblyMemory:  memory,
+		},
+	})
+	device.peers.IDMap = map[mtypes.Vertex]*Peer{1: {ID: 1}}
+	device.PopulatePools()
+	return device
+}
+
+// fragElem puts a fragment where RoutineSequentialReceiver finds it.
+func fragElem(device *Device, fragment []byte) *QueueInboundElement {
+	elem := &QueueInboundElement{buffer: device.GetMessageBuffer(), Flags: path.FlagFragment}
+	elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+len(fragment)]
+	copy(elem.packet, fragment)
+	return elem
+}
+
+func TestFragmentReassemble(t *testing.T) {
+	device := newFragTestDevice(576, 1<<20)
+	packet := make([]byte, path.EgHeaderLen+1500)
+	rand.New(rand.NewSource(1)).Read(packet)
+
+	size := device.FragmentSize(0)
+	fragments := device.Fragment(packet, size)
+	if len(fragments) != 3 {
+		t.Fatalf("got %d fragments of %d bytes, want 3", len(fragments), size)
+	}
+	for _, fragment := range fragments {
+		if len(fragment)+MessageTransportSize+PaddingMultiple-1 > 576 {
+			t.Fatalf("fragment of %d bytes doesn't fit in the path MTU", len(fragment))
+		}
+	}
+	if device.Fragment(packet[:path.EgHeaderLen+size], size) != nil {
+		t.Fatal("small packet fragmented")
+	}
+
+	for i, index := range []int{2, 0, 1} {
+		elem := fragElem(device, fragments[index])
+		complete := device.ReassembleFragment(elem, 1)
+		if complete != (i == 2) {
+			t.Fatalf("fragment %d: complete %v", index, complete)
+		}
+		if complete && (!bytes.Equal(elem.packet, packet) || elem.Flags != 0) {
+			t.Fatal("reassembled frame mismatch")
+		}
+	}
+	if device.frag.size != 0 || len(device.frag.groups) != 0 {
+		t.Fatalf("reassembly memory not released: %d bytes", device.frag.size)
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	device := newFragTestDevice(576, 1000)
+	packet := make([]byte, path.EgHeaderLen+1500)
+	size := device.FragmentSize(0)
+
+	// the first fragments of two frames don't fit together in the memory limit
+	first := device.Fragment(packet, size)
+	second := device.Fragment(packet, size)
+	device.ReassembleFragment(fragElem(device, first[0]), 1)
+	device.ReassembleFragment(fragElem(device, second[0]), 1)
+	if len(device.frag.groups) != 1 || device.frag.size > 1000 {
+		t.Fatalf("memory limit not enforced: %d groups %d bytes", len(device.frag.groups), device.frag.size)
+	}
+	if device.peers.IDMap[1].stats.fragDropped != 1 {
+		t.Fatal("evicted frame not counted")
+	}
+
+	// incomplete frames time out
+	time.Sleep(60 * time.Millisecond)
+	third := device.Fragment(packet[:path.EgHeaderLen+2*size], size)
+	device.ReassembleFragment(fragElem(device, third[0]), 1)
+	for _, g := range device.frag.groups {
+		if g.key.id != 3 {
+			t.Fatalf("frame %d did not time out", g.key.id)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"gopkg.in/yaml.v2"
+)
+
+// An edge rotates its private key in two phases, each KeyRotationOverlap long, so that every edge has got the
+// new PubKey from the supernode before we use it:
+//
+//	announce: we use the current key, and accept the new one as well
+//	retire:   we use the new key, which is saved to the config file, and accept the previous one as well
+//
+// Then the previous key is dropped. Our register messages report the key we use and the other one we accept,
+// which is how the supernode learns the new key and when we switched to it.
+
+const (
+	KeyPhaseIdle     = "idle"
+	KeyPhaseAnnounce = "announce"
+	KeyPhaseRetire   = "retire"
+)
+
+type keyRotationState struct {
+	sync.Mutex
+	phase string
+}
+
+// RotatePrivateKey starts rotating our private key to sk.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey) error {
+	if device.IsSuperNode || !device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
+		return errors.New("key rotation requires a supernode")
+	}
+	overlap := device.EdgeConfig().DynamicRoute.SuperNode.KeyRotationOverlap
+	if overlap <= 0 {
+		return fmt.Errorf("KeyRotationOverlap must > 0 : %v", overlap)
+	}
+	device.keyRotation.Lock()
+	defer device.keyRotation.Unlock()
+	if device.keyRotation.phase != "" && device.keyRotation.phase != KeyPhaseIdle {
+		return errors.New("a key rotation is in progress")
+	}
+	if err := device.setPrivateKeyAlt(sk); err != nil {
+		return err
+	}
+	device.keyRotation.phase = KeyPhaseAnnounce
+	if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatControl, nil, "Key rotation %v: new PubKey:%v", KeyPhaseAnnounce, sk.PublicKey().ToString())
+	}
+	device.Chan_SendRegisterStart <- struct{}{}
+	go device.routineRotatePrivateKey(mtypes.S2TD(overlap))
+	return nil
+}
+
+func (device *Device) routineRotatePrivateKey(overlap time.Duration) {
+	time.Sleep(overlap)
+	device.staticIdentity.RLock()
+	sk := device.staticIdentity.privateKeyAlt
+	device.staticIdentity.RUnlock()
+	if err := device.saveEdgePrivKey(sk); err != nil {
+		device.log.Errorf("Key rotation aborted, failed to save the new private key: %v", err)
+		device.dropPrivateKeyAlt()
+		device.setKeyRotationPhase(KeyPhaseIdle)
+		device.Chan_SendRegisterStart <- struct{}{}
+		return
+	}
+	device.switchPrivateKey()
+	device.setKeyRotationPhase(KeyPhaseRetire)
+	device.Chan_SendRegisterStart <- struct{}{}
+
+	time.Sleep(overlap)
+	device.dropPrivateKeyAlt()
+	device.setKeyRotationPhase(KeyPhaseIdle)
+	device.Chan_SendRegisterStart <- struct{}{}
+}
+
+func (device *Device) setKeyRotationPhase(phase string) {
+	device.keyRotation.Lock()
+	device.keyRotation.phase = phase
+	device.keyRotation.Unlock()
+	if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatControl, nil, "Key rotation %v", phase)
+	}
+}
+
+// saveEdgePrivKey writes sk to the config file, whether SaveNewPeers is set or not. We can't start with the
+// old key once the supernode has switched to the new one.
+func (device *Device) saveEdgePrivKey(sk NoisePrivateKey) error {
+	device.edgeConfigLock.Lock()
+	defer device.edgeConfigLock.Unlock()
+	return device.updateEdgeConfig(func(econfig *mtypes.EdgeConfig) error {
+		econfig.PrivKey = sk.ToString()
+		configbytes, err := yaml.Marshal(econfig)
+		if err != nil {
+			return err
+		}
+		return mtypes.WriteFileAtomic(device.EdgeConfigPath, configbytes, 0600)
+	})
+}
+
+// switchPrivateKey swaps our private key and the other one we accept. Sessions go on, the next handshakes use the new key.
+func (device *Device) switchPrivateKey() {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	identity := &device.staticIdentity
+	identity.privateKey, identity.privateKeyAlt = identity.privateKeyAlt, identity.privateKey
+	identity.publicKey, identity.publicKeyAlt = identity.publicKeyAlt, identity.publicKey
+	device.cookieChecker.Init(identity.publicKey)
+	device.cookieCheckerAlt.Init(identity.publicKeyAlt)
+
+	for _, peer := range device.peers.keyMap {
+		handshake := &peer.handshake
+		handshake.mutex.Lock()
+		handshake.precomputedStaticStatic = identity.privateKey.sharedSecret(handshake.remoteStatic)
+		handshake.mutex.Unlock()
+	}
+}
+
+// setPrivateKeyAlt makes us accept handshakes for sk as well.
+func (device *Device) setPrivateKeyAlt(sk NoisePrivateKey) error {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+	if sk.IsZero() || sk.Equals(device.staticIdentity.privateKey) {
+		return errors.New("the new private key must differ from the current one")
+	}
+	device.staticIdentity.privateKeyAlt = sk
+	device.staticIdentity.publicKeyAlt = sk.PublicKey()
+	device.cookieCheckerAlt.Init(device.staticIdentity.publicKeyAlt)
+	return nil
+}
+
+func (device *Device) dropPrivateKeyAlt() {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+	setZero(device.staticIdentity.privateKeyAlt[:])
+	device.staticIdentity.publicKeyAlt = NoisePublicKey{}
+}
+
+// macChecker returns the cookie checker of the key a handshake message is for, nil if its mac1 is invalid.
+func (device *Device) macChecker(msg []byte) *CookieChecker {
+	if device.cookieChecker.CheckMAC1(msg) {
+		return &device.cookieChecker
+	}
+	device.staticIdentity.RLock()
+	rotating := !device.staticIdentity.publicKeyAlt.IsZero()
+	device.staticIdentity.RUnlock()
+	if rotating && device.cookieCheckerAlt.CheckMAC1(msg) {
+		return &device.cookieCheckerAlt
+	}
+	return nil
+}
+
+// SetPeerKeys changes the PubKey of a peer, and the other one we accept from it while it rotates them, zero for none.
+// Sessions go on, the next handshakes use the new keys.
+func (device *Device) SetPeerKeys(peer *Peer, pk NoisePublicKey, alt NoisePublicKey) error {
+	if alt.Equals(pk) {
+		alt = NoisePublicKey{}
+	}
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	for _, key := range []NoisePublicKey{pk, alt} {
+		if key.IsZero() {
+			continue
+		}
+		other, ok := device.peers.keyMap[key]
+		if !ok {
+			other, ok = device.peers.keyMapAlt[key]
+		}
+		if ok && other != peer {
+			return fmt.Errorf("PubKey %v belongs to peer %v", key.ToString(), other.ID.ToString())
+		}
+	}
+
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+
+	if !pk.Equals(handshake.remoteStatic) {
+		delete(device.peers.keyMap, handshake.remoteStatic)
+		device.peers.keyMap[pk] = peer
+		if _, ok := device.peers.SuperPeer[handshake.remoteStatic]; ok {
+			delete(device.peers.SuperPeer, handshake.remoteStatic)
+			device.peers.SuperPeer[pk] = peer
+		}
+		handshake.remoteStatic = pk
+		handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
+		peer.cookieGenerator.Init(pk)
+	}
+	if !handshake.remoteStaticAlt.IsZero() {
+		delete(device.peers.keyMapAlt, handshake.remoteStaticAlt)
+	}
+	handshake.remoteStaticAlt = alt
+	if !alt.IsZero() {
+		device.peers.keyMapAlt[alt] = peer
+	}
+	return nil
+}
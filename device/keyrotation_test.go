@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tai64n"
+)
+
+func newKeyTestDevice(id mtypes.Vertex) *Device {
+	sk, _ := RandomKeyPair()
+	device := &Device{ID: id, log: NewLogger(LogLevelSilent, "")}
+	device.indexTable.Init()
+	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.keyMapAlt = make(map[NoisePublicKey]*Peer)
+	device.staticIdentity.privateKey = sk
+	device.staticIdentity.publicKey = sk.PublicKey()
+	device.cookieChecker.Init(device.staticIdentity.publicKey)
+	return device
+}
+
+// addKeyTestPeer makes device know other by pk.
+func addKeyTestPeer(t *testing.T, device *Device, other *Device, pk NoisePublicKey) *Peer {
+	peer := &Peer{device: device, ID: other.ID}
+	if err := device.SetPeerKeys(peer, pk, NoisePublicKey{}); err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+// handshake reports whether initiator completes a handshake with responder.
+func handshake(initiator *Device, peer *Peer, responder *Device) bool {
+	// back to back handshakes are replays and floods otherwise
+	for _, remote := range responder.peers.keyMap {
+		remote.handshake.lastTimestamp = tai64n.Timestamp{}
+		remote.handshake.lastInitiationConsumption = time.Time{}
+	}
+	msg, err := initiator.CreateMessageInitiation(peer)
+	if err != nil {
+		return false
+	}
+	remote := responder.ConsumeMessageInitiation(msg)
+	if remote == nil {
+		return false
+	}
+	resp, err := responder.CreateMessageResponse(remote)
+	if err != nil {
+		return false
+	}
+	if initiator.ConsumeMessageResponse(resp) != peer {
+		return false
+	}
+	return peer.handshake.chainKey == remote.handshake.chainKey
+}
+
+func TestKeyRotationHandshake(t *testing.T) {
+	node1, node2 := newKeyTestDevice(1), newKeyTestDevice(2)
+	oldpk := node1.staticIdentity.publicKey
+	peer1 := addKeyTestPeer(t, node2, node1, oldpk)
+	peer2 := addKeyTestPeer(t, node1, node2, node2.staticIdentity.publicKey)
+	if !handshake(node1, peer2, node2) || !handshake(node2, peer1, node1) {
+		t.Fatal("handshake without rotation failed")
+	}
+
+	// announce: node 2 may know node 1 by either key
+	sk, newpk := RandomKeyPair()
+	if err := node1.setPrivateKeyAlt(sk); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(node2, peer1, node1) {
+		t.Error("handshake to the current key failed")
+	}
+	if err := node2.SetPeerKeys(peer1, newpk, oldpk); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(node2, peer1, node1) {
+		t.Error("handshake to the new key failed")
+	}
+	if !handshake(node1, peer2, node2) {
+		t.Error("handshake from the current key failed")
+	}
+
+	// retire: node 1 uses the new key, node 2 still knows it by the previous one
+	node1.switchPrivateKey()
+	if err := node2.SetPeerKeys(peer1, oldpk, newpk); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(node1, peer2, node2) || !handshake(node2, peer1, node1) {
+		t.Error("handshake with the previous key failed")
+	}
+	if node2.LookupPeer(newpk) != peer1 || node2.LookupPeer(oldpk) != peer1 {
+		t.Error("peer not found by both keys")
+	}
+
+	node1.dropPrivateKeyAlt()
+	if err := node2.SetPeerKeys(peer1, newpk, NoisePublicKey{}); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(node1, peer2, node2) || !handshake(node2, peer1, node1) {
+		t.Error("handshake with the new key failed")
+	}
+	if node2.LookupPeer(oldpk) != nil {
+		t.Error("peer still found by the previous key")
+	}
+	node2.SetPeerKeys(peer1, oldpk, NoisePublicKey{})
+	if handshake(node2, peer1, node1) || handshake(node1, peer2, node2) {
+		t.Error("handshake with a dropped key succeeded")
+	}
+
+	node3 := newKeyTestDevice(3)
+	addKeyTestPeer(t, node2, node3, node3.staticIdentity.publicKey)
+	if node2.SetPeerKeys(peer1, oldpk, node3.staticIdentity.publicKey) == nil {
+		t.Error("PubKey of another peer accepted")
+	}
+}
+
+func TestSaveEdgePrivKey(t *testing.T) {
+	device := newKeyTestDevice(1)
+	device.EdgeConfigPath = filepath.Join(t.TempDir(), "edge.yaml")
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	device.EdgeConfig().DynamicRoute.SaveNewPeers = true
+	sk, _ := RandomKeyPair()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			device.SaveConfig()
+		}()
+	}
+	if err := device.saveEdgePrivKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	var saved mtypes.EdgeConfig
+	if err := mtypes.ReadYaml(device.EdgeConfigPath, &saved); err != nil || saved.PrivKey != sk.ToString() {
+		t.Fatalf("saved PrivKey %v: %v", saved.PrivKey, err)
+	}
+	if info, _ := os.Stat(device.EdgeConfigPath); info.Mode().Perm() != 0600 {
+		t.Errorf("config file mode %v", info.Mode())
+	}
+}
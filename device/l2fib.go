@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// A MAC address moves when a frame from it arrives from another node than the L2FIB says.
+// A loop makes it bounce between nodes on every frame, so a MAC moving more than
+// MacFlap.MaxMoves times a minute is held for MacFlap.HoldTime:
+// frozen keeps it where it was, blackholed drops every frame from and to it.
+
+const (
+	MacFlapFreeze    = "freeze"
+	MacFlapBlackhole = "blackhole"
+)
+
+const macFlapWindow = time.Minute
+
+// moveScriptInterval is how often MacFlap.MoveScript may run for the moves of one MAC, flapping runs it anyway.
+const moveScriptInterval = 10 * time.Second
+
+// CheckMacFlap returns why conf can't be the MacFlap of the config.
+func CheckMacFlap(conf mtypes.MacFlapInfo) error {
+	switch conf.Action {
+	case "", MacFlapFreeze, MacFlapBlackhole:
+	default:
+		return fmt.Errorf("MacFlap.Action: unknown action %v, must be %v or %v", conf.Action, MacFlapFreeze, MacFlapBlackhole)
+	}
+	if conf.MaxMoves < 0 || conf.HoldTime < 0 {
+		return fmt.Errorf("MacFlap: MaxMoves and HoldTime must >= 0")
+	}
+	return nil
+}
+
+type IdAndTime struct {
+	id    uint32 // mtypes.Vertex, accessed atomically and changed under flap
+	time  int64  // UnixNano of the last frame from id, accessed atomically
+	Moves uint64 // accessed atomically
+
+	flap struct {
+		sync.Mutex
+		windowStart time.Time
+		windowMoves int
+		heldUntil   time.Time
+		lastScript  time.Time // MacFlap.MoveScript last ran for the MAC
+	}
+}
+
+func newIdAndTime(id mtypes.Vertex, now time.Time) *IdAndTime {
+	return &IdAndTime{id: uint32(id), time: now.UnixNano()}
+}
+
+// NodeID returns the node the MAC is at.
+func (idtime *IdAndTime) NodeID() mtypes.Vertex {
+	return mtypes.Vertex(atomic.LoadUint32(&idtime.id))
+}
+
+// LastSeen returns when the last frame from the MAC arrived from NodeID.
+func (idtime *IdAndTime) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&idtime.time))
+}
+
+func (idtime *IdAndTime) seen(now time.Time) {
+	atomic.StoreInt64(&idtime.time, now.UnixNano())
+}
+
+// Held reports whether the MAC is held after flapping.
+func (idtime *IdAndTime) Held() bool {
+	idtime.flap.Lock()
+	defer idtime.flap.Unlock()
+	return time.Now().Before(idtime.flap.heldUntil)
+}
+
+// Blackholed reports whether frames from and to the MAC are dropped.
+func (device *Device) Blackholed(idtime *IdAndTime) bool {
+	return device.EdgeConfig().MacFlap.Action == MacFlapBlackhole && idtime.Held()
+}
+
+// LearnMac updates the L2FIB with a frame from src_macaddr received from src_nodeID.
+// It returns false if the frame must be dropped.
+func (device *Device) LearnMac(src_macaddr tap.MacAddress, src_nodeID mtypes.Vertex) bool {
+	if tap.IsNotUnicast(src_macaddr) {
+		return true
+	}
+	now := time.Now()
+	val, ok := device.l2fib.Load(src_macaddr)
+	if !ok {
+		val, ok = device.l2fib.LoadOrStore(src_macaddr, newIdAndTime(src_nodeID, now)) // Write to l2fib table
+		if !ok {
+			if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"src": src_nodeID.ToString()}, "L2FIB [%v -> %v] added.", src_macaddr.String(), src_nodeID.ToString())
+			}
+			return true
+		}
+	}
+	idtime := val.(*IdAndTime)
+	if idtime.NodeID() == src_nodeID {
+		idtime.seen(now)
+		return !device.Blackholed(idtime)
+	}
+
+	conf := device.EdgeConfig().MacFlap
+	idtime.flap.Lock()
+	held := now.Before(idtime.flap.heldUntil)
+	old_nodeID := idtime.NodeID()
+	if held || old_nodeID == src_nodeID {
+		// a held MAC stays where it is, and another frame from src_nodeID may have moved it meanwhile
+		idtime.flap.Unlock()
+		if old_nodeID == src_nodeID {
+			idtime.seen(now)
+		}
+		return !held || conf.Action != MacFlapBlackhole
+	}
+	atomic.AddUint64(&idtime.Moves, 1)
+	if now.Sub(idtime.flap.windowStart) > macFlapWindow {
+		idtime.flap.windowStart = now
+		idtime.flap.windowMoves = 0
+	}
+	idtime.flap.windowMoves++
+	flapping := conf.MaxMoves > 0 && idtime.flap.windowMoves > conf.MaxMoves
+	if flapping {
+		idtime.flap.heldUntil = now.Add(mtypes.S2TD(conf.HoldTime))
+		idtime.flap.windowMoves = 0
+	}
+	if !flapping || conf.Action == MacFlapBlackhole {
+		atomic.StoreUint32(&idtime.id, uint32(src_nodeID))
+		idtime.seen(now)
+	}
+	runScript := flapping || now.Sub(idtime.flap.lastScript) >= moveScriptInterval
+	if runScript {
+		idtime.flap.lastScript = now
+	}
+	idtime.flap.Unlock()
+
+	if flapping {
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelError) {
+			device.slog.Errorf(mtypes.LogCatInternal, mtypes.LogFields{"src": src_nodeID.ToString()}, "L2FIB [%v] flapping between %v and %v, %v for %vs.", src_macaddr.String(), old_nodeID.ToString(), src_nodeID.ToString(), conf.Action, conf.HoldTime)
+		}
+		device.runMoveScript("flap", src_macaddr, old_nodeID, src_nodeID)
+		return conf.Action != MacFlapBlackhole
+	}
+	if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"src": src_nodeID.ToString()}, "L2FIB [%v -> %v] moved from %v.", src_macaddr.String(), src_nodeID.ToString(), old_nodeID.ToString())
+	}
+	if runScript {
+		device.runMoveScript("move", src_macaddr, old_nodeID, src_nodeID)
+	}
+	return true
+}
+
+// runMoveScript runs MacFlap.MoveScript with the event, the MAC address, the old and the new node as arguments.
+func (device *Device) runMoveScript(event string, mac tap.MacAddress, old_nodeID mtypes.Vertex, new_nodeID mtypes.Vertex) {
+	if device.EdgeConfig().MacFlap.MoveScript == "" {
+		return
+	}
+	device.runScript("MoveScript", device.EdgeConfig().MacFlap.MoveScript, event, mac.String(), old_nodeID.ToString(), new_nodeID.ToString())
+}
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestLearnMac(t *testing.T) {
+	for _, action := range []string{MacFlapFreeze, MacFlapBlackhole} {
+		device := &Device{}
+		device.edgeConfig.Store(&mtypes.EdgeConfig{
+			MacFlap: mtypes.MacFlapInfo{MaxMoves: 3, HoldTime: 0.1, Action: action},
+		})
+		mac := tap.MacAddress{0x02, 0, 0, 0, 0, 1}
+		lookup := func() *IdAndTime {
+			val, _ := device.l2fib.Load(mac)
+			return val.(*IdAndTime)
+		}
+
+		if !device.LearnMac(mac, 1) {
+			t.Fatal("new MAC dropped")
+		}
+		// a loop between node 1 and 2
+		for i := 0; i < 3; i++ {
+			device.LearnMac(mac, 2)
+			device.LearnMac(mac, 1)
+			if i == 0 && lookup().NodeID() != 1 {
+				t.Fatalf("%v: MAC not moved back to 1", action)
+			}
+		}
+		idtime := lookup()
+		if !idtime.Held() {
+			t.Fatalf("%v: flapping MAC not held after %v moves", action, idtime.Moves)
+		}
+		if idtime.Moves != 4 {
+			t.Errorf("%v: %v moves, want 4", action, idtime.Moves)
+		}
+		if action == MacFlapFreeze {
+			if idtime.NodeID() != 2 || !device.LearnMac(mac, 1) || idtime.NodeID() != 2 {
+				t.Errorf("freeze: MAC at %v, want it frozen at 2", idtime.NodeID())
+			}
+		} else if device.LearnMac(mac, 1) || !device.Blackholed(idtime) {
+			t.Errorf("blackhole: frames from the MAC not dropped")
+		}
+
+		time.Sleep(150 * time.Millisecond)
+		if idtime.Held() || !device.LearnMac(mac, 3) || idtime.NodeID() != 3 {
+			t.Errorf("%v: MAC still held after HoldTime", action)
+		}
+	}
+}
+
+func TestLearnMacNoFlapProtection(t *testing.T) {
+	device := &Device{}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	mac := tap.MacAddress{0x02, 0, 0, 0, 0, 1}
+	for i := 0; i < 100; i++ {
+		if !device.LearnMac(mac, mtypes.Vertex(i%2+1)) {
+			t.Fatal("frame dropped")
+		}
+	}
+	val, _ := device.l2fib.Load(mac)
+	if idtime := val.(*IdAndTime); idtime.Held() || idtime.Moves != 99 || idtime.NodeID() != 2 {
+		t.Errorf("held %v moves %v at %v", idtime.Held(), idtime.Moves, idtime.NodeID())
+	}
+	if !device.LearnMac(tap.MacAddress{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1) {
+		t.Error("broadcast source dropped")
+	}
+}
+
+func TestLearnMacConcurrent(t *testing.T) {
+	device := &Device{}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	mac := tap.MacAddress{0x02, 0, 0, 0, 0, 1}
+	device.LearnMac(mac, 1)
+	val, _ := device.l2fib.Load(mac)
+	idtime := val.(*IdAndTime)
+	// the frames of node 2 arrive on several receivers, they move the MAC once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				device.LearnMac(mac, 2)
+				if id := idtime.NodeID(); id != 1 && id != 2 {
+					t.Errorf("MAC at %v", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if moves := atomic.LoadUint64(&idtime.Moves); moves != 1 || idtime.NodeID() != 2 {
+		t.Errorf("%v moves, at %v", moves, idtime.NodeID())
+	}
+}
+
+func TestMoveScriptRateLimit(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	moves := filepath.Join(t.TempDir(), "moves")
+	device := &Device{}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	device.EdgeConfig().MacFlap.MoveScript = "sh -c 'echo $0 $1 >> " + moves + "'"
+	for i := 0; i < 100; i++ {
+		device.LearnMac(tap.MacAddress{0x02, 0, 0, 0, 0, 1}, mtypes.Vertex(i%2+1))
+		device.LearnMac(tap.MacAddress{0x02, 0, 0, 0, 0, 2}, mtypes.Vertex(i%2+1))
+	}
+	// the scripts run in the background
+	readLines := func() []string {
+		out, _ := os.ReadFile(moves)
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(readLines()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if lines := readLines(); len(lines) != 2 {
+		t.Errorf("MoveScript ran %v times for 2 MACs: %q", len(lines), lines)
+	}
+}
+
+func TestCheckMacFlap(t *testing.T) {
+	for _, conf := range []mtypes.MacFlapInfo{{}, {MaxMoves: 10, HoldTime: 60, Action: MacFlapFreeze}, {Action: MacFlapBlackhole}} {
+		if err := CheckMacFlap(conf); err != nil {
+			t.Errorf("%+v: %v", conf, err)
+		}
+	}
+	for _, conf := range []mtypes.MacFlapInfo{{Action: "blackhold"}, {MaxMoves: -1}, {HoldTime: -1}} {
+		if CheckMacFlap(conf) == nil {
+			t.Errorf("%+v accepted", conf)
+		}
+	}
+}
@@ -8,6 +8,8 @@ package device
 import (
 	"log"
 	"os"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
 // A Logger provides logging for a Device.
@@ -18,6 +20,8 @@ import (
 type Logger struct {
 	Verbosef func(format string, args ...interface{})
 	Errorf   func(format string, args ...interface{})
+	// Structured is used by the device for categorized logs. It may be nil.
+	Structured *mtypes.Logger
 }
 
 // Log levels for use with NewLogger.
@@ -34,7 +38,7 @@ func DiscardLogf(format string, args ...interface{}) {}
 // It logs at the specified log level and above.
 // It decorates log lines with the log level, date, time, and prepend.
 func NewLogger(level int, prepend string) *Logger {
-	logger := &Logger{DiscardLogf, DiscardLogf}
+	logger := &Logger{DiscardLogf, DiscardLogf, nil}
 	logf := func(prefix string) func(string, ...interface{}) {
 		return log.New(os.Stdout, prefix+": "+prepend, log.Ldate|log.Ltime).Printf
 	}
@@ -46,3 +50,18 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// NewStructuredLogger constructs a Logger on top of a structured logger.
+// Verbosef and Errorf are logged to the device category
+// at debug and error level respectively.
+func NewStructuredLogger(slog *mtypes.Logger) *Logger {
+	return &Logger{
+		Verbosef: func(format string, args ...interface{}) {
+			slog.Debugf(mtypes.LogCatDevice, nil, format, args...)
+		},
+		Errorf: func(format string, args ...interface{}) {
+			slog.Errorf(mtypes.LogCatDevice, nil, format, args...)
+		},
+		Structured: slog,
+	}
+}
@@ -0,0 +1,221 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Edges bridged into the same LAN flood every broadcast around a loop through the VPN.
+// Each edge writes a signed probe frame out of its tap every LoopDetect.Interval.
+// A probe we read from our tap came through the LAN from another edge, or from ourselves.
+// While it keeps coming, the edge with the larger node ID stops flooding if LoopDetect.Block is set.
+// Probes never enter the VPN.
+
+const (
+	LoopProbeEtherType = 0x88B5 // IEEE 802 local experimental
+	LoopProbeMaxAge    = 60 * time.Second
+
+	LoopProbeOffsetMagic   = 14
+	LoopProbeOffsetNodeID  = 18
+	LoopProbeOffsetSession = 20
+	LoopProbeOffsetTime    = 24
+	LoopProbeOffsetMAC     = 32
+	LoopProbeLen           = 60 // minimum ethernet frame size
+
+	BPDUPassthrough = "passthrough"
+	BPDUBlock       = "block"
+)
+
+var loopProbeMagic = []byte("EGLD")
+
+// CheckLoopDetect returns why conf can't be the LoopDetect of the config.
+func CheckLoopDetect(conf mtypes.LoopDetectInfo) error {
+	switch conf.BPDU {
+	case "", BPDUPassthrough, BPDUBlock:
+	default:
+		return fmt.Errorf("LoopDetect.BPDU: unknown value %v, must be %v or %v", conf.BPDU, BPDUPassthrough, BPDUBlock)
+	}
+	if conf.Enabled && conf.Interval <= 0 {
+		return fmt.Errorf("LoopDetect.Interval must > 0")
+	}
+	return nil
+}
+
+var bpduMacAddr = tap.MacAddress{0x01, 0x80, 0xc2, 0x00, 0x00, 0x00}
+
+type loopState struct {
+	session  uint32
+	key      [blake2s.Size]byte
+	blocking uint32 // accessed atomically
+
+	sync.Mutex
+	seen map[mtypes.Vertex]time.Time // edges whose probes came in from the LAN
+}
+
+func (device *Device) loopProbeMAC(probe []byte) []byte {
+	mac, _ := blake2s.New128(device.loop.key[:])
+	mac.Write(probe[:LoopProbeOffsetMAC])
+	return mac.Sum(nil)
+}
+
+func (device *Device) newLoopProbe(now time.Time) []byte {
+	probe := make([]byte, LoopProbeLen)
+	copy(probe[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	srcMac, err := tap.GetMacAddr(device.EdgeConfig().Interface.MacAddrPrefix, uint32(device.ID))
+	if err != nil {
+		srcMac = tap.MacAddress{0x02, 0, 0, 0, byte(device.ID >> 8), byte(device.ID)}
+	}
+	copy(probe[6:12], srcMac[:])
+	binary.BigEndian.PutUint16(probe[12:14], LoopProbeEtherType)
+	copy(probe[LoopProbeOffsetMagic:], loopProbeMagic)
+	binary.LittleEndian.PutUint16(probe[LoopProbeOffsetNodeID:], uint16(device.ID))
+	binary.LittleEndian.PutUint32(probe[LoopProbeOffsetSession:], device.loop.session)
+	binary.LittleEndian.PutUint64(probe[LoopProbeOffsetTime:], uint64(now.UnixNano()))
+	copy(probe[LoopProbeOffsetMAC:], device.loopProbeMAC(probe))
+	return probe
+}
+
+// parseLoopProbe returns the edge which sent the probe, if it is signed with our key and recent.
+func (device *Device) parseLoopProbe(probe []byte, now time.Time) (mtypes.Vertex, bool) {
+	if len(probe) < LoopProbeOffsetMAC+blake2s.Size128 || !bytes.Equal(probe[LoopProbeOffsetMagic:LoopProbeOffsetNodeID], loopProbeMagic) {
+		return mtypes.NodeID_Invalid, false
+	}
+	if !bytes.Equal(probe[LoopProbeOffsetMAC:LoopProbeOffsetMAC+blake2s.Size128], device.loopProbeMAC(probe)) {
+		return mtypes.NodeID_Invalid, false
+	}
+	sent := time.Unix(0, int64(binary.LittleEndian.Uint64(probe[LoopProbeOffsetTime:])))
+	if now.Sub(sent) > LoopProbeMaxAge || sent.Sub(now) > LoopProbeMaxAge {
+		return mtypes.NodeID_Invalid, false
+	}
+	return mtypes.Vertex(binary.LittleEndian.Uint16(probe[LoopProbeOffsetNodeID:])), true
+}
+
+// LoopBlocking reports whether flooding is blocked because of a loop.
+func (device *Device) LoopBlocking() bool {
+	return atomic.LoadUint32(&device.loop.blocking) != 0
+}
+
+func (device *Device) loopDetectEnabled() bool {
+	return device.EdgeConfig().LoopDetect.Enabled && device.EdgeConfig().LoopDetect.Key != ""
+}
+
+func (device *Device) filterFrame(frame []byte) bool {
+	if len(frame) < 14 {
+		return true
+	}
+	if device.loopDetectEnabled() && binary.BigEndian.Uint16(frame[12:14]) == LoopProbeEtherType {
+		return false
+	}
+	if tap.GetDstMacAddr(frame) == bpduMacAddr {
+		return device.EdgeConfig().LoopDetect.BPDU != BPDUBlock
+	}
+	return true
+}
+
+// FilterFromLAN reports whether a frame read from the tap may be sent into the VPN.
+// It consumes loop probes and drops BPDUs if configured.
+func (device *Device) FilterFromLAN(frame []byte) bool {
+	if device.filterFrame(frame) {
+		return true
+	}
+	if src_nodeID, ok := device.parseLoopProbe(frame, time.Now()); ok {
+		device.loopProbeReceived(src_nodeID)
+	}
+	return false
+}
+
+// FilterToLAN reports whether a frame received from the VPN may be written to the tap.
+func (device *Device) FilterToLAN(frame []byte) bool {
+	return device.filterFrame(frame)
+}
+
+func (device *Device) loopProbeReceived(src_nodeID mtypes.Vertex) {
+	device.loop.Lock()
+	defer device.loop.Unlock()
+	if device.loop.seen == nil {
+		device.loop.seen = make(map[mtypes.Vertex]time.Time)
+	}
+	_, known := device.loop.seen[src_nodeID]
+	device.loop.seen[src_nodeID] = time.Now()
+	if known {
+		return
+	}
+	device.log.Errorf("L2 loop detected: probe of node %v received from the LAN of tap %v", src_nodeID.ToString(), device.EdgeConfig().Interface.Name)
+	device.runAlarmScript("loop", src_nodeID)
+	device.updateLoopBlocking()
+}
+
+// expireLoopProbes forgets the edges we haven't seen a probe of since before.
+func (device *Device) expireLoopProbes(before time.Time) {
+	device.loop.Lock()
+	defer device.loop.Unlock()
+	for src_nodeID, seen := range device.loop.seen {
+		if seen.Before(before) {
+			delete(device.loop.seen, src_nodeID)
+			device.log.Errorf("L2 loop cleared: no probe of node %v received from the LAN of tap %v", src_nodeID.ToString(), device.EdgeConfig().Interface.Name)
+			device.runAlarmScript("clear", src_nodeID)
+		}
+	}
+	device.updateLoopBlocking()
+}
+
+// updateLoopBlocking blocks flooding if we see our own probe, or of an edge with a smaller node ID.
+// Only one of two edges on the same LAN blocks. The caller holds device.loop.
+func (device *Device) updateLoopBlocking() {
+	var blocking uint32
+	if device.EdgeConfig().LoopDetect.Block {
+		for src_nodeID := range device.loop.seen {
+			if src_nodeID <= device.ID {
+				blocking = 1
+			}
+		}
+	}
+	if atomic.SwapUint32(&device.loop.blocking, blocking) != blocking && device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatInternal, nil, "Flooding blocked: %v", blocking != 0)
+	}
+}
+
+// runAlarmScript runs LoopDetect.AlarmScript with the event and the node whose probe we received as arguments.
+func (device *Device) runAlarmScript(event string, src_nodeID mtypes.Vertex) {
+	if device.EdgeConfig().LoopDetect.AlarmScript == "" {
+		return
+	}
+	device.runScript("AlarmScript", device.EdgeConfig().LoopDetect.AlarmScript, event, src_nodeID.ToString())
+}
+
+func (device *Device) RoutineLoopDetect() {
+	conf := device.EdgeConfig().LoopDetect
+	if !conf.Enabled {
+		return
+	}
+	if !device.loopDetectEnabled() {
+		device.log.Errorf("Loop detection disabled: LoopDetect.Key is empty")
+		return
+	}
+	interval := mtypes.S2TD(conf.Interval)
+	offset := MessageTransportOffsetContent + path.EgHeaderLen
+	for !device.isClosed() {
+		now := time.Now()
+		buf := make([]byte, offset+LoopProbeLen)
+		copy(buf[offset:], device.newLoopProbe(now))
+		if _, err := device.tap.device.Write(buf, offset); err != nil && !device.isClosed() {
+			device.log.Errorf("Failed to write loop probe to TUN device: %v", err)
+		}
+		device.expireLoopProbes(now.Add(-3 * interval))
+		time.Sleep(interval)
+	}
+}
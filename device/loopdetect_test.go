@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/crypto/blake2s"
+)
+
+func newLoopTestDevice(id mtypes.Vertex, key string) *Device {
+	device := &Device{
+		ID:  id,
+		log: NewLogger(LogLevelSilent, ""),
+	}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{
+		LoopDetect: mtypes.LoopDetectInfo{Enabled: true, Interval: 1, Key: key, Block: true, BPDU: BPDUBlock},
+	})
+	device.loop.key = blake2s.Sum256([]byte(key))
+	return device
+}
+
+func TestLoopDetect(t *testing.T) {
+	edge1, edge2 := newLoopTestDevice(1, "secret"), newLoopTestDevice(2, "secret")
+	now := time.Now()
+
+	// both edges are bridged to the same LAN, each reads the probe of the other from its tap
+	if edge2.FilterFromLAN(edge1.newLoopProbe(now)) || edge1.FilterFromLAN(edge2.newLoopProbe(now)) {
+		t.Fatal("probe sent into the VPN")
+	}
+	if !edge2.LoopBlocking() || edge1.LoopBlocking() {
+		t.Fatalf("blocking: edge1 %v, edge2 %v, want only edge2", edge1.LoopBlocking(), edge2.LoopBlocking())
+	}
+	edge2.expireLoopProbes(now.Add(time.Second))
+	if edge2.LoopBlocking() {
+		t.Error("still blocking after the probes stopped")
+	}
+
+	// probes of other networks, old probes and forged probes don't count
+	other := newLoopTestDevice(1, "other secret")
+	forged := edge1.newLoopProbe(now)
+	forged[LoopProbeOffsetNodeID]++
+	for _, probe := range [][]byte{other.newLoopProbe(now), edge1.newLoopProbe(now.Add(-2 * LoopProbeMaxAge)), forged} {
+		edge2.FilterFromLAN(probe)
+	}
+	if edge2.LoopBlocking() || len(edge2.loop.seen) != 0 {
+		t.Errorf("invalid probe accepted: %v", edge2.loop.seen)
+	}
+
+	bpdu := make([]byte, 60)
+	copy(bpdu, bpduMacAddr[:])
+	if edge1.FilterFromLAN(bpdu) || edge1.FilterToLAN(bpdu) {
+		t.Error("BPDU not blocked")
+	}
+	edge1.EdgeConfig().LoopDetect.BPDU = BPDUPassthrough
+	if !edge1.FilterFromLAN(bpdu) || !edge1.FilterToLAN(bpdu) {
+		t.Error("BPDU not passed through")
+	}
+}
+
+func TestCheckLoopDetect(t *testing.T) {
+	for _, conf := range []mtypes.LoopDetectInfo{{}, {Enabled: true, Interval: 5, BPDU: BPDUBlock}, {BPDU: BPDUPassthrough}} {
+		if err := CheckLoopDetect(conf); err != nil {
+			t.Errorf("%+v: %v", conf, err)
+		}
+	}
+	for _, conf := range []mtypes.LoopDetectInfo{{BPDU: "drop"}, {Enabled: true}, {Enabled: true, Interval: -1}} {
+		if CheckLoopDetect(conf) == nil {
+			t.Errorf("%+v accepted", conf)
+		}
+	}
+}
@@ -115,10 +115,13 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte       // hash value
 	chainKey                  [blake2s.Size]byte       // chain key
 	presharedKey              NoisePresharedKey        // psk
+	presharedKeyAlt           NoisePresharedKey        // psk accepted as well while the supernode rotates them
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
 	remoteStatic              NoisePublicKey           // long term key
+	remoteStaticAlt           NoisePublicKey           // long term key accepted as well while the peer rotates them
+	initiatorStatic           NoisePublicKey           // long term key of the peer in the consumed initiation
 	remoteEphemeral           NoisePublicKey           // ephemeral public key
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
 	lastTimestamp             tai64n.Timestamp
@@ -253,21 +256,32 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+	// decrypt static key, the initiator may use the other key we accept
 
-	// decrypt static key
 	var err error
 	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if isZero(ss[:]) {
-		return nil
+	privateKey := device.staticIdentity.privateKey
+	for _, local := range []NoisePrivateKey{device.staticIdentity.privateKey, device.staticIdentity.privateKeyAlt} {
+		if local.IsZero() {
+			continue
+		}
+		publicKey := local.PublicKey()
+		mixHash(&hash, &InitialHash, publicKey[:])
+		mixHash(&hash, &hash, msg.Ephemeral[:])
+		mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+		ss := local.sharedSecret(msg.Ephemeral)
+		if isZero(ss[:]) {
+			return nil
+		}
+		KDF2(&chainKey, &key, chainKey[:], ss[:])
+		aead, _ := chacha20poly1305.New(key[:])
+		_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
+		if err == nil {
+			privateKey = local
+			break
+		}
 	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
 		return nil
 	}
@@ -288,7 +302,15 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	staticStatic := handshake.precomputedStaticStatic
+	if !peerPK.Equals(handshake.remoteStatic) || !privateKey.Equals(device.staticIdentity.privateKey) {
+		if !peerPK.Equals(handshake.remoteStatic) && !peerPK.Equals(handshake.remoteStaticAlt) {
+			handshake.mutex.RUnlock()
+			return nil
+		}
+		staticStatic = privateKey.sharedSecret(peerPK)
+	}
+	if isZero(staticStatic[:]) {
 		handshake.mutex.RUnlock()
 		return nil
 	}
@@ -296,9 +318,9 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
+	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
@@ -328,6 +350,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.chainKey = chainKey
 	handshake.remoteIndex = msg.Sender
 	handshake.remoteEphemeral = msg.Ephemeral
+	handshake.initiatorStatic = peerPK
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
@@ -381,7 +404,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	func() {
 		ss := handshake.localEphemeral.sharedSecret(handshake.remoteEphemeral)
 		handshake.mixKey(ss[:])
-		ss = handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
+		ss = handshake.localEphemeral.sharedSecret(handshake.initiatorStatic)
 		handshake.mixKey(ss[:])
 	}()
 
@@ -462,28 +485,35 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		// add preshared key (psk)
-
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
+		// add preshared key (psk), the responder may use the other one we accept
 
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		psks := []NoisePresharedKey{handshake.presharedKey}
+		if handshake.presharedKeyAlt != (NoisePresharedKey{}) {
+			psks = append(psks, handshake.presharedKeyAlt)
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		preChainKey, preHash := chainKey, hash
+		for _, psk := range psks {
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&chainKey,
+				&tau,
+				&key,
+				preChainKey[:],
+				psk[:],
+			)
+			mixHash(&hash, &preHash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
+			if err == nil {
+				mixHash(&hash, &hash, msg.Empty[:])
+				return true
+			}
+		}
+		return false
 	}()
 
 	if !ok {
@@ -10,7 +10,6 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"sort"
 	"sync"
@@ -54,8 +53,8 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 	defer et.Unlock()
 	newmap_super := make(map[string]*endpoint_tryitem)
 	if urls.IsEmpty() {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Reset trylist(super) %v\n", et.peer.ID.ToString(), "nil")
+		if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString()}, "Reset trylist(super) %v", "nil")
 		}
 	}
 	for url, it := range urls.GetList(UseLocalIP) {
@@ -74,19 +73,19 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 			}
 		}
 		if err != nil {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v error: %v\n", et.peer.ID.ToString(), url, err)
+			if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString(), "endpoint": url}, "Update trylist(super) error: %v", err)
 			}
 			continue
 		}
 		if val, ok := et.trymap_super[url]; ok {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v\n", et.peer.ID.ToString(), url)
+			if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString(), "endpoint": url}, "Update trylist(super)")
 			}
 			newmap_super[url] = val
 		} else {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : New trylist(super) %v\n", et.peer.ID.ToString(), url)
+			if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString(), "endpoint": url}, "New trylist(super)")
 			}
 			newmap_super[url] = &endpoint_tryitem{
 				URL:      url,
@@ -106,8 +105,8 @@ func (et *endpoint_trylist) UpdateP2P(url string) {
 	et.Lock()
 	defer et.Unlock()
 	if _, ok := et.trymap_p2p[url]; !ok {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Add trylist(p2p) %v\n", et.peer.ID.ToString(), url)
+		if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString(), "endpoint": url}, "Add trylist(p2p)")
 		}
 		et.trymap_p2p[url] = &endpoint_tryitem{
 			URL:      url,
@@ -136,8 +135,8 @@ func (et *endpoint_trylist) GetNextTry() (bool, string) {
 	}
 	for url, v := range et.trymap_p2p {
 		if v.firstTry.After(time.Time{}) && v.firstTry.Add(et.timeout).Before(time.Now()) {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Delete trylist(p2p) %v\n", et.peer.ID.ToString(), url)
+			if et.peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				et.peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": et.peer.ID.ToString(), "endpoint": url}, "Delete trylist(p2p)")
 			}
 			delete(et.trymap_p2p, url)
 		}
@@ -247,6 +246,8 @@ type Peer struct {
 	endpoint_trylist *endpoint_trylist
 
 	LastPacketReceivedAdd1Sec atomic.Value // *time.Time
+	certificate               atomic.Value // []byte, sent by the peer in its pings, in admission mode ca
+	certAdmitted              AtomicBool   // added because of its certificate, removed once it expires
 
 	SingleWayLatency filterwindow
 
@@ -267,6 +268,21 @@ type Peer struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		txCompressSaved   uint64 // bytes saved by compressing packets to this node
+		rxCompressSaved   uint64 // bytes saved by compressed packets from this node
+		fecParitySent     uint64 // FEC parity packets sent to peer
+		fecParityReceived uint64 // FEC parity packets received from peer
+		fecRecovered      uint64 // packets from peer recovered by FEC
+
+		dupSent      uint64    // duplicated packets sent to this node
+		dupWon       [2]uint64 // duplicated packets from this node, by the path of the copy which arrived first
+		dupDiscarded uint64    // late copies of duplicated packets from this node
+
+		fragSent        uint64 // frames sent in fragments to this node
+		fragReassembled uint64 // frames from this node reassembled
+		fragDropped     uint64 // incomplete frames from this node dropped
+
+		e2eDropped uint64 // frames to this node dropped since they couldn't be encrypted end to end
 	}
 
 	disableRoaming bool
@@ -292,6 +308,8 @@ type Peer struct {
 		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
 	}
 
+	fec peerFEC
+
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
 	persistentKeepaliveInterval uint32 // accessed atomically
@@ -328,8 +346,8 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	}
 
 	// create peer
-	if device.LogLevel.LogInternal {
-		fmt.Println("Internal: Create peer with ID : " + id.ToString() + " and PubKey:" + pk.ToString())
+	if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": id.ToString()}, "Create peer with PubKey: %v", pk.ToString())
 	}
 	peer := new(Peer)
 	peer.ConnAF = conn.EnabledAf46
@@ -340,7 +358,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
-	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout), device.enabledAf)
+	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig().DynamicRoute.PeerAliveTimeout), device.enabledAf)
 	peer.SingleWayLatency.device = device
 	peer.SingleWayLatency.Push(mtypes.Infinity)
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
@@ -348,6 +366,9 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
 	// map public key
 	oldpeer, ok := device.peers.keyMap[pk]
+	if !ok {
+		oldpeer, ok = device.peers.keyMapAlt[pk]
+	}
 	if ok {
 		if oldpeer.ID != id {
 			oldpeer = nil
@@ -377,6 +398,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	} else { // Regular peer, other edgenodes
 		device.peers.keyMap[pk] = peer
 		device.peers.IDMap[id] = peer
+		atomic.AddUint32(&device.peers.version, 1)
 	}
 
 	// start peer
@@ -388,7 +410,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 }
 
 func (peer *Peer) IsPeerAlive() bool {
-	PeerAliveTimeout := mtypes.S2TD(peer.device.EdgeConfig.DynamicRoute.PeerAliveTimeout)
+	PeerAliveTimeout := mtypes.S2TD(peer.device.EdgeConfig().DynamicRoute.PeerAliveTimeout)
 	if peer.endpoint == nil {
 		return false
 	}
@@ -399,6 +421,10 @@ func (peer *Peer) IsPeerAlive() bool {
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	return peer.SendBuffers([][]byte{buffer})
+}
+
+func (peer *Peer) SendBuffers(buffers [][]byte) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
@@ -413,9 +439,13 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	err := peer.device.net.bind.Send(buffers, peer.endpoint)
 	if err == nil {
-		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		var totalLen uint64
+		for _, b := range buffers {
+			totalLen += uint64(len(b))
+		}
+		atomic.AddUint64(&peer.stats.txBytes, totalLen)
 	}
 	return err
 }
@@ -540,6 +570,7 @@ func (peer *Peer) Stop() {
 	peer.device.log.Verbosef("%v - Stopping", peer)
 
 	peer.timersStop()
+	peer.fecStop()
 	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
 	peer.queue.inbound.c <- nil
 	peer.queue.outbound.c <- nil
@@ -550,7 +581,7 @@ func (peer *Peer) Stop() {
 }
 
 func (peer *Peer) SetPSK(psk NoisePresharedKey) {
-	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		peer.device.log.Verbosef("Preshared keys disabled in P2P mode.")
 		return
 	}
@@ -559,9 +590,19 @@ func (peer *Peer) SetPSK(psk NoisePresharedKey) {
 	peer.handshake.mutex.Unlock()
 }
 
+// SetPSKAlt sets the PSK we accept besides our own while the supernode rotates them, or clears it with a zero key.
+func (peer *Peer) SetPSKAlt(psk NoisePresharedKey) {
+	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig().DynamicRoute.P2P.UseP2P {
+		return
+	}
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKeyAlt = psk
+	peer.handshake.mutex.Unlock()
+}
+
 func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_perfer int, static bool) error {
-	if peer.device.LogLevel.LogInternal {
-		fmt.Printf("Internal: Set endpoint to %v for NodeID: %v static:%v\n", connurl, peer.ID.ToString(), static)
+	if peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peer.ID.ToString(), "endpoint": connurl}, "Set endpoint static:%v", static)
 	}
 	var err error
 	_, connIP, err := conn.LookupIP(connurl, af, af_perfer)
@@ -569,8 +610,8 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 		return err
 	}
 	if peer.GetEndpointDstStr() == connIP {
-		//if peer.device.LogLevel.LogInternal {
-		//	fmt.Printf("Internal: Same as original endpoint:%v, skip for NodeID:%v\n", connurl, peer.ID.ToString())
+		//if peer.device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		//	peer.device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peer.ID.ToString(), "endpoint": connurl}, "Same as original endpoint, skip")
 		//}
 		return nil
 	}
@@ -594,8 +635,8 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.ID == mtypes.NodeID_SuperNode {
 		conn, err := net.Dial("udp", endpoint.DstToString())
 		if err != nil {
-			if peer.device.LogLevel.LogControl {
-				fmt.Printf("Control: Set endpoint to peer %v failed: %v", peer.ID, err)
+			if peer.device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				peer.device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Set endpoint to peer failed: %v", err)
 			}
 			return
 		}
@@ -639,7 +680,10 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	if peer.StaticConn { //static conn do not write new endpoint to config
 		return
 	}
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P { //Must in p2p mode
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P { //Must in p2p mode
+		return
+	}
+	if peer.certAdmitted.Get() { //the config file can't keep its certificate, it would stay after the certificate expired
 		return
 	}
 	if peer.endpoint != nil && peer.endpoint.DstIP().Equal(endpoint.DstIP()) { //endpoint changed
@@ -653,31 +697,38 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	if bytes.Equal(peer.handshake.presharedKey[:], make([]byte, 32)) {
 		pskstr = ""
 	}
-	for _, peerfile := range device.EdgeConfig.Peers {
-		if peerfile.NodeID == peer.ID && peerfile.PubKey == pubkeystr {
-			foundInFile = true
-			if !peerfile.Static {
-				peerfile.EndPoint = url
+	device.updateEdgeConfig(func(econfig *mtypes.EdgeConfig) error {
+		for _, peerfile := range econfig.Peers {
+			if peerfile.NodeID == peer.ID && peerfile.PubKey == pubkeystr {
+				foundInFile = true
+				if !peerfile.Static {
+					peerfile.EndPoint = url
+				}
+			} else if peerfile.NodeID == peer.ID || peerfile.PubKey == pubkeystr {
+				panic("Found NodeID match " + peer.ID.ToString() + ", but PubKey Not match %s enrties in config file" + pubkeystr)
 			}
-		} else if peerfile.NodeID == peer.ID || peerfile.PubKey == pubkeystr {
-			panic("Found NodeID match " + peer.ID.ToString() + ", but PubKey Not match %s enrties in config file" + pubkeystr)
 		}
-	}
-	if !foundInFile {
-		device.EdgeConfig.Peers = append(device.EdgeConfig.Peers, mtypes.PeerInfo{
-			NodeID:   peer.ID,
-			PubKey:   pubkeystr,
-			PSKey:    pskstr,
-			EndPoint: url,
-			Static:   false,
-		})
-	}
+		if !foundInFile {
+			econfig.Peers = append(econfig.Peers[:len(econfig.Peers):len(econfig.Peers)], mtypes.PeerInfo{
+				NodeID:   peer.ID,
+				PubKey:   pubkeystr,
+				PSKey:    pskstr,
+				EndPoint: url,
+				Static:   false,
+			})
+		}
+		return nil
+	})
 	go device.SaveConfig()
 }
 
 func (device *Device) SaveConfig() {
-	if device.EdgeConfig.DynamicRoute.SaveNewPeers {
-		configbytes, _ := yaml.Marshal(device.EdgeConfig)
-		ioutil.WriteFile(device.EdgeConfigPath, configbytes, 0644)
+	if device.EdgeConfig().DynamicRoute.SaveNewPeers {
+		device.edgeConfigLock.Lock()
+		defer device.edgeConfigLock.Unlock()
+		configbytes, _ := yaml.Marshal(device.EdgeConfig())
+		if err := mtypes.WriteFileAtomic(device.EdgeConfigPath, configbytes, 0600); err != nil {
+			device.log.Errorf("Save config %v: %v", device.EdgeConfigPath, err)
+		}
 	}
 }
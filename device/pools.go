@@ -8,6 +8,8 @@ package device
 import (
 	"sync"
 	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 )
 
 type WaitPool struct {
@@ -55,6 +57,12 @@ func (device *Device) PopulatePools() {
 	device.pool.outboundElements = NewWaitPool(PreallocatedBuffersPerPool, func() interface{} {
 		return new(QueueOutboundElement)
 	})
+	device.pool.inboundElementsContainers = NewWaitPool(PreallocatedBuffersPerPool, func() interface{} {
+		return &QueueInboundElementsContainer{elems: make([]*QueueInboundElement, 0, conn.IdealBatchSize)}
+	})
+	device.pool.outboundElementsContainers = NewWaitPool(PreallocatedBuffersPerPool, func() interface{} {
+		return &QueueOutboundElementsContainer{elems: make([]*QueueOutboundElement, 0, conn.IdealBatchSize)}
+	})
 }
 
 func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
@@ -82,3 +90,31 @@ func (device *Device) PutOutboundElement(elem *QueueOutboundElement) {
 	elem.clearPointers()
 	device.pool.outboundElements.Put(elem)
 }
+
+func (device *Device) GetInboundElementsContainer() *QueueInboundElementsContainer {
+	c := device.pool.inboundElementsContainers.Get().(*QueueInboundElementsContainer)
+	c.Mutex = sync.Mutex{}
+	return c
+}
+
+func (device *Device) PutInboundElementsContainer(c *QueueInboundElementsContainer) {
+	for i := range c.elems {
+		c.elems[i] = nil
+	}
+	c.elems = c.elems[:0]
+	device.pool.inboundElementsContainers.Put(c)
+}
+
+func (device *Device) GetOutboundElementsContainer() *QueueOutboundElementsContainer {
+	c := device.pool.outboundElementsContainers.Get().(*QueueOutboundElementsContainer)
+	c.Mutex = sync.Mutex{}
+	return c
+}
+
+func (device *Device) PutOutboundElementsContainer(c *QueueOutboundElementsContainer) {
+	for i := range c.elems {
+		c.elems[i] = nil
+	}
+	c.elems = c.elems[:0]
+	device.pool.outboundElementsContainers.Put(c)
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// PSKDB keeps the PSK of each pair of edges, which the supernode hands out with UsePSKForInterEdge.
+// Rotate starts a new version of all of them. Edges switch to it in two phases, each one switch-over window long,
+// so that every edge has downloaded the keys of a phase before any edge starts the next one:
+//
+//	announce: edges use the current version, and accept the next one as well
+//	retire:   edges use the next version, which is the current one now, and accept the previous one as well
+//
+// Then the previous version is forgotten, and nodes removed before the rotation know none of the PSKs in use.
+
+const (
+	PSKPhaseIdle     = "idle"
+	PSKPhaseAnnounce = "announce"
+	PSKPhaseRetire   = "retire"
+)
+
+type VPair struct {
+	s mtypes.Vertex
+	d mtypes.Vertex
+}
+
+type pskVersion struct {
+	VPair
+	version uint64
+}
+
+// PSKState is the rotation state reported by the supernode.
+type PSKState struct {
+	Version  uint64    // version edges use, starts at 1
+	Phase    string    // idle, announce or retire
+	PhaseEnd time.Time // when the phase ends, unless idle
+}
+
+type PSKDB struct {
+	db sync.Map // pskVersion -> NoisePresharedKey
+
+	mutex    sync.RWMutex
+	rotated  uint64 // number of rotations, the current version is rotated+1
+	phase    string
+	phaseEnd time.Time
+	window   time.Duration
+}
+
+func newVPair(s mtypes.Vertex, d mtypes.Vertex) VPair {
+	if s > d {
+		s, d = d, s
+	}
+	return VPair{s: s, d: d}
+}
+
+func (D *PSKDB) get(vp VPair, version uint64) NoisePresharedKey {
+	key := pskVersion{VPair: vp, version: version}
+	pski, ok := D.db.Load(key)
+	if !ok {
+		pski, _ = D.db.LoadOrStore(key, RandomPSK())
+	}
+	return pski.(NoisePresharedKey)
+}
+
+// GetPSK returns the PSK of s and d in the current version.
+func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
+	psk, _, _ = D.Keys(s, d)
+	return
+}
+
+// Keys returns the PSK s and d use, the other one they accept during a rotation or a zero key, and the version in use.
+func (D *PSKDB) Keys(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey, alt NoisePresharedKey, version uint64) {
+	D.mutex.RLock()
+	defer D.mutex.RUnlock()
+	vp := newVPair(s, d)
+	version = D.rotated + 1
+	psk = D.get(vp, version)
+	switch D.phase {
+	case PSKPhaseAnnounce:
+		alt = D.get(vp, version+1)
+	case PSKPhaseRetire:
+		alt = D.get(vp, version-1)
+	}
+	return
+}
+
+func (D *PSKDB) rotating() bool {
+	return D.phase == PSKPhaseAnnounce || D.phase == PSKPhaseRetire
+}
+
+// Rotate starts a rotation with a switch-over window of the given length.
+func (D *PSKDB) Rotate(now time.Time, window time.Duration) error {
+	if window <= 0 {
+		return errors.New("switch-over window must > 0")
+	}
+	D.mutex.Lock()
+	defer D.mutex.Unlock()
+	if D.rotating() {
+		return errors.New("a rotation is in progress")
+	}
+	D.phase = PSKPhaseAnnounce
+	D.phaseEnd = now.Add(window)
+	D.window = window
+	return nil
+}
+
+// Advance moves a rotation to its next phase once the current one has ended, and reports whether it did.
+func (D *PSKDB) Advance(now time.Time) bool {
+	D.mutex.Lock()
+	defer D.mutex.Unlock()
+	if !D.rotating() || now.Before(D.phaseEnd) {
+		return false
+	}
+	switch D.phase {
+	case PSKPhaseAnnounce:
+		D.rotated++
+		D.phase = PSKPhaseRetire
+		D.phaseEnd = now.Add(D.window)
+	case PSKPhaseRetire:
+		previous := D.rotated
+		D.db.Range(func(key, value interface{}) bool {
+			if key.(pskVersion).version <= previous {
+				D.db.Delete(key)
+			}
+			return true
+		})
+		D.phase = PSKPhaseIdle
+	}
+	return true
+}
+
+func (D *PSKDB) State() PSKState {
+	D.mutex.RLock()
+	defer D.mutex.RUnlock()
+	state := PSKState{Version: D.rotated + 1, Phase: PSKPhaseIdle}
+	if D.rotating() {
+		state.Phase = D.phase
+		state.PhaseEnd = D.phaseEnd
+	}
+	return state
+}
+
+func (D *PSKDB) DelNode(n mtypes.Vertex) {
+	D.db.Range(func(key, value interface{}) bool {
+		vp := key.(pskVersion)
+		if vp.s == n || vp.d == n {
+			D.db.Delete(vp)
+		}
+		return true
+	})
+}
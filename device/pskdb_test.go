@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestPSKDBRotation(t *testing.T) {
+	var db PSKDB
+	now := time.Now()
+	v1, alt, version := db.Keys(2, 1)
+	if v1 != db.GetPSK(1, 2) || alt != (NoisePresharedKey{}) || version != 1 {
+		t.Fatalf("version %v alt %v", version, alt)
+	}
+	if db.Rotate(now, 0) == nil {
+		t.Error("rotation without a switch-over window started")
+	}
+	if err := db.Rotate(now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if db.Rotate(now, time.Minute) == nil {
+		t.Error("second rotation started during a rotation")
+	}
+
+	// announce: the next PSK is accepted
+	psk, v2, version := db.Keys(1, 2)
+	if psk != v1 || v2 == (NoisePresharedKey{}) || v2 == v1 || version != 1 || db.State().Phase != PSKPhaseAnnounce {
+		t.Fatalf("announce: version %v state %+v", version, db.State())
+	}
+	if db.Advance(now.Add(time.Second)) {
+		t.Error("phase ended before the switch-over window")
+	}
+
+	// retire: the next PSK is used, the previous one is accepted
+	if !db.Advance(now.Add(time.Minute)) {
+		t.Fatal("announce phase didn't end")
+	}
+	psk, alt, version = db.Keys(1, 2)
+	if psk != v2 || alt != v1 || version != 2 || db.State().Phase != PSKPhaseRetire {
+		t.Fatalf("retire: version %v state %+v", version, db.State())
+	}
+
+	if !db.Advance(now.Add(2 * time.Minute)) {
+		t.Fatal("retire phase didn't end")
+	}
+	psk, alt, version = db.Keys(1, 2)
+	if psk != v2 || alt != (NoisePresharedKey{}) || version != 2 || db.State().Phase != PSKPhaseIdle {
+		t.Fatalf("idle: version %v state %+v", version, db.State())
+	}
+	db.db.Range(func(key, value interface{}) bool {
+		if key.(pskVersion).version != 2 {
+			t.Errorf("PSK of version %v kept", key.(pskVersion).version)
+		}
+		return true
+	})
+	db.DelNode(1)
+	if db.GetPSK(1, 2) == v2 {
+		t.Error("PSK of a deleted node kept")
+	}
+}
+
+func TestPSKRotationPairKeys(t *testing.T) {
+	node1, node3 := newAuthTestDevice(t, 1), newAuthTestDevice(t, 3)
+	node3.EdgeConfig().E2EEncryption = mtypes.E2EInfo{Enabled: true}
+	// node 3 switched to the next PSK already, node 1 didn't
+	peer1 := node3.peers.IDMap[1]
+	peer1.handshake.presharedKeyAlt = peer1.handshake.presharedKey
+	peer1.handshake.presharedKey[1] = 1
+
+	frame := broadcastPacket(1, 3, []byte("frame of node 1"))
+	buf := make([]byte, MaxMessageSize)
+	elem := &QueueOutboundElement{Type: path.NormalPacket, packet: buf[:copy(buf, frame)]}
+	if err := node1.EncryptPacket(elem, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := node3.DecryptPacket(&QueueInboundElement{Type: path.NormalPacket, Flags: elem.Flags, packet: elem.packet}, 1); err != nil {
+		t.Errorf("frame encrypted with the previous PSK dropped: %v", err)
+	}
+	flags, packet := node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), []mtypes.Vertex{3})
+	if !node3.CheckSourceAuth(&QueueInboundElement{Type: path.PingPacket, Flags: flags, packet: packet}, 2, 1, mtypes.NodeID_Spread) {
+		t.Error("ping authenticated with the previous PSK dropped")
+	}
+
+	peer1.handshake.presharedKeyAlt = NoisePresharedKey{}
+	flags, packet = node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), []mtypes.Vertex{3})
+	if node3.CheckSourceAuth(&QueueInboundElement{Type: path.PingPacket, Flags: flags, packet: packet}, 2, 1, mtypes.NodeID_Spread) {
+		t.Error("ping authenticated with a PSK no longer accepted")
+	}
+}
@@ -10,9 +10,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,16 +33,27 @@ type QueueHandshakeElement struct {
 }
 
 type QueueInboundElement struct {
-	Type path.Usage
-	TTL  uint8
-	sync.Mutex
+	Type     path.Usage
+	Flags    path.HeaderFlags
+	TTL      uint8
 	buffer   *[MaxMessageSize]byte
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
 	endpoint conn.Endpoint
+	fecPeer  *Peer // records the packet for FEC once it is decrypted, nil if it isn't recorded
+}
+
+// A QueueInboundElementsContainer holds the transport packets of a peer read in one batch.
+// The decryption workers unlock it when every packet is decrypted.
+type QueueInboundElementsContainer struct {
+	sync.Mutex
+	elems []*QueueInboundElement
 }
 
+// inboundBatch collects the transport packets of one receive batch per peer.
+type inboundBatch map[*Peer]*QueueInboundElementsContainer
+
 // clearPointers clears elem fields that contain pointers.
 // This makes the garbage collector's life easier and
 // avoids accidentally keeping other objects around unnecessarily.
@@ -54,6 +63,7 @@ func (elem *QueueInboundElement) clearPointers() {
 	elem.packet = nil
 	elem.keypair = nil
 	elem.endpoint = nil
+	elem.fecPeer = nil
 }
 
 /* Called when a new authenticated message has been received
@@ -76,7 +86,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * Every time the bind is updated a new routine is started for
  * IPv4 and IPv6 (separately)
  */
-func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
+func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.ReceiveFunc) {
 	recvName := recv.PrettyName()
 	defer func() {
 		device.log.Verbosef("Routine: receive incoming %s - stopped", recvName)
@@ -89,20 +99,34 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 
 	// receive datagrams until conn is closed
 
-	buffer := device.GetMessageBuffer()
-
 	var (
+		buffers     = make([]*[MaxMessageSize]byte, maxBatchSize)
+		packets     = make([][]byte, maxBatchSize)
+		sizes       = make([]int, maxBatchSize)
+		endpoints   = make([]conn.Endpoint, maxBatchSize)
+		batch       = make(inboundBatch)
 		err         error
-		size        int
-		endpoint    conn.Endpoint
+		count       int
 		deathSpiral int
 	)
 
+	for i := range buffers {
+		buffers[i] = device.GetMessageBuffer()
+		packets[i] = buffers[i][:]
+	}
+
+	defer func() {
+		for i := range buffers {
+			if buffers[i] != nil {
+				device.PutMessageBuffer(buffers[i])
+			}
+		}
+	}()
+
 	for {
-		size, endpoint, err = recv(buffer[:])
+		count, err = recv(packets, sizes, endpoints)
 
 		if err != nil {
-			device.PutMessageBuffer(buffer)
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
@@ -113,137 +137,196 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			if deathSpiral < 10 {
 				deathSpiral++
 				time.Sleep(time.Second / 3)
-				buffer = device.GetMessageBuffer()
 				continue
 			}
 			return
 		}
 		deathSpiral = 0
 
-		if size < MinMessageSize {
-			continue
+		for i := 0; i < count; i++ {
+			if sizes[i] < MinMessageSize {
+				continue
+			}
+			if device.receiveIncoming(buffers[i], packets[i][:sizes[i]], endpoints[i], batch) {
+				buffers[i] = device.GetMessageBuffer()
+				packets[i] = buffers[i][:]
+			}
+			endpoints[i] = nil
 		}
+		device.flushInboundBatch(batch)
+	}
+}
 
-		// check size of packet
-
-		packet := buffer[:size]
-		msgType := path.Usage(packet[0])
-		msgTTL := uint8(packet[1])
-		msgType_wg := msgType
-		if msgType >= path.MessageTransportType {
-			msgType_wg = path.MessageTransportType
+// receiveIncoming dispatches a received datagram.
+// It returns true if the buffer was consumed.
+func (device *Device) receiveIncoming(buffer *[MaxMessageSize]byte, packet []byte, endpoint conn.Endpoint, batch inboundBatch) bool {
+	msgType, msgFlags := path.SplitUsageFlags(packet[0])
+	if msgType == path.FECParity {
+		if msgFlags == 0 {
+			device.ReceiveFECParity(packet, endpoint, batch)
 		}
+		return false
+	}
+	msgType_wg := msgType
+	if msgType >= path.MessageTransportType {
+		msgType_wg = path.MessageTransportType
+	} else if msgFlags != 0 {
+		return false
+	}
 
-		var okay bool
+	var okay bool
 
-		switch msgType_wg {
+	switch msgType_wg {
 
-		// check if transport
+	// check if transport
 
-		case path.MessageTransportType:
+	case path.MessageTransportType:
+		return device.queueInboundTransport(buffer, packet, endpoint, true, batch)
 
-			// check size
+	// otherwise it is a fixed size & handshake related packet
 
-			if len(packet) < MessageTransportSize {
-				continue
-			}
+	case path.MessageInitiationType:
+		okay = len(packet) == MessageInitiationSize
 
-			// lookup key pair
+	case path.MessageResponseType:
+		okay = len(packet) == MessageResponseSize
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+	case path.MessageCookieReplyType:
+		okay = len(packet) == MessageCookieReplySize
 
-			// check keypair expiry
+	default:
+		device.log.Verbosef("Received message with unknown type")
+	}
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+	if okay {
+		select {
+		case device.queue.handshake.c <- QueueHandshakeElement{
+			msgType:  msgType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+		}:
+			return true
+		default:
+		}
+	}
+	return false
+}
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.Type = msgType
-			elem.TTL = msgTTL
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-			if peer.isRunning.Get() {
-				peer.queue.inbound.c <- elem
-				device.queue.decryption.c <- elem
-				buffer = device.GetMessageBuffer()
-			} else {
+// flushInboundBatch adds the containers of the batch to the decryption queues.
+func (device *Device) flushInboundBatch(batch inboundBatch) {
+	for peer, elemsContainer := range batch {
+		delete(batch, peer)
+		if peer.isRunning.Get() {
+			peer.queue.inbound.c <- elemsContainer
+			device.queue.decryption.c <- elemsContainer
+		} else {
+			for _, elem := range elemsContainer.elems {
+				device.PutMessageBuffer(elem.buffer)
 				device.PutInboundElement(elem)
 			}
-			continue
+			device.PutInboundElementsContainer(elemsContainer)
+		}
+	}
+}
 
-		// otherwise it is a fixed size & handshake related packet
+// queueInboundTransport adds a transport packet to the container of its peer in the batch.
+// It returns false if the packet was dropped and the buffer can be reused.
+func (device *Device) queueInboundTransport(buffer *[MaxMessageSize]byte, packet []byte, endpoint conn.Endpoint, record bool, batch inboundBatch) bool {
+	msgType, msgFlags := path.SplitUsageFlags(packet[0])
+	msgTTL := uint8(packet[1])
 
-		case path.MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+	// check size
 
-		case path.MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+	if len(packet) < MessageTransportSize {
+		return false
+	}
 
-		case path.MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	// lookup key pair
 
-		default:
-			device.log.Verbosef("Received message with unknown type")
-		}
+	receiver := binary.LittleEndian.Uint32(
+		packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+	)
+	value := device.indexTable.Lookup(receiver)
+	keypair := value.keypair
+	if keypair == nil {
+		return false
+	}
 
-		if okay {
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
-				msgType:  msgType,
-				buffer:   buffer,
-				packet:   packet,
-				endpoint: endpoint,
-			}:
-				buffer = device.GetMessageBuffer()
-			default:
-			}
-		}
+	// check keypair expiry
+
+	if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+		return false
+	}
+
+	peer := value.peer
+	if !peer.isRunning.Get() {
+		return false
+	}
+
+	// create work element
+	elem := device.GetInboundElement()
+	elem.Type = msgType
+	elem.Flags = msgFlags
+	elem.TTL = msgTTL
+	elem.packet = packet
+	elem.buffer = buffer
+	elem.keypair = keypair
+	elem.endpoint = endpoint
+	elem.counter = 0
+	if record && device.FECActive(peer) {
+		elem.fecPeer = peer
+	}
+
+	elemsContainer, ok := batch[peer]
+	if !ok {
+		elemsContainer = device.GetInboundElementsContainer()
+		elemsContainer.Lock()
+		batch[peer] = elemsContainer
 	}
+	elemsContainer.elems = append(elemsContainer.elems, elem)
+	return true
 }
 
 func (device *Device) RoutineDecryption(id int) {
 	var nonce [chacha20poly1305.NonceSize]byte
+	var ciphertext [MaxMessageSize]byte
 
 	defer device.log.Verbosef("Routine: decryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: decryption worker %d - started", id)
 
-	for elem := range device.queue.decryption.c {
-		// split message into fields
-		counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
-		content := elem.packet[MessageTransportOffsetContent:]
-
-		// decrypt and release to consumer
-		var err error
-		elem.counter = binary.LittleEndian.Uint64(counter)
-		// copy counter to nonce
-		binary.LittleEndian.PutUint64(nonce[0x4:0xc], elem.counter)
-		elem.packet, err = elem.keypair.receive.Open(
-			content[:0],
-			nonce[:],
-			content,
-			nil,
-		)
-		if err != nil {
-			elem.packet = nil
+	for elemsContainer := range device.queue.decryption.c {
+		// packets recovered by FEC are appended to the container, and decrypted in turn
+		for i := 0; i < len(elemsContainer.elems); i++ {
+			elem := elemsContainer.elems[i]
+			// the packet FEC records, before it is decrypted in place
+			var recorded []byte
+			if elem.fecPeer != nil {
+				recorded = ciphertext[:copy(ciphertext[:], elem.packet)]
+			}
+
+			// split message into fields
+			counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
+			content := elem.packet[MessageTransportOffsetContent:]
+
+			// decrypt and release to consumer
+			var err error
+			elem.counter = binary.LittleEndian.Uint64(counter)
+			// copy counter to nonce
+			binary.LittleEndian.PutUint64(nonce[0x4:0xc], elem.counter)
+			elem.packet, err = elem.keypair.receive.Open(
+				content[:0],
+				nonce[:],
+				content,
+				nil,
+			)
+			if err != nil {
+				elem.packet = nil
+			} else if recorded != nil {
+				elemsContainer.elems = device.fecRecovered(elem, elem.fecPeer.fecReceived(recorded), elemsContainer.elems)
+			}
 		}
-		elem.Unlock()
+		elemsContainer.Unlock()
 	}
 }
 
@@ -297,7 +380,8 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
+			checker := device.macChecker(elem.packet)
+			if checker == nil {
 				device.log.Verbosef("Received packet with invalid mac1")
 				goto skip
 			}
@@ -308,8 +392,8 @@ func (device *Device) RoutineHandshake(id int) {
 
 				// verify MAC2 field
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
-					device.SendHandshakeCookie(&elem)
+				if !checker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					device.SendHandshakeCookie(&elem, checker)
 					goto skip
 				}
 
@@ -412,248 +496,308 @@ func (device *Device) RoutineHandshake(id int) {
 
 func (peer *Peer) RoutineSequentialReceiver() {
 	device := peer.device
-	var peer_out *Peer
+	var decompressor decompressor
 	defer func() {
 		device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
 		peer.stopping.Done()
 	}()
 	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
 
-	for elem := range peer.queue.inbound.c {
-		if elem == nil {
+	for elemsContainer := range peer.queue.inbound.c {
+		if elemsContainer == nil {
 			return
 		}
-		var EgHeader path.EgHeader
-		var err error
-		var src_nodeID mtypes.Vertex
-		var dst_nodeID mtypes.Vertex
-		var packet_type path.Usage
-		should_process := false
-		should_receive := false
-		should_transfer := false
-		currentTime := time.Now()
-		storeTime := currentTime.Add(time.Second)
-		if currentTime.After((*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time))) {
-			peer.LastPacketReceivedAdd1Sec.Store(&storeTime)
+		elemsContainer.Lock()
+		written := false
+		for _, elem := range elemsContainer.elems {
+			if peer.receiveInbound(elem, &decompressor) {
+				written = true
+			}
+			device.PutMessageBuffer(elem.buffer)
+			device.PutInboundElement(elem)
 		}
-		elem.Lock()
-		if elem.packet == nil {
-			// decryption failed
-			goto skip
+		device.PutInboundElementsContainer(elemsContainer)
+		if written && len(peer.queue.inbound.c) == 0 {
+			if err := device.tap.device.Flush(); err != nil {
+				device.log.Errorf("Unable to flush packets: %v", err)
+			}
 		}
+	}
+}
 
-		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
-			goto skip
-		}
+// receiveInbound handles a decrypted packet of the peer, and reports whether it was written to the tap device.
+// The buffer of elem is returned to the pool by the caller.
+func (peer *Peer) receiveInbound(elem *QueueInboundElement, decompressor *decompressor) bool {
+	device := peer.device
+	var peer_out *Peer
+	var EgHeader path.EgHeader
+	var err error
+	var src_nodeID mtypes.Vertex
+	var dst_nodeID mtypes.Vertex
+	var packet_type path.Usage
+	should_process := false
+	should_receive := false
+	should_transfer := false
+	currentTime := time.Now()
+	storeTime := currentTime.Add(time.Second)
+	if currentTime.After((*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time))) {
+		peer.LastPacketReceivedAdd1Sec.Store(&storeTime)
+	}
+	if elem.packet == nil {
+		// decryption failed
+		return false
+	}
 
-		peer.SetEndpointFromPacket(elem.endpoint)
-		if peer.ReceivedWithKeypair(elem.keypair) {
-			peer.timersHandshakeComplete()
-			peer.SendStagedPackets()
-		}
+	if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+		return false
+	}
 
-		peer.keepKeyFreshReceiving()
-		peer.timersAnyAuthenticatedPacketTraversal()
-		peer.timersAnyAuthenticatedPacketReceived()
-		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+	peer.SetEndpointFromPacket(elem.endpoint)
+	if peer.ReceivedWithKeypair(elem.keypair) {
+		peer.timersHandshakeComplete()
+		peer.SendStagedPackets()
+	}
 
-		if len(elem.packet) == 0 {
-			device.log.Verbosef("%v - Receiving keepalive packet", peer)
-			goto skip
-		}
-		peer.timersDataReceived()
+	peer.keepKeyFreshReceiving()
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+
+	if len(elem.packet) == 0 {
+		device.log.Verbosef("%v - Receiving keepalive packet", peer)
+		return false
+	}
+	peer.timersDataReceived()
 
+	if len(elem.packet) <= path.EgHeaderLen {
+		device.log.Errorf("Invalid EgHeader from peer %v", peer)
+		return false
+	}
+	if elem.Flags == path.FlagExtended {
+		if err := device.StripExtHeader(elem); err != nil {
+			device.log.Errorf("Invalid ExtHeader from peer %v: %v", peer, err)
+			return false
+		}
 		if len(elem.packet) <= path.EgHeaderLen {
 			device.log.Errorf("Invalid EgHeader from peer %v", peer)
-			goto skip
+			return false
 		}
-		EgHeader, _ = path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU) // EG header
-		src_nodeID = EgHeader.GetSrc()
-		dst_nodeID = EgHeader.GetDst()
-		packet_type = elem.Type
-		if !packet_type.IsValid_EgType() {
-			if device.LogLevel.LogTransit {
-				fmt.Printf("Transit: Invalid packet usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
-			}
-			goto skip
+	}
+	EgHeader, _ = path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU) // EG header
+	src_nodeID = EgHeader.GetSrc()
+	dst_nodeID = EgHeader.GetDst()
+	packet_type = elem.Type
+	if !packet_type.IsValid_EgType() {
+		if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"usage": elem.Type.ToString(), "src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "Invalid packet ttl:%v, content %v PL:%v", elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet))
 		}
-		if device.IsSuperNode {
-			if packet_type.IsControl_Edge2Super() {
-				should_process = true
-			} else {
-				device.log.Errorf("received unsupported packet_type %v S:%v From:%v IP:%v", packet_type, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
-				goto skip
+		return false
+	}
+	if elem.Flags != 0 {
+		// only the sequence number is allowed on broadcast, and everything else on unicast data packets.
+		// Any packet may be authenticated.
+		flags := elem.Flags &^ path.FlagAuthenticated
+		is_broadcast := dst_nodeID == mtypes.NodeID_Broadcast || dst_nodeID == mtypes.NodeID_Spread
+		if is_broadcast && flags&^path.FlagSequenced != 0 || !is_broadcast && (!packet_type.IsNormal() && flags != 0 || flags.Has(path.FlagSequenced)) {
+			device.log.Errorf("received unexpected flags %v usage:%v S:%v D:%v From:%v", elem.Flags, packet_type.ToString(), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString())
+			return false
+		}
+	}
+	if device.IsSuperNode {
+		if packet_type.IsControl_Edge2Super() {
+			should_process = true
+		} else {
+			device.log.Errorf("received unsupported packet_type %v S:%v From:%v IP:%v", packet_type, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+			return false
+		}
+		switch dst_nodeID {
+		case mtypes.NodeID_SuperNode:
+			should_process = true
+		default:
+			device.log.Errorf("received invalid dst_nodeID: %v S:%v From:%v IP:%v", dst_nodeID, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+			return false
+		}
+	} else {
+		// Set should_receive and should_process
+		if packet_type.IsNormal() {
+			switch dst_nodeID {
+			case device.ID:
+				should_receive = true
+			case mtypes.NodeID_Broadcast:
+				should_receive = true
+			case mtypes.NodeID_Spread:
+				should_receive = true
 			}
+		}
+		if packet_type.IsControl_Edge2Edge() {
 			switch dst_nodeID {
-			case mtypes.NodeID_SuperNode:
+			case device.ID:
+				should_process = true
+			case mtypes.NodeID_Broadcast:
+				should_process = true
+			case mtypes.NodeID_Spread:
 				should_process = true
-			default:
-				device.log.Errorf("received invalid dst_nodeID: %v S:%v From:%v IP:%v", dst_nodeID, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
-				goto skip
-			}
-		} else {
-			// Set should_receive and should_process
-			if packet_type.IsNormal() {
-				switch dst_nodeID {
-				case device.ID:
-					should_receive = true
-				case mtypes.NodeID_Broadcast:
-					should_receive = true
-				case mtypes.NodeID_Spread:
-					should_receive = true
-				}
 			}
-			if packet_type.IsControl_Edge2Edge() {
+		}
+		if packet_type.IsControl_Super2Edge() {
+			if peer.ID == mtypes.NodeID_SuperNode {
 				switch dst_nodeID {
 				case device.ID:
 					should_process = true
-				case mtypes.NodeID_Broadcast:
-					should_process = true
-				case mtypes.NodeID_Spread:
+				case mtypes.NodeID_SuperNode:
 					should_process = true
 				}
-			}
-			if packet_type.IsControl_Super2Edge() {
-				if peer.ID == mtypes.NodeID_SuperNode {
-					switch dst_nodeID {
-					case device.ID:
-						should_process = true
-					case mtypes.NodeID_SuperNode:
-						should_process = true
-					}
 
-				} else {
-					device.log.Errorf("received ServerUpdate packet from non supernode S:%v From:%v IP:%v", src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
-					goto skip
-				}
+			} else {
+				device.log.Errorf("received ServerUpdate packet from non supernode S:%v From:%v IP:%v", src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+				return false
 			}
+		}
 
-			// Set should_transfer
-			switch dst_nodeID {
-			case mtypes.NodeID_Broadcast:
+		// Set should_transfer
+		switch dst_nodeID {
+		case mtypes.NodeID_Broadcast, mtypes.NodeID_Spread:
+			var first bool
+			if elem.Flags.Has(path.FlagSequenced) {
+				first = device.CheckSequence(src_nodeID, elem.packet)
+			} else if dst_nodeID == mtypes.NodeID_Spread {
+				first = device.CheckNoDup(elem.packet[path.EgHeaderLen:])
+			} else {
+				first = true
+			}
+			if first {
 				should_transfer = true
-			case mtypes.NodeID_Spread:
-				packet := elem.packet[path.EgHeaderLen:] //packet body
-				if device.CheckNoDup(packet) {
-					should_transfer = true
-				} else {
-					if device.LogLevel.LogTransit {
-						fmt.Printf("Transit: Duplicate packet dropped. S:%v D:%v From:%v \n", src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID)
-					}
-					goto skip
-				}
-			case device.ID:
-				should_transfer = false
-			case mtypes.NodeID_SuperNode:
-				should_transfer = false
-			case mtypes.NodeID_Invalid:
-				should_transfer = false
-			default:
-				if device.graph.Next(device.ID, dst_nodeID) != mtypes.NodeID_Invalid {
-					should_transfer = true
-				} else {
-					device.log.Verbosef("No route to peer ID %v", dst_nodeID)
+			} else {
+				if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) {
+					device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString()}, "Duplicate packet dropped")
 				}
+				return false
 			}
-		}
-		if should_transfer {
-			l2ttl := elem.TTL
-			if l2ttl == 0 {
-				device.log.Verbosef("TTL is 0 %v", dst_nodeID)
+		case device.ID:
+			should_transfer = false
+		case mtypes.NodeID_SuperNode:
+			should_transfer = false
+		case mtypes.NodeID_Invalid:
+			should_transfer = false
+		default:
+			if _, ok := device.forwarding().next[dst_nodeID]; ok || elem.Flags.Has(path.FlagDuplicate) {
+				should_transfer = true
 			} else {
-				l2ttl = l2ttl - 1
-				if dst_nodeID == mtypes.NodeID_Broadcast { //Regular transfer algorithm
-					go device.TransitBoardcastPacket(src_nodeID, peer.ID, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
-				} else if dst_nodeID == mtypes.NodeID_Spread { // Control Message will try send to every know node regardless the connectivity
-					skip_list := make(map[mtypes.Vertex]bool)
-					skip_list[src_nodeID] = true //Don't send to conimg peer and source peer
-					skip_list[peer.ID] = true
-					go device.SpreadPacket(skip_list, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
+				device.log.Verbosef("No route to peer ID %v", dst_nodeID)
+			}
+		}
+	}
+	if should_transfer {
+		l2ttl := elem.TTL
+		if l2ttl == 0 {
+			device.log.Verbosef("TTL is 0 %v", dst_nodeID)
+		} else {
+			l2ttl = l2ttl - 1
+			if dst_nodeID == mtypes.NodeID_Broadcast { //Regular transfer algorithm
+				device.TransitBoardcastPacket(src_nodeID, peer.ID, elem.Type, elem.Flags, l2ttl, elem.packet, MessageTransportOffsetContent)
+			} else if dst_nodeID == mtypes.NodeID_Spread { // Control Message will try send to every know node regardless the connectivity
+				skip_list := make(map[mtypes.Vertex]bool)
+				skip_list[src_nodeID] = true //Don't send to conimg peer and source peer
+				skip_list[peer.ID] = true
+				device.SpreadPacket(skip_list, elem.Type, elem.Flags, l2ttl, elem.packet, MessageTransportOffsetContent)
 
+			} else {
+				fwd := device.forwarding()
+				peer_out = fwd.next[dst_nodeID]
+				if elem.Flags.Has(path.FlagDuplicate) {
+					peer_out = fwd.peers[device.DupNextHop(elem.packet)]
+				}
+				if peer_out != nil {
+					if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) {
+						device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString()}, "Transfer To:%v TTL:%v", peer_out.ID.ToString(), l2ttl)
+					}
+					device.SendPacketFlags(peer_out, elem.Type, elem.Flags, l2ttl, elem.packet, MessageTransportOffsetContent)
 				} else {
-					next_id := device.graph.Next(device.ID, dst_nodeID)
-					if next_id != mtypes.NodeID_Invalid {
-						device.peers.RLock()
-						peer_out = device.peers.IDMap[next_id]
-						device.peers.RUnlock()
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", peer.ID, device.ID, peer_out.ID, src_nodeID.ToString(), dst_nodeID.ToString(), l2ttl)
-						}
-						go device.SendPacket(peer_out, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
-					} else {
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: No route to %v,usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", dst_nodeID.ToString(), elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
-						}
+					if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) {
+						device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"usage": elem.Type.ToString(), "src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "No route ttl:%v, content %v PL:%v", elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet))
 					}
 				}
 			}
 		}
+	}
 
-		if should_process {
-			if packet_type != path.NormalPacket {
-				if device.LogLevel.LogControl {
-					if peer.GetEndpointDstStr() != "" {
-						fmt.Printf("Control: Recv %v S:%v D:%v TTL:%v From:%v IP:%v\n", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					}
-				}
-				err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
-				if err != nil {
-					device.log.Errorf(err.Error())
+	if elem.Flags.Has(path.FlagSequenced) {
+		device.StripSequence(elem)
+	}
+
+	if should_process {
+		if !device.CheckSourceAuth(elem, peer.ID, src_nodeID, dst_nodeID) {
+			return false
+		}
+		if packet_type != path.NormalPacket {
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				if peer.GetEndpointDstStr() != "" {
+					device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"usage": packet_type.ToString(), "src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "Recv %v TTL:%v", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), elem.TTL)
 				}
 			}
+			if mtypes.IsWireFormat(elem.packet[path.EgHeaderLen:]) {
+				device.AddNodeFeatures(src_nodeID, mtypes.FeatureWireFormat)
+			}
+			err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
+			if err != nil {
+				device.log.Errorf(err.Error())
+			}
 		}
+	}
 
-		if should_receive { // Write message to tap device
-			if packet_type == path.NormalPacket {
-				if len(elem.packet) <= path.EgHeaderLen+12 {
-					device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
-					goto skip
-				}
-				if device.LogLevel.LogNormal {
-					packet_len := len(elem.packet) - path.EgHeaderLen
-					fmt.Printf("Normal: Recv Len:%v S:%v D:%v TTL:%v From:%v IP:%v:\n", strconv.Itoa(packet_len), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					if device.LogLevel.DumpNormal {
-						packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-						fmt.Println(packet.Dump())
-					}
-				}
-				src_macaddr := tap.GetSrcMacAddr(elem.packet[path.EgHeaderLen:])
-				if !tap.IsNotUnicast(src_macaddr) {
-					val, ok := device.l2fib.Load(src_macaddr)
-					if ok {
-						idtime := val.(*IdAndTime)
-						if idtime.ID != src_nodeID {
-							idtime.ID = src_nodeID
-							if device.LogLevel.LogInternal {
-								fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", src_macaddr.String(), src_nodeID)
-							}
-						}
-						idtime.Time = time.Now()
-					} else {
-						device.l2fib.Store(src_macaddr, &IdAndTime{
-							ID:   src_nodeID,
-							Time: time.Now(),
-						}) // Write to l2fib table
-						if device.LogLevel.LogInternal {
-							fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", src_macaddr.String(), src_nodeID)
-						}
-					}
+	if should_receive { // Write message to tap device
+		if packet_type == path.NormalPacket {
+			if elem.Flags.Has(path.FlagDuplicate) && !device.ReceiveDuplicated(elem, src_nodeID) {
+				return false
+			}
+			if elem.Flags.Has(path.FlagFragment) && !device.ReassembleFragment(elem, src_nodeID) {
+				return false
+			}
+			if elem.Flags.Has(path.FlagEncrypted) {
+				if err = device.DecryptPacket(elem, src_nodeID); err != nil {
+					device.log.Errorf("Failed to decrypt packet S:%v From:%v: %v", src_nodeID.ToString(), peer.ID.ToString(), err)
+					return false
 				}
-				_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
-				if err != nil && !device.isClosed() {
-					device.log.Errorf("Failed to write packet to TUN device: %v", err)
+			} else if !device.CheckSourceAuth(elem, peer.ID, src_nodeID, dst_nodeID) {
+				return false
+			} else if device.E2ERequired(peer.ID, src_nodeID, dst_nodeID) {
+				device.log.Errorf("Unencrypted packet dropped S:%v From:%v", src_nodeID.ToString(), peer.ID.ToString())
+				return false
+			}
+			if len(elem.packet) <= path.EgHeaderLen+12 {
+				device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
+				return false
+			}
+			if elem.Flags.Has(path.FlagCompressed) {
+				if err = device.DecompressPacket(decompressor, elem, src_nodeID); err != nil {
+					device.log.Errorf("Failed to decompress packet S:%v From:%v: %v", src_nodeID.ToString(), peer.ID.ToString(), err)
+					return false
 				}
-				if len(peer.queue.inbound.c) == 0 {
-					err = device.tap.device.Flush()
-					if err != nil {
-						peer.device.log.Errorf("Unable to flush packets: %v", err)
-					}
+			}
+			if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+				packet_len := len(elem.packet) - path.EgHeaderLen
+				device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "Recv Len:%v TTL:%v", packet_len, elem.TTL)
+				if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelDebug) {
+					packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
+					device.slog.Debugf(mtypes.LogCatNormal, nil, "%v", packet.Dump())
 				}
 			}
+			if !device.FilterToLAN(elem.packet[path.EgHeaderLen:]) {
+				return false
+			}
+			if dst_nodeID != device.ID && device.LoopBlocking() {
+				return false
+			}
+			src_macaddr := tap.GetSrcMacAddr(elem.packet[path.EgHeaderLen:])
+			if !device.LearnMac(src_macaddr, src_nodeID) {
+				return false
+			}
+			_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
+			if err != nil && !device.isClosed() {
+				device.log.Errorf("Failed to write packet to TUN device: %v", err)
+			}
+			return true
 		}
-
-	skip:
-		device.PutMessageBuffer(elem.buffer)
-		device.PutInboundElement(elem)
 	}
+	return false
 }
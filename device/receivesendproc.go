@@ -15,8 +15,8 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
@@ -29,135 +29,242 @@ import (
 	"github.com/google/gopacket/layers"
 )
 
-type packet_send_params struct {
-	peer *Peer
-	elem *QueueOutboundElement
+func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet []byte, offset int) {
+	device.SendPacketFlags(peer, usage, 0, ttl, packet, offset)
 }
 
-func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet []byte, offset int) {
+// SendPacketFlags is SendPacket with header flags, used to forward flagged packets unchanged.
+func (device *Device) SendPacketFlags(peer *Peer, usage path.Usage, flags path.HeaderFlags, ttl uint8, packet []byte, offset int) {
+	device.SendPacketExt(peer, usage, path.ExtHeader{Flags: flags}, ttl, packet, offset)
+}
+
+// SendPacketExt is SendPacket with an ExtHeader, which is only inserted after the EgHeader if the flags or options need it.
+// Check that the peer supports FeatureExtHeader before, the packet is dropped otherwise.
+func (device *Device) SendPacketExt(peer *Peer, usage path.Usage, ext path.ExtHeader, ttl uint8, packet []byte, offset int) {
 	if peer == nil {
 		return
 	} else if peer.endpoint == nil {
 		return
 	}
-	if usage == path.NormalPacket && len(packet)-path.EgHeaderLen <= 12 {
-		if device.LogLevel.LogNormal {
-			fmt.Printf("Normal: Send Len:%v Invalid packet: Ethernet packet too small\n", len(packet)-path.EgHeaderLen)
+	extLen := 0
+	if ext.Needed() {
+		if !device.NodeFeatures(peer.ID).Has(mtypes.FeatureExtHeader) {
+			if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Send Len:%v Invalid packet: peer doesn't support the ExtHeader", len(packet)-path.EgHeaderLen)
+			}
+			return
+		}
+		extLen = ext.Len()
+	}
+	if len(packet)+extLen > MaxContentSize {
+		if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Send Len:%v Invalid packet: packet too large", len(packet)-path.EgHeaderLen)
+		}
+		return
+	}
+	if usage == path.NormalPacket && ext.Flags == 0 && len(packet)-path.EgHeaderLen <= 12 {
+		if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Send Len:%v Invalid packet: Ethernet packet too small", len(packet)-path.EgHeaderLen)
 		}
 		return
 	}
 
-	if device.LogLevel.LogNormal {
-		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		if usage == path.NormalPacket && EgHeader.GetSrc() == device.ID {
 			dst_nodeID := EgHeader.GetDst()
 			packet_len := len(packet) - path.EgHeaderLen
-			fmt.Printf("Normal: Send Len:%v S:%v D:%v TTL:%v To:%v IP:%v:\n", packet_len, device.ID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
-			if device.LogLevel.DumpNormal {
+			device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"src": device.ID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "Send Len:%v TTL:%v", packet_len, ttl)
+			if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelDebug) {
 				packet_dump := gopacket.NewPacket(packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-				fmt.Println(packet_dump.Dump())
+				device.slog.Debugf(mtypes.LogCatNormal, nil, "%v", packet_dump.Dump())
 			}
 		}
 	}
-	if device.LogLevel.LogControl {
-		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		if usage != path.NormalPacket {
 			if peer.GetEndpointDstStr() != "" {
 				src_nodeID := EgHeader.GetSrc()
 				dst_nodeID := EgHeader.GetDst()
-				fmt.Printf("Control: Send %v S:%v D:%v TTL:%v To:%v IP:%v\n", device.sprint_received(usage, packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
+				device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"usage": usage.ToString(), "src": src_nodeID.ToString(), "dst": dst_nodeID.ToString(), "peer_id": peer.ID.ToString(), "endpoint": peer.GetEndpointDstStr()}, "Send %v TTL:%v", device.sprint_received(usage, packet[path.EgHeaderLen:]), ttl)
 			}
 		}
 	}
 	var elem *QueueOutboundElement
 	elem = device.NewOutboundElement()
-	copy(elem.buffer[offset:offset+len(packet)], packet)
 	elem.Type = usage
+	elem.Flags = ext.Flags
 	elem.TTL = ttl
-	elem.packet = elem.buffer[offset : offset+len(packet)]
-	device.chan_send_packet <- &packet_send_params{
-		peer: peer,
-		elem: elem,
+	if extLen != 0 {
+		if err := ext.Insert(elem.buffer[offset:offset+len(packet)+extLen], packet); err != nil {
+			device.log.Errorf("Failed to build ExtHeader: %v", err)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			return
+		}
+		elem.Flags = path.FlagExtended
+	} else {
+		copy(elem.buffer[offset:offset+len(packet)], packet)
 	}
+	elem.packet = elem.buffer[offset : offset+len(packet)+extLen]
+	device.enqueueSendPacket(peer, elem)
 }
 
-func (device *Device) RoutineSendPacket() {
-	var elem *QueueOutboundElement
+// StripExtHeader moves the flags of an ExtHeader back into elem.Flags and removes it from the packet,
+// so that the packet looks like one without it. The packet stays at the start of its buffer.
+func (device *Device) StripExtHeader(elem *QueueInboundElement) error {
+	ext, n, err := path.ParseExtHeader(elem.packet[path.EgHeaderLen:])
+	if err != nil {
+		return err
+	}
+	copy(elem.packet[path.EgHeaderLen:], elem.packet[path.EgHeaderLen+n:])
+	elem.packet = elem.packet[:len(elem.packet)-n]
+	elem.Flags = ext.Flags
+	return nil
+}
+
+func (device *Device) startSendPipeline() {
+	shards := runtime.NumCPU()
+	device.chan_send_packet = make([]chan *QueueOutboundElement, shards)
+	for i := range device.chan_send_packet {
+		device.chan_send_packet[i] = make(chan *QueueOutboundElement, QueueOutboundSize)
+		go device.RoutineSendPacket(i)
+	}
+}
+
+// enqueueSendPacket hands elem to the RoutineSendPacket of its peer, so packets to a peer stay in order.
+// It blocks while that queue is full, which slows down whoever produces the packets instead of piling them up.
+func (device *Device) enqueueSendPacket(peer *Peer, elem *QueueOutboundElement) {
+	elem.peer = peer
+	queue := device.chan_send_packet[int(peer.ID)%len(device.chan_send_packet)]
+	select {
+	case queue <- elem:
+		// RoutineSendPacket may have flushed the queue and stopped before elem came in
+		if device.isClosed() {
+			device.flushSendQueue(queue)
+		}
+	case <-device.closed:
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}
+}
+
+// flushSendQueue returns the elements left in a queue of RoutineSendPacket to the pools.
+func (device *Device) flushSendQueue(queue chan *QueueOutboundElement) {
 	for {
-		if elem != nil {
+		select {
+		case elem := <-queue:
 			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
+		default:
+			return
+		}
+	}
+}
+
+/* Stages packets queued by enqueueSendPacket to their peers
+ *
+ * Obs. One instance per CPU, each serving a fixed share of the peers
+ */
+func (device *Device) RoutineSendPacket(shard int) {
+	queue := device.chan_send_packet[shard]
+	staged := make(map[*Peer]bool)
+	for {
+		var elem *QueueOutboundElement
+		select {
+		case elem = <-queue:
+		case <-device.closed:
+			device.flushSendQueue(queue)
+			return
+		}
+		// stage everything queued already, so that each peer sends it as one batch
+	stage:
+		for count := 1; ; count++ {
+			if elem.peer.isRunning.Get() {
+				elem.peer.StagePacket(elem)
+				staged[elem.peer] = true
+			} else {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			if count == QueueStagedSize {
+				break
+			}
+			select {
+			case elem = <-queue:
+			default:
+				break stage
+			}
 		}
-		elem = device.NewOutboundElement()
-		params := <-device.chan_send_packet
-		elem := params.elem
-		peer := params.peer
-		if peer.isRunning.Get() {
-			peer.StagePacket(elem)
-			elem = nil
+		for peer := range staged {
 			peer.SendStagedPackets()
+			delete(staged, peer)
 		}
 	}
 }
 
 func (device *Device) BoardcastPacket(skip_list map[mtypes.Vertex]bool, usage path.Usage, ttl uint8, packet []byte, offset int) { // Send packet to all connected peers
-	send_list := device.graph.GetBoardcastList(device.ID)
-	for node_id := range skip_list {
-		send_list[node_id] = false
-	}
-	device.peers.RLock()
-	for node_id, should_send := range send_list {
-		if should_send {
-			peer_out := device.peers.IDMap[node_id]
-			go device.SendPacket(peer_out, usage, ttl, packet, offset)
+	flags, packet := device.SequencePacket(0, packet)
+	for _, peer_out := range device.forwarding().broadcast {
+		if !skip_list[peer_out.ID] {
+			device.SendPacketFlags(peer_out, usage, flags, ttl, packet, offset)
 		}
 	}
-	device.peers.RUnlock()
 }
 
-func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.Usage, ttl uint8, packet []byte, offset int) { // Send packet to all peers no matter it is alive
-	device.peers.RLock()
-	for peer_id, peer_out := range device.peers.IDMap {
+func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.Usage, flags path.HeaderFlags, ttl uint8, packet []byte, offset int) { // Send packet to all peers no matter it is alive
+	flags, packet = device.AuthenticatePacket(usage, flags, packet, nil)
+	flags, packet = device.SequencePacket(flags, packet)
+	for peer_id, peer_out := range device.forwarding().peers {
 		if _, ok := skip_list[peer_id]; ok {
-			if device.LogLevel.LogTransit && peer_out.endpoint != nil {
-				fmt.Printf("Transit: Skipped Spread Packet packet Me:%v To:%d  TTL:%v\n", device.ID, peer_out.ID, ttl)
+			if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) && peer_out.endpoint != nil {
+				device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"peer_id": peer_out.ID.ToString()}, "Skipped Spread Packet TTL:%v", ttl)
 			}
 			continue
 		}
-		go device.SendPacket(peer_out, usage, ttl, packet, offset)
+		device.SendPacketFlags(peer_out, usage, flags, ttl, packet, offset)
 	}
-	device.peers.RUnlock()
 }
 
-func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mtypes.Vertex, usage path.Usage, ttl uint8, packet []byte, offset int) {
-	node_boardcast_list, errs := device.graph.GetBoardcastThroughList(device.ID, in_id, src_nodeID)
-	if device.LogLevel.LogControl {
+func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mtypes.Vertex, usage path.Usage, flags path.HeaderFlags, ttl uint8, packet []byte, offset int) {
+	fwd := device.forwarding()
+	node_boardcast_list, ok := fwd.through[src_nodeID]
+	if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		errs := fwd.throughErrs[src_nodeID]
+		if !ok {
+			errs = []error{fmt.Errorf("nhTable[%v] not exist", src_nodeID)}
+		}
 		for _, err := range errs {
-			fmt.Printf("Internal: Can't boardcast: %v", err)
+			device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"src": src_nodeID.ToString()}, "Can't boardcast: %v", err)
 		}
 	}
-	device.peers.RLock()
-	for peer_id := range node_boardcast_list {
-		peer_out := device.peers.IDMap[peer_id]
-		if device.LogLevel.LogTransit {
-			fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", in_id, device.ID, peer_out.ID, src_nodeID.ToString(), peer_out.ID.ToString(), ttl)
+	for _, peer_out := range node_boardcast_list {
+		if peer_out.ID == in_id {
+			continue
 		}
-		go device.SendPacket(peer_out, usage, ttl, packet, offset)
+		if device.slog.Enabled(mtypes.LogCatTransit, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatTransit, mtypes.LogFields{"src": src_nodeID.ToString(), "peer_id": in_id.ToString()}, "Transfer To:%v TTL:%v", peer_out.ID.ToString(), ttl)
+		}
+		device.SendPacketFlags(peer_out, usage, flags, ttl, packet, offset)
 	}
-	device.peers.RUnlock()
 }
 
 func (device *Device) Send2Super(usage path.Usage, ttl uint8, packet []byte, offset int) {
-	device.peers.RLock()
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.SuperPeer))
 		for _, peer_out := range device.peers.SuperPeer {
+			peers = append(peers, peer_out)
+		}
+		device.peers.RUnlock()
+		for _, peer_out := range peers {
 			/*if device.LogTransit {
 				fmt.Printf("Send to supernode %s\n", peer_out.endpoint.DstToString())
 			}*/
-			go device.SendPacket(peer_out, usage, ttl, packet, offset)
+			device.SendPacket(peer_out, usage, ttl, packet, offset)
 		}
 	}
-	device.peers.RUnlock()
 }
 
 func (device *Device) CheckNoDup(packet []byte) bool {
@@ -169,6 +276,22 @@ func (device *Device) CheckNoDup(packet []byte) bool {
 	return !ok
 }
 
+// EncodeMessage encodes a control message in the wire format if dst_nodeID supports it, and as gob for older nodes.
+// Spread and broadcast messages use the wire format only if every node does.
+func (device *Device) EncodeMessage(dst_nodeID mtypes.Vertex, msg mtypes.WireMessage) ([]byte, error) {
+	var wire bool
+	switch dst_nodeID {
+	case mtypes.NodeID_Broadcast, mtypes.NodeID_Spread:
+		wire = device.NetworkSupports(mtypes.FeatureWireFormat)
+	default:
+		wire = device.NodeFeatures(dst_nodeID).Has(mtypes.FeatureWireFormat)
+	}
+	if wire {
+		return msg.MarshalWire(), nil
+	}
+	return mtypes.GetByte(msg)
+}
+
 func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []byte) (err error) {
 	if device.IsSuperNode {
 		switch msg_type {
@@ -263,44 +386,40 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 	}
 }
 
-func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
-	body, err := mtypes.GetByte(&mtypes.PingMsg{
+// GeneratePingPacket builds a ping to the peer, authenticated for the peer if it supports it.
+func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, peer *Peer, request_reply int) ([]byte, path.Usage, path.HeaderFlags, uint8, error) {
+	body, err := device.EncodeMessage(peer.ID, &mtypes.PingMsg{
+		RequestID:    peer.fec.NextPingID(),
 		Src_nodeID:   src_nodeID,
 		Time:         device.graph.GetCurrentTime(),
 		RequestReply: request_reply,
+		Features:     device.LocalFeatures(),
+		LossRate:     peer.fec.rxLoss.Loss(),
+		Certificate:  device.admission.certificate,
 	})
 	if err != nil {
-		return nil, path.PingPacket, 0, err
+		return nil, path.PingPacket, 0, 0, err
 	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 	if err != nil {
-		return nil, path.PingPacket, 0, err
+		return nil, path.PingPacket, 0, 0, err
 	}
 	header.SetDst(mtypes.NodeID_Spread)
 	header.SetSrc(device.ID)
 	copy(buf[path.EgHeaderLen:], body)
-	return buf, path.PingPacket, 0, nil
+	flags, buf := device.AuthenticatePacket(path.PingPacket, 0, buf, []mtypes.Vertex{peer.ID})
+	return buf, path.PingPacket, flags, 0, nil
 }
 
 func (device *Device) SendPing(peer *Peer, times int, replies int, interval float64) {
 	for i := 0; i < times; i++ {
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, replies)
-		device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
+		packet, usage, flags, ttl, _ := device.GeneratePingPacket(device.ID, peer, replies)
+		device.SendPacketFlags(peer, usage, flags, ttl, packet, MessageTransportOffsetContent)
 		time.Sleep(mtypes.S2TD(interval))
 	}
 }
 
-func compareVersion(v1 string, v2 string) bool {
-	if strings.Contains(v1, "-") {
-		v1 = strings.Split(v1, "-")[0]
-	}
-	if strings.Contains(v2, "-") {
-		v2 = strings.Split(v2, "-")[0]
-	}
-	return v1 == v2
-}
-
 func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.RegisterMsg) error {
 	ServerUpdateMsg := mtypes.ServerUpdateMsg{
 		Node_id: peer.ID,
@@ -316,32 +435,36 @@ func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.Regi
 			Params:  fmt.Sprintf("Your nodeID: %v is not match with registered nodeID: %v", content.Node_id, peer.ID),
 		}
 	}
-	if !compareVersion(content.Version, device.Version) {
+	// Edges of any version may join, as long as they support what the supernode requires.
+	required, _ := mtypes.ParseFeatures(device.SuperConfig.RequiredFeatures)
+	if missing := required &^ content.Features; missing != 0 {
 		ServerUpdateMsg = mtypes.ServerUpdateMsg{
 			Node_id: peer.ID,
 			Action:  mtypes.ThrowError,
 			Code:    int(syscall.ENOSYS),
-			Params:  fmt.Sprintf("Your version: \"%v\" is not compatible with our version: \"%v\"", content.Version, device.Version),
+			Params:  fmt.Sprintf("Your version: \"%v\" lacks features required by the supernode: %v", content.Version, missing.ToString()),
 		}
 	}
 	if ServerUpdateMsg.Action != mtypes.NoAction {
-		body, err := mtypes.GetByte(&ServerUpdateMsg)
+		body, err := device.EncodeMessage(peer.ID, &ServerUpdateMsg)
 		if err != nil {
 			return err
 		}
 		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		header.SetSrc(device.ID)
 		copy(buf[path.EgHeaderLen:], body)
 		header.SetDst(mtypes.NodeID_SuperNode)
 		device.SendPacket(peer, path.ServerUpdate, 0, buf, MessageTransportOffsetContent)
 		return nil
 	}
+	device.SetNodeFeatures(peer.ID, content.Features)
 	device.Chan_server_register <- content
 	return nil
 }
 
 func (device *Device) server_process_Pong(peer *Peer, content mtypes.PongMsg) error {
+	device.SetNodeFeatures(content.Dst_nodeID, content.Features)
 	device.Chan_server_pong <- content
 	return nil
 }
@@ -350,55 +473,84 @@ func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
 	Timediff := device.graph.GetCurrentTime().Sub(content.Time).Seconds()
 	NewTimediff := peer.SingleWayLatency.Push(Timediff)
 
+	device.SetNodeFeatures(content.Src_nodeID, content.Features)
+	peer.fec.rxLoss.Push(content.RequestID)
+	device.SetFECTxLoss(peer, content.LossRate)
+	if device.admission.mode == AdmissionCA && content.Src_nodeID == peer.ID {
+		// kept to pass on to the other nodes, which can't check that the peer owns the PubKey
+		peer.handshake.mutex.RLock()
+		pk := peer.handshake.remoteStatic
+		peer.handshake.mutex.RUnlock()
+		if err := device.AdmitPeer(peer.ID, pk, content.Certificate); err != nil {
+			device.slog.Errorf(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Invalid certificate: %v", err)
+		} else {
+			peer.certificate.Store(content.Certificate)
+		}
+	}
 	PongMSG := mtypes.PongMsg{
 		Src_nodeID:     content.Src_nodeID,
 		Dst_nodeID:     device.ID,
 		Timediff:       NewTimediff,
-		TimeToAlive:    device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
-		AdditionalCost: device.EdgeConfig.DynamicRoute.AdditionalCost,
+		TimeToAlive:    device.EdgeConfig().DynamicRoute.PeerAliveTimeout,
+		AdditionalCost: device.EdgeConfig().DynamicRoute.AdditionalCost,
+		Features:       device.LocalFeatures(),
 	}
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P && time.Now().After(device.graph.NhTableExpire) {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P && time.Now().After(device.graph.NhTableExpire) {
 		device.graph.UpdateLatencyMulti([]mtypes.PongMsg{PongMSG}, true, false)
 	}
-	body, err := mtypes.GetByte(&PongMSG)
-	if err != nil {
-		return err
+	// the supernode and the other nodes may not read the same format
+	pong := func(dst_nodeID mtypes.Vertex) ([]byte, error) {
+		body, err := device.EncodeMessage(dst_nodeID, &PongMSG)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, path.EgHeaderLen+len(body))
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+		header.SetSrc(device.ID)
+		header.SetDst(dst_nodeID)
+		copy(buf[path.EgHeaderLen:], body)
+		return buf, nil
 	}
-	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-	header.SetSrc(device.ID)
-	copy(buf[path.EgHeaderLen:], body)
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
-		header.SetDst(mtypes.NodeID_SuperNode)
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
+		buf, err := pong(mtypes.NodeID_SuperNode)
+		if err != nil {
+			return err
+		}
 		device.Send2Super(path.PongPacket, 0, buf, MessageTransportOffsetContent)
 	}
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
-		header.SetDst(mtypes.NodeID_Spread)
-		device.SpreadPacket(make(map[mtypes.Vertex]bool), path.PongPacket, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
+		buf, err := pong(mtypes.NodeID_Spread)
+		if err != nil {
+			return err
+		}
+		device.SpreadPacket(make(map[mtypes.Vertex]bool), path.PongPacket, 0, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 	}
 	go device.SendPing(peer, content.RequestReply, 0, 3)
 	return nil
 }
 
 func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	device.SetNodeFeatures(content.Dst_nodeID, content.Features)
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		if time.Now().After(device.graph.NhTableExpire) {
-			device.graph.UpdateLatency(content.Src_nodeID, content.Dst_nodeID, content.Timediff, device.EdgeConfig.DynamicRoute.PeerAliveTimeout, content.AdditionalCost, true, false)
+			device.graph.UpdateLatency(content.Src_nodeID, content.Dst_nodeID, content.Timediff, device.EdgeConfig().DynamicRoute.PeerAliveTimeout, content.AdditionalCost, true, false)
 		}
 		if !peer.AskedForNeighbor {
 			QueryPeerMsg := mtypes.QueryPeerMsg{
 				Request_ID: uint32(device.ID),
 			}
-			body, err := mtypes.GetByte(&QueryPeerMsg)
+			body, err := device.EncodeMessage(mtypes.NodeID_Spread, &QueryPeerMsg)
 			if err != nil {
 				return err
 			}
 			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 			header.SetSrc(device.ID)
 			header.SetDst(mtypes.NodeID_Spread)
 			copy(buf[path.EgHeaderLen:], body)
-			device.SendPacket(peer, path.QueryPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+			// the peer spreads it to every node
+			flags, buf := device.AuthenticatePacket(path.QueryPeer, 0, buf, nil)
+			device.SendPacketFlags(peer, path.QueryPeer, flags, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 		}
 	}
 	return nil
@@ -406,10 +558,11 @@ func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
 
 func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error {
 	var send_signal bool
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	var psk_version uint64
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.Peer.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download PeerInfo")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Same Hash, skip download PeerInfo")
 			}
 			return nil
 		}
@@ -418,7 +571,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		client := http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.EdgeConfig().DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -429,8 +582,8 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download PeerInfo from :" + req.URL.RequestURI())
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download PeerInfo from :%v", req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
 		if err != nil {
@@ -447,26 +600,29 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 			device.log.Errorf("Control: Download peerinfo failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download peerinfo result :" + string(allbytes))
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download peerinfo result :%v", string(allbytes))
 		}
 		if err := json.Unmarshal(allbytes, &peer_infos); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
 		}
 
+		// peers rotating their key are listed with the one they use, and the other one as PubKeyAlt
+		rotating := make(map[string]mtypes.Vertex)
+		for _, peerinfo := range peer_infos {
+			if peerinfo.PubKeyAlt != "" {
+				rotating[peerinfo.PubKeyAlt] = peerinfo.NodeID
+			}
+		}
 		for nodeID, thepeer := range device.peers.IDMap {
 			pk := thepeer.handshake.remoteStatic
-			psk := thepeer.handshake.presharedKey
 			if val, ok := peer_infos[pk.ToString()]; ok {
 				if val.NodeID != nodeID {
 					device.RemovePeer(pk)
 					continue
-				} else if val.PSKey != psk.ToString() {
-					device.RemovePeer(pk)
-					continue
 				}
-			} else {
+			} else if id, ok := rotating[pk.ToString()]; !ok || id != nodeID {
 				device.RemovePeer(pk)
 				continue
 			}
@@ -478,22 +634,34 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				device.log.Errorf("Error decode base64:", err)
 				continue
 			}
-			if bytes.Equal(sk[:], device.staticIdentity.publicKey[:]) {
+			if bytes.Equal(sk[:], device.staticIdentity.publicKey[:]) || peerinfo.NodeID == device.ID {
 				continue
 			}
+			var alt NoisePublicKey
+			if peerinfo.PubKeyAlt != "" {
+				alt, err = Str2PubKey(peerinfo.PubKeyAlt)
+				if err != nil {
+					device.log.Errorf("Error decode base64:", err)
+					continue
+				}
+			}
 			thepeer := device.LookupPeer(sk)
+			if thepeer == nil && !alt.IsZero() {
+				// the peer switched to its new key before we got it
+				thepeer = device.LookupPeer(alt)
+			}
 			if thepeer == nil { //not exist in local
 				if len(peerinfo.Connurl.ExternalV4)+len(peerinfo.Connurl.ExternalV6)+len(peerinfo.Connurl.LocalV4)+len(peerinfo.Connurl.LocalV6) == 0 {
 					continue
 				}
-				if device.LogLevel.LogControl {
-					fmt.Println("Control: Add new peer to local ID:" + peerinfo.NodeID.ToString() + " PubKey:" + PubKey)
+				if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+					device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peerinfo.NodeID.ToString()}, "Add new peer to local PubKey:%v", PubKey)
 				}
 				if device.graph.Weight(device.ID, peerinfo.NodeID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 				}
 				if device.graph.Weight(peerinfo.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 				}
 				thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, 0)
 				if err != nil {
@@ -501,22 +669,38 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 					continue
 				}
 			}
+			if err := device.SetPeerKeys(thepeer, sk, alt); err != nil {
+				device.log.Errorf("Failed to update the keys of peer %v: %v", peerinfo.NodeID.ToString(), err)
+				continue
+			}
 			if peerinfo.PSKey != "" {
+				// a new PSK takes effect at the next handshake, the sessions of the old one go on until then
 				pk, err := Str2PSKey(peerinfo.PSKey)
 				if err != nil {
 					device.log.Errorf("Error decode base64:", err)
 					continue
 				}
+				var alt NoisePresharedKey
+				if peerinfo.PSKeyAlt != "" {
+					alt, err = Str2PSKey(peerinfo.PSKeyAlt)
+					if err != nil {
+						device.log.Errorf("Error decode base64:", err)
+						continue
+					}
+				}
 				thepeer.SetPSK(pk)
+				thepeer.SetPSKAlt(alt)
+				psk_version = peerinfo.PSKVersion
 			}
 
-			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
+			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig().DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig().AfPrefer)
 			if !thepeer.IsPeerAlive() {
 				//Peer died, try to switch to this new endpoint
 				send_signal = true
 			}
 		}
 		device.state_hashes.Peer.Store(State_hash)
+		device.psk_version.Store(psk_version)
 		if send_signal {
 			device.event_tryendpoint <- struct{}{}
 		}
@@ -525,10 +709,10 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 }
 
 func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) error {
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.NhTable.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download nhTable")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Same Hash, skip download nhTable")
 			}
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
@@ -538,7 +722,7 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.EdgeConfig().DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -549,8 +733,8 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download NhTable from :%v", req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
 		if err != nil {
@@ -567,8 +751,8 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 			device.log.Errorf("Control: Download NhTable failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable result :" + string(allbytes))
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download NhTable result :%v", string(allbytes))
 		}
 		if err := json.Unmarshal(allbytes, &NhTable); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
@@ -581,10 +765,10 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 }
 
 func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string) error {
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.SuperParam.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download SuperParams")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Same Hash, skip download SuperParams")
 			}
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
@@ -593,7 +777,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.EdgeConfig().DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -604,8 +788,8 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams from :" + req.URL.RequestURI())
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download SuperParams from :%v", req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
 		if err != nil {
@@ -622,8 +806,8 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			device.log.Errorf("Control: Download SuperParams failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams result :" + string(allbytes))
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Download SuperParams result :%v", string(allbytes))
 		}
 		if err := json.Unmarshal(allbytes, &SuperParams); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
@@ -642,15 +826,18 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			return fmt.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
 		}
 
-		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
-		device.EdgeConfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
+		device.updateEdgeConfig(func(econfig *mtypes.EdgeConfig) error {
+			econfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
+			econfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
+			if SuperParams.AdditionalCost >= 0 {
+				econfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
+			}
+			return nil
+		})
 		device.SuperConfig.HttpPostInterval = SuperParams.HttpPostInterval
 		device.SuperConfig.DampingFilterRadius = SuperParams.DampingFilterRadius
 		device.Chan_SendPingStart <- struct{}{}
 		device.Chan_HttpPostStart <- struct{}{}
-		if SuperParams.AdditionalCost >= 0 {
-			device.EdgeConfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
-		}
 
 		device.state_hashes.SuperParam.Store(State_hash)
 	}
@@ -659,8 +846,8 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 
 func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerUpdateMsg) error {
 	if peer.ID != mtypes.NodeID_SuperNode {
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Ignored UpdateErrorMsg. Not from supernode.")
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Ignored UpdateErrorMsg. Not from supernode.")
 		}
 		return nil
 	}
@@ -688,7 +875,7 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 }
 
 func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error { //Send all my peers to all my peers
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		device.peers.RLock()
 		for pubkey, peer := range device.peers.keyMap {
 			if peer.ID >= mtypes.NodeID_Special {
@@ -702,6 +889,10 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 				// peer died, skip
 				continue
 			}
+			if peer.certExpired(time.Now()) {
+				// removed soon, skip
+				continue
+			}
 
 			peer.handshake.mutex.RLock()
 			response := mtypes.BoardcastPeerMsg{
@@ -711,17 +902,20 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 				ConnURL:    peer.endpoint.DstToString(),
 			}
 			peer.handshake.mutex.RUnlock()
-			body, err := mtypes.GetByte(response)
+			if cert, ok := peer.certificate.Load().([]byte); ok {
+				response.Certificate = cert
+			}
+			body, err := device.EncodeMessage(mtypes.NodeID_Spread, &response)
 			if err != nil {
 				device.log.Errorf("Error at receivesendproc.go line221: ", err)
 				continue
 			}
 			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+			header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 			header.SetDst(mtypes.NodeID_Spread)
 			header.SetSrc(device.ID)
 			copy(buf[path.EgHeaderLen:], body)
-			device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+			device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, 0, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 		}
 		device.peers.RUnlock()
 	}
@@ -729,7 +923,7 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 }
 
 func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.BoardcastPeerMsg) (err error) {
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		var pk NoisePublicKey
 		if content.Request_ID == uint32(device.ID) {
 			peer.AskedForNeighbor = true
@@ -739,20 +933,38 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 		}
 		copy(pk[:], content.PubKey[:])
 		thepeer := device.LookupPeer(pk)
+		if device.AdmissionRequired() {
+			var reason error
+			if thepeer != nil && thepeer.ID != content.NodeID {
+				reason = fmt.Errorf("PubKey belongs to %v", thepeer.ID.ToString())
+			} else if thepeer == nil && device.forwarding().peers[content.NodeID] != nil {
+				reason = errors.New("NodeID has another PubKey")
+			} else if thepeer == nil {
+				reason = device.AdmitPeer(content.NodeID, pk, content.Certificate)
+			}
+			if reason != nil {
+				device.slog.Errorf(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peer.ID.ToString()}, "Rejected peer %v PubKey:%v: %v", content.NodeID.ToString(), pk.ToString(), reason)
+				return nil
+			}
+		}
 		if thepeer == nil { //not exist in local
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Add new peer to local ID:" + content.NodeID.ToString() + " PubKey:" + pk.ToString())
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": content.NodeID.ToString()}, "Add new peer to local PubKey:%v", pk.ToString())
 			}
 			if device.graph.Weight(device.ID, content.NodeID, false) == mtypes.Infinity { // add node to graph
-				device.graph.UpdateLatency(device.ID, content.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+				device.graph.UpdateLatency(device.ID, content.NodeID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 			}
 			if device.graph.Weight(content.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
-				device.graph.UpdateLatency(content.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+				device.graph.UpdateLatency(content.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 			}
 			thepeer, err = device.NewPeer(pk, content.NodeID, false, 0)
 			if err != nil {
 				return err
 			}
+			if device.admission.mode == AdmissionCA {
+				thepeer.certificate.Store(content.Certificate)
+				thepeer.certAdmitted.Set(true)
+			}
 		}
 		if !thepeer.IsPeerAlive() {
 			//Peer died, try to switch to this new endpoint
@@ -765,15 +977,15 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 }
 
 func (device *Device) RoutineTryReceivedEndpoint() {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)
+	timeout := mtypes.S2TD(device.EdgeConfig().DynamicRoute.ConnNextTry)
 	for {
 		NextRun := false
 		<-device.event_tryendpoint
 		for _, thepeer := range device.peers.IDMap {
-			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
+			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig().DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
 				//Peer alives
 				continue
 			} else {
@@ -784,7 +996,7 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 				if thepeer.StaticConn {
 					continue
 				}
-				err := thepeer.SetEndpointFromConnURL(connurl, device.enabledAf, device.EdgeConfig.AfPrefer, thepeer.StaticConn) //trying to bind first url in the list and wait ConnNextTry seconds
+				err := thepeer.SetEndpointFromConnURL(connurl, device.enabledAf, device.EdgeConfig().AfPrefer, thepeer.StaticConn) //trying to bind first url in the list and wait ConnNextTry seconds
 				if err != nil {
 					device.log.Errorf("Bind " + connurl + " failed!")
 					thepeer.endpoint_trylist.Delete(connurl)
@@ -792,10 +1004,10 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 				}
 				if FastTry {
 					NextRun = true
-					if device.LogLevel.LogControl {
-						fmt.Printf("Control: First try for peer %v at endpoint %v, sending hole-punching ping\n", thepeer.ID.ToString(), connurl)
+					if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+						device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": thepeer.ID.ToString(), "endpoint": connurl}, "First try for peer, sending hole-punching ping")
 					}
-					go device.SendPing(thepeer, int(device.EdgeConfig.DynamicRoute.ConnNextTry+1), 1, 1)
+					go device.SendPing(thepeer, int(device.EdgeConfig().DynamicRoute.ConnNextTry+1), 1, 1)
 				}
 
 			}
@@ -809,8 +1021,8 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 			}
 		}
 		time.Sleep(timeout)
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: RoutineSetEndpoint: NextRun:%v\n", NextRun)
+		if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatInternal, nil, "RoutineSetEndpoint: NextRun:%v", NextRun)
 		}
 		if NextRun {
 			device.event_tryendpoint <- struct{}{}
@@ -819,62 +1031,66 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 }
 
 func (device *Device) RoutineDetectOfflineAndTryNextEndpoint() {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
-		return
-	}
-	if device.EdgeConfig.DynamicRoute.TimeoutCheckInterval == 0 {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.TimeoutCheckInterval)
 	for {
+		// read every time, a reload may change it
+		if device.EdgeConfig().DynamicRoute.TimeoutCheckInterval == 0 {
+			time.Sleep(time.Second)
+			continue
+		}
 		device.event_tryendpoint <- struct{}{}
-		time.Sleep(timeout)
+		time.Sleep(mtypes.S2TD(device.EdgeConfig().DynamicRoute.TimeoutCheckInterval))
 	}
 }
 
 func (device *Device) RoutineSendPing(startchan chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
 	startchan <- struct{}{}
 	for {
-		if device.EdgeConfig.DynamicRoute.SendPingInterval > 0 {
-			waitchan = time.After(mtypes.S2TD(device.EdgeConfig.DynamicRoute.SendPingInterval))
+		if device.EdgeConfig().DynamicRoute.SendPingInterval > 0 {
+			waitchan = time.After(mtypes.S2TD(device.EdgeConfig().DynamicRoute.SendPingInterval))
 		} else {
 			waitchan = make(<-chan time.Time)
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineSendPing()")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Start RoutineSendPing()")
 			}
 			for len(startchan) > 0 {
 				<-startchan
 			}
 		case <-waitchan:
 		}
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, 0)
-		device.SpreadPacket(make(map[mtypes.Vertex]bool), usage, ttl, packet, MessageTransportOffsetContent)
+		// pings are numbered per peer, so that the peer can measure the loss rate of the link
+		for _, peer_out := range device.forwarding().peers {
+			packet, usage, flags, ttl, _ := device.GeneratePingPacket(device.ID, peer_out, 0)
+			device.SendPacketFlags(peer_out, usage, flags, ttl, packet, MessageTransportOffsetContent)
+		}
 	}
 }
 
 func (device *Device) RoutineRegister(startchan chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
 	startchan <- struct{}{}
 	for {
-		if device.EdgeConfig.DynamicRoute.SendPingInterval > 0 {
-			waitchan = time.After(mtypes.S2TD(device.EdgeConfig.DynamicRoute.SendPingInterval))
+		if device.EdgeConfig().DynamicRoute.SendPingInterval > 0 {
+			waitchan = time.After(mtypes.S2TD(device.EdgeConfig().DynamicRoute.SendPingInterval))
 		} else {
 			waitchan = time.After(8 * time.Second)
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineRegister()")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Start RoutineRegister()")
 			}
 			for len(startchan) > 0 {
 				<-startchan
@@ -884,7 +1100,10 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 		local_PeerStateHash := device.state_hashes.Peer.Load().(string)
 		local_NhTableHash := device.state_hashes.NhTable.Load().(string)
 		local_SuperParamState := device.state_hashes.SuperParam.Load().(string)
-		body, _ := mtypes.GetByte(mtypes.RegisterMsg{
+		device.staticIdentity.RLock()
+		PubKey, PubKeyAlt := device.staticIdentity.publicKey, device.staticIdentity.publicKeyAlt
+		device.staticIdentity.RUnlock()
+		body, _ := device.EncodeMessage(mtypes.NodeID_SuperNode, &mtypes.RegisterMsg{
 			Node_id:             device.ID,
 			PeerStateHash:       local_PeerStateHash,
 			NhStateHash:         local_NhTableHash,
@@ -892,9 +1111,13 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 			Version:             device.Version,
 			JWTSecret:           device.JWTSecret,
 			HttpPostCount:       device.HttpPostCount,
+			Features:            device.LocalFeatures(),
+			PSKVersion:          device.psk_version.Load().(uint64),
+			PubKey:              PubKey,
+			PubKeyAlt:           PubKeyAlt,
 		})
 		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		header.SetDst(mtypes.NodeID_SuperNode)
 		header.SetSrc(device.ID)
 		copy(buf[path.EgHeaderLen:], body)
@@ -903,7 +1126,7 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 }
 
 func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
@@ -916,8 +1139,8 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		select {
 		case <-waitchan:
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutinePostPeerInfo()")
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, nil, "Start RoutinePostPeerInfo()")
 			}
 			for len(startchan) > 0 {
 				<-startchan
@@ -934,11 +1157,11 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 					Src_nodeID:  id,
 					Dst_nodeID:  device.ID,
 					Timediff:    peer.SingleWayLatency.GetVal(),
-					TimeToAlive: -time.Since(*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)).Seconds() + device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
+					TimeToAlive: -time.Since(*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)).Seconds() + device.EdgeConfig().DynamicRoute.PeerAliveTimeout,
 				}
 				pongs = append(pongs, pong)
-				if device.LogLevel.LogControl {
-					fmt.Printf("Control: Pack %v S:%v D:%v To:Post body\n", pong.ToString(), pong.Src_nodeID.ToString(), pong.Dst_nodeID.ToString())
+				if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+					device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"src": pong.Src_nodeID.ToString(), "dst": pong.Dst_nodeID.ToString()}, "Pack %v To:Post body", pong.ToString())
 				}
 			}
 			device.peers.RLock()
@@ -947,7 +1170,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		// Prepare post paramater and post body
 		LocalV4s := make(map[string]float64)
 		LocalV6s := make(map[string]float64)
-		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP {
+		if !device.EdgeConfig().DynamicRoute.SuperNode.SkipLocalIP {
 			if !device.peers.LocalV4.Equal(net.IP{}) {
 				LocalV4 := net.UDPAddr{
 					IP:   device.peers.LocalV4,
@@ -964,7 +1187,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 				LocalV6s[LocalV6.String()] = 100
 			}
 		}
-		for _, AIP := range device.EdgeConfig.DynamicRoute.SuperNode.AdditionalLocalIP {
+		for _, AIP := range device.EdgeConfig().DynamicRoute.SuperNode.AdditionalLocalIP {
 			success := false
 			_, ipstr, err := conn.LookupIP(AIP, conn.EnabledAf4, 0)
 			if err == nil {
@@ -997,7 +1220,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
+		downloadurl := device.EdgeConfig().DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
 		req, err := http.NewRequest("POST", downloadurl, bytes.NewReader(body))
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -1011,19 +1234,19 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		req.Header.Set("Content-Type", "application/octet-stream")
 		req.Header.Set("Content-Encoding", "gzip")
 		device.HttpPostCount += 1
-		if device.LogLevel.LogControl {
-			fmt.Printf("Control: Post to %v\n", downloadurl)
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, nil, "Post to %v", downloadurl)
 		}
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf("RoutinePostPeerInfo: " + err.Error())
 		} else {
-			if device.LogLevel.LogControl {
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
 				res, err := ioutil.ReadAll(resp.Body)
 				if err == nil {
-					fmt.Printf("Control: Post result %v\n", string(res))
+					device.slog.Infof(mtypes.LogCatControl, nil, "Post result %v", string(res))
 				} else {
-					fmt.Printf("Control: Post error %v %v\n", err, string(res))
+					device.slog.Infof(mtypes.LogCatControl, nil, "Post error %v %v", err, string(res))
 				}
 			}
 			resp.Body.Close()
@@ -1036,7 +1259,7 @@ func (device *Device) RoutineRecalculateNhTable() {
 		return
 	}
 
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		return
 	}
 	for {
@@ -1049,30 +1272,34 @@ func (device *Device) RoutineRecalculateNhTable() {
 }
 
 func (device *Device) RoutineSpreadAllMyNeighbor() {
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.P2P.SendPeerInterval)
 	for {
+		device.removeExpiredPeers()
 		device.process_RequestPeerMsg(mtypes.QueryPeerMsg{
 			Request_ID: uint32(mtypes.NodeID_Broadcast),
 		})
-		time.Sleep(timeout)
+		time.Sleep(mtypes.S2TD(device.EdgeConfig().DynamicRoute.P2P.SendPeerInterval))
 	}
 }
 
 func (device *Device) RoutineResetEndpoint() {
-	var ResetEndPointInterval float64
-	if device.IsSuperNode {
-		ResetEndPointInterval = device.SuperConfig.ResetEndPointInterval
-	} else {
-		ResetEndPointInterval = device.EdgeConfig.ResetEndPointInterval
-	}
-	if ResetEndPointInterval <= 0.01 {
-		return
-	}
-	timeout := mtypes.S2TD(ResetEndPointInterval)
 	for {
+		// read every time, a reload may change it
+		var ResetEndPointInterval float64
+		if device.IsSuperNode {
+			ResetEndPointInterval = device.SuperConfig.ResetEndPointInterval
+		} else {
+			ResetEndPointInterval = device.EdgeConfig().ResetEndPointInterval
+		}
+		if ResetEndPointInterval <= 0.01 {
+			if device.IsSuperNode {
+				return
+			}
+			time.Sleep(time.Second)
+			continue
+		}
 		for _, peer := range device.peers.keyMap {
 			if !peer.StaticConn { //Do not reset connecton for dynamic peer
 				continue
@@ -1083,29 +1310,31 @@ func (device *Device) RoutineResetEndpoint() {
 			if peer.IsPeerAlive() {
 				continue
 			}
-			err := peer.SetEndpointFromConnURL(peer.ConnURL, peer.ConnAF, device.EdgeConfig.AfPrefer, peer.StaticConn)
+			err := peer.SetEndpointFromConnURL(peer.ConnURL, peer.ConnAF, device.EdgeConfig().AfPrefer, peer.StaticConn)
 			if err != nil {
 				device.log.Errorf("Failed to bind "+peer.ConnURL, err)
 				continue
 			}
 		}
-		time.Sleep(timeout)
+		time.Sleep(mtypes.S2TD(ResetEndPointInterval))
 	}
 }
 
 func (device *Device) RoutineClearL2FIB() {
-	if device.EdgeConfig.L2FIBTimeout <= 0.01 {
-		return
-	}
-	timeout := mtypes.S2TD(device.EdgeConfig.L2FIBTimeout)
 	for {
+		// read every time, a reload may change it
+		if device.EdgeConfig().L2FIBTimeout <= 0.01 {
+			time.Sleep(time.Second)
+			continue
+		}
+		timeout := mtypes.S2TD(device.EdgeConfig().L2FIBTimeout)
 		device.l2fib.Range(func(k interface{}, v interface{}) bool {
 			val := v.(*IdAndTime)
-			if time.Now().After(val.Time.Add(timeout)) {
-				mac := k.(tap.MacAddress)
+			if time.Now().After(val.LastSeen().Add(timeout)) && !val.Held() {
+				mac, dst_nodeID := k.(tap.MacAddress), val.NodeID()
 				device.l2fib.Delete(k)
-				if device.LogLevel.LogInternal {
-					fmt.Printf("Internal: L2FIB [%v -> %v] deleted.\n", mac.String(), val.ID)
+				if device.slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					device.slog.Infof(mtypes.LogCatInternal, mtypes.LogFields{"dst": dst_nodeID.ToString()}, "L2FIB [%v -> %v] deleted.", mac.String(), dst_nodeID.ToString())
 				}
 			}
 			return true
@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// An edge reloads its config on SIGHUP or the reload_config UAPI key. The fields copied by reloadableFields
+// are applied to a copy of the config which replaces it, sessions of unchanged peers go on. A change of any other field takes a restart,
+// then the whole reload is refused and nothing is applied.
+
+// reloadableFields copies the fields we can apply without a restart from src to dst.
+func reloadableFields(dst *mtypes.EdgeConfig, src *mtypes.EdgeConfig) {
+	LogFormat := dst.LogLevel.LogFormat
+	dst.LogLevel = src.LogLevel
+	dst.LogLevel.LogFormat = LogFormat
+	dst.DefaultTTL = src.DefaultTTL
+	dst.L2FIBTimeout = src.L2FIBTimeout
+	dst.ListenPort = src.ListenPort
+	dst.FwMark = src.FwMark
+	dst.AfPrefer = src.AfPrefer
+	dst.NextHopTable = src.NextHopTable
+	dst.ResetEndPointInterval = src.ResetEndPointInterval
+	dst.Peers = src.Peers
+	dst.DynamicRoute.SendPingInterval = src.DynamicRoute.SendPingInterval
+	dst.DynamicRoute.PeerAliveTimeout = src.DynamicRoute.PeerAliveTimeout
+	dst.DynamicRoute.TimeoutCheckInterval = src.DynamicRoute.TimeoutCheckInterval
+	dst.DynamicRoute.ConnNextTry = src.DynamicRoute.ConnNextTry
+	dst.DynamicRoute.AdditionalCost = src.DynamicRoute.AdditionalCost
+	dst.DynamicRoute.DampingFilterRadius = src.DynamicRoute.DampingFilterRadius
+	dst.DynamicRoute.SaveNewPeers = src.DynamicRoute.SaveNewPeers
+	dst.DynamicRoute.SuperNode.SkipLocalIP = src.DynamicRoute.SuperNode.SkipLocalIP
+	dst.DynamicRoute.SuperNode.KeyRotationOverlap = src.DynamicRoute.SuperNode.KeyRotationOverlap
+	dst.DynamicRoute.P2P.SendPeerInterval = src.DynamicRoute.P2P.SendPeerInterval
+}
+
+// restartFields returns the fields which differ between oldconf and newconf, but take a restart to change.
+func restartFields(oldconf *mtypes.EdgeConfig, newconf *mtypes.EdgeConfig) []string {
+	check := *newconf
+	reloadableFields(&check, oldconf)
+	return mtypes.DiffFields(*oldconf, check)
+}
+
+// checkConfigPeers returns why peers can't be the Peers of the config.
+func checkConfigPeers(peers []mtypes.PeerInfo) error {
+	NodeIDs := make(map[mtypes.Vertex]bool)
+	PubKeys := make(map[string]bool)
+	for _, peerconf := range peers {
+		if peerconf.NodeID >= mtypes.NodeID_Special {
+			return fmt.Errorf("Peers: NodeID %v is a special NodeID", peerconf.NodeID)
+		}
+		if NodeIDs[peerconf.NodeID] || PubKeys[peerconf.PubKey] {
+			return fmt.Errorf("Peers: NodeID %v or its PubKey appears twice", peerconf.NodeID)
+		}
+		NodeIDs[peerconf.NodeID] = true
+		PubKeys[peerconf.PubKey] = true
+		if _, err := Str2PubKey(peerconf.PubKey); err != nil {
+			return fmt.Errorf("Peers: PubKey of %v: %v", peerconf.NodeID, err)
+		}
+		if peerconf.PSKey != "" {
+			if _, err := Str2PSKey(peerconf.PSKey); err != nil {
+				return fmt.Errorf("Peers: PSKey of %v: %v", peerconf.NodeID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AddConfigPeer adds a peer of the Peers of the config.
+func (device *Device) AddConfigPeer(peerconf mtypes.PeerInfo) error {
+	pk, err := Str2PubKey(peerconf.PubKey)
+	if err != nil {
+		return err
+	}
+	peer, err := device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive)
+	if err != nil {
+		return err
+	}
+	if peerconf.PSKey != "" {
+		psk, err := Str2PSKey(peerconf.PSKey)
+		if err != nil {
+			return err
+		}
+		peer.SetPSK(psk)
+	}
+	if peerconf.EndPoint != "" {
+		err = peer.SetEndpointFromConnURL(peerconf.EndPoint, device.enabledAf, device.EdgeConfig().AfPrefer, peerconf.Static)
+		if err != nil {
+			return fmt.Errorf("failed to set endpoint %v: %v", peerconf.EndPoint, err)
+		}
+	}
+	return nil
+}
+
+// updateConfigPeer applies the changes from oldconf to newconf of a peer of the config.
+func (device *Device) updateConfigPeer(peer *Peer, oldconf mtypes.PeerInfo, newconf mtypes.PeerInfo) error {
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, newconf.PersistentKeepalive)
+	if newconf.PSKey != oldconf.PSKey {
+		var psk NoisePresharedKey
+		if newconf.PSKey != "" {
+			psk, _ = Str2PSKey(newconf.PSKey)
+		}
+		peer.SetPSK(psk)
+	}
+	if newconf.EndPoint != "" && (newconf.EndPoint != oldconf.EndPoint || newconf.Static != oldconf.Static) {
+		err := peer.SetEndpointFromConnURL(newconf.EndPoint, device.enabledAf, device.EdgeConfig().AfPrefer, newconf.Static)
+		if err != nil {
+			return fmt.Errorf("failed to set endpoint %v: %v", newconf.EndPoint, err)
+		}
+	}
+	return nil
+}
+
+// checkConfigTimers returns why the timers of the config can't be used.
+func checkConfigTimers(conf *mtypes.EdgeConfig) error {
+	if conf.DynamicRoute.P2P.UseP2P && conf.DynamicRoute.P2P.SendPeerInterval <= 0 {
+		return errors.New("DynamicRoute.P2P.SendPeerInterval must > 0")
+	}
+	if conf.DynamicRoute.P2P.UseP2P || conf.DynamicRoute.SuperNode.UseSuperNode {
+		if conf.DynamicRoute.TimeoutCheckInterval <= 0 {
+			return errors.New("DynamicRoute.TimeoutCheckInterval must > 0")
+		}
+		if conf.DynamicRoute.ConnNextTry <= 0 {
+			return errors.New("DynamicRoute.ConnNextTry must > 0")
+		}
+	}
+	return nil
+}
+
+// reloadPeers adds, removes and updates the peers of the config from oldpeers to newpeers, and returns the
+// peers of the config which are applied. Peers which aren't in oldpeers, from the supernode or learned in
+// P2P mode, are left alone.
+func (device *Device) reloadPeers(oldpeers []mtypes.PeerInfo, newpeers []mtypes.PeerInfo) (applied []mtypes.PeerInfo, err error) {
+	olds := make(map[string]mtypes.PeerInfo)
+	for _, peerconf := range oldpeers {
+		olds[peerconf.PubKey] = peerconf
+	}
+	news := make(map[string]bool)
+	for _, peerconf := range newpeers {
+		news[peerconf.PubKey] = true
+	}
+	for _, peerconf := range oldpeers {
+		if !news[peerconf.PubKey] {
+			pk, _ := Str2PubKey(peerconf.PubKey)
+			device.RemovePeer(pk)
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peerconf.NodeID.ToString()}, "Reload: peer removed")
+			}
+		}
+	}
+	var errs []error
+	for _, peerconf := range newpeers {
+		pk, _ := Str2PubKey(peerconf.PubKey)
+		peer := device.LookupPeer(pk)
+		if peer != nil && peer.ID != peerconf.NodeID {
+			device.RemovePeer(pk)
+			peer = nil
+		}
+		if peer == nil {
+			if err := device.AddConfigPeer(peerconf); err != nil {
+				// AddConfigPeer may fail after the peer is created
+				device.RemovePeer(pk)
+				errs = append(errs, fmt.Errorf("peer %v: %v", peerconf.NodeID, err))
+				continue
+			}
+			applied = append(applied, peerconf)
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peerconf.NodeID.ToString()}, "Reload: peer added")
+			}
+			continue
+		}
+		if oldconf := olds[peerconf.PubKey]; oldconf != peerconf {
+			if err := device.updateConfigPeer(peer, oldconf, peerconf); err != nil {
+				errs = append(errs, fmt.Errorf("peer %v: %v", peerconf.NodeID, err))
+				// the endpoint is the only change which fails, and it is kept
+				peerconf.EndPoint, peerconf.Static = oldconf.EndPoint, oldconf.Static
+				applied = append(applied, peerconf)
+				continue
+			}
+			if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peerconf.NodeID.ToString()}, "Reload: peer updated")
+			}
+		}
+		applied = append(applied, peerconf)
+	}
+	return applied, errors.Join(errs...)
+}
+
+// ReloadConfig reads the config file again and applies the changes without a restart.
+func (device *Device) ReloadConfig() error {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	return device.reloadConfig()
+}
+
+func (device *Device) reloadConfig() error {
+	if device.IsSuperNode {
+		return errors.New("reload is only supported by edges")
+	}
+	var newconf mtypes.EdgeConfig
+	err := mtypes.ReadYaml(device.EdgeConfigPath, &newconf)
+	if err != nil {
+		return err
+	}
+	return device.ApplyConfig(&newconf)
+}
+
+// ApplyConfig applies the changes of newconf to the running edge, or refuses it if it changes fields which take a restart.
+func (device *Device) ApplyConfig(newconf *mtypes.EdgeConfig) error {
+	oldconf := device.EdgeConfig()
+	if fields := restartFields(oldconf, newconf); len(fields) > 0 {
+		return fmt.Errorf("these fields take a restart: %v", strings.Join(fields, ", "))
+	}
+	if newconf.DefaultTTL <= 0 {
+		return errors.New("DefaultTTL must > 0")
+	}
+	if err := checkConfigTimers(newconf); err != nil {
+		return err
+	}
+	if err := checkConfigPeers(newconf.Peers); err != nil {
+		return err
+	}
+	if err := device.slog.SetLevels(newconf.LogLevel); err != nil {
+		return err
+	}
+	if !newconf.DynamicRoute.P2P.UseP2P && !newconf.DynamicRoute.SuperNode.UseSuperNode {
+		device.slog.SetLevel(mtypes.LogCatNTP, mtypes.LogLevelError) // NTP in static mode is useless, same as at startup
+	}
+
+	// newconf records what is applied, the config keeps the old values of the changes which failed
+	var errs []error
+	if newconf.ListenPort != oldconf.ListenPort {
+		if err := device.handleDeviceLine("listen_port", fmt.Sprint(newconf.ListenPort)); err != nil {
+			errs = append(errs, err)
+			newconf.ListenPort = oldconf.ListenPort
+		}
+	}
+	if newconf.FwMark != oldconf.FwMark {
+		if err := device.handleDeviceLine("fwmark", fmt.Sprint(newconf.FwMark)); err != nil {
+			errs = append(errs, err)
+			newconf.FwMark = oldconf.FwMark
+		}
+	}
+	applied, err := device.reloadPeers(oldconf.Peers, newconf.Peers)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	newconf.Peers = applied
+	UseSuperNode := oldconf.DynamicRoute.SuperNode.UseSuperNode
+	if !reflect.DeepEqual(newconf.NextHopTable, oldconf.NextHopTable) && !UseSuperNode && !oldconf.DynamicRoute.P2P.UseP2P {
+		device.graph.SetNHTable(newconf.NextHopTable)
+	}
+	if !UseSuperNode {
+		device.SuperConfig.DampingFilterRadius = newconf.DynamicRoute.DampingFilterRadius
+	}
+	device.updateEdgeConfig(func(econfig *mtypes.EdgeConfig) error {
+		if UseSuperNode {
+			// the supernode decides these
+			newconf.DynamicRoute.SendPingInterval = econfig.DynamicRoute.SendPingInterval
+			newconf.DynamicRoute.PeerAliveTimeout = econfig.DynamicRoute.PeerAliveTimeout
+			newconf.DynamicRoute.AdditionalCost = econfig.DynamicRoute.AdditionalCost
+		}
+		reloadableFields(econfig, newconf)
+		return nil
+	})
+	if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		device.slog.Infof(mtypes.LogCatControl, nil, "Reloaded config from %v", device.EdgeConfigPath)
+	}
+	return errors.Join(errs...)
+}
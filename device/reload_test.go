@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func newReloadTestConf() mtypes.EdgeConfig {
+	var conf mtypes.EdgeConfig
+	conf.Interface.IType = "dummy"
+	conf.NodeID = 1
+	conf.NodeName = "Node01"
+	conf.DefaultTTL = 200
+	conf.L2FIBTimeout = 3600
+	conf.DynamicRoute.SendPingInterval = 16
+	conf.DynamicRoute.PeerAliveTimeout = 70
+	conf.DynamicRoute.AdditionalCost = 10
+	return conf
+}
+
+func TestRestartFields(t *testing.T) {
+	oldconf := newReloadTestConf()
+	newconf := newReloadTestConf()
+	newconf.L2FIBTimeout = 60
+	newconf.LogLevel.LogLevel = "info"
+	newconf.DynamicRoute.SendPingInterval = 5
+	newconf.NextHopTable = mtypes.NextHopTable{1: {2: 2}}
+	newconf.Peers = []mtypes.PeerInfo{{NodeID: 2, PubKey: "x"}}
+	if fields := restartFields(&oldconf, &newconf); len(fields) != 0 {
+		t.Errorf("reloadable fields take a restart: %v", fields)
+	}
+
+	newconf.Interface.IType = "tap"
+	newconf.LogLevel.LogFormat = "json"
+	newconf.DynamicRoute.P2P.UseP2P = true
+	want := []string{"Interface.IType", "LogLevel.LogFormat", "DynamicRoute.P2P.UseP2P"}
+	if fields := restartFields(&oldconf, &newconf); !reflect.DeepEqual(fields, want) {
+		t.Errorf("restartFields = %v, want %v", fields, want)
+	}
+}
+
+func TestCheckConfigPeers(t *testing.T) {
+	_, pk1 := RandomKeyPair()
+	_, pk2 := RandomKeyPair()
+	peers := []mtypes.PeerInfo{
+		{NodeID: 2, PubKey: pk1.ToString(), PSKey: RandomPSK().ToString()},
+		{NodeID: 3, PubKey: pk2.ToString()},
+	}
+	if err := checkConfigPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []mtypes.PeerInfo{
+		{NodeID: 2, PubKey: pk2.ToString()},
+		{NodeID: 4, PubKey: pk1.ToString()},
+		{NodeID: 4, PubKey: "x"},
+		{NodeID: 4, PubKey: RandomPSK().ToString(), PSKey: "x"},
+		{NodeID: mtypes.NodeID_SuperNode, PubKey: RandomPSK().ToString()},
+	} {
+		if checkConfigPeers(append(peers, bad)) == nil {
+			t.Errorf("peer %v accepted", bad)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	oldconf := newReloadTestConf()
+	device := &Device{
+		SuperConfig: &mtypes.SuperConfig{},
+		log:         NewLogger(LogLevelSilent, ""),
+	}
+	device.edgeConfig.Store(&oldconf)
+	device.slog, _ = mtypes.NewLoggerWithOutput(oldconf.LogLevel, oldconf.NodeName, oldconf.NodeID, io.Discard)
+
+	newconf := newReloadTestConf()
+	newconf.L2FIBTimeout = 60
+	newconf.DynamicRoute.DampingFilterRadius = 3
+	newconf.LogLevel.LogControl = true
+	newconf.LogLevel.LogNTP = true
+	if err := device.ApplyConfig(&newconf); err != nil {
+		t.Fatal(err)
+	}
+	conf := device.EdgeConfig()
+	if oldconf.L2FIBTimeout != 3600 {
+		t.Error("config written in place, the data path reads it")
+	}
+	if conf.L2FIBTimeout != 60 || device.SuperConfig.DampingFilterRadius != 3 || !device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		t.Error("reloadable fields not applied")
+	}
+	if device.slog.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+		t.Error("NTP logs enabled in static mode")
+	}
+
+	newconf = newReloadTestConf()
+	newconf.DefaultTTL = 100
+	newconf.NodeName = "Node02"
+	if device.ApplyConfig(&newconf) == nil {
+		t.Error("NodeName changed without a restart")
+	}
+	if conf := device.EdgeConfig(); conf.DefaultTTL != 200 || conf.L2FIBTimeout != 60 {
+		t.Error("refused reload applied")
+	}
+
+	// the supernode decides the timers
+	device.updateEdgeConfig(func(econfig *mtypes.EdgeConfig) error {
+		econfig.DynamicRoute.SuperNode.UseSuperNode = true
+		econfig.DynamicRoute.SendPingInterval = 15
+		return nil
+	})
+	newconf = newReloadTestConf()
+	newconf.DynamicRoute.SuperNode.UseSuperNode = true
+	newconf.DynamicRoute.ConnNextTry = 5
+	if device.ApplyConfig(&newconf) == nil {
+		t.Error("TimeoutCheckInterval 0 accepted")
+	}
+	newconf.DynamicRoute.TimeoutCheckInterval = 20
+	newconf.DynamicRoute.ConnNextTry = -1
+	if device.ApplyConfig(&newconf) == nil {
+		t.Error("ConnNextTry -1 accepted")
+	}
+	if conf := device.EdgeConfig(); conf.DynamicRoute.TimeoutCheckInterval != 0 {
+		t.Error("refused reload applied")
+	}
+	newconf.DynamicRoute.ConnNextTry = 5
+	if err := device.ApplyConfig(&newconf); err != nil {
+		t.Fatal(err)
+	}
+	if conf := device.EdgeConfig(); conf.DynamicRoute.SendPingInterval != 15 || conf.DynamicRoute.ConnNextTry != 5 {
+		t.Error("timers of the supernode overwritten")
+	}
+}
+
+func TestApplyConfigConcurrent(t *testing.T) {
+	oldconf := newReloadTestConf()
+	device := &Device{
+		SuperConfig: &mtypes.SuperConfig{},
+		log:         NewLogger(LogLevelSilent, ""),
+	}
+	device.edgeConfig.Store(&oldconf)
+	var err error
+	if device.graph, err = path.NewGraph(3, false, mtypes.GraphRecalculateSetting{StaticMode: true}, mtypes.NTPInfo{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the data path reads the config while it is reloaded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if conf := device.EdgeConfig(); conf.DefaultTTL != 200 && conf.DefaultTTL != 100 || len(conf.NextHopTable[1]) != len(conf.NextHopTable[2]) {
+				t.Errorf("read DefaultTTL %v NextHopTable %v", conf.DefaultTTL, conf.NextHopTable)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		newconf := newReloadTestConf()
+		if i%2 == 0 {
+			newconf.DefaultTTL = 100
+			newconf.NextHopTable = mtypes.NextHopTable{1: {2: 2}, 2: {1: 1}}
+		}
+		if err := device.ApplyConfig(&newconf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -9,9 +9,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -47,9 +45,9 @@ import (
  */
 
 type QueueOutboundElement struct {
-	Type path.Usage
-	TTL  uint8
-	sync.Mutex
+	Type    path.Usage
+	Flags   path.HeaderFlags
+	TTL     uint8
 	buffer  *[MaxMessageSize]byte // slice holding the packet data
 	packet  []byte                // slice of "buffer" (always!)
 	nonce   uint64                // nonce for encryption
@@ -57,11 +55,18 @@ type QueueOutboundElement struct {
 	peer    *Peer                 // related peer
 }
 
+// A QueueOutboundElementsContainer holds the staged packets of a peer sent in one batch.
+// The encryption workers unlock it when every packet is encrypted.
+type QueueOutboundElementsContainer struct {
+	sync.Mutex
+	elems []*QueueOutboundElement
+}
+
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem := device.GetOutboundElement()
 	elem.buffer = device.GetMessageBuffer()
-	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
+	elem.Flags = 0
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -175,11 +180,11 @@ func (peer *Peer) SendHandshakeResponse() error {
 	return err
 }
 
-func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
+func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement, checker *CookieChecker) error {
 	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	reply, err := checker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
@@ -188,7 +193,7 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	device.net.bind.Send([][]byte{writer.Bytes()}, initiatingElem.endpoint)
 	return nil
 }
 
@@ -203,27 +208,112 @@ func (peer *Peer) keepKeyFreshSending() {
 	}
 }
 
+// tunReader reads one queue of the TUN, a batch at a time if the device supports it
+type tunReader struct {
+	device *Device
+	queue  int
+	batch  tap.BatchDevice // nil if the device reads a single frame at a time
+	elems  []*QueueOutboundElement
+	bufs   [][]byte
+	sizes  []int
+	next   int // next element of elems to hand out
+	count  int // elements read into elems
+}
+
+func (device *Device) newTUNReader(queue int) *tunReader {
+	r := &tunReader{
+		device: device,
+		queue:  queue,
+	}
+	if batch, ok := device.tap.device.(tap.BatchDevice); ok {
+		r.batch = batch
+		r.elems = make([]*QueueOutboundElement, batch.BatchSize())
+		r.bufs = make([][]byte, batch.BatchSize())
+		r.sizes = make([]int, batch.BatchSize())
+	}
+	return r
+}
+
+// Read returns the next frame at offset of elem.buffer, reading another batch from the TUN once all are handed out.
+// A frame of size 0 is to be skipped.
+func (r *tunReader) Read(offset int) (elem *QueueOutboundElement, size int, err error) {
+	if r.batch == nil {
+		elem = r.device.NewOutboundElement()
+		size, err = r.device.tap.device.Read(elem.buffer[:], offset)
+		return
+	}
+	for r.next == r.count {
+		for i := range r.elems {
+			if r.elems[i] == nil {
+				r.elems[i] = r.device.NewOutboundElement()
+			}
+			r.bufs[i] = r.elems[i].buffer[:]
+		}
+		r.next = 0
+		r.count, err = r.batch.ReadBatch(r.queue, r.bufs, r.sizes, offset)
+		if errors.Is(err, tap.ErrTooManySegments) {
+			if r.device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+				r.device.slog.Infof(mtypes.LogCatNormal, nil, "Invalid packet: TSO frame splits into more than %v segments", len(r.bufs))
+			}
+			r.count, err = 0, nil
+			continue
+		}
+		if err != nil {
+			r.count = 0
+			elem = r.elems[0]
+			r.elems[0] = nil
+			return
+		}
+	}
+	elem, size = r.elems[r.next], r.sizes[r.next]
+	r.elems[r.next] = nil
+	r.next++
+	return
+}
+
+// Close returns the elements that were not handed out
+func (r *tunReader) Close() {
+	for i, elem := range r.elems {
+		if elem != nil {
+			r.device.PutMessageBuffer(elem.buffer)
+			r.device.PutOutboundElement(elem)
+			r.elems[i] = nil
+		}
+	}
+}
+
 /* Reads packets from the TUN and inserts
  * into staged queue for peer
  *
- * Obs. Single instance per TUN device
+ * Obs. Single instance per TUN device queue
  */
-func (device *Device) RoutineReadFromTUN() {
+func (device *Device) RoutineReadFromTUN(queue int) {
+	reader := device.newTUNReader(queue)
 	defer func() {
-		device.log.Verbosef("Routine: TUN reader - stopped")
+		reader.Close()
+		device.log.Verbosef("Routine: TUN reader %d - stopped", queue)
 		device.state.stopping.Done()
 		device.queue.encryption.wg.Done()
 	}()
 
-	device.log.Verbosef("Routine: TUN reader - started")
+	device.log.Verbosef("Routine: TUN reader %d - started", queue)
 
 	var elem *QueueOutboundElement
+	var compressor *compressor
+	if device.EdgeConfig().Compression.Enabled {
+		var err error
+		compressor, err = newCompressor(device.EdgeConfig().Compression.Level)
+		if err != nil {
+			device.log.Errorf("Compression disabled: %v", err)
+		}
+	}
 
 	for {
-		elem = device.NewOutboundElement()
 		// read packet
 		offset := MessageTransportHeaderSize
-		size, err := device.tap.device.Read(elem.buffer[:], offset+path.EgHeaderLen)
+		var size int
+		var err error
+		elem, size, err = reader.Read(offset + path.EgHeaderLen)
 
 		if err != nil {
 			if !device.isClosed() {
@@ -237,52 +327,120 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || (size+path.EgHeaderLen) > MaxContentSize {
+		if size == 0 || (size+path.EgHeaderLen) > MaxContentSize && !device.EdgeConfig().Fragmentation.Enabled {
 			continue
 		}
 
 		//add custom header dst_node, src_node, ttl
 		size += path.EgHeaderLen
 		elem.packet = elem.buffer[offset : offset+size]
-		EgBody, _ := path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		EgBody, _ := path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		dst_nodeID := EgBody.GetDst()
+		if !device.FilterFromLAN(elem.packet[path.EgHeaderLen:]) {
+			continue
+		}
 		dstMacAddr := tap.GetDstMacAddr(elem.packet[path.EgHeaderLen:])
 		// lookup peer
 		if tap.IsNotUnicast(dstMacAddr) {
 			dst_nodeID = mtypes.NodeID_Broadcast
 		} else if val, ok := device.l2fib.Load(dstMacAddr); !ok { //Lookup failed
 			dst_nodeID = mtypes.NodeID_Broadcast
+		} else if idtime := val.(*IdAndTime); device.Blackholed(idtime) {
+			continue
 		} else {
-			dst_nodeID = val.(*IdAndTime).ID
+			dst_nodeID = idtime.NodeID()
 		}
 		packet_len := len(elem.packet) - path.EgHeaderLen
 		EgBody.SetSrc(device.ID)
 		EgBody.SetDst(dst_nodeID)
 		elem.Type = path.NormalPacket
-		elem.TTL = device.EdgeConfig.DefaultTTL
+		elem.TTL = device.EdgeConfig().DefaultTTL
 		if packet_len <= 12 {
-			if device.LogLevel.LogNormal {
-				fmt.Println("Normal: Invalid packet: Ethernet packet too small." + " Len:" + strconv.Itoa(packet_len))
+			if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+				device.slog.Infof(mtypes.LogCatNormal, nil, "Invalid packet: Ethernet packet too small. Len:%v", packet_len)
 			}
 			continue
 		}
 
 		if dst_nodeID != mtypes.NodeID_Broadcast {
+			fwd := device.forwarding()
 			var peer *Peer
-			next_id := device.graph.Next(device.ID, dst_nodeID)
-			if next_id != mtypes.NodeID_Invalid {
-				device.peers.RLock()
-				peer = device.peers.IDMap[next_id]
-				device.peers.RUnlock()
+			var paths [2][]mtypes.Vertex
+			duplicate := false
+			if device.EdgeConfig().Duplication.Enabled && device.MatchDuplicateRule(elem.packet[path.EgHeaderLen:]) {
+				paths, duplicate = device.DuplicatePaths(dst_nodeID)
+			}
+			supports := func(features mtypes.Features) bool {
+				if duplicate {
+					return device.RouteSupports(paths[0], features) && device.RouteSupports(paths[1], features)
+				}
+				return device.PathSupports(dst_nodeID, features)
+			}
+			if !duplicate {
+				peer = fwd.next[dst_nodeID]
 				if peer == nil {
 					continue
 				}
-				device.chan_send_packet <- &packet_send_params{
-					peer: peer,
-					elem: elem,
+			}
+			if supports(mtypes.FeatureCompression) {
+				device.CompressTo(compressor, elem, dst_nodeID)
+			}
+			if device.E2EEnabled(dst_nodeID) {
+				// never fall back to a frame transit nodes can read
+				if !supports(E2EFeatures) {
+					device.e2eDropped(dst_nodeID, errE2EUnsupported)
+					continue
 				}
+				if err := device.EncryptPacket(elem, dst_nodeID); err != nil {
+					device.e2eDropped(dst_nodeID, err)
+					continue
+				}
+			} else if device.EdgeConfig().SourceAuth.DataFrames && supports(SourceAuthFeatures) {
+				elem.Flags, elem.packet = device.AuthenticatePacket(elem.Type, elem.Flags, elem.packet, []mtypes.Vertex{dst_nodeID})
 			}
-		} else {
+			var fragments [][]byte
+			if device.EdgeConfig().Fragmentation.Enabled && supports(mtypes.FeatureFragment) {
+				extra := 0
+				if duplicate {
+					extra = DupHeaderLen(len(paths[0]) - 1)
+					if len(paths[1]) > len(paths[0]) {
+						extra = DupHeaderLen(len(paths[1]) - 1)
+					}
+				}
+				if elem.Flags&^path.HeaderFlagsMask != 0 {
+					extra += path.ExtHeaderMinLen
+				}
+				fragments = device.Fragment(elem.packet, device.FragmentSize(extra))
+			}
+			if fragments == nil && len(elem.packet) > MaxContentSize {
+				if device.slog.Enabled(mtypes.LogCatNormal, mtypes.LogLevelInfo) {
+					device.slog.Infof(mtypes.LogCatNormal, mtypes.LogFields{"dst": dst_nodeID.ToString()}, "Invalid packet: Ethernet packet too large. Len:%v", packet_len)
+				}
+				continue
+			}
+			if fragments == nil && !duplicate && elem.Flags&^path.HeaderFlagsMask == 0 {
+				device.enqueueSendPacket(peer, elem)
+				continue
+			}
+			flags := elem.Flags
+			if fragments == nil {
+				fragments = [][]byte{elem.packet}
+			} else {
+				flags |= path.FlagFragment
+				if dst_peer := fwd.peers[dst_nodeID]; dst_peer != nil {
+					atomic.AddUint64(&dst_peer.stats.fragSent, 1)
+				}
+			}
+			for _, fragment := range fragments {
+				if duplicate {
+					device.SendDuplicated(elem.Type, flags, elem.TTL, fragment, paths)
+				} else {
+					device.SendPacketFlags(peer, elem.Type, flags, elem.TTL, fragment, MessageTransportOffsetContent)
+				}
+			}
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		} else if len(elem.packet) <= MaxContentSize && !device.LoopBlocking() {
 			device.BoardcastPacket(make(map[mtypes.Vertex]bool, 0), elem.Type, elem.TTL, elem.packet, offset)
 		}
 
@@ -317,29 +475,48 @@ top:
 		return
 	}
 
+	batchSize := peer.device.BatchSize()
 	for {
-		select {
-		case elem := <-peer.queue.staged:
-			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
-			if elem.nonce >= RejectAfterMessages {
-				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
-				peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
-				goto top
+		elemsContainer := peer.device.GetOutboundElementsContainer()
+		rejected := false
+	collect:
+		for len(elemsContainer.elems) < batchSize {
+			select {
+			case elem := <-peer.queue.staged:
+				elem.peer = peer
+				elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+				if elem.nonce >= RejectAfterMessages {
+					atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+					peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
+					rejected = true
+					break collect
+				}
+				elem.keypair = keypair
+				elemsContainer.elems = append(elemsContainer.elems, elem)
+			default:
+				break collect
 			}
+		}
 
-			elem.keypair = keypair
-			elem.Lock()
-
+		if len(elemsContainer.elems) == 0 {
+			peer.device.PutOutboundElementsContainer(elemsContainer)
+		} else if peer.isRunning.Get() {
 			// add to parallel and sequential queue
-			if peer.isRunning.Get() {
-				peer.queue.outbound.c <- elem
-				peer.device.queue.encryption.c <- elem
-			} else {
+			elemsContainer.Lock()
+			peer.queue.outbound.c <- elemsContainer
+			peer.device.queue.encryption.c <- elemsContainer
+		} else {
+			for _, elem := range elemsContainer.elems {
 				peer.device.PutMessageBuffer(elem.buffer)
 				peer.device.PutOutboundElement(elem)
 			}
-		default:
+			peer.device.PutOutboundElementsContainer(elemsContainer)
+		}
+
+		if rejected {
+			goto top
+		}
+		if len(peer.queue.staged) == 0 {
 			return
 		}
 	}
@@ -385,32 +562,34 @@ func (device *Device) RoutineEncryption(id int) {
 	defer device.log.Verbosef("Routine: encryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
-	for elem := range device.queue.encryption.c {
-		// populate header fields
-		header := elem.buffer[:MessageTransportHeaderSize]
+	for elemsContainer := range device.queue.encryption.c {
+		for _, elem := range elemsContainer.elems {
+			// populate header fields
+			header := elem.buffer[:MessageTransportHeaderSize]
 
-		fieldReceiver := header[MessageTransportOffsetReceiver:MessageTransportOffsetCounter]
-		fieldNonce := header[MessageTransportOffsetCounter:MessageTransportHeaderSize]
+			fieldReceiver := header[MessageTransportOffsetReceiver:MessageTransportOffsetCounter]
+			fieldNonce := header[MessageTransportOffsetCounter:MessageTransportHeaderSize]
 
-		header[0] = uint8(elem.Type)
-		header[1] = uint8(elem.TTL)
-		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
-		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
+			header[0] = path.JoinUsageFlags(elem.Type, elem.Flags)
+			header[1] = uint8(elem.TTL)
+			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
+			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-		// pad content to multiple of 16
-		paddingSize := calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&device.tap.mtu)))
-		elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
+			// pad content to multiple of 16
+			paddingSize := calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&device.tap.mtu)))
+			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
 
-		// encrypt content and release to consumer
+			// encrypt content and release to consumer
 
-		binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
-		elem.packet = elem.keypair.send.Seal(
-			header,
-			nonce[:],
-			elem.packet,
-			nil,
-		)
-		elem.Unlock()
+			binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
+			elem.packet = elem.keypair.send.Seal(
+				header,
+				nonce[:],
+				elem.packet,
+				nil,
+			)
+		}
+		elemsContainer.Unlock()
 	}
 }
 
@@ -427,36 +606,55 @@ func (peer *Peer) RoutineSequentialSender() {
 	}()
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
 
-	for elem := range peer.queue.outbound.c {
-		if elem == nil {
+	bufs := make([][]byte, 0, device.BatchSize())
+
+	for elemsContainer := range peer.queue.outbound.c {
+		bufs = bufs[:0]
+		if elemsContainer == nil {
 			return
 		}
-		elem.Lock()
+		elemsContainer.Lock()
 		if !peer.isRunning.Get() {
 			// peer has been stopped; return re-usable elems to the shared pool.
 			// This is an optimization only. It is possible for the peer to be stopped
 			// immediately after this check, in which case, elem will get processed.
-			// The timers and SendBuffer code are resilient to a few stragglers.
+			// The timers and SendBuffers code are resilient to a few stragglers.
 			// TODO: rework peer shutdown order to ensure
 			// that we never accidentally keep timers alive longer than necessary.
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+			for _, elem := range elemsContainer.elems {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			device.PutOutboundElementsContainer(elemsContainer)
 			continue
 		}
+		dataSent := false
+		for _, elem := range elemsContainer.elems {
+			if len(elem.packet) != MessageKeepaliveSize {
+				dataSent = true
+			}
+			bufs = append(bufs, elem.packet)
+		}
 
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
 
-		// send message and return buffer to pool
+		// send messages and return buffers to pool
 
-		err := peer.SendBuffer(elem.packet)
-		if len(elem.packet) != MessageKeepaliveSize {
+		err := peer.SendBuffers(bufs)
+		if dataSent {
 			peer.timersDataSent()
 		}
-		device.PutMessageBuffer(elem.buffer)
-		device.PutOutboundElement(elem)
+		for _, elem := range elemsContainer.elems {
+			if err == nil {
+				peer.FECSent(elem.packet)
+			}
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		}
+		device.PutOutboundElementsContainer(elemsContainer)
 		if err != nil {
-			device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+			device.log.Errorf("%v - Failed to send data packets: %v", peer, err)
 			continue
 		}
 
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// newSendTestDevice is node 1 with established sessions to nodes 2 and up.
+// Packets that reach the encryption queue are counted and dropped.
+func newSendTestDevice(tb testing.TB, peers int) (device *Device, peerList []*Peer, queued *uint64) {
+	graph, err := path.NewGraph(peers+1, false, mtypes.GraphRecalculateSetting{StaticMode: true}, mtypes.NTPInfo{}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	device = &Device{
+		ID:     1,
+		log:    NewLogger(LogLevelError, ""),
+		graph:  graph,
+		closed: make(chan int),
+	}
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	device.state.state = uint32(deviceStateUp)
+	binds := bindtest.NewChannelBinds()
+	device.net.bind = binds[0]
+	device.PopulatePools()
+	device.queue.encryption = &outboundQueue{c: make(chan *QueueOutboundElementsContainer, QueueOutboundSize)}
+	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
+	device.startSendPipeline()
+
+	endpoint, _ := binds[0].ParseEndpoint("127.0.0.1:1")
+	nhTable := mtypes.NextHopTable{1: {}}
+	for i := 0; i < peers; i++ {
+		peer := &Peer{device: device, ID: mtypes.Vertex(i + 2), endpoint: endpoint}
+		peer.isRunning.Set(true)
+		peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+		peer.queue.outbound = &autodrainingOutboundQueue{c: make(chan *QueueOutboundElementsContainer, QueueOutboundSize)}
+		peer.keypairs.current = &Keypair{created: time.Now()}
+		go func() {
+			for range peer.queue.outbound.c {
+			}
+		}()
+		device.peers.IDMap[peer.ID] = peer
+		nhTable[1][peer.ID] = peer.ID
+		peerList = append(peerList, peer)
+	}
+	graph.SetNHTable(nhTable)
+
+	queued = new(uint64)
+	go func() {
+		for elemsContainer := range device.queue.encryption.c {
+			atomic.AddUint64(queued, uint64(len(elemsContainer.elems)))
+			for _, elem := range elemsContainer.elems {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			device.PutOutboundElementsContainer(elemsContainer)
+		}
+	}()
+	return
+}
+
+func waitQueued(tb testing.TB, queued *uint64, want uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(queued) < want {
+		if time.Now().After(deadline) {
+			tb.Fatalf("queued %d of %d packets", atomic.LoadUint64(queued), want)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestSendPipeline(t *testing.T) {
+	const packets = 5000
+	device, peers, queued := newSendTestDevice(t, 4)
+	packet := make([]byte, path.EgHeaderLen+100)
+	for i := 0; i < packets; i++ {
+		device.SendPacket(peers[i%len(peers)], path.NormalPacket, 1, packet, MessageTransportOffsetContent)
+	}
+	device.BoardcastPacket(map[mtypes.Vertex]bool{peers[0].ID: true}, path.NormalPacket, 1, packet, MessageTransportOffsetContent)
+	waitQueued(t, queued, packets+uint64(len(peers)-1))
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadUint64(queued); got != packets+uint64(len(peers)-1) {
+		t.Fatalf("queued %d packets, want %d", got, packets+len(peers)-1)
+	}
+}
+
+func TestSendPacketExt(t *testing.T) {
+	device, peers, queued := newSendTestDevice(t, 1)
+	packet := []byte{0, 2, 0, 1, 'e', 'x', 't', 'e', 'n', 'd', 'e', 'd'}
+	ext := path.ExtHeader{Flags: path.FlagCompressed, Options: []path.ExtOption{{Type: 5, Value: []byte{1, 2}}}}
+	device.SendPacketExt(peers[0], path.NormalPacket, ext, 1, packet, MessageTransportOffsetContent)
+	device.SetNodeFeatures(peers[0].ID, mtypes.FeatureExtHeader)
+	device.SendPacketExt(peers[0], path.NormalPacket, ext, 1, packet, MessageTransportOffsetContent)
+	waitQueued(t, queued, 1)
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadUint64(queued); got != 1 {
+		t.Fatalf("queued %d packets, want only the one to the peer supporting the ExtHeader", got)
+	}
+
+	buf := make([]byte, len(packet)+ext.Len())
+	ext.Insert(buf, packet)
+	elem := &QueueInboundElement{packet: buf, Flags: path.FlagExtended}
+	if err := device.StripExtHeader(elem); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(elem.packet, packet) || elem.Flags != path.FlagCompressed {
+		t.Errorf("stripped %x flags %v, want %x flags %v", elem.packet, elem.Flags, packet, path.FlagCompressed)
+	}
+	if &elem.packet[0] != &buf[0] {
+		t.Error("packet moved in its buffer")
+	}
+}
+
+func BenchmarkSendPacket(b *testing.B) {
+	device, peers, queued := newSendTestDevice(b, 8)
+	packet := make([]byte, path.EgHeaderLen+1400)
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			device.SendPacket(peers[i%len(peers)], path.NormalPacket, 1, packet, MessageTransportOffsetContent)
+			i++
+		}
+	})
+	waitQueued(b, queued, uint64(b.N))
+}
+
+func BenchmarkBoardcastPacket(b *testing.B) {
+	device, peers, queued := newSendTestDevice(b, 8)
+	packet := make([]byte, path.EgHeaderLen+1400)
+	skip := map[mtypes.Vertex]bool{}
+	b.SetBytes(int64(len(packet) * len(peers)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			device.BoardcastPacket(skip, path.NormalPacket, 1, packet, MessageTransportOffsetContent)
+		}
+	})
+	waitQueued(b, queued, uint64(b.N*len(peers)))
+}
+
+func TestSendPipelineClose(t *testing.T) {
+	device, peers, _ := newSendTestDevice(t, 4)
+	device.pool.outboundElements = NewWaitPool(1<<20, func() interface{} { return new(QueueOutboundElement) })
+	atomic.StoreUint32(&device.state.state, uint32(deviceStateClosed))
+	close(device.closed)
+	time.Sleep(10 * time.Millisecond)
+
+	// packets sent while the device closes go back to the pools, wherever they are queued
+	packet := make([]byte, path.EgHeaderLen+100)
+	for i := 0; i < 100; i++ {
+		device.SendPacket(peers[i%len(peers)], path.NormalPacket, 1, packet, MessageTransportOffsetContent)
+	}
+	for shard, queue := range device.chan_send_packet {
+		if len(queue) != 0 {
+			t.Errorf("%v packets left in the queue of shard %v", len(queue), shard)
+		}
+	}
+	if count := atomic.LoadUint32(&device.pool.outboundElements.count); count != 0 {
+		t.Errorf("%v elements not returned to the pool", count)
+	}
+}
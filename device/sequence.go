@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Broadcast and spread packets may reach a node over more than one path.
+// The source numbers them in a SeqHeader after the EgHeader, and every node keeps
+// a sliding window per source, so that it forwards and receives each packet once.
+// Packets from nodes without FeatureSequence fall back to the hash based CheckNoDup.
+
+const (
+	SeqHeaderOffsetSession = 0
+	SeqHeaderOffsetSeq     = 8
+	SeqHeaderLen           = 16
+)
+
+type seqState struct {
+	session uint64 // see newSession, so that other nodes reset their filter and drop the packets of older starts
+
+	sendLock sync.Mutex
+	seq      uint64
+
+	recvLock sync.Mutex
+	filters  map[mtypes.Vertex]*sessionFilter
+}
+
+// NetworkSupports reports whether every node we can reach supports the features.
+// Broadcast and spread packets may pass any of them.
+func (device *Device) NetworkSupports(features mtypes.Features) bool {
+	fwd := device.forwarding()
+	for id := range fwd.next {
+		if !device.NodeFeatures(id).Has(features) {
+			return false
+		}
+	}
+	for id := range fwd.peers {
+		if !device.NodeFeatures(id).Has(features) {
+			return false
+		}
+	}
+	return true
+}
+
+// SequencePacket numbers a broadcast or spread packet we originate.
+// The sequenced packet is a new slice, packet itself is never written.
+// The packet is returned unchanged if a node doesn't support it or it would get too large.
+func (device *Device) SequencePacket(flags path.HeaderFlags, packet []byte) (path.HeaderFlags, []byte) {
+	if flags.Has(path.FlagSequenced) || len(packet) < path.EgHeaderLen || len(packet)+SeqHeaderLen > MaxContentSize {
+		return flags, packet
+	}
+	EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+	if EgHeader.GetSrc() != device.ID || (EgHeader.GetDst() != mtypes.NodeID_Broadcast && EgHeader.GetDst() != mtypes.NodeID_Spread) {
+		return flags, packet
+	}
+	if !device.NetworkSupports(mtypes.FeatureSequence) {
+		return flags, packet
+	}
+	device.seq.sendLock.Lock()
+	seq := device.seq.seq
+	device.seq.seq++
+	device.seq.sendLock.Unlock()
+
+	sequenced := make([]byte, len(packet)+SeqHeaderLen)
+	copy(sequenced, packet[:path.EgHeaderLen])
+	copy(sequenced[path.EgHeaderLen+SeqHeaderLen:], packet[path.EgHeaderLen:])
+	header := sequenced[path.EgHeaderLen : path.EgHeaderLen+SeqHeaderLen]
+	binary.LittleEndian.PutUint64(header[SeqHeaderOffsetSession:SeqHeaderOffsetSeq], device.seq.session)
+	binary.LittleEndian.PutUint64(header[SeqHeaderOffsetSeq:], seq)
+	return flags | path.FlagSequenced, sequenced
+}
+
+// CheckSequence reports whether a sequenced packet from src_nodeID is seen for the first time.
+func (device *Device) CheckSequence(src_nodeID mtypes.Vertex, packet []byte) bool {
+	if src_nodeID == device.ID || len(packet) < path.EgHeaderLen+SeqHeaderLen {
+		return false
+	}
+	header := packet[path.EgHeaderLen : path.EgHeaderLen+SeqHeaderLen]
+	session := binary.LittleEndian.Uint64(header[SeqHeaderOffsetSession:SeqHeaderOffsetSeq])
+	seq := binary.LittleEndian.Uint64(header[SeqHeaderOffsetSeq:])
+
+	device.seq.recvLock.Lock()
+	defer device.seq.recvLock.Unlock()
+	if device.seq.filters == nil {
+		device.seq.filters = make(map[mtypes.Vertex]*sessionFilter)
+	}
+	f, ok := device.seq.filters[src_nodeID]
+	if !ok {
+		f = &sessionFilter{}
+		device.seq.filters[src_nodeID] = f
+	}
+	return f.validate(session, seq)
+}
+
+// StripSequence removes the SeqHeader, after the packet has been checked and forwarded.
+func (device *Device) StripSequence(elem *QueueInboundElement) {
+	copy(elem.packet[path.EgHeaderLen:], elem.packet[path.EgHeaderLen+SeqHeaderLen:])
+	elem.packet = elem.packet[:len(elem.packet)-SeqHeaderLen]
+	elem.Flags &^= path.FlagSequenced
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func broadcastPacket(src, dst mtypes.Vertex, body []byte) []byte {
+	packet := make([]byte, path.EgHeaderLen, path.EgHeaderLen+len(body)+SeqHeaderLen)
+	EgHeader, _ := path.NewEgHeader(packet, DefaultMTU)
+	EgHeader.SetSrc(src)
+	EgHeader.SetDst(dst)
+	return append(packet, body...)
+}
+
+func TestSequencePacket(t *testing.T) {
+	device := newForwardTestDevice(t)
+	device.edgeConfig.Store(&mtypes.EdgeConfig{})
+	device.seq.session = 42
+	body := []byte("broadcast body")
+
+	flags, packet := device.SequencePacket(0, broadcastPacket(2, mtypes.NodeID_Broadcast, body))
+	if flags != 0 {
+		t.Fatal("sequenced although no other node supports it")
+	}
+	device.SetNodeFeatures(1, mtypes.FeatureSequence)
+	device.SetNodeFeatures(3, mtypes.FeatureSequence)
+	orig := make([]byte, len(packet), len(packet)+SeqHeaderLen)
+	copy(orig, packet)
+	flags, packet = device.SequencePacket(0, orig)
+	if !bytes.Equal(orig, broadcastPacket(2, mtypes.NodeID_Broadcast, body)) || !bytes.Equal(orig[len(orig):cap(orig)], make([]byte, SeqHeaderLen)) {
+		t.Fatal("SequencePacket wrote to the caller's buffer")
+	}
+	if !flags.Has(path.FlagSequenced) || len(packet) != path.EgHeaderLen+SeqHeaderLen+len(body) {
+		t.Fatalf("flags %v len %v", flags, len(packet))
+	}
+	if !bytes.Equal(packet[path.EgHeaderLen+SeqHeaderLen:], body) || binary.LittleEndian.Uint64(packet[path.EgHeaderLen:]) != 42 {
+		t.Fatalf("bad sequenced packet %x", packet)
+	}
+	if flags, _ := device.SequencePacket(0, broadcastPacket(1, mtypes.NodeID_Broadcast, body)); flags != 0 {
+		t.Error("sequenced a packet in transit")
+	}
+	if flags, _ := device.SequencePacket(0, broadcastPacket(2, 3, body)); flags != 0 {
+		t.Error("sequenced a unicast packet")
+	}
+	_, second := device.SequencePacket(0, broadcastPacket(2, mtypes.NodeID_Spread, body))
+	if seq := binary.LittleEndian.Uint64(second[path.EgHeaderLen+SeqHeaderOffsetSeq:]); seq != 1 {
+		t.Errorf("second packet got seq %v", seq)
+	}
+
+	// node 3 receives our packets
+	receiver := newForwardTestDevice(t)
+	receiver.ID = 3
+	if !receiver.CheckSequence(2, packet) || !receiver.CheckSequence(2, second) {
+		t.Fatal("first copy dropped")
+	}
+	if receiver.CheckSequence(2, packet) || receiver.CheckSequence(2, second) {
+		t.Fatal("second copy accepted")
+	}
+	if device.CheckSequence(2, packet) {
+		t.Error("accepted our own packet")
+	}
+	// we restarted, a delayed packet of the session before doesn't reset the filter again
+	binary.LittleEndian.PutUint64(packet[path.EgHeaderLen:], 43)
+	if !receiver.CheckSequence(2, packet) {
+		t.Error("packet of a new session dropped")
+	}
+	older := append([]byte(nil), second...)
+	if receiver.CheckSequence(2, older) {
+		t.Error("packet of the session before accepted")
+	}
+	if receiver.CheckSequence(2, packet) {
+		t.Error("packet of the new session accepted twice")
+	}
+
+	elem := &QueueInboundElement{packet: packet, Flags: flags}
+	device.StripSequence(elem)
+	if elem.Flags != 0 || !bytes.Equal(elem.packet[path.EgHeaderLen:], body) {
+		t.Errorf("stripped to %x flags %v", elem.packet, elem.Flags)
+	}
+}
@@ -0,0 +1,316 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/replay"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Every transit node decrypts the packets it forwards, so it could change them or forge their source.
+// The source inserts an AuthHeader after the EgHeader of the packets it originates, with a tag for each node
+// meant to receive them. A tag is keyed with a key derived from the PSK of the source and that node,
+// which transit nodes don't know. The SeqHeader, FragHeader and DupHeader are inserted before the AuthHeader,
+// and removed before it is checked. The length excludes the padding which every hop may add.
+//
+//	number of tags (1) | session (8) | counter (8) | length of the body (2) | tags
+//	tag: node ID (2) | blake2s-128 over usage, flags, EgHeader, AuthHeader without the tags and body (16)
+
+const (
+	AuthHeaderOffsetCount   = 0
+	AuthHeaderOffsetSession = 1
+	AuthHeaderOffsetCounter = 9
+	AuthHeaderOffsetLength  = 17
+	AuthHeaderOffsetTags    = 19
+	AuthTagLen              = 2 + blake2s.Size128
+	AuthHeaderMaxTags       = math.MaxUint8
+)
+
+const SourceAuthFeatures = mtypes.FeatureExtHeader | mtypes.FeatureSourceAuth
+
+var sourceAuthLabel = []byte("EtherGuard source authentication")
+
+func AuthHeaderLen(tags int) int {
+	return AuthHeaderOffsetTags + tags*AuthTagLen
+}
+
+type authState struct {
+	session uint64 // see newSession
+
+	sendLock sync.Mutex
+	counter  uint64
+
+	recvLock sync.Mutex
+	filters  map[mtypes.Vertex]*sessionFilter
+}
+
+// sessionFilter drops replayed counters of a node. A session is the time the node started, like the timestamp
+// in a handshake initiation, so the packets of an older session are replays as well.
+type sessionFilter struct {
+	session uint64
+	filter  replay.Filter
+}
+
+// newSession returns the session of a start of this node.
+func newSession() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// validate reports whether counter of session is seen for the first time, and forgets the older session.
+func (f *sessionFilter) validate(session uint64, counter uint64) bool {
+	if session < f.session {
+		return false
+	}
+	if session > f.session {
+		f.session = session
+		f.filter.Reset()
+	}
+	return f.filter.ValidateCounter(counter, math.MaxUint64)
+}
+
+// pairKey derives the key for the label from the PSK we share with the node, if we share one.
+func (device *Device) pairKey(id mtypes.Vertex, label []byte) (key [blake2s.Size]byte, ok bool) {
+	keys := device.pairKeys(id, label)
+	if len(keys) == 0 {
+		return key, false
+	}
+	return keys[0], true
+}
+
+// pairKeys derives the keys for the label we accept from the node: the one of our PSK,
+// and the one of the other PSK we accept while the supernode rotates them.
+func (device *Device) pairKeys(id mtypes.Vertex, label []byte) (keys [][blake2s.Size]byte) {
+	peer := device.forwarding().peers[id]
+	if peer == nil {
+		return nil
+	}
+	peer.handshake.mutex.RLock()
+	psks := []NoisePresharedKey{peer.handshake.presharedKey, peer.handshake.presharedKeyAlt}
+	peer.handshake.mutex.RUnlock()
+	for _, psk := range psks {
+		if psk == (NoisePresharedKey{}) {
+			continue
+		}
+		var key [blake2s.Size]byte
+		mac, _ := blake2s.New256(psk[:])
+		mac.Write(label)
+		mac.Sum(key[:0])
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func sourceAuthTag(key *[blake2s.Size]byte, usage path.Usage, flags path.HeaderFlags, EgHeader []byte, header []byte, body []byte) []byte {
+	mac, _ := blake2s.New128(key[:])
+	mac.Write([]byte{uint8(usage), uint8(flags)})
+	mac.Write(EgHeader)
+	mac.Write(header[:AuthHeaderOffsetTags])
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// AuthenticatePacket inserts an AuthHeader into a packet we originate, with tags for the recipients we share a PSK with.
+// nil recipients are every node, if all of them support SourceAuthFeatures. Otherwise the caller checks that
+// the nodes on the way do. The AuthHeader is inserted in place if packet has the capacity, so its content is changed.
+// The packet is returned unchanged if none of the recipients can verify it.
+func (device *Device) AuthenticatePacket(usage path.Usage, flags path.HeaderFlags, packet []byte, recipients []mtypes.Vertex) (path.HeaderFlags, []byte) {
+	if device.IsSuperNode || !device.EdgeConfig().SourceAuth.Enabled || flags.Has(path.FlagAuthenticated) || len(packet) < path.EgHeaderLen {
+		return flags, packet
+	}
+	EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+	if EgHeader.GetSrc() != device.ID {
+		return flags, packet
+	}
+	if recipients == nil {
+		if !device.NetworkSupports(SourceAuthFeatures) {
+			return flags, packet
+		}
+		for id := range device.forwarding().peers {
+			recipients = append(recipients, id)
+		}
+	}
+	room := (MaxContentSize - path.ExtHeaderMinLen - SeqHeaderLen - len(packet) - AuthHeaderLen(0)) / AuthTagLen
+	if room > AuthHeaderMaxTags {
+		room = AuthHeaderMaxTags
+	}
+	ids := make([]mtypes.Vertex, 0, len(recipients))
+	keys := make([][blake2s.Size]byte, 0, len(recipients))
+	for _, id := range recipients {
+		if len(ids) >= room {
+			break
+		}
+		if id == device.ID || !device.NodeFeatures(id).Has(SourceAuthFeatures) {
+			continue
+		}
+		if key, ok := device.pairKey(id, sourceAuthLabel); ok {
+			ids = append(ids, id)
+			keys = append(keys, key)
+		}
+	}
+	if len(ids) == 0 {
+		return flags, packet
+	}
+	device.auth.sendLock.Lock()
+	counter := device.auth.counter
+	device.auth.counter++
+	device.auth.sendLock.Unlock()
+
+	flags |= path.FlagAuthenticated
+	size := len(packet)
+	headerLen := AuthHeaderLen(len(ids))
+	packet = append(packet, make([]byte, headerLen)...)
+	copy(packet[path.EgHeaderLen+headerLen:], packet[path.EgHeaderLen:size])
+	header := packet[path.EgHeaderLen : path.EgHeaderLen+headerLen]
+	body := packet[path.EgHeaderLen+headerLen:]
+	header[AuthHeaderOffsetCount] = uint8(len(ids))
+	binary.LittleEndian.PutUint64(header[AuthHeaderOffsetSession:], device.auth.session)
+	binary.LittleEndian.PutUint64(header[AuthHeaderOffsetCounter:], counter)
+	binary.LittleEndian.PutUint16(header[AuthHeaderOffsetLength:], uint16(len(body)))
+	for i, id := range ids {
+		tag := header[AuthHeaderLen(i):AuthHeaderLen(i+1)]
+		binary.LittleEndian.PutUint16(tag, uint16(id))
+		copy(tag[2:], sourceAuthTag(&keys[i], usage, flags, packet[:path.EgHeaderLen], header, body))
+	}
+	return flags, packet
+}
+
+// verifySourceAuth removes the AuthHeader and checks our tag in it.
+// It reports false without an error if there is no tag for us, or no key to check it with.
+func (device *Device) verifySourceAuth(elem *QueueInboundElement, src_nodeID mtypes.Vertex) (bool, error) {
+	packet := elem.packet
+	if len(packet) < path.EgHeaderLen+AuthHeaderLen(0) {
+		return false, errors.New("AuthHeader truncated")
+	}
+	headerLen := AuthHeaderLen(int(packet[path.EgHeaderLen+AuthHeaderOffsetCount]))
+	if len(packet) < path.EgHeaderLen+headerLen {
+		return false, errors.New("AuthHeader truncated")
+	}
+	header := make([]byte, headerLen)
+	copy(header, packet[path.EgHeaderLen:])
+	length := int(binary.LittleEndian.Uint16(header[AuthHeaderOffsetLength:]))
+	if len(packet) < path.EgHeaderLen+headerLen+length {
+		return false, errors.New("body truncated")
+	}
+	copy(packet[path.EgHeaderLen:], packet[path.EgHeaderLen+headerLen:path.EgHeaderLen+headerLen+length])
+	elem.packet = packet[:path.EgHeaderLen+length]
+	flags := elem.Flags
+	elem.Flags &^= path.FlagAuthenticated
+
+	var tag []byte
+	for i := 0; i < int(header[AuthHeaderOffsetCount]); i++ {
+		if mtypes.Vertex(binary.LittleEndian.Uint16(header[AuthHeaderLen(i):])) == device.ID {
+			tag = header[AuthHeaderLen(i)+2 : AuthHeaderLen(i+1)]
+			break
+		}
+	}
+	if tag == nil {
+		return false, nil
+	}
+	keys := device.pairKeys(src_nodeID, sourceAuthLabel)
+	if len(keys) == 0 {
+		return false, nil
+	}
+	valid := false
+	for i := range keys {
+		if subtle.ConstantTimeCompare(tag, sourceAuthTag(&keys[i], elem.Type, flags, elem.packet[:path.EgHeaderLen], header, elem.packet[path.EgHeaderLen:])) == 1 {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return false, errors.New("wrong tag")
+	}
+	session := binary.LittleEndian.Uint64(header[AuthHeaderOffsetSession:])
+	counter := binary.LittleEndian.Uint64(header[AuthHeaderOffsetCounter:])
+
+	device.auth.recvLock.Lock()
+	defer device.auth.recvLock.Unlock()
+	if device.auth.filters == nil {
+		device.auth.filters = make(map[mtypes.Vertex]*sessionFilter)
+	}
+	f, ok := device.auth.filters[src_nodeID]
+	if !ok {
+		f = &sessionFilter{}
+		device.auth.filters[src_nodeID] = f
+	}
+	if !f.validate(session, counter) {
+		return false, errors.New("replayed")
+	}
+	return true, nil
+}
+
+// sourceAuthRequired reports whether packets of the usage to dst_nodeID must be authenticated.
+// Packets which come directly from their source, like the ones of the supernode, are authenticated by the session
+// with the peer already. The first pings to a peer are of those, before we know the features of the peer.
+func (device *Device) sourceAuthRequired(usage path.Usage, peer_id mtypes.Vertex, src_nodeID mtypes.Vertex, dst_nodeID mtypes.Vertex) bool {
+	conf := device.EdgeConfig().SourceAuth
+	if !conf.Require || src_nodeID == peer_id {
+		return false
+	}
+	if usage.IsNormal() {
+		return conf.DataFrames && dst_nodeID == device.ID
+	}
+	return true
+}
+
+// claimedSender returns the node a control message claims to come from, if it claims one.
+func claimedSender(usage path.Usage, body []byte) (mtypes.Vertex, bool) {
+	switch usage {
+	case path.PingPacket:
+		if content, err := mtypes.ParsePingMsg(body); err == nil {
+			return content.Src_nodeID, true
+		}
+	case path.PongPacket:
+		if content, err := mtypes.ParsePongMsg(body); err == nil {
+			return content.Dst_nodeID, true
+		}
+	case path.QueryPeer:
+		if content, err := mtypes.ParseQueryPeerMsg(body); err == nil {
+			return mtypes.Vertex(content.Request_ID), true
+		}
+	}
+	return mtypes.NodeID_Invalid, false
+}
+
+// CheckSourceAuth verifies and removes the AuthHeader of a packet from src_nodeID, which we receive from peer_id.
+// It reports false if the packet must be dropped: the tag is wrong or replayed, the message claims
+// another sender, or the packet isn't authenticated and SourceAuth.Require applies to it.
+func (device *Device) CheckSourceAuth(elem *QueueInboundElement, peer_id mtypes.Vertex, src_nodeID mtypes.Vertex, dst_nodeID mtypes.Vertex) bool {
+	if device.IsSuperNode {
+		return true
+	}
+	authenticated := false
+	if elem.Flags.Has(path.FlagAuthenticated) {
+		var err error
+		authenticated, err = device.verifySourceAuth(elem, src_nodeID)
+		if err != nil {
+			device.log.Errorf("Invalid source authentication usage:%v S:%v D:%v: %v", elem.Type.ToString(), src_nodeID.ToString(), dst_nodeID.ToString(), err)
+			return false
+		}
+	}
+	if authenticated && !elem.Type.IsNormal() {
+		if sender, ok := claimedSender(elem.Type, elem.packet[path.EgHeaderLen:]); ok && sender != src_nodeID {
+			device.log.Errorf("Invalid source authentication usage:%v S:%v D:%v: message claims to be from %v", elem.Type.ToString(), src_nodeID.ToString(), dst_nodeID.ToString(), sender.ToString())
+			return false
+		}
+	}
+	if !authenticated && device.sourceAuthRequired(elem.Type, peer_id, src_nodeID, dst_nodeID) {
+		if device.slog.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			device.slog.Infof(mtypes.LogCatControl, mtypes.LogFields{"usage": elem.Type.ToString(), "src": src_nodeID.ToString(), "dst": dst_nodeID.ToString()}, "Unauthenticated packet dropped")
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// newAuthTestDevice is node id in the network of newForwardTestDevice, with a PSK for each pair of nodes.
+func newAuthTestDevice(tb testing.TB, id mtypes.Vertex) *Device {
+	device := newForwardTestDevice(tb)
+	device.ID = id
+	device.log = NewLogger(LogLevelSilent, "")
+	device.edgeConfig.Store(&mtypes.EdgeConfig{
+		SourceAuth: mtypes.SourceAuthInfo{Enabled: true, DataFrames: true, Require: true},
+	})
+	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
+	for other := mtypes.Vertex(1); other <= 3; other++ {
+		if other == id {
+			continue
+		}
+		peer := &Peer{ID: other}
+		peer.handshake.presharedKey[0] = byte(id + other)
+		device.peers.IDMap[other] = peer
+		device.SetNodeFeatures(other, SourceAuthFeatures)
+	}
+	return device
+}
+
+func pingPacket(src mtypes.Vertex, claimed mtypes.Vertex) []byte {
+	return broadcastPacket(src, mtypes.NodeID_Spread, (&mtypes.PingMsg{RequestID: 1, Src_nodeID: claimed}).MarshalWire())
+}
+
+func TestSourceAuth(t *testing.T) {
+	node1, node2, node3 := newAuthTestDevice(t, 1), newAuthTestDevice(t, 2), newAuthTestDevice(t, 3)
+	// node 3 receives everything through node 2
+	receive := func(usage path.Usage, flags path.HeaderFlags, packet []byte, src, dst mtypes.Vertex) (*QueueInboundElement, bool) {
+		elem := &QueueInboundElement{Type: usage, Flags: flags, packet: append([]byte(nil), packet...)}
+		return elem, node3.CheckSourceAuth(elem, 2, src, dst)
+	}
+
+	ping := pingPacket(1, 1)
+	flags, packet := node1.AuthenticatePacket(path.PingPacket, 0, append([]byte(nil), ping...), nil)
+	if flags != path.FlagAuthenticated || len(packet) != len(ping)+AuthHeaderLen(2) {
+		t.Fatalf("flags %v len %v", flags, len(packet))
+	}
+	// every hop may pad it
+	if elem, ok := receive(path.PingPacket, flags, append(packet, make([]byte, 13)...), 1, mtypes.NodeID_Spread); !ok || elem.Flags != 0 || !bytes.Equal(elem.packet, ping) {
+		t.Fatalf("authenticated ping dropped or not stripped: %v %x", ok, elem.packet)
+	}
+	if _, ok := receive(path.PingPacket, flags, packet, 1, mtypes.NodeID_Spread); ok {
+		t.Error("replayed ping accepted")
+	}
+	// node 1 restarts, its packets of the session before are replays
+	_, older := node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), nil)
+	node1.auth.session, node1.auth.counter = node1.auth.session+1, 0
+	_, packet = node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), nil)
+	if _, ok := receive(path.PingPacket, flags, packet, 1, mtypes.NodeID_Spread); !ok {
+		t.Error("ping of the new session dropped")
+	}
+	if _, ok := receive(path.PingPacket, flags, older, 1, mtypes.NodeID_Spread); ok {
+		t.Error("ping of the session before accepted")
+	}
+	if flags, _ := node2.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), nil); flags != 0 {
+		t.Error("authenticated a packet in transit")
+	}
+
+	// node 2 forwards the packets of node 1
+	_, packet = node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), nil)
+	packet[len(packet)-1]++
+	if _, ok := receive(path.PingPacket, flags, packet, 1, mtypes.NodeID_Spread); ok {
+		t.Error("changed ping accepted")
+	}
+	_, packet = node2.AuthenticatePacket(path.PingPacket, 0, pingPacket(2, 2), nil)
+	EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], DefaultMTU)
+	EgHeader.SetSrc(1)
+	if _, ok := receive(path.PingPacket, flags, packet, 1, mtypes.NodeID_Spread); ok {
+		t.Error("ping with a forged source accepted")
+	}
+	_, packet = node2.AuthenticatePacket(path.PingPacket, 0, pingPacket(2, 1), nil)
+	if _, ok := receive(path.PingPacket, flags, packet, 2, mtypes.NodeID_Spread); ok {
+		t.Error("ping claiming another sender accepted")
+	}
+
+	// unauthenticated packets
+	if _, ok := receive(path.PingPacket, 0, pingPacket(1, 1), 1, mtypes.NodeID_Spread); ok {
+		t.Error("unauthenticated ping accepted")
+	}
+	flags, packet = node1.AuthenticatePacket(path.PingPacket, 0, pingPacket(1, 1), []mtypes.Vertex{2})
+	if _, ok := receive(path.PingPacket, flags, packet, 1, mtypes.NodeID_Spread); ok {
+		t.Error("ping without a tag for us accepted")
+	}
+	if !node3.CheckSourceAuth(&QueueInboundElement{Type: path.PingPacket, packet: pingPacket(2, 2)}, 2, 2, mtypes.NodeID_Spread) {
+		t.Error("ping of a direct peer dropped")
+	}
+	if !node3.CheckSourceAuth(&QueueInboundElement{Type: path.ServerUpdate, packet: broadcastPacket(mtypes.NodeID_SuperNode, 3, []byte("update"))}, mtypes.NodeID_SuperNode, mtypes.NodeID_SuperNode, 3) {
+		t.Error("message of the supernode dropped")
+	}
+	frame := broadcastPacket(1, 3, make([]byte, 60))
+	if _, ok := receive(path.NormalPacket, 0, frame, 1, 3); ok {
+		t.Error("unauthenticated data frame accepted")
+	}
+	if _, ok := receive(path.NormalPacket, 0, broadcastPacket(1, mtypes.NodeID_Broadcast, make([]byte, 60)), 1, mtypes.NodeID_Broadcast); !ok {
+		t.Error("broadcast data frame dropped")
+	}
+	flags, packet = node1.AuthenticatePacket(path.NormalPacket, path.FlagCompressed, append([]byte(nil), frame...), []mtypes.Vertex{3})
+	if elem, ok := receive(path.NormalPacket, flags, packet, 1, 3); !ok || elem.Flags != path.FlagCompressed || !bytes.Equal(elem.packet, frame) {
+		t.Errorf("authenticated data frame dropped or not stripped: %v %x", ok, elem.packet)
+	}
+	node3.EdgeConfig().SourceAuth.Require = false
+	if _, ok := receive(path.PingPacket, 0, pingPacket(1, 1), 1, mtypes.NodeID_Spread); !ok {
+		t.Error("unauthenticated ping dropped without Require")
+	}
+}
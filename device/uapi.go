@@ -19,6 +19,8 @@ import (
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 )
 
 type IPCError struct {
@@ -98,6 +100,23 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		if device.slog != nil {
+			for cat := mtypes.LogCategory(0); cat < mtypes.LogCatNum; cat++ {
+				sendf("log_level=%s:%s", cat.ToString(), mtypes.LogLevel2String(device.slog.Level(cat)))
+			}
+		}
+
+		device.l2fib.Range(func(k interface{}, v interface{}) bool {
+			mac := k.(tap.MacAddress)
+			idtime := v.(*IdAndTime)
+			node_id := idtime.NodeID()
+			sendf("l2fib_mac=%s", mac.String())
+			sendf("l2fib_node_id=%s", node_id.ToString())
+			sendf("l2fib_moves=%d", atomic.LoadUint64(&idtime.Moves))
+			sendf("l2fib_held=%v", idtime.Held())
+			return true
+		})
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -119,6 +138,22 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("last_handshake_time_nsec=%d", nano)
 			sendf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes))
 			sendf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes))
+			sendf("features=%s", device.NodeFeatures(peer.ID).ToString())
+			sendf("tx_compress_saved_bytes=%d", atomic.LoadUint64(&peer.stats.txCompressSaved))
+			sendf("rx_compress_saved_bytes=%d", atomic.LoadUint64(&peer.stats.rxCompressSaved))
+			sendf("fec_tx_loss=%.4f", peer.fec.TxLoss())
+			sendf("fec_rx_loss=%.4f", peer.fec.rxLoss.Loss())
+			sendf("fec_parity_sent=%d", atomic.LoadUint64(&peer.stats.fecParitySent))
+			sendf("fec_parity_received=%d", atomic.LoadUint64(&peer.stats.fecParityReceived))
+			sendf("fec_recovered=%d", atomic.LoadUint64(&peer.stats.fecRecovered))
+			sendf("dup_sent=%d", atomic.LoadUint64(&peer.stats.dupSent))
+			sendf("dup_primary_won=%d", atomic.LoadUint64(&peer.stats.dupWon[0]))
+			sendf("dup_secondary_won=%d", atomic.LoadUint64(&peer.stats.dupWon[1]))
+			sendf("dup_discarded=%d", atomic.LoadUint64(&peer.stats.dupDiscarded))
+			sendf("frag_sent=%d", atomic.LoadUint64(&peer.stats.fragSent))
+			sendf("frag_reassembled=%d", atomic.LoadUint64(&peer.stats.fragReassembled))
+			sendf("frag_dropped=%d", atomic.LoadUint64(&peer.stats.fragDropped))
+			sendf("e2e_dropped=%d", atomic.LoadUint64(&peer.stats.e2eDropped))
 			sendf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval))
 			sendf("allowed_ip=%s/%d", net.IPv4zero.String(), 0)
 			sendf("allowed_ip=%s/%d", net.IPv6zero.String(), 0)
@@ -204,6 +239,17 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.log.Verbosef("UAPI: Updating private key")
 		device.SetPrivateKey(sk)
 
+	case "rotate_private_key":
+		var sk NoisePrivateKey
+		err := sk.FromHex(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to rotate private_key: %w", err)
+		}
+		device.log.Verbosef("UAPI: Rotating private key")
+		if err := device.RotatePrivateKey(sk); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to rotate private_key: %w", err)
+		}
+
 	case "listen_port":
 		port, err := strconv.ParseUint(value, 10, 16)
 		if err != nil {
@@ -232,6 +278,15 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "reload_config":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set reload_config, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Reloading config")
+		if err := device.reloadConfig(); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to reload config: %w", err)
+		}
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -239,6 +294,25 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
 
+	case "log_level":
+		catstr, levelstr, ok := strings.Cut(value, ":")
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level, expected <category>:<level>: %v", value)
+		}
+		cat, err := mtypes.String2LogCategory(catstr)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		level, err := mtypes.String2LogLevel(levelstr)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		if device.slog == nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: structured logging is not enabled")
+		}
+		device.log.Verbosef("UAPI: Updating log level of %v to %v", cat.ToString(), mtypes.LogLevel2String(level))
+		device.slog.SetLevel(cat, level)
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package fec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomShards(r *rand.Rand, n int, size int) [][]byte {
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		r.Read(shards[i])
+	}
+	return shards
+}
+
+func TestReconstruct(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for _, tc := range []struct{ n, k int }{{1, 1}, {4, 2}, {10, 3}, {MaxDataShards, MaxParityShards}} {
+		data := randomShards(r, tc.n, 100)
+		parity := make([][]byte, tc.k)
+		for i := range parity {
+			parity[i] = make([]byte, 100)
+		}
+		if err := Encode(data, parity); err != nil {
+			t.Fatal(err)
+		}
+		for trial := 0; trial < 20; trial++ {
+			lost := r.Intn(tc.k + 1)
+			if lost > tc.n {
+				lost = tc.n
+			}
+			received := append([][]byte{}, data...)
+			for _, j := range r.Perm(tc.n)[:lost] {
+				received[j] = nil
+			}
+			// drop the parity shards we don't need
+			parityReceived := append([][]byte{}, parity...)
+			for _, i := range r.Perm(tc.k)[:tc.k-lost] {
+				parityReceived[i] = nil
+			}
+			if err := Reconstruct(received, parityReceived); err != nil {
+				t.Fatalf("n=%d k=%d lost=%d: %v", tc.n, tc.k, lost, err)
+			}
+			for j := range data {
+				if !bytes.Equal(received[j], data[j]) {
+					t.Fatalf("n=%d k=%d lost=%d: shard %d mismatch", tc.n, tc.k, lost, j)
+				}
+			}
+		}
+	}
+}
+
+func TestReconstructTooFew(t *testing.T) {
+	data := randomShards(rand.New(rand.NewSource(1)), 4, 10)
+	parity := [][]byte{make([]byte, 10), make([]byte, 10)}
+	if err := Encode(data, parity); err != nil {
+		t.Fatal(err)
+	}
+	data[0], data[1], data[2] = nil, nil, nil
+	if err := Reconstruct(data, parity); err != ErrTooFewShards {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestGroupRecovery(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	var enc Encoder
+	dec := NewDecoder(256, 8)
+
+	packets := make([][]byte, 10)
+	for i := range packets {
+		packets[i] = make([]byte, 20+r.Intn(1400))
+		r.Read(packets[i])
+		if !enc.Add(5, uint64(100+i), packets[i]) {
+			t.Fatalf("packet %d rejected", i)
+		}
+	}
+	if enc.Add(5, 200, packets[0]) {
+		t.Fatal("non-consecutive packet accepted")
+	}
+	stream, base, n, parity, err := enc.Flush(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream != 5 || base != 100 || n != 10 || len(parity) != 3 {
+		t.Fatalf("unexpected group stream=%d base=%d n=%d k=%d", stream, base, n, len(parity))
+	}
+
+	lost := map[int]bool{2: true, 5: true, 9: true}
+	for i, p := range packets {
+		if !lost[i] {
+			if rec := dec.AddData(stream, base+uint64(i), p); rec != nil {
+				t.Fatal("recovered without parity")
+			}
+		}
+	}
+	var recovered [][]byte
+	for i, p := range parity {
+		rec, err := dec.AddParity(stream, base, n, len(parity), i, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && rec != nil {
+			t.Fatal("recovered with too few parity shards")
+		}
+		recovered = append(recovered, rec...)
+	}
+	if len(recovered) != len(lost) {
+		t.Fatalf("recovered %d packets, want %d", len(recovered), len(lost))
+	}
+	for _, rec := range recovered {
+		found := false
+		for i := range lost {
+			if bytes.Equal(rec, packets[i]) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("recovered packet doesn't match any lost packet")
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package fec
+
+import "encoding/binary"
+
+// Packets are stored in shards prefixed with their length,
+// and padded with zero to the size of the largest packet in the group.
+const lengthPrefixSize = 2
+
+// An Encoder collects consecutive packets of one stream into a group.
+// A stream is a sequence of packets numbered by consecutive sequence numbers.
+type Encoder struct {
+	stream uint32
+	base   uint64
+	shards [][]byte
+	size   int
+}
+
+// Add appends a packet to the current group.
+// It returns false if the packet doesn't continue the group, the caller should Flush and Add again.
+func (e *Encoder) Add(stream uint32, seq uint64, packet []byte) bool {
+	if len(e.shards) == 0 {
+		e.stream = stream
+		e.base = seq
+	} else if stream != e.stream || seq != e.base+uint64(len(e.shards)) || len(e.shards) >= MaxDataShards {
+		return false
+	}
+	shard := make([]byte, lengthPrefixSize+len(packet))
+	binary.LittleEndian.PutUint16(shard, uint16(len(packet)))
+	copy(shard[lengthPrefixSize:], packet)
+	e.shards = append(e.shards, shard)
+	if len(shard) > e.size {
+		e.size = len(shard)
+	}
+	return true
+}
+
+func (e *Encoder) Len() int {
+	return len(e.shards)
+}
+
+// Flush computes parityCount parity shards for the current group and starts a new group.
+func (e *Encoder) Flush(parityCount int) (stream uint32, base uint64, n int, parity [][]byte, err error) {
+	stream, base, n = e.stream, e.base, len(e.shards)
+	data := e.shards
+	size := e.size
+	e.shards = nil
+	e.size = 0
+	if n == 0 || parityCount <= 0 {
+		return
+	}
+	if parityCount > MaxParityShards {
+		parityCount = MaxParityShards
+	}
+	for j := range data {
+		if len(data[j]) < size {
+			data[j] = append(data[j], make([]byte, size-len(data[j]))...)
+		}
+	}
+	parity = make([][]byte, parityCount)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+	}
+	err = Encode(data, parity)
+	return
+}
+
+type packetKey struct {
+	stream uint32
+	seq    uint64
+}
+
+type group struct {
+	stream uint32
+	base   uint64
+	n      int
+	parity [][]byte
+	done   bool
+}
+
+func (g *group) contains(stream uint32, seq uint64) bool {
+	return g.stream == stream && seq >= g.base && seq < g.base+uint64(g.n)
+}
+
+// A Decoder keeps the recently received packets and recovers the lost ones when parity arrives.
+// Memory is bounded by the number of packets and groups it remembers.
+type Decoder struct {
+	maxPackets int
+	maxGroups  int
+	packets    map[packetKey][]byte
+	order      []packetKey
+	groups     []*group
+}
+
+func NewDecoder(maxPackets int, maxGroups int) *Decoder {
+	return &Decoder{
+		maxPackets: maxPackets,
+		maxGroups:  maxGroups,
+		packets:    make(map[packetKey][]byte, maxPackets),
+	}
+}
+
+// AddData records a received packet. It returns the packets recovered thanks to it, if any.
+// The packets and parity shards must be authenticated by the caller, since the first one of a seq or index is kept.
+func (d *Decoder) AddData(stream uint32, seq uint64, packet []byte) (recovered [][]byte) {
+	key := packetKey{stream, seq}
+	if _, ok := d.packets[key]; ok {
+		return nil
+	}
+	if len(d.order) >= d.maxPackets {
+		delete(d.packets, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.packets[key] = append([]byte(nil), packet...)
+	d.order = append(d.order, key)
+	for _, g := range d.groups {
+		if !g.done && g.contains(stream, seq) {
+			return d.tryRecover(g)
+		}
+	}
+	return nil
+}
+
+// AddParity records an authenticated parity shard of the group [base, base+n) and returns the recovered packets.
+func (d *Decoder) AddParity(stream uint32, base uint64, n int, k int, index int, shard []byte) (recovered [][]byte, err error) {
+	if n <= 0 || n > MaxDataShards || k <= 0 || k > MaxParityShards || index < 0 || index >= k || len(shard) < lengthPrefixSize {
+		return nil, ErrInvalidGroupArg
+	}
+	var g *group
+	for _, it := range d.groups {
+		if it.stream == stream && it.base == base {
+			g = it
+			break
+		}
+	}
+	if g == nil {
+		if len(d.groups) >= d.maxGroups {
+			d.evictGroup()
+		}
+		g = &group{
+			stream: stream,
+			base:   base,
+			n:      n,
+			parity: make([][]byte, k),
+		}
+		d.groups = append(d.groups, g)
+	}
+	if g.done {
+		return nil, nil
+	}
+	if g.n != n || len(g.parity) != k || g.parity[index] != nil {
+		return nil, nil
+	}
+	for _, p := range g.parity {
+		if p != nil && len(p) != len(shard) {
+			return nil, ErrShardSize
+		}
+	}
+	g.parity[index] = append([]byte(nil), shard...)
+	return d.tryRecover(g), nil
+}
+
+// evictGroup forgets the oldest group which is done, or the oldest group if none is.
+// The packets of a group may be recorded long after its parity, once they are decrypted.
+func (d *Decoder) evictGroup() {
+	evict := 0
+	for i, g := range d.groups {
+		if g.done {
+			evict = i
+			break
+		}
+	}
+	d.groups = append(d.groups[:evict], d.groups[evict+1:]...)
+}
+
+func (d *Decoder) tryRecover(g *group) (recovered [][]byte) {
+	size := 0
+	parityCount := 0
+	for _, p := range g.parity {
+		if p != nil {
+			size = len(p)
+			parityCount++
+		}
+	}
+	data := make([][]byte, g.n)
+	missing := 0
+	for j := range data {
+		packet, ok := d.packets[packetKey{g.stream, g.base + uint64(j)}]
+		if !ok {
+			missing++
+			continue
+		}
+		if lengthPrefixSize+len(packet) > size {
+			// inconsistent with the parity, give up this group
+			g.done = true
+			return nil
+		}
+		shard := make([]byte, size)
+		binary.LittleEndian.PutUint16(shard, uint16(len(packet)))
+		copy(shard[lengthPrefixSize:], packet)
+		data[j] = shard
+	}
+	if missing == 0 {
+		g.done = true
+		return nil
+	}
+	if parityCount < missing {
+		return nil
+	}
+	g.done = true
+	lost := make([]bool, g.n)
+	for j := range data {
+		lost[j] = data[j] == nil
+	}
+	if err := Reconstruct(data, g.parity); err != nil {
+		return nil
+	}
+	for j, shard := range data {
+		if !lost[j] {
+			continue
+		}
+		length := int(binary.LittleEndian.Uint16(shard))
+		if lengthPrefixSize+length > len(shard) {
+			continue
+		}
+		recovered = append(recovered, shard[lengthPrefixSize:lengthPrefixSize+length])
+	}
+	return
+}
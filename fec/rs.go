@@ -0,0 +1,222 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package fec implements a systematic Reed-Solomon erasure code over GF(2^8)
+// and the grouping of variable-length packets into equal-length shards.
+package fec
+
+import "errors"
+
+const (
+	MaxDataShards   = 64
+	MaxParityShards = 32
+)
+
+var (
+	ErrTooManyShards   = errors.New("fec: too many shards")
+	ErrShardSize       = errors.New("fec: shards have different sizes")
+	ErrTooFewShards    = errors.New("fec: too few shards to reconstruct")
+	ErrSingularMatrix  = errors.New("fec: singular matrix")
+	ErrInvalidGroupArg = errors.New("fec: invalid group parameters")
+)
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd computes dst ^= c * src
+func mulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i := range dst {
+			dst[i] ^= src[i]
+		}
+		return
+	}
+	logc := int(gfLog[c])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[logc+int(gfLog[s])]
+		}
+	}
+}
+
+// coefficient of data shard j in parity shard i, taken from a Cauchy matrix
+// so that every square sub-matrix is invertible.
+func coefficient(i, j int) byte {
+	return gfInv(byte(255-i) ^ byte(j))
+}
+
+func shardSize(shards [][]byte) (int, error) {
+	size := -1
+	for _, s := range shards {
+		if s == nil {
+			continue
+		}
+		if size == -1 {
+			size = len(s)
+		} else if len(s) != size {
+			return 0, ErrShardSize
+		}
+	}
+	return size, nil
+}
+
+// Encode computes the parity shards from the data shards.
+// All shards must have the same size and parity shards must be allocated by the caller.
+func Encode(data [][]byte, parity [][]byte) error {
+	if len(data) > MaxDataShards || len(parity) > MaxParityShards {
+		return ErrTooManyShards
+	}
+	all := append(append([][]byte{}, data...), parity...)
+	for _, s := range all {
+		if s == nil {
+			return ErrShardSize
+		}
+	}
+	if _, err := shardSize(all); err != nil {
+		return err
+	}
+	for i, p := range parity {
+		for k := range p {
+			p[k] = 0
+		}
+		for j, d := range data {
+			mulAdd(p, d, coefficient(i, j))
+		}
+	}
+	return nil
+}
+
+// Reconstruct fills the missing (nil) data shards.
+// Missing parity shards must be nil too. Parity shards are not rebuilt.
+func Reconstruct(data [][]byte, parity [][]byte) error {
+	if len(data) > MaxDataShards || len(parity) > MaxParityShards {
+		return ErrTooManyShards
+	}
+	size, err := shardSize(append(append([][]byte{}, data...), parity...))
+	if err != nil {
+		return err
+	}
+	var missing []int
+	for j, d := range data {
+		if d == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var rows []int
+	for i, p := range parity {
+		if p != nil && len(rows) < len(missing) {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < len(missing) {
+		return ErrTooFewShards
+	}
+
+	// syndrome: parity minus the contribution of the known data shards
+	syndromes := make([][]byte, len(rows))
+	for r, i := range rows {
+		syndromes[r] = append([]byte(nil), parity[i]...)
+		for j, d := range data {
+			if d != nil {
+				mulAdd(syndromes[r], d, coefficient(i, j))
+			}
+		}
+	}
+
+	// solve the sub-matrix of the missing columns
+	m := len(missing)
+	matrix := make([][]byte, m)
+	for r, i := range rows {
+		matrix[r] = make([]byte, m)
+		for c, j := range missing {
+			matrix[r][c] = coefficient(i, j)
+		}
+	}
+	inverse, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+	for c, j := range missing {
+		shard := make([]byte, size)
+		for r := range rows {
+			mulAdd(shard, syndromes[r], inverse[c][r])
+		}
+		data[j] = shard
+	}
+	return nil
+}
+
+// invert inverts a square matrix by Gauss-Jordan elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, ErrSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for k := range work[c] {
+			work[c][k] = gfMul(work[c][k], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				mulAdd(work[r], work[c], work[r][c])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
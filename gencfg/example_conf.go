@@ -37,6 +37,8 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			RecvAddr:      "127.0.0.1:4001",
 			SendAddr:      "127.0.0.1:5001",
 			L2HeaderMode:  "nochg",
+			Queues:        1,
+			VnetHdr:       false,
 		},
 		NodeID:       1,
 		NodeName:     "Node01",
@@ -52,12 +54,69 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		AfPrefer: 4,
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
+			LogFormat:   "text",
 			LogTransit:  false,
 			LogControl:  true,
 			LogNormal:   false,
 			LogInternal: true,
 			LogNTP:      true,
 		},
+		Compression: mtypes.CompressionInfo{
+			Enabled: false,
+			Level:   1,
+			MinSize: 128,
+		},
+		FEC: mtypes.FECInfo{
+			Enabled:         false,
+			DataShards:      10,
+			MinParityShards: 0,
+			MaxParityShards: 4,
+			FlushTimeout:    0.005,
+		},
+		Duplication: mtypes.DuplicationInfo{
+			Enabled: false,
+			Rules: []mtypes.DuplicateRule{
+				{
+					EtherType: 0x0800,
+					IPProto:   17,
+					PortMin:   5060,
+					PortMax:   5061,
+				},
+				{
+					DSCP: 46,
+				},
+			},
+		},
+		Fragmentation: mtypes.FragmentInfo{
+			Enabled:           false,
+			PathMTU:           1452,
+			ReassemblyTimeout: 1,
+			ReassemblyMemory:  4 << 20,
+		},
+		MacFlap: mtypes.MacFlapInfo{
+			MaxMoves:   10,
+			HoldTime:   60,
+			Action:     "freeze",
+			MoveScript: "",
+		},
+		LoopDetect: mtypes.LoopDetectInfo{
+			Enabled:     false,
+			Interval:    5,
+			Key:         "",
+			Block:       true,
+			AlarmScript: "",
+			BPDU:        "passthrough",
+		},
+		SourceAuth: mtypes.SourceAuthInfo{
+			Enabled:    true,
+			DataFrames: false,
+			Require:    false,
+		},
+		E2EEncryption: mtypes.E2EInfo{
+			Enabled:      false,
+			Destinations: []mtypes.Vertex{},
+			Require:      false,
+		},
 		DynamicRoute: mtypes.DynamicRouteInfo{
 			SendPingInterval:     16,
 			PeerAliveTimeout:     70,
@@ -78,6 +137,7 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				SuperNodeInfoTimeout: 50,
 				SkipLocalIP:          false,
 				AdditionalLocalIP:    []string{"11.11.11.11:11111"},
+				KeyRotationOverlap:   120,
 			},
 			P2P: mtypes.P2PInfo{
 				UseP2P:           false,
@@ -103,6 +163,12 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 						},
 					},
 				},
+				Admission: mtypes.AdmissionInfo{
+					Mode:        "open",
+					AllowedKeys: map[mtypes.Vertex][]string{},
+					CAPubKey:    "",
+					Certificate: "",
+				},
 			},
 			NTPConfig: mtypes.NTPInfo{
 				UseNTP:           true,
@@ -161,7 +227,7 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		},
 	}
 	if getDemo {
-		g, _ := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+		g, _ := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 		g.UpdateLatency(1, 2, 0.5, 99999, 0, false, false)
 		g.UpdateLatency(2, 1, 0.5, 99999, 0, false, false)
 		g.UpdateLatency(2, 3, 0.5, 99999, 0, false, false)
@@ -214,6 +280,7 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		API_Prefix:           "/eg_api",
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
+			LogFormat:   "text",
 			LogTransit:  false,
 			LogControl:  true,
 			LogNormal:   false,
@@ -226,6 +293,7 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		HttpPostInterval:      50,
 		SendPingInterval:      15,
 		ResetEndPointInterval: 600,
+		RequiredFeatures:      []string{},
 		Passwords: mtypes.Passwords{
 			ShowState:   random_passwd + "_showstate",
 			AddPeer:     random_passwd + "_addpeer",
@@ -233,6 +301,12 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 			UpdatePeer:  random_passwd + "_updatepeer",
 			UpdateSuper: random_passwd + "_updatesuper",
 		},
+		APIUsers: []mtypes.APIUser{},
+		AuditLog: "",
+		ConfigHistory: mtypes.ConfigHistoryInfo{
+			Keep: 20,
+			Dir:  "",
+		},
 		GraphRecalculateSetting: mtypes.GraphRecalculateSetting{
 			StaticMode: false,
 			ManualLatency: mtypes.DistTable{
@@ -264,6 +338,16 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		},
 		EdgeTemplate:       "example_config/super_mode/n1.yaml",
 		UsePSKForInterEdge: true,
+		PSKRotation: mtypes.PSKRotationInfo{
+			Interval:   0,
+			SwitchOver: 120,
+		},
+		Enrollment: mtypes.EnrollmentInfo{
+			Enabled:    false,
+			NodeIDFrom: 200,
+			NodeIDTo:   299,
+			TokenTTL:   3600,
+		},
 		Peers: []mtypes.SuperPeerInfo{
 			{
 				NodeID:         1,
@@ -0,0 +1,28 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package gencfg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// GenAPIToken generates a token for an API user of the supernode. The TokenHash goes to the config of the supernode,
+// and the token to the user.
+func GenAPIToken() error {
+	tokenbytes := make([]byte, 32)
+	if _, err := rand.Read(tokenbytes); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenbytes)
+	tokenHash := sha256.Sum256([]byte(token))
+	fmt.Println("Token:", token)
+	fmt.Println("TokenHash:", hex.EncodeToString(tokenHash[:]))
+	return nil
+}
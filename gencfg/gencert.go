@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package gencfg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func printCertCfg() {
+	tconfig := CertCfg{
+		CAPrivKey: "",
+		NodeID:    1,
+		PubKey:    "CooSkIP7/wiC7Rh83UYnB2yPkJijkNFmhtorHtyYlzY=",
+		ValidDays: 365,
+	}
+	toprint, _ := yaml.Marshal(tconfig)
+	fmt.Print(string(toprint))
+}
+
+// GenCert signs a certificate for the P2P.Admission ca mode of a node, with a new CA if none is given.
+func GenCert(CertCfgPath string, printExample bool) (err error) {
+	CertCfg := CertCfg{}
+	if printExample {
+		printCertCfg()
+		return
+	}
+	err = mtypes.ReadYaml(CertCfgPath, &CertCfg)
+	if err != nil {
+		return err
+	}
+	pk, err := device.Str2PubKey(CertCfg.PubKey)
+	if err != nil {
+		return err
+	}
+	if CertCfg.ValidDays <= 0 {
+		return fmt.Errorf("Valid days must > 0")
+	}
+	var ca ed25519.PrivateKey
+	if CertCfg.CAPrivKey == "" {
+		_, ca, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		fmt.Println("CA private key:", base64.StdEncoding.EncodeToString(ca.Seed()))
+	} else {
+		seed, err := base64.StdEncoding.DecodeString(CertCfg.CAPrivKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("CA private key is not a base64 encoded ed25519 seed")
+		}
+		ca = ed25519.NewKeyFromSeed(seed)
+	}
+	expiry := time.Now().Add(time.Duration(CertCfg.ValidDays * float64(24*time.Hour)))
+	cert := device.SignPeerCertificate(ca, CertCfg.NodeID, pk, expiry)
+	fmt.Println("CAPubKey:", base64.StdEncoding.EncodeToString(ca.Public().(ed25519.PublicKey)))
+	fmt.Println("Certificate:", base64.StdEncoding.EncodeToString(cert))
+	fmt.Println("Expires:", expiry.Format(time.RFC3339))
+	return nil
+}
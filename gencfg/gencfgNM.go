@@ -72,7 +72,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 		}
 	}
 
-	g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
+	g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 	edges := []mtypes.PongMsg{}
 	if NMCfg.DistanceMatrix != "" {
 		edges, err = path.ParseDistanceMatrix(NMCfg.DistanceMatrix)
@@ -241,6 +241,15 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 	econfig.DynamicRoute.SuperNode.PubKeyV6 = ""
 	econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = ""
 
+	if enableP2P {
+		// only the nodes generated here may join
+		econfig.DynamicRoute.P2P.Admission.Mode = device.AdmissionAllowlist
+		econfig.DynamicRoute.P2P.Admission.AllowedKeys = make(map[mtypes.Vertex][]string)
+		for NodeID, Edge := range edge_infos {
+			econfig.DynamicRoute.P2P.Admission.AllowedKeys[NodeID] = []string{Edge.PubKey}
+		}
+	}
+
 	var pskdb device.PSKDB
 	for NodeID, Edge := range edge_infos {
 		econfig.NodeName = NMCfg.NetworkName
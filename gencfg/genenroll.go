@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package gencfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func printEnrollCfg() {
+	tconfig := EnrollCfg{
+		EdgeAPIUrl:     "http://127.0.0.1:3456/eg_net/eg_api",
+		Token:          "",
+		NodeName:       "",
+		ConfigOutput:   "EgNet_edge.yaml",
+		ConfigOutputOW: false,
+	}
+	toprint, _ := yaml.Marshal(tconfig)
+	fmt.Print(string(toprint))
+}
+
+// Enroll joins a supernode with an enrollment token. It generates the private key here and sends only the PubKey,
+// then saves the config the supernode returns with the private key filled in.
+func Enroll(EnrollCfgPath string, printExample bool) (err error) {
+	EnrollCfg := EnrollCfg{}
+	if printExample {
+		printEnrollCfg()
+		return
+	}
+	err = mtypes.ReadYaml(EnrollCfgPath, &EnrollCfg)
+	if err != nil {
+		return err
+	}
+	if EnrollCfg.Token == "" {
+		return fmt.Errorf("Enrollment token is required")
+	}
+	if EnrollCfg.ConfigOutput == "" {
+		return fmt.Errorf("Config output path is required")
+	}
+	if _, err := os.Stat(EnrollCfg.ConfigOutput); err == nil && !EnrollCfg.ConfigOutputOW {
+		return fmt.Errorf("%v exists, set \"Enable generated config overwrite\" to overwrite it", EnrollCfg.ConfigOutput)
+	}
+
+	sk, pk := device.RandomKeyPair()
+	client := &http.Client{
+		Timeout: 8 * time.Second,
+	}
+	resp, err := client.PostForm(strings.TrimSuffix(EnrollCfg.EdgeAPIUrl, "/")+"/edge/enroll", url.Values{
+		"Token":  {EnrollCfg.Token},
+		"PubKey": {pk.ToString()},
+		"Name":   {EnrollCfg.NodeName},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("enrollment failed with %v: %v", resp.Status, string(body))
+	}
+
+	econfig := mtypes.EdgeConfig{}
+	err = yaml.Unmarshal(body, &econfig)
+	if err != nil {
+		return fmt.Errorf("can't parse the config from the supernode: %v", err)
+	}
+	econfig.PrivKey = sk.ToString()
+	mtypesBytes, _ := yaml.Marshal(econfig)
+	err = ioutil.WriteFile(EnrollCfg.ConfigOutput, mtypesBytes, 0o600)
+	if err != nil {
+		return err
+	}
+	fmt.Println("NodeID:", econfig.NodeID.ToString())
+	fmt.Println("NodeName:", econfig.NodeName)
+	fmt.Println("PubKey:", pk.ToString())
+	fmt.Println("Config saved to", EnrollCfg.ConfigOutput)
+	return nil
+}
@@ -53,6 +53,21 @@ type NMCfg struct {
 	DistanceMatrix string                          `yaml:"Distance matrix for all nodes"`
 }
 
+type CertCfg struct {
+	CAPrivKey string        `yaml:"CA private key"` // leave blank to generate a new CA
+	NodeID    mtypes.Vertex `yaml:"Node ID"`
+	PubKey    string        `yaml:"Node public key"`
+	ValidDays float64       `yaml:"Valid days"`
+}
+
+type EnrollCfg struct {
+	EdgeAPIUrl     string `yaml:"EdgeAPI url"`
+	Token          string `yaml:"Enrollment token"`
+	NodeName       string `yaml:"Node name(optional)"` // ignored if the token was issued for a name
+	ConfigOutput   string `yaml:"Config output path"`
+	ConfigOutputOW bool   `yaml:"Enable generated config overwrite"`
+}
+
 type edge_raw_info struct {
 	Endpoint string `yaml:"Endpoint(optional)"`
 }
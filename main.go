@@ -29,16 +29,18 @@ const (
 )
 
 const (
-	ENV_EG_UAPI_FD  = "EG_UAPI_FD"
-	ENV_EG_UAPI_DIR = "EG_UAPI_DIR"
+	ENV_EG_UAPI_FD   = "EG_UAPI_FD"
+	ENV_EG_UAPI_DIR  = "EG_UAPI_DIR"
+	ENV_EG_API_TOKEN = "EG_API_TOKEN"
 )
 
 var (
 	tconfig      = flag.String("config", "", "Config path for the interface.")
-	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg]")
+	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg|rotatekey|reload|rollback]\nrotatekey rotates the private key of the running edge of -config.\nreload makes the running edge of -config reload it, like SIGHUP.\nrollback rolls the supernode of -config back to -revision.")
+	revision     = flag.Uint64("revision", 0, "Revision of the config for rollback mode. 0 lists the revisions")
 	printExample = flag.Bool("example", false, "Print example config")
-	cfgmode      = flag.String("cfgmode", "", "Running mode for generated config. [none|super|p2p]")
-	bind         = flag.String("bind", "linux", "UDP socket bind mode. [linux|std]\nYou may need std mode if you want to run Etherguard under WSL.")
+	cfgmode      = flag.String("cfgmode", "", "Running mode for generated config. [none|super|p2p|cert|enroll|apitoken]\nenroll joins a supernode with an enrollment token.\napitoken generates a token of an API user.")
+	bind         = flag.String("bind", "linux", "UDP socket bind mode. [linux|linux-offload|std]\nlinux-offload also enables UDP GSO/GRO if the kernel supports it.\nYou may need std mode if you want to run Etherguard under WSL.")
 	nouapi       = flag.Bool("no-uapi", false, "Disable UAPI\nWith UAPI, you can check etherguard status by \"wg\" command")
 	pprofaddr    = flag.String("pprof", "", "pprof listing address")
 	version      = flag.Bool("version", false, "Show version")
@@ -77,6 +79,12 @@ func main() {
 		err = Edge(*tconfig, !*nouapi, *printExample, *bind)
 	case "super":
 		err = Super(*tconfig, !*nouapi, *printExample, *bind)
+	case "rotatekey":
+		err = RotateKey(*tconfig)
+	case "reload":
+		err = Reload(*tconfig)
+	case "rollback":
+		err = Rollback(*tconfig, *revision)
 	case "solve":
 		err = path.Solve(*tconfig, *printExample)
 	case "gencfg":
@@ -87,6 +95,12 @@ func main() {
 			err = gencfg.GenNMCfg(*tconfig, false, *printExample)
 		case "p2p":
 			err = gencfg.GenNMCfg(*tconfig, true, *printExample)
+		case "cert":
+			err = gencfg.GenCert(*tconfig, *printExample)
+		case "enroll":
+			err = gencfg.Enroll(*tconfig, *printExample)
+		case "apitoken":
+			err = gencfg.GenAPIToken()
 		default:
 			err = fmt.Errorf("gencfg: generate config for %v mode are not implement", *cfgmode)
 		}
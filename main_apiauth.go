@@ -0,0 +1,279 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// The manage API accepts the shared Passwords, and the tokens of APIUsers. A user may call the operations of its
+// roles, named after the passwords they replace, and only for the NodeIDs it is limited to. The token goes to the
+// Authorization header as a bearer token, or to the Password parameter like a password.
+// Mutating calls are appended to the audit log, whether they succeed or not.
+
+const (
+	RoleShowState   = "ShowState"
+	RoleAddPeer     = "AddPeer"
+	RoleDelPeer     = "DelPeer"
+	RoleUpdatePeer  = "UpdatePeer"
+	RoleUpdateSuper = "UpdateSuper"
+)
+
+type apiUser struct {
+	name      string
+	tokenHash []byte
+	roles     map[string]bool
+	nodeIDs   map[mtypes.Vertex]bool // nil for all
+}
+
+// apiPrincipal is who called the manage API.
+type apiPrincipal struct {
+	Name    string
+	nodeIDs map[mtypes.Vertex]bool // nil for all
+}
+
+type AuditEntry struct {
+	Time         string
+	User         string // empty if the caller didn't authenticate
+	Remote       string
+	ForwardedFor string `json:",omitempty"`
+	Action       string
+	Params       map[string]string `json:",omitempty"` // without secrets
+	Status       int
+}
+
+type auditLog struct {
+	sync.Mutex
+	file *os.File // nil writes to the log of the supernode
+}
+
+var apiRoles = map[string]bool{
+	RoleShowState:   true,
+	RoleAddPeer:     true,
+	RoleDelPeer:     true,
+	RoleUpdatePeer:  true,
+	RoleUpdateSuper: true,
+}
+
+var auditSecrets = map[string]bool{
+	"Password": true,
+	"PrivKey":  true,
+	"PSKey":    true,
+	"Token":    true,
+}
+
+func rolePassword(role string) string {
+	switch role {
+	case RoleShowState:
+		return httpobj.http_passwords.ShowState
+	case RoleAddPeer:
+		return httpobj.http_passwords.AddPeer
+	case RoleDelPeer:
+		return httpobj.http_passwords.DelPeer
+	case RoleUpdatePeer:
+		return httpobj.http_passwords.UpdatePeer
+	case RoleUpdateSuper:
+		return httpobj.http_passwords.UpdateSuper
+	}
+	return ""
+}
+
+func load_apiusers(users []mtypes.APIUser) ([]apiUser, error) {
+	ret := make([]apiUser, 0, len(users))
+	names := make(map[string]bool)
+	for _, user := range users {
+		if user.Name == "" || names[user.Name] {
+			return nil, fmt.Errorf("APIUsers: Name must be unique and not empty : %v", user.Name)
+		}
+		names[user.Name] = true
+		tokenHash, err := hex.DecodeString(user.TokenHash)
+		if err != nil || len(tokenHash) != sha256.Size {
+			return nil, fmt.Errorf("APIUsers %v: TokenHash must be a hex encoded sha256 : %v", user.Name, user.TokenHash)
+		}
+		parsed := apiUser{
+			name:      user.Name,
+			tokenHash: tokenHash,
+			roles:     make(map[string]bool),
+		}
+		for _, role := range user.Roles {
+			if !apiRoles[role] {
+				return nil, fmt.Errorf("APIUsers %v: unknown role : %v", user.Name, role)
+			}
+			parsed.roles[role] = true
+		}
+		if user.NodeIDs != "" {
+			NodeIDs, _, _, err := gencfg.ParseIDs(user.NodeIDs)
+			if err != nil {
+				return nil, fmt.Errorf("APIUsers %v: NodeIDs: %v", user.Name, err)
+			}
+			parsed.nodeIDs = make(map[mtypes.Vertex]bool)
+			for _, NodeID := range NodeIDs {
+				parsed.nodeIDs[mtypes.Vertex(NodeID)] = true
+			}
+		}
+		ret = append(ret, parsed)
+	}
+	return ret, nil
+}
+
+// api_secret returns the bearer token or the Password parameter of a manage API call, empty if there is none.
+func api_secret(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("Password")
+}
+
+// authenticate returns who called the manage API if it may call the operations of role.
+func authenticate(w http.ResponseWriter, r *http.Request, role string) (*apiPrincipal, *APIError) {
+	secret := api_secret(r)
+	if secret == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "unauthenticated", "Paramater Password: Missing paramater.")
+	}
+	if checkPassword(secret, rolePassword(role)) {
+		audit_user(w, "Passwords."+role)
+		return &apiPrincipal{Name: "Passwords." + role}, nil
+	}
+	tokenHash := sha256.Sum256([]byte(secret))
+	for _, user := range httpobj.http_apiusers {
+		if subtle.ConstantTimeCompare(tokenHash[:], user.tokenHash) != 1 {
+			continue
+		}
+		audit_user(w, user.name)
+		if !user.roles[role] {
+			return nil, apiErrorf(http.StatusForbidden, "forbidden", "API user %v doesn't have the role %v", user.name, role)
+		}
+		return &apiPrincipal{Name: user.name, nodeIDs: user.nodeIDs}, nil
+	}
+	return nil, apiErrorf(http.StatusUnauthorized, "unauthorized", "Paramater Password: Wrong password")
+}
+
+// authorize is authenticate, which responds with the error itself.
+func authorize(w http.ResponseWriter, r *http.Request, role string) (*apiPrincipal, bool) {
+	principal, apierr := authenticate(w, r, role)
+	if apierr != nil {
+		apierr.writeText(w)
+		return nil, false
+	}
+	return principal, true
+}
+
+func (principal *apiPrincipal) canManage(NodeID mtypes.Vertex) *APIError {
+	if principal.nodeIDs == nil || principal.nodeIDs[NodeID] {
+		return nil
+	}
+	return apiErrorf(http.StatusForbidden, "forbidden", "Paramater NodeID: API user %v can't manage NodeID %v", principal.Name, NodeID.ToString())
+}
+
+// allowNode reports whether the principal may manage NodeID, and responds with an error otherwise.
+func (principal *apiPrincipal) allowNode(w http.ResponseWriter, NodeID mtypes.Vertex) bool {
+	if apierr := principal.canManage(NodeID); apierr != nil {
+		apierr.writeText(w)
+		return false
+	}
+	return true
+}
+
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	user   string
+	params map[string]string // of calls without form parameters
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func audit_user(w http.ResponseWriter, user string) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.user = user
+	}
+}
+
+// audit_body records the fields of a json request body as the parameters of the call.
+func audit_body(w http.ResponseWriter, body interface{}) {
+	aw, ok := w.(*auditWriter)
+	if !ok {
+		return
+	}
+	var fields map[string]interface{}
+	bodybytes, _ := json.Marshal(body)
+	if json.Unmarshal(bodybytes, &fields) != nil {
+		return
+	}
+	for key, val := range fields {
+		if auditSecrets[key] || val == nil {
+			continue
+		}
+		if aw.params == nil {
+			aw.params = make(map[string]string)
+		}
+		switch val.(type) {
+		case string, float64, bool:
+			aw.params[key] = fmt.Sprintf("%v", val)
+		default:
+			valbytes, _ := json.Marshal(val)
+			aw.params[key] = string(valbytes)
+		}
+	}
+}
+
+// audited appends every call of handler to the audit log.
+func audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := &auditWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(aw, r)
+		r.ParseForm()
+		entry := AuditEntry{
+			Time:         time.Now().Format(time.RFC3339),
+			User:         aw.user,
+			Remote:       r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Action:       action,
+			Status:       aw.status,
+		}
+		entry.Params = aw.params
+		for key, val := range r.Form {
+			if auditSecrets[key] || len(val) == 0 {
+				continue
+			}
+			if entry.Params == nil {
+				entry.Params = make(map[string]string)
+			}
+			entry.Params[key] = val[0]
+		}
+		httpobj.http_audit.write(entry)
+	}
+}
+
+func (audit *auditLog) write(entry AuditEntry) {
+	line, _ := json.Marshal(entry)
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.file == nil {
+		if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+			httpobj.http_log.Infof(mtypes.LogCatControl, nil, "Audit: %v", string(line))
+		}
+		return
+	}
+	if _, err := audit.file.Write(append(line, '\n')); err != nil {
+		httpobj.http_log.Errorf(mtypes.LogCatControl, nil, "Audit log: %v, entry: %v", err, string(line))
+	}
+}
@@ -0,0 +1,282 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const testAPIPrefix = "/eg_api"
+
+var testPasswords = mtypes.Passwords{
+	ShowState:   "passwd_showstate",
+	AddPeer:     "passwd_addpeer",
+	DelPeer:     "passwd_delpeer",
+	UpdatePeer:  "passwd_updatepeer",
+	UpdateSuper: "passwd_updatesuper",
+}
+
+func testTokenHash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(tokenHash[:])
+}
+
+func testPubKey(n byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{n}, 32))
+}
+
+// newAPITestServer sets up httpobj like a supernode without devices, with the peers 1 and 2 and users,
+// and returns the manage APIs and the path of the audit log.
+func newAPITestServer(t *testing.T, users []mtypes.APIUser) (*http.ServeMux, string) {
+	t.Helper()
+	dir := t.TempDir()
+	apiusers, err := load_apiusers(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.log")
+	auditFile, err := os.Create(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditFile.Close() })
+	sconfig := &mtypes.SuperConfig{
+		PeerAliveTimeout: 70,
+		SendPingInterval: 15,
+		HttpPostInterval: 50,
+	}
+	sconfigPath := filepath.Join(dir, "super.yaml")
+	httpobj = http_shared_objects{
+		http_HashSalt:     []byte("salt"),
+		http_passwords:    testPasswords,
+		http_apiusers:     apiusers,
+		http_audit:        auditLog{file: auditFile},
+		http_PeerID2Info:  make(map[mtypes.Vertex]mtypes.SuperPeerInfo),
+		http_PeerState:    make(map[string]*PeerState),
+		http_PeerIPs:      make(map[string]*HttpPeerLocalIP),
+		http_sconfig:      sconfig,
+		http_sconfig_path: sconfigPath,
+		http_history:      mtypes.NewConfigHistory(sconfigPath, mtypes.ConfigHistoryInfo{}),
+		http_econfig_tmp:  &mtypes.EdgeConfig{},
+	}
+	for _, NodeID := range []mtypes.Vertex{1, 2} {
+		peerinfo := mtypes.SuperPeerInfo{
+			NodeID:         NodeID,
+			Name:           "Node_0" + NodeID.ToString(),
+			PubKey:         testPubKey(byte(NodeID)),
+			AdditionalCost: 10,
+		}
+		if err := super_peeradd(peerinfo); err != nil {
+			t.Fatal(err)
+		}
+		sconfig.Peers = append(sconfig.Peers, peerinfo)
+	}
+	mux := http.NewServeMux()
+	manage_register(mux, testAPIPrefix)
+	return mux, auditPath
+}
+
+// testCall calls the manage API with the bearer token, if there is one.
+func testCall(mux *http.ServeMux, method string, target string, token string, body string, header ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, testAPIPrefix+target, reader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func readAudit(t *testing.T, auditPath string) []AuditEntry {
+	t.Helper()
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+var testAPIUsers = []mtypes.APIUser{
+	{Name: "viewer", TokenHash: testTokenHash("viewer-token"), Roles: []string{RoleShowState}},
+	{Name: "ops", TokenHash: testTokenHash("ops-token"), Roles: []string{RoleShowState, RoleAddPeer, RoleDelPeer, RoleUpdatePeer}, NodeIDs: "[2~9]"},
+}
+
+func TestLoadAPIUsers(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []mtypes.APIUser
+		ok    bool
+	}{
+		{"valid", testAPIUsers, true},
+		{"empty name", []mtypes.APIUser{{TokenHash: testTokenHash("a")}}, false},
+		{"duplicate name", []mtypes.APIUser{{Name: "a", TokenHash: testTokenHash("a")}, {Name: "a", TokenHash: testTokenHash("b")}}, false},
+		{"token instead of hash", []mtypes.APIUser{{Name: "a", TokenHash: "ops-token"}}, false},
+		{"short hash", []mtypes.APIUser{{Name: "a", TokenHash: testTokenHash("a")[:32]}}, false},
+		{"unknown role", []mtypes.APIUser{{Name: "a", TokenHash: testTokenHash("a"), Roles: []string{"Admin"}}}, false},
+		{"bad NodeIDs", []mtypes.APIUser{{Name: "a", TokenHash: testTokenHash("a"), NodeIDs: "1-9"}}, false},
+	}
+	for _, tt := range tests {
+		if _, err := load_apiusers(tt.users); (err == nil) != tt.ok {
+			t.Errorf("%v: load_apiusers error %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	newAPITestServer(t, testAPIUsers)
+	tests := []struct {
+		name     string
+		auth     string // Authorization header
+		password string // Password parameter
+		role     string
+		user     string // empty if it fails
+		status   int
+	}{
+		{"bearer token", "Bearer viewer-token", "", RoleShowState, "viewer", 0},
+		{"token as password", "", "ops-token", RoleAddPeer, "ops", 0},
+		{"password", "", testPasswords.UpdateSuper, RoleUpdateSuper, "Passwords.UpdateSuper", 0},
+		{"wrong token", "Bearer viewer-token2", "", RoleShowState, "", http.StatusUnauthorized},
+		{"token hash", "Bearer " + testTokenHash("viewer-token"), "", RoleShowState, "", http.StatusUnauthorized},
+		{"password of another role", "", testPasswords.ShowState, RoleAddPeer, "", http.StatusUnauthorized},
+		{"missing role", "Bearer viewer-token", "", RoleAddPeer, "", http.StatusForbidden},
+		{"missing role of a limited user", "Bearer ops-token", "", RoleUpdateSuper, "", http.StatusForbidden},
+		{"no secret", "Basic dXNlcjpwYXNz", "", RoleShowState, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?Password="+tt.password, nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		principal, apierr := authenticate(httptest.NewRecorder(), r, tt.role)
+		if tt.status != 0 {
+			if apierr == nil || apierr.Status != tt.status {
+				t.Errorf("%v: got %+v, want status %v", tt.name, apierr, tt.status)
+			}
+			continue
+		}
+		if apierr != nil || principal.Name != tt.user {
+			t.Errorf("%v: got %+v %+v, want user %v", tt.name, principal, apierr, tt.user)
+		}
+	}
+}
+
+func TestAPINodeIDScope(t *testing.T) {
+	mux, _ := newAPITestServer(t, testAPIUsers)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"legacy add outside", "POST", "/manage/peer/add?NodeID=10&Name=Node_10&AdditionalCost=10&SkipLocalIP=false&PubKey=" + testPubKey(10), "", http.StatusForbidden},
+		{"legacy add inside", "POST", "/manage/peer/add?NodeID=3&Name=Node_03&AdditionalCost=10&SkipLocalIP=false&PubKey=" + testPubKey(3), "", http.StatusOK},
+		{"legacy update outside", "POST", "/manage/peer/update?NodeID=1&AdditionalCost=20", "", http.StatusForbidden},
+		{"legacy update inside", "POST", "/manage/peer/update?NodeID=2&AdditionalCost=20", "", http.StatusOK},
+		{"legacy del outside", "GET", "/manage/peer/del?NodeID=1", "", http.StatusForbidden},
+		{"legacy del inside", "GET", "/manage/peer/del?NodeID=9", "", http.StatusNotFound},
+		{"v2 create outside", "POST", "/v2/peers", `{"NodeID":10,"Name":"Node_10","PubKey":"` + testPubKey(10) + `"}`, http.StatusForbidden},
+		{"v2 create inside", "POST", "/v2/peers", `{"NodeID":4,"Name":"Node_04","PubKey":"` + testPubKey(4) + `"}`, http.StatusCreated},
+		{"v2 update outside", "PATCH", "/v2/peers/1", `{"AdditionalCost":30}`, http.StatusForbidden},
+		{"v2 update inside", "PATCH", "/v2/peers/2", `{"AdditionalCost":30}`, http.StatusOK},
+		{"v2 delete outside", "DELETE", "/v2/peers/1", "", http.StatusForbidden},
+		{"v2 delete inside", "DELETE", "/v2/peers/9", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := testCall(mux, tt.method, tt.target, "ops-token", tt.body); w.Code != tt.status {
+			t.Errorf("%v: status %v, want %v: %v", tt.name, w.Code, tt.status, w.Body.String())
+		}
+	}
+	if httpobj.http_PeerID2Info[1].AdditionalCost != 10 || httpobj.http_PeerID2Info[2].AdditionalCost != 30 {
+		t.Errorf("peers are %+v", httpobj.http_PeerID2Info)
+	}
+	if _, has := httpobj.http_PeerID2Info[10]; has {
+		t.Error("added a peer outside of NodeIDs")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	mux, auditPath := newAPITestServer(t, testAPIUsers)
+	PSKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x55}, 32))
+	calls := []struct {
+		method string
+		target string
+		token  string
+		body   string
+		action string // empty if it isn't audited
+		user   string
+		status int
+	}{
+		{"GET", "/v2/super/params", "viewer-token", "", "", "", http.StatusOK},
+		{"GET", "/v2/peers", "viewer-token", "", "", "", http.StatusOK},
+		{"POST", "/manage/peer/update?NodeID=2&AdditionalCost=20&Password=" + testPasswords.UpdatePeer, "", "", "manage/peer/update", "Passwords.UpdatePeer", http.StatusOK},
+		{"POST", "/manage/peer/add?NodeID=5&Name=Node_05&AdditionalCost=10&SkipLocalIP=false&PSKey=" + PSKey + "&PubKey=" + testPubKey(5), "viewer-token", "", "manage/peer/add", "viewer", http.StatusForbidden},
+		{"GET", "/manage/peer/del?NodeID=2&Password=wrong", "", "", "manage/peer/del", "", http.StatusUnauthorized},
+		{"GET", "/manage/peer/del?PrivKey=" + PSKey, "", "", "manage/peer/del", "", http.StatusNotFound},
+		{"POST", "/v2/peers", "ops-token", `{"NodeID":5,"Name":"Node_05","PSKey":"` + PSKey + `","PubKey":"` + testPubKey(5) + `"}`, "POST /v2/peers", "ops", http.StatusCreated},
+		{"PATCH", "/v2/peers/1", "ops-token", `{"AdditionalCost":30}`, "PATCH /v2/peers/{id}", "ops", http.StatusForbidden},
+	}
+	var want []AuditEntry
+	for _, call := range calls {
+		if w := testCall(mux, call.method, call.target, call.token, call.body); w.Code != call.status {
+			t.Fatalf("%v %v: status %v, want %v: %v", call.method, call.target, w.Code, call.status, w.Body.String())
+		}
+		if call.action != "" {
+			want = append(want, AuditEntry{Action: call.action, User: call.user, Status: call.status})
+		}
+	}
+	entries := readAudit(t, auditPath)
+	if len(entries) != len(want) {
+		t.Fatalf("%v audit lines, want %v: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.Action != want[i].Action || entry.User != want[i].User || entry.Status != want[i].Status {
+			t.Errorf("audit line %v is %+v, want %+v", i, entry, want[i])
+		}
+		for key, val := range entry.Params {
+			if auditSecrets[key] || strings.Contains(val, PSKey) || strings.Contains(val, "passwd_") || strings.Contains(val, "wrong") {
+				t.Errorf("audit line %v has the secret %v=%v", i, key, val)
+			}
+		}
+	}
+	if entries[1].Params["NodeID"] != "5" || entries[1].Params["Name"] != "Node_05" {
+		t.Errorf("form parameters not recorded: %+v", entries[1].Params)
+	}
+	if entries[4].Params["NodeID"] != "5" || entries[4].Params["PubKey"] != testPubKey(5) {
+		t.Errorf("json body not recorded: %+v", entries[4].Params)
+	}
+}
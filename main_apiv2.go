@@ -0,0 +1,541 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// The v2 manage API takes and returns json. Errors are {"Error":{"Code":...,"Message":...}}.
+// Resources have an ETag over their config, not their state. Send it back in If-Match to update
+// or delete them only if nobody changed them since you got it, 412 otherwise.
+// The OpenAPI description at /v2/openapi.json is generated from v2Routes, the routes we serve.
+
+type V2Peer struct {
+	NodeID         mtypes.Vertex
+	Name           string
+	PubKey         string
+	PubKeyAlt      string `json:",omitempty"`
+	AdditionalCost float64
+	SkipLocalIP    bool
+	EndPoint       string     `json:",omitempty"`
+	ExternalIP     string     `json:",omitempty"`
+	LastSeen       *time.Time `json:",omitempty"` // nil if never seen
+	Version        string
+	Features       string
+	PSKVersion     uint64
+}
+
+type V2PeerCreate struct {
+	NodeID         mtypes.Vertex
+	Name           string
+	PubKey         string
+	PSKey          string `json:",omitempty"`
+	AdditionalCost float64
+	SkipLocalIP    bool
+	NextHopTable   mtypes.NextHopTable `json:",omitempty"` // required in static mode
+}
+
+type V2PeerCreated struct {
+	Peer       V2Peer
+	EdgeConfig string // yaml, generated from EdgeTemplate
+}
+
+type V2SuperParams struct {
+	SendPingInterval    float64
+	HttpPostInterval    float64
+	PeerAliveTimeout    float64
+	DampingFilterRadius uint64
+}
+
+type V2Routes struct {
+	NhTable   mtypes.NextHopTable
+	Infinity  float64
+	Edges     map[mtypes.Vertex]map[mtypes.Vertex]float64
+	Edges_Nh  map[mtypes.Vertex]map[mtypes.Vertex]float64
+	Dist      mtypes.DistTable
+	Dist_noAC mtypes.DistTable
+}
+
+type V2Error struct {
+	Error *APIError
+}
+
+type v2Route struct {
+	Method      string
+	Path        string // after apiprefix
+	OperationID string
+	Summary     string
+	Role        string
+	Request     interface{} // json body, nil for none
+	Status      int         // on success
+	Response    interface{} // json body on success, nil for none
+	handler     func(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError
+}
+
+var v2Routes = []v2Route{
+	{"GET", "/v2/peers", "listPeers", "List the peers", RoleShowState, nil, http.StatusOK, []V2Peer{}, v2_peers_list},
+	{"POST", "/v2/peers", "createPeer", "Add a peer", RoleAddPeer, V2PeerCreate{}, http.StatusCreated, V2PeerCreated{}, v2_peer_create},
+	{"GET", "/v2/peers/{id}", "getPeer", "Get a peer", RoleShowState, nil, http.StatusOK, V2Peer{}, v2_peer_get},
+	{"PATCH", "/v2/peers/{id}", "updatePeer", "Update a peer", RoleUpdatePeer, PeerPatch{}, http.StatusOK, V2Peer{}, v2_peer_update},
+	{"DELETE", "/v2/peers/{id}", "deletePeer", "Delete a peer", RoleDelPeer, nil, http.StatusNoContent, nil, v2_peer_delete},
+	{"GET", "/v2/super/params", "getSuperParams", "Get the parameters of the supernode", RoleShowState, nil, http.StatusOK, V2SuperParams{}, v2_superparams_get},
+	{"PATCH", "/v2/super/params", "updateSuperParams", "Update the parameters of the supernode", RoleUpdateSuper, SuperParamsPatch{}, http.StatusOK, V2SuperParams{}, v2_superparams_update},
+	{"GET", "/v2/super/revisions", "listRevisions", "List the revisions of the config of the supernode", RoleUpdateSuper, nil, http.StatusOK, []mtypes.ConfigRevision{}, v2_revisions_list},
+	{"POST", "/v2/super/revisions/{rev}/rollback", "rollback", "Roll the supernode back to a revision of its config", RoleUpdateSuper, nil, http.StatusOK, mtypes.ConfigRevision{}, v2_rollback},
+	{"GET", "/v2/routes", "getRoutes", "Get the graph and the routes the supernode computed", RoleShowState, nil, http.StatusOK, V2Routes{}, v2_routes_get},
+}
+
+// v2PathParams are the types of the parameters in the paths of v2Routes.
+var v2PathParams = map[string]reflect.Type{
+	"id":  reflect.TypeOf(mtypes.Vertex(0)),
+	"rev": reflect.TypeOf(uint64(0)),
+}
+
+func api_etag(v interface{}) string {
+	body, _ := json.Marshal(v)
+	md5_hash_raw := md5.Sum(append(body, httpobj.http_HashSalt...))
+	return "\"" + hex.EncodeToString(md5_hash_raw[:]) + "\""
+}
+
+// v2_ifmatch checks the If-Match header against the current ETag of the resource.
+func v2_ifmatch(r *http.Request, etag string) *APIError {
+	ifmatch := r.Header.Get("If-Match")
+	if ifmatch == "" || ifmatch == "*" {
+		return nil
+	}
+	for _, tag := range strings.Split(ifmatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return nil
+		}
+	}
+	return apiErrorf(http.StatusPreconditionFailed, "precondition_failed", "If-Match: the resource was changed, its ETag is %v now", etag)
+}
+
+func v2_write(w http.ResponseWriter, status int, etag string, body interface{}) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	ret, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(ret)
+}
+
+func v2_read(w http.ResponseWriter, r *http.Request, body interface{}) *APIError {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		return apiErrorf(http.StatusBadRequest, "bad_request", "Request body: %v", err)
+	}
+	audit_body(w, body)
+	return nil
+}
+
+func v2_nodeid(r *http.Request) (mtypes.Vertex, *APIError) {
+	NodeID, err := strconv.ParseUint(r.PathValue("id"), 10, 16)
+	if err != nil {
+		return 0, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater id: %v", err)
+	}
+	return mtypes.Vertex(NodeID), nil
+}
+
+func v2_handler(route v2Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, apierr := authenticate(w, r, route.Role)
+		if apierr == nil {
+			apierr = route.handler(w, r, principal)
+		}
+		if apierr != nil {
+			v2_write(w, apierr.Status, "", V2Error{Error: apierr})
+		}
+	}
+}
+
+func v2_peer(peerinfo mtypes.SuperPeerInfo) V2Peer {
+	// No lock, lock before call me
+	PS := httpobj.http_PeerState[peerinfo.PubKey]
+	peer := V2Peer{
+		NodeID:         peerinfo.NodeID,
+		Name:           peerinfo.Name,
+		PubKey:         peerinfo.PubKey,
+		PubKeyAlt:      PS.PubKeyAlt.Load().(string),
+		AdditionalCost: peerinfo.AdditionalCost,
+		SkipLocalIP:    peerinfo.SkipLocalIP,
+		EndPoint:       peerinfo.EndPoint,
+		ExternalIP:     peerinfo.ExternalIP,
+		Version:        PS.Version.Load().(string),
+		Features:       PS.Features.Load().(mtypes.Features).ToString(),
+		PSKVersion:     PS.PSKVersion.Load().(uint64),
+	}
+	if LastSeen := PS.LastSeen.Load().(time.Time); !LastSeen.IsZero() {
+		peer.LastSeen = &LastSeen
+	}
+	return peer
+}
+
+func v2_superparams() V2SuperParams {
+	// No lock, lock before call me
+	return V2SuperParams{
+		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
+		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
+		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
+		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
+	}
+}
+
+func v2_peers_list(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	peers := make([]V2Peer, 0, len(httpobj.http_sconfig.Peers))
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		peers = append(peers, v2_peer(peerinfo))
+	}
+	v2_write(w, http.StatusOK, api_etag(httpobj.http_sconfig.Peers), peers)
+	return nil
+}
+
+func v2_peer_create(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	var create V2PeerCreate
+	if apierr := v2_read(w, r, &create); apierr != nil {
+		return apierr
+	}
+	if apierr := principal.canManage(create.NodeID); apierr != nil {
+		return apierr
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if apierr := v2_ifmatch(r, api_etag(httpobj.http_sconfig.Peers)); apierr != nil {
+		return apierr
+	}
+	peerinfo := mtypes.SuperPeerInfo{
+		NodeID:         create.NodeID,
+		Name:           create.Name,
+		PubKey:         create.PubKey,
+		PSKey:          create.PSKey,
+		AdditionalCost: create.AdditionalCost,
+		SkipLocalIP:    create.SkipLocalIP,
+	}
+	EdgeConfig, apierr := api_peeradd(principal.Name, peerinfo, create.NextHopTable)
+	if apierr != nil {
+		return apierr
+	}
+	peerinfo = httpobj.http_PeerID2Info[create.NodeID]
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+create.NodeID.ToString())
+	v2_write(w, http.StatusCreated, api_etag(peerinfo), V2PeerCreated{
+		Peer:       v2_peer(peerinfo),
+		EdgeConfig: string(EdgeConfig),
+	})
+	return nil
+}
+
+func v2_peer_get(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	NodeID, apierr := v2_nodeid(r)
+	if apierr != nil {
+		return apierr
+	}
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has {
+		return apiErrorf(http.StatusNotFound, "not_found", "Paramater id: \"%v\" not found", NodeID)
+	}
+	v2_write(w, http.StatusOK, api_etag(peerinfo), v2_peer(peerinfo))
+	return nil
+}
+
+func v2_peer_update(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	NodeID, apierr := v2_nodeid(r)
+	if apierr != nil {
+		return apierr
+	}
+	if apierr := principal.canManage(NodeID); apierr != nil {
+		return apierr
+	}
+	var patch PeerPatch
+	if apierr := v2_read(w, r, &patch); apierr != nil {
+		return apierr
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has {
+		return apiErrorf(http.StatusNotFound, "not_found", "Paramater id: \"%v\" not found", NodeID)
+	}
+	if apierr := v2_ifmatch(r, api_etag(peerinfo)); apierr != nil {
+		return apierr
+	}
+	if _, apierr := api_peerupdate(principal.Name, NodeID, patch); apierr != nil {
+		return apierr
+	}
+	peerinfo = httpobj.http_PeerID2Info[NodeID]
+	v2_write(w, http.StatusOK, api_etag(peerinfo), v2_peer(peerinfo))
+	return nil
+}
+
+func v2_peer_delete(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	NodeID, apierr := v2_nodeid(r)
+	if apierr != nil {
+		return apierr
+	}
+	if apierr := principal.canManage(NodeID); apierr != nil {
+		return apierr
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has {
+		return apiErrorf(http.StatusNotFound, "not_found", "Paramater id: \"%v\" not found", NodeID)
+	}
+	if apierr := v2_ifmatch(r, api_etag(peerinfo)); apierr != nil {
+		return apierr
+	}
+	api_peerdel(principal.Name, NodeID)
+	v2_write(w, http.StatusNoContent, "", nil)
+	return nil
+}
+
+func v2_superparams_get(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	params := v2_superparams()
+	v2_write(w, http.StatusOK, api_etag(params), params)
+	return nil
+}
+
+func v2_superparams_update(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	var patch SuperParamsPatch
+	if apierr := v2_read(w, r, &patch); apierr != nil {
+		return apierr
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if apierr := v2_ifmatch(r, api_etag(v2_superparams())); apierr != nil {
+		return apierr
+	}
+	if _, apierr := api_superupdate(principal.Name, patch); apierr != nil {
+		return apierr
+	}
+	params := v2_superparams()
+	v2_write(w, http.StatusOK, api_etag(params), params)
+	return nil
+}
+
+func v2_revisions_list(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	revs, err := httpobj.http_history.List()
+	if err != nil {
+		return apiErrorf(http.StatusInternalServerError, "internal_error", "ConfigHistory: %v", err)
+	}
+	v2_write(w, http.StatusOK, api_etag(httpobj.http_sconfig), revs)
+	return nil
+}
+
+func v2_rollback(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	revnum, err := strconv.ParseUint(r.PathValue("rev"), 10, 64)
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "bad_request", "Paramater rev: %v", err)
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if apierr := v2_ifmatch(r, api_etag(httpobj.http_sconfig)); apierr != nil {
+		return apierr
+	}
+	saved, apierr := api_rollback(principal.Name, revnum)
+	if apierr != nil {
+		return apierr
+	}
+	v2_write(w, http.StatusOK, api_etag(httpobj.http_sconfig), saved)
+	return nil
+}
+
+func v2_routes_get(w http.ResponseWriter, r *http.Request, principal *apiPrincipal) *APIError {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	v2_write(w, http.StatusOK, "", V2Routes{
+		NhTable:   httpobj.http_graph.GetNHTable(false),
+		Infinity:  mtypes.Infinity,
+		Edges:     httpobj.http_graph.GetEdges(false, false),
+		Edges_Nh:  httpobj.http_graph.GetEdges(true, true),
+		Dist:      httpobj.http_graph.GetDtst(true),
+		Dist_noAC: httpobj.http_graph.GetDtst(false),
+	})
+	return nil
+}
+
+// v2_register adds the v2 manage API to mux. Calls which change something go to the audit log.
+func v2_register(mux *http.ServeMux, apiprefix string) {
+	for _, route := range v2Routes {
+		handler := v2_handler(route)
+		if route.Method != "GET" {
+			handler = audited(route.Method+" "+route.Path, handler)
+		}
+		mux.HandleFunc(route.Method+" "+apiprefix+route.Path, handler)
+	}
+	openapi, _ := json.Marshal(v2_openapi(apiprefix))
+	mux.HandleFunc("GET "+apiprefix+"/v2/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(openapi)
+	})
+}
+
+// v2_openapi describes v2Routes in OpenAPI 3.0.
+func v2_openapi(apiprefix string) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": openapi_schema(reflect.TypeOf(V2Error{}), schemas)}},
+	}
+	for _, route := range v2Routes {
+		operation := map[string]interface{}{
+			"operationId": route.OperationID,
+			"summary":     route.Summary,
+			"x-role":      route.Role,
+			"security":    []map[string][]string{{"bearer": {}}, {"password": {}}},
+		}
+		var parameters []map[string]interface{}
+		for _, part := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     strings.Trim(part, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   openapi_schema(v2PathParams[strings.Trim(part, "{}")], schemas),
+				})
+			}
+		}
+		if route.Method != "GET" {
+			parameters = append(parameters, map[string]interface{}{
+				"name":   "If-Match",
+				"in":     "header",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": openapi_schema(reflect.TypeOf(route.Request), schemas)}},
+			}
+		}
+		response := map[string]interface{}{
+			"description": http.StatusText(route.Status),
+			"headers":     map[string]interface{}{"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+		}
+		if route.Response != nil {
+			response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": openapi_schema(reflect.TypeOf(route.Response), schemas)}}
+		}
+		operation["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): response,
+			"default":                  errorResponse,
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "EtherGuard supernode manage API",
+			"version": "2",
+		},
+		"servers": []map[string]interface{}{{"url": apiprefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer":   map[string]interface{}{"type": "http", "scheme": "bearer", "description": "Token of an API user"},
+				"password": map[string]interface{}{"type": "apiKey", "in": "query", "name": "Password", "description": "Password of the role, or token of an API user"},
+			},
+		},
+	}
+}
+
+// openapi_schema returns the schema of the json encoding of t. Named structs go to schemas and are referenced.
+func openapi_schema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := openapi_schema(t.Elem(), schemas)
+		if _, ref := schema["$ref"]; ref {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			schema["maximum"] = uint64(1)<<t.Bits() - 1
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openapi_schema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openapi_schema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, has := schemas[t.Name()]; has {
+			return ref
+		}
+		schemas[t.Name()] = nil // placeholder for recursive types
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = openapi_schema(field.Type, schemas)
+			if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if required != nil {
+			schema["required"] = required
+		}
+		schemas[t.Name()] = schema
+		return ref
+	}
+	panic(fmt.Sprintf("openapi_schema: unsupported type %v", t))
+}
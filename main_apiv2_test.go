@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testV2Error(t *testing.T, body []byte) *APIError {
+	t.Helper()
+	var v2err V2Error
+	if err := json.Unmarshal(body, &v2err); err != nil || v2err.Error == nil {
+		t.Fatalf("error body %q: %v", body, err)
+	}
+	return v2err.Error
+}
+
+func TestV2IfMatch(t *testing.T) {
+	mux, _ := newAPITestServer(t, testAPIUsers)
+
+	w := testCall(mux, "GET", "/v2/peers/2", "viewer-token", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %v ETag %q", w.Code, etag)
+	}
+	if w := testCall(mux, "PATCH", "/v2/peers/2", "ops-token", `{"AdditionalCost":20}`, "If-Match", `"stale"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("update with a stale ETag: status %v", w.Code)
+	} else if apierr := testV2Error(t, w.Body.Bytes()); apierr.Code != "precondition_failed" || !strings.Contains(apierr.Message, etag) {
+		t.Errorf("update with a stale ETag: %+v", apierr)
+	}
+	w = testCall(mux, "PATCH", "/v2/peers/2", "ops-token", `{"AdditionalCost":20}`, "If-Match", "W/"+etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("update with the ETag: status %v ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	// somebody else changed the peer since we got etag
+	if w := testCall(mux, "PATCH", "/v2/peers/2", "ops-token", `{"AdditionalCost":30}`, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("update with the old ETag: status %v", w.Code)
+	}
+	if w := testCall(mux, "DELETE", "/v2/peers/2", "ops-token", "", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with the old ETag: status %v", w.Code)
+	}
+	if httpobj.http_PeerID2Info[2].AdditionalCost != 20 {
+		t.Errorf("peer 2 is %+v", httpobj.http_PeerID2Info[2])
+	}
+
+	// the list has an ETag over all peers, creating one changes it
+	w = testCall(mux, "GET", "/v2/peers", "viewer-token", "")
+	listEtag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || listEtag == "" {
+		t.Fatalf("status %v ETag %q", w.Code, listEtag)
+	}
+	create := func(NodeID byte) string {
+		return `{"NodeID":` + strconv.Itoa(int(NodeID)) + `,"Name":"Node_0` + strconv.Itoa(int(NodeID)) + `","PubKey":"` + testPubKey(NodeID) + `"}`
+	}
+	if w := testCall(mux, "POST", "/v2/peers", "ops-token", create(3), "If-Match", listEtag); w.Code != http.StatusCreated {
+		t.Fatalf("create with the list ETag: status %v: %v", w.Code, w.Body.String())
+	}
+	if w := testCall(mux, "POST", "/v2/peers", "ops-token", create(4), "If-Match", listEtag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("create with the old list ETag: status %v", w.Code)
+	}
+	if w := testCall(mux, "GET", "/v2/peers", "viewer-token", ""); w.Header().Get("ETag") == listEtag {
+		t.Error("list ETag not changed by the new peer")
+	}
+	if _, has := httpobj.http_PeerID2Info[4]; has {
+		t.Error("peer created with the old list ETag")
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	mux, _ := newAPITestServer(t, testAPIUsers)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{"wrong token", "GET", "/v2/peers", "wrong-token", "", http.StatusUnauthorized, "unauthorized"},
+		{"no token", "GET", "/v2/peers", "", "", http.StatusBadRequest, "unauthenticated"},
+		{"missing role", "DELETE", "/v2/peers/2", "viewer-token", "", http.StatusForbidden, "forbidden"},
+		{"create outside NodeIDs", "POST", "/v2/peers", "ops-token", `{"NodeID":1,"Name":"Node_01","PubKey":"` + testPubKey(1) + `"}`, http.StatusForbidden, "forbidden"},
+		{"update outside NodeIDs", "PATCH", "/v2/peers/1", "ops-token", `{"AdditionalCost":20}`, http.StatusForbidden, "forbidden"},
+		{"delete outside NodeIDs", "DELETE", "/v2/peers/1", "ops-token", "", http.StatusForbidden, "forbidden"},
+		{"not found", "GET", "/v2/peers/3", "viewer-token", "", http.StatusNotFound, "not_found"},
+		{"bad id", "GET", "/v2/peers/x", "viewer-token", "", http.StatusBadRequest, "bad_request"},
+		{"bad rev", "POST", "/v2/super/revisions/x/rollback?Password=" + testPasswords.UpdateSuper, "", "", http.StatusBadRequest, "bad_request"},
+		{"existing NodeID", "POST", "/v2/peers", "ops-token", `{"NodeID":2,"Name":"Node_02","PubKey":"` + testPubKey(3) + `"}`, http.StatusConflict, "conflict"},
+		{"empty name", "POST", "/v2/peers", "ops-token", `{"NodeID":3,"PubKey":"` + testPubKey(3) + `"}`, http.StatusBadRequest, "bad_request"},
+		{"malformed body", "PATCH", "/v2/peers/2", "ops-token", `{"AdditionalCost":`, http.StatusBadRequest, "bad_request"},
+		{"unknown field in update", "PATCH", "/v2/peers/2", "ops-token", `{"AdditionalCost":20,"Cost":20}`, http.StatusBadRequest, "bad_request"},
+		{"unknown field in create", "POST", "/v2/peers", "ops-token", `{"NodeID":3,"Name":"Node_03","PubKey":"` + testPubKey(3) + `","PrivKey":"x"}`, http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range tests {
+		w := testCall(mux, tt.method, tt.target, tt.token, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%v: status %v, want %v: %v", tt.name, w.Code, tt.status, w.Body.String())
+			continue
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%v: Content-Type %q", tt.name, w.Header().Get("Content-Type"))
+		}
+		if apierr := testV2Error(t, w.Body.Bytes()); apierr.Code != tt.code || apierr.Message == "" {
+			t.Errorf("%v: error %+v, want code %v", tt.name, apierr, tt.code)
+		}
+	}
+	if len(httpobj.http_PeerID2Info) != 2 || httpobj.http_PeerID2Info[2].AdditionalCost != 10 {
+		t.Errorf("failed calls changed the peers: %+v", httpobj.http_PeerID2Info)
+	}
+}
+
+func TestV2OpenAPI(t *testing.T) {
+	mux, _ := newAPITestServer(t, testAPIUsers)
+	w := testCall(mux, "GET", "/v2/openapi.json", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v", w.Code)
+	}
+	var openapi struct {
+		Servers []struct{ URL string }
+		Paths   map[string]map[string]struct {
+			OperationID string
+			Responses   map[string]interface{}
+		}
+		Components struct {
+			Schemas map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &openapi); err != nil {
+		t.Fatal(err)
+	}
+	if len(openapi.Servers) != 1 || openapi.Servers[0].URL != testAPIPrefix {
+		t.Errorf("servers %+v", openapi.Servers)
+	}
+	for _, route := range v2Routes {
+		op, ok := openapi.Paths[route.Path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%v %v not described", route.Method, route.Path)
+			continue
+		}
+		if op.OperationID != route.OperationID {
+			t.Errorf("%v %v: operationId %q, want %q", route.Method, route.Path, op.OperationID, route.OperationID)
+		}
+		if _, ok := op.Responses[strconv.Itoa(route.Status)]; !ok {
+			t.Errorf("%v %v: response %v not described", route.Method, route.Path, route.Status)
+		}
+	}
+	refs := regexp.MustCompile(`"\$ref":"#/components/schemas/([^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	if len(refs) == 0 {
+		t.Error("no schema referenced")
+	}
+	for _, ref := range refs {
+		if _, ok := openapi.Components.Schemas[ref[1]]; !ok {
+			t.Errorf("schema %v referenced but not described", ref[1])
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"gopkg.in/yaml.v2"
+)
+
+// The supernode saves its config through http_history, which replaces the file atomically and keeps the last
+// ConfigHistory.Keep revisions. A rollback applies a revision to the running supernode like the manage API calls
+// which made it, and pushes the changes to the edges. The keys of the peers we have stay, since the edges rotate them.
+
+// save_sconfig saves the config after user changed it. It returns the revision it was saved as.
+func save_sconfig(user string, action string) mtypes.ConfigRevision {
+	// No lock, lock before call me
+	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
+	rev, err := httpobj.http_history.Save(mtypesBytes, user, action)
+	if err != nil {
+		httpobj.http_log.Errorf(mtypes.LogCatControl, nil, "Save config %v: %v", httpobj.http_sconfig_path, err)
+		return rev
+	}
+	if rev.Revision != 0 && httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		httpobj.http_log.Infof(mtypes.LogCatControl, nil, "Config saved as revision %v, %v by %v", rev.Revision, action, user)
+	}
+	return rev
+}
+
+// update_superparams_state updates the hashes of the parameters each peer should have.
+func update_superparams_state() {
+	// No lock, lock before call me
+	SuperParams := mtypes.API_SuperParams{
+		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
+		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
+		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
+		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
+		AdditionalCost:      10,
+	}
+	for _, peerinfo := range httpobj.http_PeerID2Info {
+		SuperParams.AdditionalCost = peerinfo.AdditionalCost
+		PubKey := peerinfo.PubKey
+		SuperParamStr, _ := json.Marshal(SuperParams)
+		md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
+		new_hash_str := hex.EncodeToString(md5_hash_raw[:])
+		httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
+	}
+}
+
+// rollback_peers returns the peers of a rollback to target, or why we can't roll back to it.
+func rollback_peers(target []mtypes.SuperPeerInfo) ([]mtypes.SuperPeerInfo, error) {
+	// No lock, lock before call me
+	peers := make([]mtypes.SuperPeerInfo, 0, len(target))
+	NodeIDs := make(map[mtypes.Vertex]bool)
+	Names := make(map[string]bool)
+	PubKeys := make(map[string]bool)
+	for _, peerinfo := range target {
+		if existing, has := httpobj.http_PeerID2Info[peerinfo.NodeID]; has {
+			peerinfo.PubKey = existing.PubKey
+			peerinfo.PSKey = existing.PSKey
+		}
+		if NodeIDs[peerinfo.NodeID] || Names[peerinfo.Name] || PubKeys[peerinfo.PubKey] {
+			return nil, fmt.Errorf("Peers: NodeID %v, its Name or its PubKey appears twice", peerinfo.NodeID)
+		}
+		NodeIDs[peerinfo.NodeID] = true
+		Names[peerinfo.Name] = true
+		PubKeys[peerinfo.PubKey] = true
+		peers = append(peers, peerinfo)
+	}
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if !NodeIDs[peerinfo.NodeID] && PubKeys[peerinfo.PubKey] {
+			// removed peers are removed in the background, their PubKey isn't free yet
+			return nil, fmt.Errorf("Peers: PubKey of %v belongs to another NodeID in the revision, delete it first", peerinfo.NodeID)
+		}
+	}
+	return peers, nil
+}
+
+// api_rollback applies a revision of the config for the manage APIs. It returns the revision it was saved as.
+func api_rollback(user string, revnum uint64) (mtypes.ConfigRevision, *APIError) {
+	// No lock, lock before call me
+	rev, err := httpobj.http_history.Get(revnum)
+	if os.IsNotExist(err) {
+		return rev, apiErrorf(http.StatusNotFound, "not_found", "Paramater Revision: revision %v not found", revnum)
+	} else if err != nil {
+		return rev, apiErrorf(http.StatusInternalServerError, "internal_error", "Revision %v: %v", revnum, err)
+	}
+	var target mtypes.SuperConfig
+	if err := yaml.Unmarshal([]byte(rev.Config), &target); err != nil {
+		return rev, apiErrorf(http.StatusInternalServerError, "internal_error", "Revision %v: %v", revnum, err)
+	}
+
+	check := target
+	check.Peers = httpobj.http_sconfig.Peers
+	check.NextHopTable = httpobj.http_sconfig.NextHopTable
+	check.SendPingInterval = httpobj.http_sconfig.SendPingInterval
+	check.HttpPostInterval = httpobj.http_sconfig.HttpPostInterval
+	check.PeerAliveTimeout = httpobj.http_sconfig.PeerAliveTimeout
+	check.DampingFilterRadius = httpobj.http_sconfig.DampingFilterRadius
+	// cleared at startup if the address family is disabled
+	if httpobj.http_sconfig.PrivKeyV4 == "" {
+		check.PrivKeyV4 = ""
+	}
+	if httpobj.http_sconfig.PrivKeyV6 == "" {
+		check.PrivKeyV6 = ""
+	}
+	if fields := mtypes.DiffFields(*httpobj.http_sconfig, check); len(fields) > 0 {
+		return rev, apiErrorf(http.StatusConflict, "conflict", "Revision %v: these fields take a restart: %v", revnum, strings.Join(fields, ", "))
+	}
+	peers, err := rollback_peers(target.Peers)
+	if err != nil {
+		return rev, apiErrorf(http.StatusConflict, "conflict", "Revision %v: %v", revnum, err)
+	}
+	StaticMode := httpobj.http_sconfig.GraphRecalculateSetting.StaticMode
+	if StaticMode {
+		if err := checkNhTable(target.NextHopTable, peers); err != nil {
+			return rev, apiErrorf(http.StatusConflict, "conflict", "Revision %v: %v", revnum, err)
+		}
+	}
+
+	NodeIDs := make(map[mtypes.Vertex]bool)
+	for _, peerinfo := range peers {
+		NodeIDs[peerinfo.NodeID] = true
+	}
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if !NodeIDs[peerinfo.NodeID] {
+			super_peerdel(peerinfo.NodeID)
+		}
+	}
+	peers_new := make([]mtypes.SuperPeerInfo, 0, len(peers))
+	for _, peerinfo := range peers {
+		if _, has := httpobj.http_PeerID2Info[peerinfo.NodeID]; has {
+			httpobj.http_PeerID2Info[peerinfo.NodeID] = peerinfo
+		} else if err := super_peeradd(peerinfo); err != nil {
+			httpobj.http_log.Errorf(mtypes.LogCatControl, mtypes.LogFields{"peer_id": peerinfo.NodeID.ToString()}, "Rollback to revision %v: %v", revnum, err)
+			continue
+		}
+		peers_new = append(peers_new, peerinfo)
+	}
+	httpobj.http_sconfig.Peers = peers_new
+	httpobj.http_sconfig.NextHopTable = target.NextHopTable
+	if StaticMode {
+		httpobj.http_graph.SetNHTable(target.NextHopTable)
+		NhTablestr, _ := json.Marshal(httpobj.http_graph.GetNHTable(true))
+		md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+		httpobj.http_NhTable_Hash = hex.EncodeToString(md5_hash_raw[:])
+		httpobj.http_NhTableStr = NhTablestr
+	}
+	httpobj.http_sconfig.SendPingInterval = target.SendPingInterval
+	httpobj.http_sconfig.HttpPostInterval = target.HttpPostInterval
+	httpobj.http_sconfig.PeerAliveTimeout = target.PeerAliveTimeout
+	httpobj.http_sconfig.DampingFilterRadius = target.DampingFilterRadius
+	update_superparams_state()
+
+	httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+	PushPeerinfo(true)
+	PushServerParams(true)
+	if StaticMode {
+		PushNhTable(true)
+	}
+	saved := save_sconfig(user, fmt.Sprintf("rollback to revision %v", revnum))
+	if len(peers_new) != len(peers) {
+		return saved, apiErrorf(http.StatusExpectationFailed, "expectation_failed", "Rolled back to revision %v, but some peers failed to be added, see the log", revnum)
+	}
+	return saved, nil
+}
+
+func manage_history(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, RoleUpdateSuper); !ok {
+		return
+	}
+	revs, err := httpobj.http_history.List()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("ConfigHistory: %v", err)))
+		return
+	}
+	ret, _ := json.Marshal(revs)
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+func manage_rollback(w http.ResponseWriter, r *http.Request) {
+	principal, ok := authorize(w, r, RoleUpdateSuper)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	Revision, err := extractParamsUint(r.Form, "Revision", 64, w)
+	if err != nil {
+		return
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	saved, apierr := api_rollback(principal.Name, Revision)
+	if apierr != nil {
+		apierr.writeText(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Rolled back to revision %v, saved as revision %v.\n", Revision, saved.Revision)))
+}
+
+// Rollback rolls the supernode of configPath back to a revision of its config, or lists the revisions if revnum is 0.
+// It asks the running supernode through the manage API, with the token of an API user in $EG_API_TOKEN or
+// Passwords.UpdateSuper. If it doesn't answer, it restores the config file only.
+func Rollback(configPath string, revnum uint64) (err error) {
+	var sconfig mtypes.SuperConfig
+	err = mtypes.ReadYaml(configPath, &sconfig)
+	if err != nil {
+		return err
+	}
+	history := mtypes.NewConfigHistory(configPath, sconfig.ConfigHistory)
+	if revnum == 0 {
+		revs, err := history.List()
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			fmt.Printf("%v\t%v\t%v\t%v\n", rev.Revision, rev.Time, rev.User, rev.Action)
+		}
+		return nil
+	}
+	rev, err := history.Get(revnum)
+	if err != nil {
+		return fmt.Errorf("revision %v: %v", revnum, err)
+	}
+	current, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Print(mtypes.ConfigDiff(string(current), rev.Config))
+	if sconfig.ListenPort_ManageAPI != "" {
+		ManageAPI, err := manage_host(sconfig.ListenPort_ManageAPI)
+		if err != nil {
+			return err
+		}
+		APIPrefix := sconfig.API_Prefix
+		if len(APIPrefix) > 0 && APIPrefix[0] != '/' {
+			APIPrefix = "/" + APIPrefix
+		}
+		params := url.Values{}
+		params.Add("Revision", strconv.FormatUint(revnum, 10))
+		req, _ := http.NewRequest("POST", "http://"+ManageAPI+APIPrefix+"/manage/super/rollback?"+params.Encode(), nil)
+		secret := os.Getenv(ENV_EG_API_TOKEN)
+		if secret == "" {
+			secret = sconfig.Passwords.UpdateSuper
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("rollback: %v %v", resp.Status, string(body))
+			}
+			fmt.Print(string(body))
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "The supernode doesn't answer: %v\n", err)
+	}
+	if err := history.Init("", "startup"); err != nil {
+		return err
+	}
+	saved, err := history.Save([]byte(rev.Config), "", fmt.Sprintf("rollback to revision %v", revnum))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored revision %v to %v as revision %v, start the supernode to apply it.\n", revnum, configPath, saved.Revision)
+	return nil
+}
@@ -6,7 +6,9 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -33,6 +36,58 @@ func printExampleEdgeConf() {
 	fmt.Print(string(toprint))
 }
 
+// RotateKey generates a new private key for the running edge of configPath, and hands it to the edge by UAPI.
+// The edge registers it with the supernode and rotates to it without downtime.
+func RotateKey(configPath string) (err error) {
+	var econfig mtypes.EdgeConfig
+	err = mtypes.ReadYaml(configPath, &econfig)
+	if err != nil {
+		fmt.Printf("Error read config: %v\t%v\n", configPath, err)
+		return err
+	}
+	sk, pk := device.RandomKeyPair()
+	uapi, err := ipc.UAPIDial(econfig.NodeName)
+	if err != nil {
+		return fmt.Errorf("UAPI of %v: %v", econfig.NodeName, err)
+	}
+	defer uapi.Close()
+	fmt.Fprintf(uapi, "set=1\nrotate_private_key=%v\n\n", hex.EncodeToString(sk[:]))
+	status, err := bufio.NewReader(uapi).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("UAPI of %v: %v", econfig.NodeName, err)
+	}
+	if status != "errno=0\n" {
+		return fmt.Errorf("rotate_private_key failed with %v, see the log of the edge", strings.TrimSpace(status))
+	}
+	fmt.Println("New PubKey:", pk.ToString())
+	return nil
+}
+
+// Reload makes the running edge of configPath reload it by UAPI, like SIGHUP does.
+func Reload(configPath string) (err error) {
+	var econfig mtypes.EdgeConfig
+	err = mtypes.ReadYaml(configPath, &econfig)
+	if err != nil {
+		fmt.Printf("Error read config: %v\t%v\n", configPath, err)
+		return err
+	}
+	uapi, err := ipc.UAPIDial(econfig.NodeName)
+	if err != nil {
+		return fmt.Errorf("UAPI of %v: %v", econfig.NodeName, err)
+	}
+	defer uapi.Close()
+	fmt.Fprintf(uapi, "set=1\nreload_config=true\n\n")
+	status, err := bufio.NewReader(uapi).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("UAPI of %v: %v", econfig.NodeName, err)
+	}
+	if status != "errno=0\n" {
+		return fmt.Errorf("reload_config failed with %v, see the log of the edge", strings.TrimSpace(status))
+	}
+	fmt.Println("Reloaded", configPath)
+	return nil
+}
+
 func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (err error) {
 	if printExample {
 		printExampleEdgeConf()
@@ -52,21 +107,11 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if len(NodeName) > 32 {
 		return errors.New("Node name can't longer than 32 :" + NodeName)
 	}
-	var logLevel int
-	switch econfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
+	slog, err := mtypes.NewLogger(econfig.LogLevel, NodeName, econfig.NodeID)
+	if err != nil {
+		return err
 	}
-	logger := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName),
-	)
+	logger := device.NewStructuredLogger(slog)
 
 	if err != nil {
 		logger.Errorf("UAPI listen error: %v", err)
@@ -84,13 +129,13 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	case "udpsock":
 		thetap, err = tap.CreateUDPSockTAP(econfig.Interface, econfig.NodeID)
 	case "tcpsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "tcp", econfig.NodeID, econfig.LogLevel)
+		thetap, err = tap.CreateSockTAP(econfig.Interface, "tcp", econfig.NodeID, slog)
 	case "unixsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unix", econfig.NodeID, econfig.LogLevel)
+		thetap, err = tap.CreateSockTAP(econfig.Interface, "unix", econfig.NodeID, slog)
 	case "unixgramsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixgram", econfig.NodeID, econfig.LogLevel)
+		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixgram", econfig.NodeID, slog)
 	case "unixpacketsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixpacket", econfig.NodeID, econfig.LogLevel)
+		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixpacket", econfig.NodeID, slog)
 	case "fd":
 		thetap, err = tap.CreateFdTAP(econfig.Interface, econfig.NodeID)
 	case "vpp":
@@ -108,13 +153,19 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if econfig.DefaultTTL <= 0 {
 		return errors.New("DefaultTTL must > 0")
 	}
+	if err := device.CheckMacFlap(econfig.MacFlap); err != nil {
+		return err
+	}
+	if err := device.CheckLoopDetect(econfig.LoopDetect); err != nil {
+		return err
+	}
 
 	////////////////////////////////////////////////////
 	// Config
 	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
-		econfig.LogLevel.LogNTP = false // NTP in static mode is useless
+		slog.SetLevel(mtypes.LogCatNTP, mtypes.LogLevelError) // NTP in static mode is useless
 	}
-	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
+	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, slog)
 	if err != nil {
 		return err
 	}
@@ -130,24 +181,18 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		return err
 	}
 	the_device.SetPrivateKey(pk)
+	if err := the_device.SetAdmission(econfig.DynamicRoute.P2P.Admission); err != nil {
+		return fmt.Errorf("P2P.Admission: %v", err)
+	}
 	the_device.IpcSet("fwmark=" + fmt.Sprint(econfig.FwMark) + "\n")
 	the_device.IpcSet("listen_port=" + strconv.Itoa(econfig.ListenPort) + "\n")
 	the_device.IpcSet("replace_peers=true\n")
 	for _, peerconf := range econfig.Peers {
-		pk, err := device.Str2PubKey(peerconf.PubKey)
+		err = the_device.AddConfigPeer(peerconf)
 		if err != nil {
-			fmt.Println("Error decode base64 ", err)
+			logger.Errorf("Failed to add peer %v: %v", peerconf.NodeID, err)
 			return err
 		}
-		the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive)
-		if peerconf.EndPoint != "" {
-			peer := the_device.LookupPeer(pk)
-			err = peer.SetEndpointFromConnURL(peerconf.EndPoint, EnabledAf, econfig.AfPrefer, peerconf.Static)
-			if err != nil {
-				logger.Errorf("Failed to set endpoint %v: %w", peerconf.EndPoint, err)
-				return err
-			}
-		}
 	}
 
 	if econfig.DynamicRoute.SuperNode.UseSuperNode {
@@ -252,8 +297,8 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
+		if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			slog.Infof(mtypes.LogCatInternal, nil, "PostScript: exec.Command(%v)", cmdarg)
 		}
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		cmd.Env = os.Environ()
@@ -264,8 +309,8 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
+		if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			slog.Infof(mtypes.LogCatInternal, nil, "PostScript output: %s", string(out))
 		}
 	}
 
@@ -273,11 +318,21 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := the_device.ReloadConfig(); err != nil {
+				logger.Errorf("Failed to reload %v: %v", configPath, err)
+			}
+		}
+	}()
+
 	the_device.Chan_Device_Initialized <- struct{}{}
 	mtypes.SdNotify(false, mtypes.SdNotifyReady)
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if econfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
+	if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		slog.Infof(mtypes.LogCatInternal, nil, "SdNotify:%v err:%v", SdNotify, err)
 	}
 
 	select {
@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// An enrollment token lets one new edge join without an admin. The edge generates its own key, and presents the
+// token with its PubKey to the edge API. It gets a NodeID from the Enrollment pool and its config in return, so
+// its private key never leaves it. Tokens are kept in memory only, restarting the supernode revokes them.
+
+type EnrollToken struct {
+	Name           string // empty lets the edge choose
+	AdditionalCost float64
+	SkipLocalIP    bool
+	Expire         time.Time
+}
+
+type EnrollTokenInfo struct {
+	Token   string `yaml:"Token"`
+	Name    string `yaml:"Name,omitempty"`
+	Expires string `yaml:"Expires"`
+}
+
+func purge_enroll(now time.Time) {
+	// No lock, lock before call me
+	for token, info := range httpobj.http_enroll {
+		if now.After(info.Expire) {
+			delete(httpobj.http_enroll, token)
+		}
+	}
+}
+
+// enroll_nodeid returns the lowest NodeID of the Enrollment pool which isn't in use.
+func enroll_nodeid() (mtypes.Vertex, bool) {
+	// No lock, lock before call me
+	conf := httpobj.http_sconfig.Enrollment
+	for NodeID := conf.NodeIDFrom; NodeID <= conf.NodeIDTo; NodeID++ {
+		if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
+			return NodeID, true
+		}
+	}
+	return mtypes.NodeID_Invalid, false
+}
+
+func manage_peerenroll(w http.ResponseWriter, r *http.Request) {
+	principal, ok := authorize(w, r, RoleAddPeer)
+	if !ok {
+		return
+	}
+	conf := httpobj.http_sconfig.Enrollment
+	if !conf.Enabled {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Enrollment is disabled.\n"))
+		return
+	}
+	// the edge may get any NodeID of the pool
+	for NodeID := conf.NodeIDFrom; NodeID <= conf.NodeIDTo; NodeID++ {
+		if !principal.allowNode(w, NodeID) {
+			return
+		}
+	}
+
+	r.ParseForm()
+	Name := r.Form.Get("Name")
+	if len(Name) > 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Paramater Name: Node name can't longer than 32"))
+		return
+	}
+	SkipLocalIP := strings.EqualFold(r.Form.Get("SkipLocalIP"), "true")
+	var err error
+	TokenTTL := conf.TokenTTL
+	if r.Form.Get("TokenTTL") != "" {
+		TokenTTL, err = extractParamsFloat(r.Form, "TokenTTL", 64, w)
+		if err != nil {
+			return
+		}
+		if TokenTTL <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Paramater TokenTTL: TokenTTL must > 0"))
+			return
+		}
+	}
+	tokenbytes := make([]byte, 32)
+	if _, err := rand.Read(tokenbytes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error creating token: %v", err)))
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenbytes)
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	AdditionalCost := httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost
+	if r.Form.Get("AdditionalCost") != "" {
+		AdditionalCost, err = extractParamsFloat(r.Form, "AdditionalCost", 64, w)
+		if err != nil {
+			return
+		}
+	}
+	now := time.Now()
+	purge_enroll(now)
+	info := &EnrollToken{
+		Name:           Name,
+		AdditionalCost: AdditionalCost,
+		SkipLocalIP:    SkipLocalIP,
+		Expire:         now.Add(mtypes.S2TD(TokenTTL)),
+	}
+	httpobj.http_enroll[token] = info
+	if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		httpobj.http_log.Infof(mtypes.LogCatControl, nil, "Enrollment token issued, Name:%v expires at %v", Name, info.Expire.Format(time.RFC3339))
+	}
+	ret_str_byte, _ := yaml.Marshal(EnrollTokenInfo{
+		Token:   token,
+		Name:    Name,
+		Expires: info.Expire.Format(time.RFC3339),
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret_str_byte)
+}
+
+func edge_enroll(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	token, err := extractParamsStr(r.Form, "Token", w)
+	if err != nil {
+		return
+	}
+	PubKey, err := extractParamsStr(r.Form, "PubKey", w)
+	if err != nil {
+		return
+	}
+	if _, err := device.Str2PubKey(PubKey); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater PubKey: %v", err)))
+		return
+	}
+	Name := r.Form.Get("Name")
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	purge_enroll(time.Now())
+	info, has := httpobj.http_enroll[token]
+	if !has {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Token: Invalid or expired token"))
+		return
+	}
+	audit_user(w, "enrollment token")
+	NodeID, ok := enroll_nodeid()
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("No free NodeID left in the Enrollment pool"))
+		return
+	}
+	if info.Name != "" {
+		Name = info.Name
+	} else if Name == "" {
+		Name = "Node_" + NodeID.ToString()
+	}
+	if len(Name) > 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Paramater Name: Node name can't longer than 32"))
+		return
+	}
+	peerinfo := mtypes.SuperPeerInfo{
+		NodeID:         NodeID,
+		Name:           Name,
+		PubKey:         PubKey,
+		PSKey:          device.RandomPSK().ToString(),
+		AdditionalCost: info.AdditionalCost,
+		SkipLocalIP:    info.SkipLocalIP,
+	}
+	err = check_peeradd(peerinfo)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ret_str_byte, err := save_peeradd("enrollment token", peerinfo)
+	if err != nil {
+		w.WriteHeader(http.StatusExpectationFailed)
+		w.Write([]byte(fmt.Sprintf("Error creating peer: %v", err)))
+		return
+	}
+	delete(httpobj.http_enroll, token)
+	if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		httpobj.http_log.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": NodeID.ToString()}, "Peer enrolled, Name:%v PubKey:%v", Name, PubKey)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret_str_byte)
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// newEnrollTestServer is newAPITestServer with the Enrollment pool 3 to 4 and the edge API.
+func newEnrollTestServer(t *testing.T) *http.ServeMux {
+	mux, _ := newAPITestServer(t, testAPIUsers)
+	httpobj.http_enroll = make(map[string]*EnrollToken)
+	httpobj.http_sconfig.Enrollment = mtypes.EnrollmentInfo{Enabled: true, NodeIDFrom: 3, NodeIDTo: 4, TokenTTL: 60}
+	mux.HandleFunc(testAPIPrefix+"/edge/enroll", audited("edge/enroll", edge_enroll))
+	return mux
+}
+
+func testIssueToken(t *testing.T, mux *http.ServeMux, query string) string {
+	t.Helper()
+	w := testCall(mux, "POST", "/manage/peer/enroll?"+query, "ops-token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("issue token: status %v: %v", w.Code, w.Body.String())
+	}
+	var info EnrollTokenInfo
+	if err := yaml.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Token == "" {
+		t.Fatalf("issue token: %q: %v", w.Body.String(), err)
+	}
+	return info.Token
+}
+
+func TestEnroll(t *testing.T) {
+	mux := newEnrollTestServer(t)
+	if w := testCall(mux, "POST", "/manage/peer/enroll", "viewer-token", ""); w.Code != http.StatusForbidden {
+		t.Errorf("issued a token without AddPeer: status %v", w.Code)
+	}
+
+	// the Name of the token wins over the one of the edge
+	token := testIssueToken(t, mux, "Name=Branch01")
+	w := testCall(mux, "POST", "/edge/enroll?Name=Mine&Token="+token+"&PubKey="+testPubKey(3), "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: status %v: %v", w.Code, w.Body.String())
+	}
+	var econfig mtypes.EdgeConfig
+	if err := yaml.Unmarshal(w.Body.Bytes(), &econfig); err != nil {
+		t.Fatal(err)
+	}
+	if econfig.NodeID != 3 || econfig.NodeName != "Branch01" || econfig.DynamicRoute.SuperNode.PSKey == "" {
+		t.Errorf("enrolled as %v %v PSKey %q", econfig.NodeID, econfig.NodeName, econfig.DynamicRoute.SuperNode.PSKey)
+	}
+	if peer := httpobj.http_PeerID2Info[3]; peer.Name != "Branch01" || peer.PubKey != testPubKey(3) {
+		t.Errorf("peer 3 is %+v", peer)
+	}
+	if w := testCall(mux, "POST", "/edge/enroll?Token="+token+"&PubKey="+testPubKey(4), "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("token used twice: status %v", w.Code)
+	}
+
+	token = testIssueToken(t, mux, "")
+	httpobj.http_enroll[token].Expire = time.Now().Add(-time.Second)
+	if w := testCall(mux, "POST", "/edge/enroll?Token="+token+"&PubKey="+testPubKey(4), "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token used: status %v", w.Code)
+	}
+	if _, has := httpobj.http_enroll[token]; has {
+		t.Error("expired token not purged")
+	}
+
+	// 4 is the last free NodeID of the pool
+	token = testIssueToken(t, mux, "")
+	if w := testCall(mux, "POST", "/edge/enroll?Name=Mine&Token="+token+"&PubKey="+testPubKey(4), "", ""); w.Code != http.StatusOK {
+		t.Fatalf("enroll: status %v: %v", w.Code, w.Body.String())
+	}
+	if peer := httpobj.http_PeerID2Info[4]; peer.Name != "Mine" {
+		t.Errorf("peer 4 is %+v", peer)
+	}
+	token = testIssueToken(t, mux, "")
+	if w := testCall(mux, "POST", "/edge/enroll?Token="+token+"&PubKey="+testPubKey(5), "", ""); w.Code != http.StatusConflict {
+		t.Errorf("enrolled with the pool full: status %v", w.Code)
+	}
+	if _, has := httpobj.http_enroll[token]; !has {
+		t.Error("token used up without enrolling")
+	}
+	if _, has := httpobj.http_PeerID2Info[5]; has || len(httpobj.http_PeerID2Info) != 4 {
+		t.Errorf("peers are %+v", httpobj.http_PeerID2Info)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -18,6 +19,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"net"
 	"net/http"
 	"net/url"
 
@@ -44,16 +46,21 @@ type http_shared_objects struct {
 	http_pskdb         device.PSKDB
 
 	http_passwords       mtypes.Passwords
+	http_apiusers        []apiUser
+	http_audit           auditLog
 	http_StateExpire     time.Time
 	http_StateString_tmp []byte
 
 	http_PeerID2Info map[mtypes.Vertex]mtypes.SuperPeerInfo
 	http_PeerState   map[string]*PeerState //the state hash reported by peer
 	http_PeerIPs     map[string]*HttpPeerLocalIP
+	http_enroll      map[string]*EnrollToken // unused enrollment tokens
 
 	http_sconfig *mtypes.SuperConfig
 
 	http_sconfig_path string
+	http_history      *mtypes.ConfigHistory
+	http_log          *mtypes.Logger
 	http_econfig_tmp  *mtypes.EdgeConfig
 
 	sync.RWMutex
@@ -76,11 +83,50 @@ type HttpState struct {
 	NhTable   mtypes.NextHopTable
 	Dist      mtypes.DistTable
 	Dist_noAC mtypes.DistTable
+	PSK       device.PSKState
 }
 
 type HttpPeerInfo struct {
-	Name     string
-	LastSeen string
+	Name       string
+	LastSeen   string
+	Version    string
+	Features   string
+	PSKVersion uint64
+	PubKeyAlt  string `json:",omitempty"`
+}
+
+// PeerPatch is an update of a peer, nil fields stay as they are.
+type PeerPatch struct {
+	AdditionalCost *float64 `json:",omitempty"`
+	SkipLocalIP    *bool    `json:",omitempty"`
+}
+
+// SuperParamsPatch is an update of the parameters of the supernode, nil fields stay as they are.
+type SuperParamsPatch struct {
+	SendPingInterval    *float64 `json:",omitempty"`
+	HttpPostInterval    *float64 `json:",omitempty"`
+	PeerAliveTimeout    *float64 `json:",omitempty"`
+	DampingFilterRadius *uint64  `json:",omitempty"`
+}
+
+// APIError is an error of the manage APIs. The form endpoints respond with its Message, v2 with all of it.
+type APIError struct {
+	Status  int `json:"-"`
+	Code    string
+	Message string
+}
+
+func apiErrorf(status int, code string, format string, a ...interface{}) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (apierr *APIError) writeText(w http.ResponseWriter) {
+	w.WriteHeader(apierr.Status)
+	w.Write([]byte(apierr.Message))
 }
 
 type PeerState struct {
@@ -91,6 +137,10 @@ type PeerState struct {
 	JETSecret             atomic.Value // mtypes.JWTSecret
 	httpPostCount         atomic.Value // uint64
 	LastSeen              atomic.Value // time.Time
+	Version               atomic.Value // string
+	Features              atomic.Value // mtypes.Features
+	PSKVersion            atomic.Value // uint64
+	PubKeyAlt             atomic.Value // string, the other key the edge accepts while it rotates them
 }
 
 func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (string, error) {
@@ -182,9 +232,10 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			continue
 		}
 		api_peerinfo[peerinfo.PubKey] = mtypes.API_Peerinfo{
-			NodeID:  peerinfo.NodeID,
-			PSKey:   peerinfo.PSKey,
-			Connurl: &mtypes.API_connurl{},
+			NodeID:    peerinfo.NodeID,
+			PubKeyAlt: httpobj.http_PeerState[peerinfo.PubKey].PubKeyAlt.Load().(string),
+			PSKey:     peerinfo.PSKey,
+			Connurl:   &mtypes.API_connurl{},
 		}
 		if httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
 			if connV4 != "" {
@@ -200,6 +251,11 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 		}
 	}
 	api_peerinfo_str_byte, _ := json.Marshal(&api_peerinfo)
+	if httpobj.http_sconfig.UsePSKForInterEdge {
+		// edges download their PSKs again in each rotation phase
+		psk_state_byte, _ := json.Marshal(httpobj.http_pskdb.State())
+		api_peerinfo_str_byte = append(api_peerinfo_str_byte, psk_state_byte...)
+	}
 	hash_raw := md5.Sum(append(api_peerinfo_str_byte, httpobj.http_HashSalt...))
 	hash_str := hex.EncodeToString(hash_raw[:])
 	StateHash = hash_str
@@ -209,6 +265,23 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 	return
 }
 
+// edge_pubkey returns the PubKey NodeID is registered with, if PubKey is that one or the other one the edge
+// accepts while it rotates its key.
+func edge_pubkey(NodeID mtypes.Vertex, PubKey string) (string, bool) {
+	// No lock, lock before call me
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has || PubKey == "" {
+		return "", false
+	}
+	if peerinfo.PubKey == PubKey {
+		return PubKey, true
+	}
+	if PS, has := httpobj.http_PeerState[peerinfo.PubKey]; has && PS.PubKeyAlt.Load().(string) == PubKey {
+		return peerinfo.PubKey, true
+	}
+	return "", false
+}
+
 func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 	// Read all params
 	params := r.URL.Query()
@@ -232,12 +305,8 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
-	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
-		return
-	}
-	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
+	PubKey, ok := edge_pubkey(NodeID, PubKey)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
 		return
@@ -292,12 +361,8 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
-	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
-		return
-	}
-	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
+	PubKey, ok := edge_pubkey(NodeID, PubKey)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
 		return
@@ -322,8 +387,12 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 			if NodeID == peerinfo.NodeID {
 				continue
 			}
-			PSK := httpobj.http_pskdb.GetPSK(NodeID, peerinfo.NodeID)
+			PSK, PSKAlt, PSKVersion := httpobj.http_pskdb.Keys(NodeID, peerinfo.NodeID)
 			peerinfo.PSKey = PSK.ToString()
+			if PSKAlt != (device.NoisePresharedKey{}) {
+				peerinfo.PSKeyAlt = PSKAlt.ToString()
+			}
+			peerinfo.PSKVersion = PSKVersion
 		} else {
 			peerinfo.PSKey = ""
 		}
@@ -363,12 +432,8 @@ func edge_get_nhtable(w http.ResponseWriter, r *http.Request) {
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
-	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
-		return
-	}
-	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
+	PubKey, ok := edge_pubkey(NodeID, PubKey)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
 		return
@@ -414,12 +479,8 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 
 	httpobj.RLock()
 	defer httpobj.RUnlock()
-	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("NodeID and PunKey are not match"))
-		return
-	}
-	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
+	PubKey, ok := edge_pubkey(NodeID, PubKey)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("NodeID and PunKey are not match"))
 		return
@@ -493,8 +554,8 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 	applied_pones := make([]mtypes.PongMsg, 0, len(client_report.Pongs))
 	for _, pong_msg := range client_report.Pongs {
 		if pong_msg.Dst_nodeID != NodeID {
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Dropped because not correct dst: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
+			if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				httpobj.http_log.Infof(mtypes.LogCatControl, mtypes.LogFields{"src": pong_msg.Src_nodeID.ToString(), "dst": pong_msg.Dst_nodeID.ToString(), "peer_id": NodeID.ToString(), "endpoint": r.RemoteAddr}, "Dropped because not correct dst: Recv %v (HTTP)", pong_msg.ToString())
 			}
 			continue
 		}
@@ -506,8 +567,8 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 				pong_msg.AdditionalCost = AdditionalCost_use
 			}
 			applied_pones = append(applied_pones, pong_msg)
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
+			if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+				httpobj.http_log.Infof(mtypes.LogCatControl, mtypes.LogFields{"src": pong_msg.Src_nodeID.ToString(), "dst": pong_msg.Dst_nodeID.ToString(), "peer_id": NodeID.ToString(), "endpoint": r.RemoteAddr}, "Recv %v (HTTP)", pong_msg.ToString())
 			}
 		}
 	}
@@ -550,14 +611,7 @@ func checkPassword(s1 string, s2 string) bool {
 }
 
 func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.ShowState) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	if _, ok := authorize(w, r, RoleShowState); !ok {
 		return
 	}
 	httpobj.RLock()
@@ -571,13 +625,18 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 			Edges_Nh:  httpobj.http_graph.GetEdges(true, true),
 			Dist:      httpobj.http_graph.GetDtst(true),
 			Dist_noAC: httpobj.http_graph.GetDtst(false),
+			PSK:       httpobj.http_pskdb.State(),
 		}
 
 		for _, peerinfo := range httpobj.http_sconfig.Peers {
 			LastSeenStr := httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).String()
 			hs.PeerInfo[peerinfo.NodeID] = HttpPeerInfo{
-				Name:     peerinfo.Name,
-				LastSeen: LastSeenStr,
+				Name:       peerinfo.Name,
+				LastSeen:   LastSeenStr,
+				Version:    httpobj.http_PeerState[peerinfo.PubKey].Version.Load().(string),
+				Features:   httpobj.http_PeerState[peerinfo.PubKey].Features.Load().(mtypes.Features).ToString(),
+				PSKVersion: httpobj.http_PeerState[peerinfo.PubKey].PSKVersion.Load().(uint64),
+				PubKeyAlt:  httpobj.http_PeerState[peerinfo.PubKey].PubKeyAlt.Load().(string),
 			}
 		}
 		httpobj.http_StateExpire = time.Now().Add(5 * time.Second)
@@ -588,14 +647,8 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 }
 
 func manage_peeradd(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.AddPeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	principal, ok := authorize(w, r, RoleAddPeer)
+	if !ok {
 		return
 	}
 
@@ -604,6 +657,9 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	if !principal.allowNode(w, NodeID) {
+		return
+	}
 	Name, err := extractParamsStr(r.Form, "Name", w)
 	if err != nil {
 		return
@@ -628,140 +684,171 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 
 	PSKey, _ := extractParamsStr(r.Form, "PSKey", nil)
 
-	httpobj.Lock()
-	defer httpobj.Unlock()
-
-	for _, peerinfo := range httpobj.http_sconfig.Peers {
-		if peerinfo.NodeID == NodeID {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater NodeID: NodeID exists"))
-			return
-		}
-		if peerinfo.Name == Name {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater Name: Node name exists"))
-			return
-		}
-		if peerinfo.PubKey == PubKey {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater PubKey: PubKey exists"))
-			return
-		}
-	}
-	if httpobj.http_sconfig.GraphRecalculateSetting.StaticMode {
-		NhTableStr := r.Form.Get("NextHopTable")
-		if NhTableStr == "" {
-			w.WriteHeader(http.StatusExpectationFailed)
-			w.Write([]byte("Paramater NextHopTable: Your NextHopTable is in static mode.\nPlease provide your new NextHopTable in \"NextHopTable\" parmater in json format"))
-			return
-		}
-		var NewNhTable mtypes.NextHopTable
+	var NewNhTable mtypes.NextHopTable
+	if NhTableStr := r.Form.Get("NextHopTable"); NhTableStr != "" {
 		err := json.Unmarshal([]byte(NhTableStr), &NewNhTable)
 		if err != nil {
 			w.WriteHeader(http.StatusExpectationFailed)
 			w.Write([]byte(fmt.Sprintf("Paramater NextHopTable: \"%v\", %v", NhTableStr, err)))
 			return
 		}
-		err = checkNhTable(NewNhTable, append(httpobj.http_sconfig.Peers, mtypes.SuperPeerInfo{
-			NodeID:         NodeID,
-			Name:           Name,
-			PubKey:         PubKey,
-			PSKey:          PSKey,
-			AdditionalCost: AdditionalCost,
-			SkipLocalIP:    SkipLocalIP,
-		}))
-		if err != nil {
-			w.WriteHeader(http.StatusExpectationFailed)
-			w.Write([]byte(fmt.Sprintf("Paramater nexthoptable: \"%v\", %v", NhTableStr, err)))
-			return
-		}
-		httpobj.http_graph.SetNHTable(NewNhTable)
 	}
-	err = super_peeradd(mtypes.SuperPeerInfo{
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	ret_str_byte, apierr := api_peeradd(principal.Name, mtypes.SuperPeerInfo{
 		NodeID:         NodeID,
 		Name:           Name,
 		PubKey:         PubKey,
 		PSKey:          PSKey,
 		AdditionalCost: AdditionalCost,
 		SkipLocalIP:    SkipLocalIP,
-	})
-	if err != nil {
-		w.WriteHeader(http.StatusExpectationFailed)
-		w.Write([]byte(fmt.Sprintf("Error creating peer: %v", err)))
+	}, NewNhTable)
+	if apierr != nil {
+		apierr.writeText(w)
 		return
 	}
-	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, mtypes.SuperPeerInfo{
-		NodeID:         NodeID,
-		Name:           Name,
-		PubKey:         PubKey,
-		PSKey:          PSKey,
-		AdditionalCost: AdditionalCost,
-		SkipLocalIP:    SkipLocalIP,
-	})
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
-	httpobj.http_econfig_tmp.NodeID = NodeID
-	httpobj.http_econfig_tmp.NodeName = Name
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret_str_byte)
+}
+
+// api_peeradd adds a peer for the manage APIs. In static mode, NhTable is the new NextHopTable with it.
+// It returns the config of the edge.
+func api_peeradd(user string, peerinfo mtypes.SuperPeerInfo, NhTable mtypes.NextHopTable) ([]byte, *APIError) {
+	// No lock, lock before call me
+	if peerinfo.NodeID >= mtypes.NodeID_Special {
+		return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater NodeID: NodeID must < %v", mtypes.NodeID_Special)
+	}
+	if peerinfo.Name == "" || len(peerinfo.Name) > 32 {
+		return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater Name: Node name can't be empty or longer than 32")
+	}
+	if _, err := device.Str2PubKey(peerinfo.PubKey); err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater PubKey: %v", err)
+	}
+	err := check_peeradd(peerinfo)
+	if err != nil {
+		return nil, apiErrorf(http.StatusConflict, "conflict", "%v", err)
+	}
+	if httpobj.http_sconfig.GraphRecalculateSetting.StaticMode {
+		if NhTable == nil {
+			return nil, apiErrorf(http.StatusExpectationFailed, "expectation_failed", "Paramater NextHopTable: Your NextHopTable is in static mode.\nPlease provide your new NextHopTable in \"NextHopTable\" parmater in json format")
+		}
+		err = checkNhTable(NhTable, append(httpobj.http_sconfig.Peers, peerinfo))
+		if err != nil {
+			return nil, apiErrorf(http.StatusExpectationFailed, "expectation_failed", "Paramater NextHopTable: %v", err)
+		}
+		httpobj.http_graph.SetNHTable(NhTable)
+	}
+	ret_str_byte, err := save_peeradd(user, peerinfo)
+	if err != nil {
+		return nil, apiErrorf(http.StatusExpectationFailed, "expectation_failed", "Error creating peer: %v", err)
+	}
+	return ret_str_byte, nil
+}
+
+// check_peeradd returns why peerinfo conflicts with the peers we have.
+func check_peeradd(peerinfo mtypes.SuperPeerInfo) error {
+	// No lock, lock before call me
+	for _, existing := range httpobj.http_sconfig.Peers {
+		if existing.NodeID == peerinfo.NodeID {
+			return errors.New("Paramater NodeID: NodeID exists")
+		}
+		if existing.Name == peerinfo.Name {
+			return errors.New("Paramater Name: Node name exists")
+		}
+		if existing.PubKey == peerinfo.PubKey {
+			return errors.New("Paramater PubKey: PubKey exists")
+		}
+	}
+	return nil
+}
+
+// save_peeradd adds a peer and saves it to the config file. It returns the config of the edge, generated from EdgeTemplate.
+func save_peeradd(user string, peerinfo mtypes.SuperPeerInfo) ([]byte, error) {
+	// No lock, lock before call me
+	err := super_peeradd(peerinfo)
+	if err != nil {
+		return nil, err
+	}
+	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, peerinfo)
+	save_sconfig(user, "peer add "+peerinfo.NodeID.ToString())
+	httpobj.http_econfig_tmp.NodeID = peerinfo.NodeID
+	httpobj.http_econfig_tmp.NodeName = peerinfo.Name
 	httpobj.http_econfig_tmp.PrivKey = "Your_Private_Key"
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = PSKey
-	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = AdditionalCost
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = SkipLocalIP
+	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = peerinfo.PSKey
+	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = peerinfo.AdditionalCost
+	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = peerinfo.SkipLocalIP
 	httpobj.http_econfig_tmp.NextHopTable = make(mtypes.NextHopTable)
 	httpobj.http_econfig_tmp.Peers = make([]mtypes.PeerInfo, 0)
 	ret_str_byte, _ := yaml.Marshal(&httpobj.http_econfig_tmp)
-	w.WriteHeader(http.StatusOK)
-	w.Write(ret_str_byte)
+	return ret_str_byte, nil
 }
 
 func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
-	toUpdate := mtypes.NodeID_Broadcast
-
-	var err error
-	var NodeID mtypes.Vertex
 
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.UpdatePeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	principal, ok := authorize(w, r, RoleUpdatePeer)
+	if !ok {
 		return
 	}
-	NodeID, err = extractParamsVertex(params, "NodeID", w)
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
 	if err != nil {
 		return
 	}
-	toUpdate = NodeID
-	httpobj.Lock()
-	defer httpobj.Unlock()
-	if _, has := httpobj.http_PeerID2Info[toUpdate]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
+	if !principal.allowNode(w, NodeID) {
 		return
 	}
-	PubKey := httpobj.http_PeerID2Info[toUpdate].PubKey
-	Updated_params := make(map[string]string)
-	new_superpeerinfo := httpobj.http_PeerID2Info[toUpdate]
+	var patch PeerPatch
 	r.ParseForm()
 	AdditionalCost, err := extractParamsFloat(r.Form, "AdditionalCost", 64, nil)
 	if err == nil {
-		Updated_params["AdditionalCost"] = fmt.Sprintf("%v", AdditionalCost)
-		new_superpeerinfo.AdditionalCost = AdditionalCost
+		patch.AdditionalCost = &AdditionalCost
 	}
 	SkipLocalIP, err := extractParamsStr(r.Form, "SkipLocalIP", nil)
 	if err == nil {
 		SkipLocalIPVal := strings.EqualFold(SkipLocalIP, "true")
-		Updated_params["SkipLocalIP"] = fmt.Sprintf("%v", SkipLocalIPVal)
-		new_superpeerinfo.SkipLocalIP = SkipLocalIPVal
+		patch.SkipLocalIP = &SkipLocalIPVal
+	}
 
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	Updated_params, apierr := api_peerupdate(principal.Name, NodeID, patch)
+	if apierr != nil {
+		apierr.writeText(w)
+		return
 	}
 	if len(Updated_params) == 0 {
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("NodeID: " + toUpdate.ToString() + " , no any paramater updated.\n"))
+		w.Write([]byte("NodeID: " + NodeID.ToString() + " , no any paramater updated.\n"))
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("NodeID: " + NodeID.ToString() + " updated following values:\n"))
+	for k, v := range Updated_params {
+		w.Write([]byte(fmt.Sprintf("%v = %v\n", k, v)))
+	}
+}
+
+// api_peerupdate applies patch to a peer for the manage APIs. It returns the values it updated.
+func api_peerupdate(user string, toUpdate mtypes.Vertex, patch PeerPatch) (map[string]string, *APIError) {
+	// No lock, lock before call me
+	new_superpeerinfo, has := httpobj.http_PeerID2Info[toUpdate]
+	if !has {
+		return nil, apiErrorf(http.StatusNotFound, "not_found", "Paramater NodeID: \"%v\" not found", toUpdate)
+	}
+	PubKey := new_superpeerinfo.PubKey
+	Updated_params := make(map[string]string)
+	if patch.AdditionalCost != nil {
+		Updated_params["AdditionalCost"] = fmt.Sprintf("%v", *patch.AdditionalCost)
+		new_superpeerinfo.AdditionalCost = *patch.AdditionalCost
+	}
+	if patch.SkipLocalIP != nil {
+		Updated_params["SkipLocalIP"] = fmt.Sprintf("%v", *patch.SkipLocalIP)
+		new_superpeerinfo.SkipLocalIP = *patch.SkipLocalIP
+	}
+	if len(Updated_params) == 0 {
+		return Updated_params, nil
+	}
 
 	httpobj.http_PeerID2Info[toUpdate] = new_superpeerinfo
 	SuperParams := mtypes.API_SuperParams{
@@ -786,31 +873,57 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	httpobj.http_sconfig.Peers = peers_new
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("NodeID: " + toUpdate.ToString() + " updated following values:\n"))
-	for k, v := range Updated_params {
-		w.Write([]byte(fmt.Sprintf("%v = %v\n", k, v)))
-	}
+	save_sconfig(user, "peer update "+toUpdate.ToString())
+	return Updated_params, nil
 }
 
 func manage_superupdate(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
+	principal, ok := authorize(w, r, RoleUpdateSuper)
+	if !ok {
+		return
+	}
 
-	var err error
+	r.ParseForm()
+	var patch SuperParamsPatch
+	PeerAliveTimeout, err := extractParamsFloat(r.Form, "PeerAliveTimeout", 64, nil)
+	if err == nil {
+		patch.PeerAliveTimeout = &PeerAliveTimeout
+	}
+	DampingFilterRadius, err := extractParamsUint(r.Form, "DampingFilterRadius", 64, nil)
+	if err == nil {
+		patch.DampingFilterRadius = &DampingFilterRadius
+	}
+	SendPingInterval, err := extractParamsFloat(r.Form, "SendPingInterval", 64, nil)
+	if err == nil {
+		patch.SendPingInterval = &SendPingInterval
+	}
+	HttpPostInterval, err := extractParamsFloat(r.Form, "HttpPostInterval", 64, nil)
+	if err == nil {
+		patch.HttpPostInterval = &HttpPostInterval
+	}
 
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	Updated_params, apierr := api_superupdate(principal.Name, patch)
+	if apierr != nil {
+		apierr.writeText(w)
 		return
 	}
-	if !checkPassword(password, httpobj.http_passwords.UpdateSuper) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	if len(Updated_params) == 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("SuperNode: no any paramater updated.\n"))
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Supernode: updated following values:\n"))
+	for k, v := range Updated_params {
+		w.Write([]byte(fmt.Sprintf("%v = %v\n", k, v)))
+	}
+}
 
-	r.ParseForm()
+// api_superupdate applies patch to the parameters of the supernode for the manage APIs. It returns the values it updated.
+func api_superupdate(user string, patch SuperParamsPatch) (map[string]string, *APIError) {
+	// No lock, lock before call me
 	Updated_params := make(map[string]string)
 
 	sconfig_temp := mtypes.SuperConfig{}
@@ -819,80 +932,66 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	sconfig_temp.HttpPostInterval = httpobj.http_sconfig.HttpPostInterval
 	sconfig_temp.DampingFilterRadius = httpobj.http_sconfig.DampingFilterRadius
 
-	PeerAliveTimeout, err := extractParamsFloat(r.Form, "PeerAliveTimeout", 64, nil)
-	if err == nil {
-		if PeerAliveTimeout <= 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater PeerAliveTimeout %v: Must > 0.\n", PeerAliveTimeout)))
-			return
+	if patch.PeerAliveTimeout != nil {
+		if *patch.PeerAliveTimeout <= 0 {
+			return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater PeerAliveTimeout %v: Must > 0.", *patch.PeerAliveTimeout)
 		}
-		Updated_params["PeerAliveTimeout"] = fmt.Sprintf("%v", PeerAliveTimeout)
-		sconfig_temp.PeerAliveTimeout = PeerAliveTimeout
+		Updated_params["PeerAliveTimeout"] = fmt.Sprintf("%v", *patch.PeerAliveTimeout)
+		sconfig_temp.PeerAliveTimeout = *patch.PeerAliveTimeout
 	}
-
-	DampingFilterRadius, err := extractParamsUint(r.Form, "DampingFilterRadius", 64, nil)
-	if err == nil {
-		Updated_params["DampingFilterRadius"] = fmt.Sprintf("%v", DampingFilterRadius)
-		sconfig_temp.DampingFilterRadius = DampingFilterRadius
+	if patch.DampingFilterRadius != nil {
+		Updated_params["DampingFilterRadius"] = fmt.Sprintf("%v", *patch.DampingFilterRadius)
+		sconfig_temp.DampingFilterRadius = *patch.DampingFilterRadius
 	}
-
-	SendPingInterval, err := extractParamsFloat(r.Form, "SendPingInterval", 64, nil)
-	if err == nil {
-		if SendPingInterval <= 0 || SendPingInterval >= sconfig_temp.PeerAliveTimeout {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater SendPingInterval: Must > 0 and < %v(PeerAliveTimeout).\n", sconfig_temp.PeerAliveTimeout)))
-			return
+	if patch.SendPingInterval != nil {
+		if *patch.SendPingInterval <= 0 || *patch.SendPingInterval >= sconfig_temp.PeerAliveTimeout {
+			return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater SendPingInterval: Must > 0 and < %v(PeerAliveTimeout).", sconfig_temp.PeerAliveTimeout)
 		}
-		Updated_params["SendPingInterval"] = fmt.Sprintf("%v", SendPingInterval)
-		sconfig_temp.SendPingInterval = SendPingInterval
+		Updated_params["SendPingInterval"] = fmt.Sprintf("%v", *patch.SendPingInterval)
+		sconfig_temp.SendPingInterval = *patch.SendPingInterval
 	}
-	HttpPostInterval, err := extractParamsFloat(r.Form, "HttpPostInterval", 64, nil)
-	if err == nil {
-		if SendPingInterval <= 0 || SendPingInterval >= sconfig_temp.PeerAliveTimeout {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater HttpPostInterval: Must > 0 and < %v(PeerAliveTimeout).\n", sconfig_temp.PeerAliveTimeout)))
-			return
+	if patch.HttpPostInterval != nil {
+		if *patch.HttpPostInterval <= 0 || *patch.HttpPostInterval >= sconfig_temp.PeerAliveTimeout {
+			return nil, apiErrorf(http.StatusBadRequest, "bad_request", "Paramater HttpPostInterval: Must > 0 and < %v(PeerAliveTimeout).", sconfig_temp.PeerAliveTimeout)
 		}
-		Updated_params["HttpPostInterval"] = fmt.Sprintf("%v", HttpPostInterval)
-		sconfig_temp.HttpPostInterval = HttpPostInterval
+		Updated_params["HttpPostInterval"] = fmt.Sprintf("%v", *patch.HttpPostInterval)
+		sconfig_temp.HttpPostInterval = *patch.HttpPostInterval
 	}
 
 	if len(Updated_params) == 0 {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("SuperNode: no any paramater updated.\n"))
-		return
+		return Updated_params, nil
 	}
 
 	httpobj.http_sconfig.PeerAliveTimeout = sconfig_temp.PeerAliveTimeout
 	httpobj.http_sconfig.SendPingInterval = sconfig_temp.SendPingInterval
 	httpobj.http_sconfig.HttpPostInterval = sconfig_temp.HttpPostInterval
 	httpobj.http_sconfig.DampingFilterRadius = sconfig_temp.DampingFilterRadius
+	update_superparams_state()
+	save_sconfig(user, "super update")
+	return Updated_params, nil
+}
 
-	SuperParams := mtypes.API_SuperParams{
-		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
-		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
-		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
-		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
-		AdditionalCost:      10,
+func manage_rotatepsk(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, RoleUpdateSuper); !ok {
+		return
+	}
+	if !httpobj.http_sconfig.UsePSKForInterEdge {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("UsePSKForInterEdge is disabled, there are no PSKs to rotate.\n"))
+		return
 	}
 	httpobj.Lock()
 	defer httpobj.Unlock()
-	for _, peerinfo := range httpobj.http_PeerID2Info {
-		SuperParams.AdditionalCost = peerinfo.AdditionalCost
-		PubKey := peerinfo.PubKey
-		SuperParamStr, _ := json.Marshal(SuperParams)
-		md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
-		new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-		httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
+	err := httpobj.http_pskdb.Rotate(time.Now(), mtypes.S2TD(httpobj.http_sconfig.PSKRotation.SwitchOver))
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("PSK rotation: %v\n", err)))
+		return
 	}
-
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	pushPSKState()
+	state := httpobj.http_pskdb.State()
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Supernode: updated following values:\n"))
-	for k, v := range Updated_params {
-		w.Write([]byte(fmt.Sprintf("%v = %v\n", k, v)))
-	}
+	w.Write([]byte(fmt.Sprintf("PSK rotation to version %v started, switch at %v.\n", state.Version+1, state.PhaseEnd.Format(time.RFC3339))))
 }
 
 func manage_peerdel(w http.ResponseWriter, r *http.Request) {
@@ -903,24 +1002,26 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	var NodeID mtypes.Vertex
 	var PrivKey string
 	var PubKey string
-	password, pwderr := extractParamsStr(params, "Password", nil)
+	var user string
 	httpobj.Lock()
 	defer httpobj.Unlock()
-	if pwderr == nil { // user provide the password
-		if checkPassword(password, httpobj.http_passwords.DelPeer) {
-			NodeID, err = extractParamsVertex(params, "NodeID", w)
-			if err != nil {
-				return
-			}
-			toDelete = NodeID
-			if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Paramater Password: Wrong password"))
+	if api_secret(r) != "" { // user provide the password
+		principal, ok := authorize(w, r, RoleDelPeer)
+		if !ok {
+			return
+		}
+		NodeID, err = extractParamsVertex(params, "NodeID", w)
+		if err != nil {
+			return
+		}
+		if !principal.allowNode(w, NodeID) {
+			return
+		}
+		toDelete = NodeID
+		user = principal.Name
+		if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
 			return
 		}
 	} else { // user don't provide the password
@@ -946,8 +1047,18 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(fmt.Sprintf("Paramater PrivKey: \"%v\" not found", PubKey)))
 			return
 		}
+		user = "PrivKey of " + toDelete.ToString()
+		audit_user(w, user)
 	}
 
+	api_peerdel(user, toDelete)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("NodeID: " + toDelete.ToString() + " deleted."))
+}
+
+// api_peerdel deletes a peer for the manage APIs.
+func api_peerdel(user string, toDelete mtypes.Vertex) {
+	// No lock, lock before call me
 	var peers_new []mtypes.SuperPeerInfo
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
 		if peerinfo.NodeID == toDelete {
@@ -958,33 +1069,57 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	httpobj.http_sconfig.Peers = peers_new
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("NodeID: " + toDelete.ToString() + " deleted."))
+	save_sconfig(user, "peer del "+toDelete.ToString())
+}
+
+// manage_register adds the manage APIs to mux. Calls which change something go to the audit log.
+func manage_register(mux *http.ServeMux, apiprefix string) {
+	mux.HandleFunc(apiprefix+"/manage/peer/add", audited("manage/peer/add", manage_peeradd))
+	mux.HandleFunc(apiprefix+"/manage/peer/del", audited("manage/peer/del", manage_peerdel))
+	mux.HandleFunc(apiprefix+"/manage/peer/update", audited("manage/peer/update", manage_peerupdate))
+	mux.HandleFunc(apiprefix+"/manage/peer/enroll", audited("manage/peer/enroll", manage_peerenroll))
+	mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
+	mux.HandleFunc(apiprefix+"/manage/super/update", audited("manage/super/update", manage_superupdate))
+	mux.HandleFunc(apiprefix+"/manage/super/rotatepsk", audited("manage/super/rotatepsk", manage_rotatepsk))
+	mux.HandleFunc(apiprefix+"/manage/super/history", manage_history)
+	mux.HandleFunc(apiprefix+"/manage/super/rollback", audited("manage/super/rollback", manage_rollback))
+	v2_register(mux, apiprefix)
+}
+
+// listen_addr returns the address to listen on for a ListenPort_* of the config, a port or a host:port.
+func listen_addr(listen string) string {
+	if listen == "" || strings.Contains(listen, ":") {
+		return listen
+	}
+	return ":" + listen
+}
+
+// manage_host returns the host:port to call the manage API listening on listen from the same machine.
+func manage_host(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen_addr(listen))
+	if err != nil {
+		return "", fmt.Errorf("ListenPort_ManageAPI: %v", err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
 func HttpServer(edgeListen string, manageListen string, apiprefix string, errchan chan error) {
 	if len(apiprefix) > 0 && apiprefix[0] != '/' {
 		apiprefix = "/" + apiprefix
 	}
-	if len(edgeListen) > 0 && edgeListen[0] != ':' {
-		edgeListen = ":" + edgeListen
-	}
-	if len(manageListen) > 0 && manageListen[0] != ':' {
-		manageListen = ":" + manageListen
-	}
+	edgeListen = listen_addr(edgeListen)
+	manageListen = listen_addr(manageListen)
 	if edgeListen == manageListen {
 		mux := http.NewServeMux()
 		mux.HandleFunc(apiprefix+"/edge/superparams", edge_get_superparams)
 		mux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		mux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		mux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
-		mux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
-		mux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
-		mux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
-		mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
-		mux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		mux.HandleFunc(apiprefix+"/edge/enroll", audited("edge/enroll", edge_enroll))
+		manage_register(mux, apiprefix)
 
 		go func() {
 			err := http.ListenAndServe(edgeListen, mux)
@@ -1000,11 +1135,8 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		edgemux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		edgemux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		edgemux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
-		managemux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
-		managemux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
-		managemux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
-		managemux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
-		managemux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		edgemux.HandleFunc(apiprefix+"/edge/enroll", audited("edge/enroll", edge_enroll))
+		manage_register(managemux, apiprefix)
 
 		go func() {
 			err := http.ListenAndServe(edgeListen, edgemux)
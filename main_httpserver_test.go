@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import "testing"
+
+func TestManageHost(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string // empty if it fails
+	}{
+		{"3456", "127.0.0.1:3456"},
+		{":3456", "127.0.0.1:3456"},
+		{"0.0.0.0:3456", "127.0.0.1:3456"},
+		{"[::]:3456", "127.0.0.1:3456"},
+		{"[::1]:3456", "[::1]:3456"},
+		{"192.168.1.1:3456", "192.168.1.1:3456"},
+		{"localhost:3456", "localhost:3456"},
+		{"::1:3456", ""},
+	}
+	for _, tt := range tests {
+		host, err := manage_host(tt.listen)
+		if tt.host == "" {
+			if err == nil {
+				t.Errorf("%v: got %v, want an error", tt.listen, host)
+			}
+			continue
+		}
+		if err != nil || host != tt.host {
+			t.Errorf("%v: got %v %v, want %v", tt.listen, host, err, tt.host)
+		}
+	}
+}
@@ -100,26 +100,32 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	if sconfig.RePushConfigInterval <= 0 {
 		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
 	}
-	var logLevel int
-	switch sconfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
+	if _, err := mtypes.ParseFeatures(sconfig.RequiredFeatures); err != nil {
+		return fmt.Errorf("RequiredFeatures: %v", err)
 	}
-
-	logger4 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v4"),
-	)
-	logger6 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v6"),
-	)
+	if sconfig.PSKRotation.Interval < 0 {
+		return fmt.Errorf("PSKRotation.Interval must >= 0 : %v", sconfig.PSKRotation.Interval)
+	}
+	if sconfig.PSKRotation.Interval > 0 && sconfig.PSKRotation.SwitchOver <= 0 {
+		return fmt.Errorf("PSKRotation.SwitchOver must > 0 : %v", sconfig.PSKRotation.SwitchOver)
+	}
+	if sconfig.Enrollment.Enabled {
+		if sconfig.GraphRecalculateSetting.StaticMode {
+			return errors.New("Enrollment is not available in static mode")
+		}
+		if sconfig.Enrollment.NodeIDTo < sconfig.Enrollment.NodeIDFrom || sconfig.Enrollment.NodeIDTo >= mtypes.NodeID_Special {
+			return fmt.Errorf("Enrollment.NodeIDTo must >= NodeIDFrom and < %v : %v", mtypes.NodeID_Special, sconfig.Enrollment.NodeIDTo)
+		}
+		if sconfig.Enrollment.TokenTTL <= 0 {
+			return fmt.Errorf("Enrollment.TokenTTL must > 0 : %v", sconfig.Enrollment.TokenTTL)
+		}
+	}
+	slog, err := mtypes.NewLogger(sconfig.LogLevel, NodeName, mtypes.NodeID_SuperNode)
+	if err != nil {
+		return err
+	}
+	logger4 := device.NewStructuredLogger(slog.WithFields(mtypes.LogFields{"node_name": NodeName + "_v4"}))
+	logger6 := device.NewStructuredLogger(slog.WithFields(mtypes.LogFields{"node_name": NodeName + "_v6"}))
 
 	EnabledAf := sconfig.DisableAf.Disalbed2Enabled()
 	if !EnabledAf.IPv4 {
@@ -130,17 +136,29 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	}
 
 	httpobj.http_sconfig_path = configPath
+	httpobj.http_log = slog
 	httpobj.http_PeerState = make(map[string]*PeerState)
 	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
 	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
+	httpobj.http_enroll = make(map[string]*EnrollToken)
 	httpobj.http_HashSalt = []byte(mtypes.RandomStr(32, fmt.Sprintf("%v", time.Now())))
 	httpobj.http_passwords = sconfig.Passwords
+	httpobj.http_apiusers, err = load_apiusers(sconfig.APIUsers)
+	if err != nil {
+		return err
+	}
+	if sconfig.AuditLog != "" {
+		httpobj.http_audit.file, err = os.OpenFile(sconfig.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("AuditLog: %v", err)
+		}
+	}
 
 	httpobj.http_super_chains = &mtypes.SUPER_Events{
 		Event_server_pong:     make(chan mtypes.PongMsg, 1<<5),
 		Event_server_register: make(chan mtypes.RegisterMsg, 1<<5),
 	}
-	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, slog)
 	if err != nil {
 		return err
 	}
@@ -208,6 +226,13 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	go Event_server_event_hendler(httpobj.http_graph, httpobj.http_super_chains)
 	go RoutinePushSettings(mtypes.S2TD(sconfig.RePushConfigInterval))
 	go RoutineTimeoutCheck()
+	if sconfig.UsePSKForInterEdge {
+		go RoutineRotatePSK(mtypes.S2TD(sconfig.PSKRotation.Interval))
+	}
+	httpobj.http_history = mtypes.NewConfigHistory(configPath, sconfig.ConfigHistory)
+	if err := httpobj.http_history.Init("", "startup"); err != nil {
+		return fmt.Errorf("ConfigHistory: %v", err)
+	}
 	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
 
 	if sconfig.PostScript != "" {
@@ -218,16 +243,16 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
+		if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			slog.Infof(mtypes.LogCatInternal, nil, "PostScript: exec.Command(%v)", cmdarg)
 		}
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
+		if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			slog.Infof(mtypes.LogCatInternal, nil, "PostScript output: %s", string(out))
 		}
 	}
 
@@ -235,8 +260,8 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	httpobj.http_device6.Chan_Device_Initialized <- struct{}{}
 
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if sconfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
+	if slog.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+		slog.Infof(mtypes.LogCatInternal, nil, "SdNotify:%v err:%v", SdNotify, err)
 	}
 
 	signal.Notify(term, syscall.SIGTERM)
@@ -276,8 +301,8 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer4.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf4, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
+				if httpobj.http_log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					httpobj.http_log.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peerconf.NodeID.ToString(), "endpoint": peerconf.EndPoint}, "Set endpoint failed:%v", err)
 				}
 			}
 		}
@@ -301,8 +326,8 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer6.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf6, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
+				if httpobj.http_log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					httpobj.http_log.Infof(mtypes.LogCatInternal, mtypes.LogFields{"peer_id": peerconf.NodeID.ToString(), "endpoint": peerconf.EndPoint}, "Set endpoint failed:%v", err)
 				}
 			}
 		}
@@ -328,12 +353,74 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 	PS.JETSecret.Store(mtypes.JWTSecret{}) // mtypes.JWTSecret
 	PS.httpPostCount.Store(uint64(0))      // uint64
 	PS.LastSeen.Store(time.Time{})         // time.Time
+	PS.Version.Store("")                   // string
+	PS.Features.Store(mtypes.Features(0))  // mtypes.Features
+	PS.PSKVersion.Store(uint64(0))         // uint64
+	PS.PubKeyAlt.Store("")                 // string
 	httpobj.http_PeerState[peerconf.PubKey] = &PS
 
 	httpobj.http_PeerIPs[peerconf.PubKey] = &HttpPeerLocalIP{}
 	return nil
 }
 
+// super_peerkeys applies the keys an edge reports in its register messages. While it rotates its key,
+// the edge reports the new key as PubKeyAlt, then the new key as PubKey and the previous one as PubKeyAlt.
+func super_peerkeys(NodeID mtypes.Vertex, PubKey string, PubKeyAlt string) error {
+	// No lock, lock before call me
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has {
+		return nil
+	}
+	PS := httpobj.http_PeerState[peerinfo.PubKey]
+	switch {
+	case PubKey == peerinfo.PubKey:
+		if PS.PubKeyAlt.Load().(string) == PubKeyAlt {
+			return nil
+		}
+	case PubKeyAlt == peerinfo.PubKey:
+		// the edge switched to its new key
+	default:
+		return fmt.Errorf("reported PubKey %v and %v, but it is registered with %v", PubKey, PubKeyAlt, peerinfo.PubKey)
+	}
+	pk, err := device.Str2PubKey(PubKey)
+	if err != nil {
+		return err
+	}
+	var alt device.NoisePublicKey
+	if PubKeyAlt != "" {
+		alt, err = device.Str2PubKey(PubKeyAlt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dev := range []*device.Device{httpobj.http_device4, httpobj.http_device6} {
+		if peer := dev.LookupPeerByStr(peerinfo.PubKey); peer != nil {
+			if err := dev.SetPeerKeys(peer, pk, alt); err != nil {
+				return err
+			}
+		}
+	}
+	PS.PubKeyAlt.Store(PubKeyAlt)
+	if PubKey != peerinfo.PubKey {
+		httpobj.http_PeerState[PubKey] = PS
+		httpobj.http_PeerIPs[PubKey] = httpobj.http_PeerIPs[peerinfo.PubKey]
+		delete(httpobj.http_PeerState, peerinfo.PubKey)
+		delete(httpobj.http_PeerIPs, peerinfo.PubKey)
+		peerinfo.PubKey = PubKey
+		httpobj.http_PeerID2Info[NodeID] = peerinfo
+		for i := range httpobj.http_sconfig.Peers {
+			if httpobj.http_sconfig.Peers[i].NodeID == NodeID {
+				httpobj.http_sconfig.Peers[i].PubKey = PubKey
+			}
+		}
+		save_sconfig("", "peer keys "+NodeID.ToString())
+	}
+	if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		httpobj.http_log.Infof(mtypes.LogCatControl, mtypes.LogFields{"peer_id": NodeID.ToString()}, "Peer keys updated, PubKey:%v PubKeyAlt:%v", PubKey, PubKeyAlt)
+	}
+	return nil
+}
+
 func super_peerdel(toDelete mtypes.Vertex) {
 	// No lock, lock before call me
 	if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
@@ -355,18 +442,11 @@ func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
 		Params:  "You've been removed from supernode.",
 	}
 	for i := 0; i < 10; i++ {
-		body, _ := mtypes.GetByte(&ServerUpdateMsg)
-		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-		header.SetSrc(mtypes.NodeID_SuperNode)
-		copy(buf[path.EgHeaderLen:], body)
-		header.SetDst(toDelete)
-
 		peer4 := httpobj.http_device4.LookupPeerByStr(PubKey)
-		httpobj.http_device4.SendPacket(peer4, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+		httpobj.http_device4.SendPacket(peer4, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device4, toDelete, toDelete, &ServerUpdateMsg), device.MessageTransportOffsetContent)
 
 		peer6 := httpobj.http_device6.LookupPeerByStr(PubKey)
-		httpobj.http_device6.SendPacket(peer6, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+		httpobj.http_device6.SendPacket(peer6, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device6, toDelete, toDelete, &ServerUpdateMsg), device.MessageTransportOffsetContent)
 		time.Sleep(mtypes.S2TD(0.1))
 	}
 	httpobj.http_device4.RemovePeerByID(toDelete)
@@ -382,12 +462,27 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 			var should_push_nh bool
 			var should_push_superparams bool
 			NodeID := reg_msg.Node_id
+			if NodeID < mtypes.NodeID_Special && reg_msg.PubKey != ([32]byte{}) {
+				var PubKeyAlt string
+				if reg_msg.PubKeyAlt != ([32]byte{}) {
+					PubKeyAlt = device.NoisePublicKey(reg_msg.PubKeyAlt).ToString()
+				}
+				httpobj.Lock()
+				err := super_peerkeys(NodeID, device.NoisePublicKey(reg_msg.PubKey).ToString(), PubKeyAlt)
+				httpobj.Unlock()
+				if err != nil {
+					httpobj.http_log.Errorf(mtypes.LogCatControl, mtypes.LogFields{"peer_id": NodeID.ToString()}, "Keys of peer: %v", err)
+				}
+			}
 			httpobj.RLock()
 			PubKey := httpobj.http_PeerID2Info[NodeID].PubKey
 			if reg_msg.Node_id < mtypes.NodeID_Special {
 				httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
 				httpobj.http_PeerState[PubKey].JETSecret.Store(reg_msg.JWTSecret)
 				httpobj.http_PeerState[PubKey].httpPostCount.Store(reg_msg.HttpPostCount)
+				httpobj.http_PeerState[PubKey].Version.Store(reg_msg.Version)
+				httpobj.http_PeerState[PubKey].Features.Store(reg_msg.Features)
+				httpobj.http_PeerState[PubKey].PSKVersion.Store(reg_msg.PSKVersion)
 				if httpobj.http_PeerState[PubKey].NhTableState.Load().(string) != reg_msg.NhStateHash {
 					httpobj.http_PeerState[PubKey].NhTableState.Store(reg_msg.NhStateHash)
 					should_push_nh = true
@@ -458,6 +553,37 @@ func RoutinePushSettings(interval time.Duration) {
 	}
 }
 
+// RoutineRotatePSK rotates the inter-edge PSKs every interval, if it isn't 0, and moves rotations through their phases.
+func RoutineRotatePSK(interval time.Duration) {
+	lastRotate := time.Now()
+	for {
+		now := time.Now()
+		httpobj.Lock()
+		if interval > 0 && now.After(lastRotate.Add(interval)) {
+			if err := httpobj.http_pskdb.Rotate(now, mtypes.S2TD(httpobj.http_sconfig.PSKRotation.SwitchOver)); err == nil {
+				lastRotate = now
+				pushPSKState()
+			}
+		}
+		if httpobj.http_pskdb.Advance(now) {
+			pushPSKState()
+		}
+		httpobj.Unlock()
+		time.Sleep(mtypes.S2TD(1))
+	}
+}
+
+// pushPSKState tells the edges to download their peers, with the PSKs of the current rotation phase.
+func pushPSKState() {
+	// No lock, lock before call me
+	state := httpobj.http_pskdb.State()
+	if httpobj.http_log.Enabled(mtypes.LogCatControl, mtypes.LogLevelInfo) {
+		httpobj.http_log.Infof(mtypes.LogCatControl, nil, "Inter-edge PSK version:%v phase:%v", state.Version, state.Phase)
+	}
+	httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+	PushPeerinfo(false)
+}
+
 func RoutineTimeoutCheck() {
 	for {
 		httpobj.http_super_chains.Event_server_register <- mtypes.RegisterMsg{
@@ -473,23 +599,25 @@ func RoutineTimeoutCheck() {
 	}
 }
 
+// ServerUpdatePacket encodes msg in the format the node reads, as far as dev knows.
+func ServerUpdatePacket(dev *device.Device, node_id mtypes.Vertex, dst_nodeID mtypes.Vertex, msg *mtypes.ServerUpdateMsg) []byte {
+	body, _ := dev.EncodeMessage(node_id, msg)
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+	header.SetDst(dst_nodeID)
+	header.SetSrc(mtypes.NodeID_SuperNode)
+	copy(buf[path.EgHeaderLen:], body)
+	return buf
+}
+
 func PushNhTable(force bool) {
 	// No lock
-	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdateNhTable,
 		Code:    0,
 		Params:  string(httpobj.http_NhTable_Hash[:]),
-	})
-	if err != nil {
-		fmt.Println("Error get byte")
-		return
 	}
-	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-	header.SetDst(mtypes.NodeID_SuperNode)
-	header.SetSrc(mtypes.NodeID_SuperNode)
-	copy(buf[path.EgHeaderLen:], body)
 	for pkstr, peerstate := range httpobj.http_PeerState {
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
@@ -497,10 +625,10 @@ func PushNhTable(force bool) {
 		}
 		if force || peerstate.NhTableState.Load().(string) != httpobj.http_NhTable_Hash {
 			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device4, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device6, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 		}
 	}
@@ -508,21 +636,12 @@ func PushNhTable(force bool) {
 
 func PushPeerinfo(force bool) {
 	//No lock
-	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdatePeer,
 		Code:    0,
 		Params:  string(httpobj.http_PeerInfo_hash[:]),
-	})
-	if err != nil {
-		fmt.Println("Error get byte")
-		return
 	}
-	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-	header.SetDst(mtypes.NodeID_SuperNode)
-	header.SetSrc(mtypes.NodeID_SuperNode)
-	copy(buf[path.EgHeaderLen:], body)
 	for pkstr, peerstate := range httpobj.http_PeerState {
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
@@ -530,10 +649,10 @@ func PushPeerinfo(force bool) {
 		}
 		if force || peerstate.PeerInfoState.Load().(string) != httpobj.http_PeerInfo_hash {
 			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device4, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device6, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 		}
 	}
@@ -548,27 +667,17 @@ func PushServerParams(force bool) {
 		}
 		if force || peerstate.SuperParamState.Load().(string) != peerstate.SuperParamStateClient.Load().(string) {
 
-			body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+			msg := mtypes.ServerUpdateMsg{
 				Node_id: mtypes.NodeID_SuperNode,
 				Action:  mtypes.UpdateSuperParams,
 				Code:    0,
 				Params:  peerstate.SuperParamState.Load().(string),
-			})
-			if err != nil {
-				fmt.Println("Error get byte")
-				return
 			}
-			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-			header.SetDst(mtypes.NodeID_SuperNode)
-			header.SetSrc(mtypes.NodeID_SuperNode)
-			copy(buf[path.EgHeaderLen:], body)
-
 			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device4, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, ServerUpdatePacket(httpobj.http_device6, peer.ID, mtypes.NodeID_SuperNode, &msg), device.MessageTransportOffsetContent)
 			}
 		}
 	}
@@ -32,6 +32,14 @@ type EdgeConfig struct {
 	DisableAf             conn.EnabledAf   `yaml:"DisabledAf"`
 	AfPrefer              int              `yaml:"AfPrefer"`
 	LogLevel              LoggerInfo       `yaml:"LogLevel"`
+	Compression           CompressionInfo  `yaml:"Compression"`
+	FEC                   FECInfo          `yaml:"FEC"`
+	Duplication           DuplicationInfo  `yaml:"Duplication"`
+	Fragmentation         FragmentInfo     `yaml:"Fragmentation"`
+	MacFlap               MacFlapInfo      `yaml:"MacFlap"`
+	LoopDetect            LoopDetectInfo   `yaml:"LoopDetect"`
+	SourceAuth            SourceAuthInfo   `yaml:"SourceAuth"`
+	E2EEncryption         E2EInfo          `yaml:"E2EEncryption"`
 	DynamicRoute          DynamicRouteInfo `yaml:"DynamicRoute"`
 	NextHopTable          NextHopTable     `yaml:"NextHopTable"`
 	ResetEndPointInterval float64          `yaml:"ResetEndPointInterval"`
@@ -56,14 +64,40 @@ type SuperConfig struct {
 	DampingFilterRadius     uint64                  `yaml:"DampingFilterRadius"`
 	LogLevel                LoggerInfo              `yaml:"LogLevel"`
 	Passwords               Passwords               `yaml:"Passwords"`
+	APIUsers                []APIUser               `yaml:"APIUsers"`
+	AuditLog                string                  `yaml:"AuditLog"` // mutating manage API calls are appended to it, or to the log if empty
+	ConfigHistory           ConfigHistoryInfo       `yaml:"ConfigHistory"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
 	NextHopTable            NextHopTable            `yaml:"NextHopTable"`
 	EdgeTemplate            string                  `yaml:"EdgeTemplate"`
 	UsePSKForInterEdge      bool                    `yaml:"UsePSKForInterEdge"`
+	PSKRotation             PSKRotationInfo         `yaml:"PSKRotation"`
+	Enrollment              EnrollmentInfo          `yaml:"Enrollment"`
 	ResetEndPointInterval   float64                 `yaml:"ResetEndPointInterval"`
+	RequiredFeatures        []string                `yaml:"RequiredFeatures"`
 	Peers                   []SuperPeerInfo         `yaml:"Peers"`
 }
 
+// PSKRotationInfo rotates the PSKs of UsePSKForInterEdge.
+type PSKRotationInfo struct {
+	Interval   float64 `yaml:"Interval"`   // seconds between rotations, 0 rotates only through the manage API
+	SwitchOver float64 `yaml:"SwitchOver"` // seconds of each phase of a rotation, while both the old and the new PSKs are accepted
+}
+
+// ConfigHistoryInfo keeps the last revisions of the config, which the manage API rewrites, to roll back to.
+type ConfigHistoryInfo struct {
+	Keep int    `yaml:"Keep"` // revisions to keep, 0 disables the history
+	Dir  string `yaml:"Dir"`  // where the revisions go, <config path>.history if empty
+}
+
+// EnrollmentInfo lets new edges join with one-time tokens issued by the manage API.
+type EnrollmentInfo struct {
+	Enabled    bool    `yaml:"Enabled"`
+	NodeIDFrom Vertex  `yaml:"NodeIDFrom"` // enrolled edges get the lowest free NodeID from NodeIDFrom to NodeIDTo
+	NodeIDTo   Vertex  `yaml:"NodeIDTo"`
+	TokenTTL   float64 `yaml:"TokenTTL"` // seconds a token is valid, unless the manage API is told otherwise
+}
+
 type Passwords struct {
 	ShowState   string `yaml:"ShowState"`
 	AddPeer     string `yaml:"AddPeer"`
@@ -72,6 +106,14 @@ type Passwords struct {
 	UpdateSuper string `yaml:"UpdateSuper"`
 }
 
+// APIUser may call the manage API operations of its Roles with its own token.
+type APIUser struct {
+	Name      string   `yaml:"Name"`
+	TokenHash string   `yaml:"TokenHash"` // sha256 of the token in hex
+	Roles     []string `yaml:"Roles"`     // ShowState, AddPeer, DelPeer, UpdatePeer or UpdateSuper, like the Passwords
+	NodeIDs   string   `yaml:"NodeIDs"`   // NodeIDs it may manage, like [1~100,200]. Empty for all
+}
+
 type InterfaceConf struct {
 	IType         string `yaml:"IType"`
 	Name          string `yaml:"Name"`
@@ -85,6 +127,8 @@ type InterfaceConf struct {
 	RecvAddr      string `yaml:"RecvAddr"`
 	SendAddr      string `yaml:"SendAddr"`
 	L2HeaderMode  string `yaml:"L2HeaderMode"`
+	Queues        int    `yaml:"Queues"`
+	VnetHdr       bool   `yaml:"VnetHdr"`
 }
 
 type PeerInfo struct {
@@ -107,14 +151,85 @@ type SuperPeerInfo struct {
 	ExternalIP     string  `yaml:"ExternalIP"`
 }
 
+type CompressionInfo struct {
+	Enabled bool `yaml:"Enabled"`
+	Level   int  `yaml:"Level"`
+	MinSize int  `yaml:"MinSize"`
+}
+
+type FECInfo struct {
+	Enabled         bool    `yaml:"Enabled"`
+	DataShards      int     `yaml:"DataShards"`
+	MinParityShards int     `yaml:"MinParityShards"`
+	MaxParityShards int     `yaml:"MaxParityShards"`
+	FlushTimeout    float64 `yaml:"FlushTimeout"`
+}
+
+type DuplicationInfo struct {
+	Enabled bool            `yaml:"Enabled"`
+	Rules   []DuplicateRule `yaml:"Rules"`
+}
+
+type FragmentInfo struct {
+	Enabled           bool    `yaml:"Enabled"`
+	PathMTU           int     `yaml:"PathMTU"`
+	ReassemblyTimeout float64 `yaml:"ReassemblyTimeout"`
+	ReassemblyMemory  int     `yaml:"ReassemblyMemory"`
+}
+
+// MacFlapInfo limits how often a MAC address may move between nodes in the L2FIB.
+type MacFlapInfo struct {
+	MaxMoves   int     `yaml:"MaxMoves"` // per minute, 0 disables flap protection
+	HoldTime   float64 `yaml:"HoldTime"`
+	Action     string  `yaml:"Action"` // freeze or blackhole
+	MoveScript string  `yaml:"MoveScript"`
+}
+
+// LoopDetectInfo detects other edges bridged into the same LAN as our tap.
+type LoopDetectInfo struct {
+	Enabled     bool    `yaml:"Enabled"`
+	Interval    float64 `yaml:"Interval"`
+	Key         string  `yaml:"Key"` // shared by all edges, probes are signed with it
+	Block       bool    `yaml:"Block"`
+	AlarmScript string  `yaml:"AlarmScript"`
+	BPDU        string  `yaml:"BPDU"` // passthrough or block
+}
+
+// SourceAuthInfo authenticates the source of packets end to end, with keys derived from the PSK of each node pair.
+type SourceAuthInfo struct {
+	Enabled    bool `yaml:"Enabled"`    // authenticate control messages we send
+	DataFrames bool `yaml:"DataFrames"` // authenticate unicast data frames we send as well
+	Require    bool `yaml:"Require"`    // drop unauthenticated control messages, and unicast data frames if DataFrames is set
+}
+
+// E2EInfo encrypts unicast data frames for their destination, with keys derived from the PSK of each node pair,
+// so that transit nodes only see the EgHeader. Broadcast frames are never encrypted.
+type E2EInfo struct {
+	Enabled      bool     `yaml:"Enabled"`
+	Destinations []Vertex `yaml:"Destinations"` // encrypt frames to these nodes, empty for every node
+	Require      bool     `yaml:"Require"`      // drop unencrypted frames from Destinations which passed a transit node
+}
+
+// DuplicateRule matches frames to send over two node-disjoint paths.
+// Zero fields match anything.
+type DuplicateRule struct {
+	EtherType uint16 `yaml:"EtherType"`
+	IPProto   uint8  `yaml:"IPProto"`
+	DSCP      uint8  `yaml:"DSCP"`
+	PortMin   uint16 `yaml:"PortMin"` // source or destination port of TCP/UDP
+	PortMax   uint16 `yaml:"PortMax"`
+}
+
 type LoggerInfo struct {
-	LogLevel    string `yaml:"LogLevel"`
-	LogTransit  bool   `yaml:"LogTransit"`
-	LogNormal   bool   `yaml:"LogNormal"`
-	DumpNormal  bool   `yaml:"DumpNormal"`
-	LogControl  bool   `yaml:"LogControl"`
-	LogInternal bool   `yaml:"LogInternal"`
-	LogNTP      bool   `yaml:"LogNTP"`
+	LogLevel    string            `yaml:"LogLevel"`
+	LogFormat   string            `yaml:"LogFormat"`
+	LogTransit  bool              `yaml:"LogTransit"`
+	LogNormal   bool              `yaml:"LogNormal"`
+	DumpNormal  bool              `yaml:"DumpNormal"`
+	LogControl  bool              `yaml:"LogControl"`
+	LogInternal bool              `yaml:"LogInternal"`
+	LogNTP      bool              `yaml:"LogNTP"`
+	Categories  map[string]string `yaml:"Categories"`
 }
 
 func (v *Vertex) ToString() string {
@@ -165,12 +280,22 @@ type SuperInfo struct {
 	SkipLocalIP          bool     `yaml:"SkipLocalIP"`
 	AdditionalLocalIP    []string `yaml:"AdditionalLocalIP"`
 	SuperNodeInfoTimeout float64  `yaml:"SuperNodeInfoTimeout"`
+	KeyRotationOverlap   float64  `yaml:"KeyRotationOverlap"`
 }
 
 type P2PInfo struct {
 	UseP2P                  bool                    `yaml:"UseP2P"`
 	SendPeerInterval        float64                 `yaml:"SendPeerInterval"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
+	Admission               AdmissionInfo           `yaml:"Admission"`
+}
+
+// AdmissionInfo decides which announced peers we add in P2P mode.
+type AdmissionInfo struct {
+	Mode        string              `yaml:"Mode"`        // open, allowlist or ca
+	AllowedKeys map[Vertex][]string `yaml:"AllowedKeys"` // public keys allowed for each NodeID, in allowlist mode
+	CAPubKey    string              `yaml:"CAPubKey"`    // ed25519 public key of the network CA, in ca mode
+	Certificate string              `yaml:"Certificate"` // our certificate signed by the CA, sent to our peers in ca mode
 }
 
 type GraphRecalculateSetting struct {
@@ -224,9 +349,12 @@ func (Connurl *API_connurl) GetList(UseLocal bool) (ret map[string]float64) {
 }
 
 type API_Peerinfo struct {
-	NodeID  Vertex
-	PSKey   string
-	Connurl *API_connurl
+	NodeID     Vertex
+	PubKeyAlt  string `json:",omitempty"` // accepted as well while the edge rotates its key
+	PSKey      string
+	PSKeyAlt   string `json:",omitempty"` // accepted as well while the supernode rotates the PSKs
+	PSKVersion uint64 `json:",omitempty"`
+	Connurl    *API_connurl
 }
 
 type API_SuperParams struct {
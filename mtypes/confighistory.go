@@ -0,0 +1,342 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigHistory writes a config file atomically, and keeps its last revisions in a directory,
+// one numbered file each, with a diff from the revision before it.
+
+// ConfigRevision is a revision of the config file.
+type ConfigRevision struct {
+	Revision uint64 `yaml:"Revision"`
+	Time     string `yaml:"Time"`
+	User     string `yaml:"User"` // who made the change, empty if it wasn't made by the manage API
+	Action   string `yaml:"Action"`
+	Diff     string `yaml:"Diff"`            // from the previous revision, secrets redacted
+	Config   string `yaml:"Config" json:"-"` // the whole config, with its secrets
+}
+
+type ConfigHistory struct {
+	path string
+	dir  string
+	keep int
+	last []byte // config we wrote last
+	sync.Mutex
+}
+
+const configDiffContext = 2
+
+var configSecretLine = regexp.MustCompile(`^(\s*(?:- )?(?:PrivKeyV4|PrivKeyV6|PrivKey|PSKey|TokenHash|ShowState|AddPeer|DelPeer|UpdatePeer|UpdateSuper):).*$`)
+
+func NewConfigHistory(configPath string, info ConfigHistoryInfo) *ConfigHistory {
+	dir := info.Dir
+	if dir == "" {
+		dir = configPath + ".history"
+	}
+	return &ConfigHistory{
+		path: configPath,
+		dir:  dir,
+		keep: info.Keep,
+	}
+}
+
+// Init reads the config file, and records it as a revision if the latest revision isn't the same,
+// like after it was edited by hand.
+func (h *ConfigHistory) Init(user string, action string) (err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.last, err = ioutil.ReadFile(h.path)
+	if err != nil || h.keep <= 0 {
+		return
+	}
+	revs, err := h.revisions()
+	if err != nil {
+		return
+	}
+	var prev []byte
+	if len(revs) > 0 {
+		latest, err := h.read(revs[len(revs)-1])
+		if err != nil {
+			return err
+		}
+		if latest.Config == string(h.last) {
+			return nil
+		}
+		prev = []byte(latest.Config)
+	}
+	_, err = h.record(revs, prev, h.last, user, action)
+	return
+}
+
+// Save writes config to the config file, and records it as a new revision.
+func (h *ConfigHistory) Save(config []byte, user string, action string) (rev ConfigRevision, err error) {
+	h.Lock()
+	defer h.Unlock()
+	err = WriteFileAtomic(h.path, config, 0600)
+	if err != nil {
+		return
+	}
+	prev := h.last
+	h.last = config
+	if h.keep <= 0 {
+		return
+	}
+	revs, err := h.revisions()
+	if err != nil {
+		return
+	}
+	return h.record(revs, prev, config, user, action)
+}
+
+// List returns the revisions we keep, the oldest first.
+func (h *ConfigHistory) List() ([]ConfigRevision, error) {
+	h.Lock()
+	defer h.Unlock()
+	revs, err := h.revisions()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]ConfigRevision, 0, len(revs))
+	for _, revnum := range revs {
+		rev, err := h.read(revnum)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rev)
+	}
+	return ret, nil
+}
+
+// Get returns a revision, os.ErrNotExist if we don't keep it.
+func (h *ConfigHistory) Get(revnum uint64) (ConfigRevision, error) {
+	h.Lock()
+	defer h.Unlock()
+	return h.read(revnum)
+}
+
+// Latest returns the number of the latest revision, 0 if there is none.
+func (h *ConfigHistory) Latest() (uint64, error) {
+	h.Lock()
+	defer h.Unlock()
+	revs, err := h.revisions()
+	if err != nil || len(revs) == 0 {
+		return 0, err
+	}
+	return revs[len(revs)-1], nil
+}
+
+func (h *ConfigHistory) revfile(revnum uint64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%08d.yaml", revnum))
+}
+
+func (h *ConfigHistory) read(revnum uint64) (rev ConfigRevision, err error) {
+	err = ReadYaml(h.revfile(revnum), &rev)
+	return
+}
+
+// revisions returns the numbers of the revisions in the directory, sorted.
+func (h *ConfigHistory) revisions() ([]uint64, error) {
+	entries, err := os.ReadDir(h.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []uint64
+	for _, entry := range entries {
+		revnum, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".yaml"), 10, 64)
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+		ret = append(ret, revnum)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// record writes config as the revision after revs, and removes the revisions we don't keep anymore.
+func (h *ConfigHistory) record(revs []uint64, prev []byte, config []byte, user string, action string) (rev ConfigRevision, err error) {
+	rev = ConfigRevision{
+		Revision: 1,
+		Time:     time.Now().Format(time.RFC3339),
+		User:     user,
+		Action:   action,
+		Diff:     ConfigDiff(string(prev), string(config)),
+		Config:   string(config),
+	}
+	if len(revs) > 0 {
+		rev.Revision = revs[len(revs)-1] + 1
+	}
+	if err = os.MkdirAll(h.dir, 0700); err != nil {
+		return
+	}
+	revbytes, _ := yaml.Marshal(&rev)
+	if err = WriteFileAtomic(h.revfile(rev.Revision), revbytes, 0600); err != nil {
+		return
+	}
+	revs = append(revs, rev.Revision)
+	for len(revs) > h.keep {
+		if err = os.Remove(h.revfile(revs[0])); err != nil {
+			return
+		}
+		revs = revs[1:]
+	}
+	return
+}
+
+// ConfigDiff returns a unified diff of the lines of two configs, with the values of the secrets redacted.
+func ConfigDiff(a string, b string) string {
+	alines := splitLines(a)
+	blines := splitLines(b)
+	ops := diffLines(alines, blines)
+	var ret strings.Builder
+	for start := 0; start < len(ops); {
+		// find the next change, and the end of the changes close to it
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for i := start; i < len(ops) && i <= end+2*configDiffContext; i++ {
+			if ops[i].kind != ' ' {
+				end = i
+			}
+		}
+		from := start - configDiffContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + configDiffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		var acount, bcount int
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				acount++
+			}
+			if op.kind != '-' {
+				bcount++
+			}
+		}
+		fmt.Fprintf(&ret, "@@ -%v,%v +%v,%v @@\n", ops[from].aline, acount, ops[from].bline, bcount)
+		for _, op := range ops[from:to] {
+			ret.WriteByte(op.kind)
+			ret.WriteString(configSecretLine.ReplaceAllString(op.line, "$1 <redacted>"))
+			ret.WriteByte('\n')
+		}
+		start = to
+	}
+	return ret.String()
+}
+
+type diffOp struct {
+	kind  byte // ' ', '-' or '+'
+	line  string
+	aline int // line number in a, or where it would be
+	bline int
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the edit script from a to b. It compares the lines between the common prefix and suffix
+// by their longest common subsequence, or replaces all of them if there are too many.
+func diffLines(a []string, b []string) []diffOp {
+	var ops []diffOp
+	ai, bi := 1, 1
+	add := func(kind byte, line string) {
+		ops = append(ops, diffOp{kind: kind, line: line, aline: ai, bline: bi})
+		if kind != '+' {
+			ai++
+		}
+		if kind != '-' {
+			bi++
+		}
+	}
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		add(' ', line)
+	}
+	am := a[prefix : len(a)-suffix]
+	bm := b[prefix : len(b)-suffix]
+	if len(am)*len(bm) > 1<<20 {
+		for _, line := range am {
+			add('-', line)
+		}
+		for _, line := range bm {
+			add('+', line)
+		}
+	} else {
+		lcs := make([][]int32, len(am)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(bm)+1)
+		}
+		for i := len(am) - 1; i >= 0; i-- {
+			for j := len(bm) - 1; j >= 0; j-- {
+				if am[i] == bm[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(am) && j < len(bm) {
+			switch {
+			case am[i] == bm[j]:
+				add(' ', am[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				add('-', am[i])
+				i++
+			default:
+				add('+', bm[j])
+				j++
+			}
+		}
+		for ; i < len(am); i++ {
+			add('-', am[i])
+		}
+		for ; j < len(bm); j++ {
+			add('+', bm[j])
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		add(' ', line)
+	}
+	return ops
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nPSKey: old\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nPSKey: new\nj\n"
+	want := "@@ -1,4 +1,4 @@\n a\n-b\n+B\n c\n d\n" +
+		"@@ -8,3 +8,4 @@\n h\n i\n-PSKey: <redacted>\n+PSKey: <redacted>\n+j\n"
+	if diff := ConfigDiff(a, b); diff != want {
+		t.Errorf("ConfigDiff = %q, want %q", diff, want)
+	}
+	if diff := ConfigDiff(a, a); diff != "" {
+		t.Errorf("ConfigDiff of the same config = %q", diff)
+	}
+}
+
+func TestConfigHistory(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "super.yaml")
+	if err := ioutil.WriteFile(configPath, []byte("Peers: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := NewConfigHistory(configPath, ConfigHistoryInfo{Keep: 2})
+	if err := h.Init("", "startup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Init("", "startup"); err != nil {
+		t.Fatal(err)
+	}
+	if latest, _ := h.Latest(); latest != 1 {
+		t.Fatalf("startup recorded as revision %v, want 1", latest)
+	}
+	for i, config := range []string{"Peers: [1]\n", "Peers: [1, 2]\n"} {
+		rev, err := h.Save([]byte(config), "alice", "peer add")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev.Revision != uint64(i+2) || rev.User != "alice" {
+			t.Errorf("Save recorded %+v", rev)
+		}
+	}
+	revs, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Revision != 2 || revs[1].Revision != 3 {
+		t.Fatalf("kept %+v, want revisions 2 and 3", revs)
+	}
+	if revs[1].Diff != "@@ -1,1 +1,1 @@\n-Peers: [1]\n+Peers: [1, 2]\n" {
+		t.Errorf("Diff = %q", revs[1].Diff)
+	}
+	if _, err := h.Get(1); err == nil {
+		t.Error("revision 1 wasn't removed")
+	}
+	config, _ := ioutil.ReadFile(configPath)
+	if string(config) != "Peers: [1, 2]\n" {
+		t.Errorf("config file = %q", config)
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	nonSecureRand "math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"time"
 
@@ -94,6 +98,76 @@ func ReadYaml(filePath string, out interface{}) (err error) {
 	return
 }
 
+// WriteFileAtomic replaces the file at filePath with data, readers see either the old or the new file.
+// The file gets perm, also if it existed with another mode.
+func WriteFileAtomic(filePath string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), filePath); err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir makes the renames in dir durable. Windows can't sync a directory, a rename is durable there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// DiffFields returns the dotted names of the fields which differ between the structs a and b.
+// Empty maps and slices equal nil ones, as they do in the config file.
+func DiffFields(a interface{}, b interface{}) []string {
+	return diffFields("", reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+func diffFields(prefix string, a reflect.Value, b reflect.Value) (ret []string) {
+	if (a.Kind() == reflect.Map || a.Kind() == reflect.Slice) && a.Len() == 0 && b.Len() == 0 {
+		return
+	}
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			ret = append(ret, prefix)
+		}
+		return
+	}
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		ret = append(ret, diffFields(name, a.Field(i), b.Field(i))...)
+	}
+	return
+}
+
 func AbsInt(a int) int {
 	if a < 0 {
 		a *= -1
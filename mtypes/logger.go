@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogCategory is the "category" field of every log entry.
+// The categories are the same as the old LogTransit/LogNormal/... switches.
+type LogCategory int
+
+const (
+	LogCatDevice LogCategory = iota
+	LogCatTransit
+	LogCatNormal
+	LogCatControl
+	LogCatInternal
+	LogCatNTP
+	LogCatNum
+)
+
+var logCategoryNames = [LogCatNum]string{"device", "transit", "normal", "control", "internal", "ntp"}
+
+func (c LogCategory) ToString() string {
+	if c < 0 || c >= LogCatNum {
+		return "unknown"
+	}
+	return logCategoryNames[c]
+}
+
+func String2LogCategory(s string) (LogCategory, error) {
+	for i, name := range logCategoryNames {
+		if strings.EqualFold(s, name) {
+			return LogCategory(i), nil
+		}
+	}
+	return LogCatNum, fmt.Errorf("unknown log category: %v", s)
+}
+
+// LogFields are the structured fields attached to a log entry.
+// Use the same keys everywhere: node_id, peer_id, usage, src, dst, endpoint.
+type LogFields = logrus.Fields
+
+const (
+	LogLevelSilent = logrus.PanicLevel
+	LogLevelError  = logrus.ErrorLevel
+	LogLevelInfo   = logrus.InfoLevel
+	LogLevelDebug  = logrus.DebugLevel
+)
+
+func String2LogLevel(s string) (logrus.Level, error) {
+	switch strings.ToLower(s) {
+	case "silent":
+		return LogLevelSilent, nil
+	case "verbose":
+		return logrus.DebugLevel, nil
+	case "":
+		return logrus.ErrorLevel, nil
+	}
+	return logrus.ParseLevel(s)
+}
+
+func LogLevel2String(l logrus.Level) string {
+	if l == LogLevelSilent {
+		return "silent"
+	}
+	return l.String()
+}
+
+// Logger is a structured logger with an independent level for each LogCategory.
+// A nil *Logger is valid and discards everything.
+type Logger struct {
+	out    *logrus.Logger
+	base   LogFields
+	levels *[LogCatNum]uint32 // logrus.Level, accessed atomically, shared with WithFields
+}
+
+// NewLogger builds a Logger from the LogLevel section of the config.
+// LogLevel sets the level of the device category and the default of the others,
+// the LogTransit/LogNormal/... switches raise their category to info (DumpNormal to debug),
+// and Categories overrides any category explicitly.
+func NewLogger(info LoggerInfo, nodeName string, nodeID Vertex) (*Logger, error) {
+	return NewLoggerWithOutput(info, nodeName, nodeID, os.Stdout)
+}
+
+func NewLoggerWithOutput(info LoggerInfo, nodeName string, nodeID Vertex, w io.Writer) (*Logger, error) {
+	l := &Logger{
+		out: logrus.New(),
+		base: LogFields{
+			"node_id":   nodeID.ToString(),
+			"node_name": nodeName,
+		},
+		levels: new([LogCatNum]uint32),
+	}
+	l.out.SetOutput(w)
+	l.out.SetLevel(logrus.TraceLevel) // filtering is done per category
+	switch strings.ToLower(info.LogFormat) {
+	case "json":
+		l.out.SetFormatter(&logrus.JSONFormatter{})
+	case "", "text":
+		l.out.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, DisableColors: true})
+	default:
+		return nil, fmt.Errorf("unknown LogFormat: %v", info.LogFormat)
+	}
+	levels, err := loggerLevels(info)
+	if err != nil {
+		return nil, err
+	}
+	*l.levels = levels
+	return l, nil
+}
+
+// SetLevels sets the levels of all categories from the LogLevel section of the config, like NewLogger.
+// The LogFormat stays as it is.
+func (l *Logger) SetLevels(info LoggerInfo) error {
+	if l == nil {
+		return nil
+	}
+	levels, err := loggerLevels(info)
+	if err != nil {
+		return err
+	}
+	for i := range levels {
+		atomic.StoreUint32(&l.levels[i], levels[i])
+	}
+	return nil
+}
+
+func loggerLevels(info LoggerInfo) (levels [LogCatNum]uint32, err error) {
+	defaultLevel, err := String2LogLevel(info.LogLevel)
+	if err != nil {
+		return levels, fmt.Errorf("LogLevel: %v", err)
+	}
+	for i := range levels {
+		levels[i] = uint32(defaultLevel)
+	}
+	raise := func(cat LogCategory, enabled bool, level logrus.Level) {
+		if enabled && logrus.Level(levels[cat]) < level {
+			levels[cat] = uint32(level)
+		}
+	}
+	raise(LogCatTransit, info.LogTransit, logrus.InfoLevel)
+	raise(LogCatNormal, info.LogNormal, logrus.InfoLevel)
+	raise(LogCatNormal, info.DumpNormal, logrus.DebugLevel)
+	raise(LogCatControl, info.LogControl, logrus.InfoLevel)
+	raise(LogCatInternal, info.LogInternal, logrus.InfoLevel)
+	raise(LogCatNTP, info.LogNTP, logrus.InfoLevel)
+
+	for catstr, levelstr := range info.Categories {
+		cat, err := String2LogCategory(catstr)
+		if err != nil {
+			return levels, err
+		}
+		level, err := String2LogLevel(levelstr)
+		if err != nil {
+			return levels, fmt.Errorf("LogLevel of %v: %v", catstr, err)
+		}
+		levels[cat] = uint32(level)
+	}
+	return levels, nil
+}
+
+// WithFields returns a Logger that adds fields to every entry.
+// The levels are shared with l, so SetLevel on either one affects both.
+func (l *Logger) WithFields(fields LogFields) *Logger {
+	if l == nil {
+		return nil
+	}
+	base := make(LogFields, len(l.base)+len(fields))
+	for k, v := range l.base {
+		base[k] = v
+	}
+	for k, v := range fields {
+		base[k] = v
+	}
+	return &Logger{
+		out:    l.out,
+		base:   base,
+		levels: l.levels,
+	}
+}
+
+func (l *Logger) Enabled(cat LogCategory, level logrus.Level) bool {
+	if l == nil || cat < 0 || cat >= LogCatNum || level == LogLevelSilent {
+		return false
+	}
+	return logrus.Level(atomic.LoadUint32(&l.levels[cat])) >= level
+}
+
+func (l *Logger) Level(cat LogCategory) logrus.Level {
+	if l == nil || cat < 0 || cat >= LogCatNum {
+		return LogLevelSilent
+	}
+	return logrus.Level(atomic.LoadUint32(&l.levels[cat]))
+}
+
+func (l *Logger) SetLevel(cat LogCategory, level logrus.Level) {
+	if l == nil || cat < 0 || cat >= LogCatNum {
+		return
+	}
+	atomic.StoreUint32(&l.levels[cat], uint32(level))
+}
+
+func (l *Logger) Logf(cat LogCategory, level logrus.Level, fields LogFields, format string, args ...interface{}) {
+	if !l.Enabled(cat, level) {
+		return
+	}
+	entry := l.out.WithFields(l.base).WithField("category", cat.ToString())
+	if len(fields) > 0 {
+		entry = entry.WithFields(fields)
+	}
+	entry.Logf(level, format, args...)
+}
+
+func (l *Logger) Errorf(cat LogCategory, fields LogFields, format string, args ...interface{}) {
+	l.Logf(cat, logrus.ErrorLevel, fields, format, args...)
+}
+
+func (l *Logger) Infof(cat LogCategory, fields LogFields, format string, args ...interface{}) {
+	l.Logf(cat, logrus.InfoLevel, fields, format, args...)
+}
+
+func (l *Logger) Debugf(cat LogCategory, fields LogFields, format string, args ...interface{}) {
+	l.Logf(cat, logrus.DebugLevel, fields, format, args...)
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	E, I, D, S := LogLevelError, LogLevelInfo, LogLevelDebug, LogLevelSilent
+	tests := []struct {
+		name string
+		info LoggerInfo
+		want [LogCatNum]logrus.Level // device, transit, normal, control, internal, ntp
+	}{
+		{"default", LoggerInfo{}, [LogCatNum]logrus.Level{E, E, E, E, E, E}},
+		{"LogLevel", LoggerInfo{LogLevel: "verbose"}, [LogCatNum]logrus.Level{D, D, D, D, D, D}},
+		{"silent", LoggerInfo{LogLevel: "silent"}, [LogCatNum]logrus.Level{S, S, S, S, S, S}},
+		{"legacy switches", LoggerInfo{LogLevel: "error", LogTransit: true, LogNormal: true, LogControl: true, LogInternal: true, LogNTP: true},
+			[LogCatNum]logrus.Level{E, I, I, I, I, I}},
+		{"DumpNormal", LoggerInfo{LogNormal: true, DumpNormal: true}, [LogCatNum]logrus.Level{E, E, D, E, E, E}},
+		{"switches don't lower LogLevel", LoggerInfo{LogLevel: "debug", LogControl: true}, [LogCatNum]logrus.Level{D, D, D, D, D, D}},
+		{"Categories override", LoggerInfo{LogLevel: "info", LogTransit: true, Categories: map[string]string{"Transit": "silent", "ntp": "debug"}},
+			[LogCatNum]logrus.Level{I, S, I, I, I, D}},
+	}
+	for _, tt := range tests {
+		levels, err := loggerLevels(tt.info)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		for cat, level := range levels {
+			if logrus.Level(level) != tt.want[cat] {
+				t.Errorf("%v: level of %v is %v, want %v", tt.name, LogCategory(cat).ToString(), LogLevel2String(logrus.Level(level)), LogLevel2String(tt.want[cat]))
+			}
+		}
+	}
+
+	for _, info := range []LoggerInfo{{LogLevel: "loud"}, {Categories: map[string]string{"routing": "info"}}, {Categories: map[string]string{"ntp": "loud"}}} {
+		if _, err := loggerLevels(info); err == nil {
+			t.Errorf("%+v accepted", info)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	l, err := NewLoggerWithOutput(LoggerInfo{LogFormat: "json", LogControl: true}, "edge1", 1, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerlog := l.WithFields(LogFields{"peer_id": "2"})
+	peerlog.Infof(LogCatControl, LogFields{"endpoint": "127.0.0.1:1"}, "peer %v up", 2)
+	peerlog.Infof(LogCatTransit, nil, "filtered")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q: %v", out.String(), err)
+	}
+	for key, val := range map[string]string{"msg": "peer 2 up", "level": "info", "category": "control", "node_id": "1", "node_name": "edge1", "peer_id": "2", "endpoint": "127.0.0.1:1"} {
+		if entry[key] != val {
+			t.Errorf("%v is %v, want %v", key, entry[key], val)
+		}
+	}
+
+	// WithFields shares the levels
+	if err := l.SetLevels(LoggerInfo{LogLevel: "silent"}); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	peerlog.Errorf(LogCatControl, nil, "filtered")
+	if out.Len() != 0 || peerlog.Enabled(LogCatDevice, LogLevelError) {
+		t.Errorf("logged at silent: %q", out.String())
+	}
+
+	var nilLogger *Logger
+	nilLogger.Errorf(LogCatDevice, nil, "discarded")
+	if nilLogger.Enabled(LogCatDevice, LogLevelError) || nilLogger.WithFields(nil) != nil {
+		t.Error("nil Logger logs")
+	}
+}
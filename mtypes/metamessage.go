@@ -23,13 +23,17 @@ func GetByte(structIn interface{}) (bb []byte, err error) {
 const Infinity = float64(99999)
 
 type RegisterMsg struct {
-	Node_id             Vertex
-	Version             string
-	PeerStateHash       string
-	NhStateHash         string
-	SuperParamStateHash string
-	JWTSecret           JWTSecret
-	HttpPostCount       uint64
+	Node_id             Vertex    // 1
+	Version             string    // 2
+	PeerStateHash       string    // 3
+	NhStateHash         string    // 4
+	SuperParamStateHash string    // 5
+	JWTSecret           JWTSecret // 6
+	HttpPostCount       uint64    // 7
+	Features            Features  // 8
+	PSKVersion          uint64    // 9, version of the inter-edge PSKs in use
+	PubKey              [32]byte  // 10, the key the edge uses
+	PubKeyAlt           [32]byte  // 11, the other key it accepts while it rotates them
 }
 
 func Hash2Str(h string) string {
@@ -41,10 +45,14 @@ func Hash2Str(h string) string {
 }
 
 func (c *RegisterMsg) ToString() string {
-	return fmt.Sprint("RegisterMsg Node_id:"+c.Node_id.ToString(), " Version:"+c.Version, " PeerHash:"+Hash2Str(c.PeerStateHash), " NhHash:"+Hash2Str(c.NhStateHash), " SuperParamHash:"+Hash2Str(c.SuperParamStateHash))
+	return fmt.Sprint("RegisterMsg Node_id:"+c.Node_id.ToString(), " Version:"+c.Version, " PeerHash:"+Hash2Str(c.PeerStateHash), " NhHash:"+Hash2Str(c.NhStateHash), " SuperParamHash:"+Hash2Str(c.SuperParamStateHash), " Features:"+c.Features.ToString())
 }
 
 func ParseRegisterMsg(bin []byte) (StructPlace RegisterMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
@@ -84,13 +92,17 @@ func (a *ServerCommand) ToString() string {
 }
 
 type ServerUpdateMsg struct {
-	Node_id Vertex
-	Action  ServerCommand
-	Code    int
-	Params  string
+	Node_id Vertex        // 1
+	Action  ServerCommand // 2
+	Code    int           // 3
+	Params  string        // 4
 }
 
 func ParseServerUpdateMsg(bin []byte) (StructPlace ServerUpdateMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
@@ -102,11 +114,86 @@ func (c *ServerUpdateMsg) ToString() string {
 	return "ServerUpdateMsg Node_id:" + c.Node_id.ToString() + " Action:" + c.Action.ToString() + " Code:" + strconv.Itoa(int(c.Code)) + " Params: " + c.Params
 }
 
+// Features is a bitmap of optional capabilities a node supports.
+type Features uint32
+
+const (
+	FeatureCompression Features = 1 << iota
+	FeatureFEC
+	FeatureDuplicate
+	FeatureFragment
+	FeatureSequence
+	FeatureWireFormat
+	FeatureExtHeader
+	FeatureSourceAuth
+	FeatureE2E
+)
+
+func (f Features) Has(feature Features) bool {
+	return f&feature == feature
+}
+
+func (f Features) ToString() string {
+	ret := ""
+	if f.Has(FeatureCompression) {
+		ret += "compression,"
+	}
+	if f.Has(FeatureFEC) {
+		ret += "fec,"
+	}
+	if f.Has(FeatureDuplicate) {
+		ret += "duplicate,"
+	}
+	if f.Has(FeatureFragment) {
+		ret += "fragment,"
+	}
+	if f.Has(FeatureSequence) {
+		ret += "sequence,"
+	}
+	if f.Has(FeatureWireFormat) {
+		ret += "wire,"
+	}
+	if f.Has(FeatureExtHeader) {
+		ret += "exthdr,"
+	}
+	if f.Has(FeatureSourceAuth) {
+		ret += "srcauth,"
+	}
+	if f.Has(FeatureE2E) {
+		ret += "e2e,"
+	}
+	if ret == "" {
+		return "none"
+	}
+	return ret[:len(ret)-1]
+}
+
+// ParseFeatures parses feature names as printed by ToString.
+func ParseFeatures(names []string) (f Features, err error) {
+	for _, name := range names {
+		var found bool
+		for bit := Features(1); bit != 0; bit <<= 1 {
+			if bit.ToString() == name && name != "none" {
+				f |= bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown feature: %v", name)
+		}
+	}
+	return
+}
+
 type PingMsg struct {
-	RequestID    uint32
-	Src_nodeID   Vertex
-	Time         time.Time
-	RequestReply int
+	RequestID    uint32    // 1
+	Src_nodeID   Vertex    // 2
+	Time         time.Time // 3
+	RequestReply int       // 4
+	Features     Features  // 5
+	LossRate     float64   // 6, loss rate of the pings received from the destination
+	Certificate  []byte    // 7, certificate of Src_nodeID signed by the network CA, in P2P mode
 }
 
 func (c *PingMsg) ToString() string {
@@ -114,6 +201,10 @@ func (c *PingMsg) ToString() string {
 }
 
 func ParsePingMsg(bin []byte) (StructPlace PingMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
@@ -122,12 +213,13 @@ func ParsePingMsg(bin []byte) (StructPlace PingMsg, err error) {
 }
 
 type PongMsg struct {
-	RequestID      uint32
-	Src_nodeID     Vertex
-	Dst_nodeID     Vertex
-	Timediff       float64
-	TimeToAlive    float64
-	AdditionalCost float64
+	RequestID      uint32   // 1
+	Src_nodeID     Vertex   // 2
+	Dst_nodeID     Vertex   // 3
+	Timediff       float64  // 4
+	TimeToAlive    float64  // 5
+	AdditionalCost float64  // 6
+	Features       Features // 7, features of Dst_nodeID, the node who sends this pong
 }
 
 func (c *PongMsg) ToString() string {
@@ -135,6 +227,10 @@ func (c *PongMsg) ToString() string {
 }
 
 func ParsePongMsg(bin []byte) (StructPlace PongMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
@@ -143,7 +239,7 @@ func ParsePongMsg(bin []byte) (StructPlace PongMsg, err error) {
 }
 
 type QueryPeerMsg struct {
-	Request_ID uint32
+	Request_ID uint32 // 1
 }
 
 func (c *QueryPeerMsg) ToString() string {
@@ -151,6 +247,10 @@ func (c *QueryPeerMsg) ToString() string {
 }
 
 func ParseQueryPeerMsg(bin []byte) (StructPlace QueryPeerMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
@@ -159,10 +259,11 @@ func ParseQueryPeerMsg(bin []byte) (StructPlace QueryPeerMsg, err error) {
 }
 
 type BoardcastPeerMsg struct {
-	Request_ID uint32
-	NodeID     Vertex
-	PubKey     [32]byte
-	ConnURL    string
+	Request_ID  uint32   // 1, 1
+	NodeID      Vertex   // 2
+	PubKey      [32]byte // 3
+	ConnURL     string   // 4
+	Certificate []byte   // 5, certificate of NodeID, if the node sent us one
 }
 
 func (c *BoardcastPeerMsg) ToString() string {
@@ -170,6 +271,10 @@ func (c *BoardcastPeerMsg) ToString() string {
 }
 
 func ParseBoardcastPeerMsg(bin []byte) (StructPlace BoardcastPeerMsg, err error) {
+	if IsWireFormat(bin) {
+		err = StructPlace.unmarshalWire(bin)
+		return
+	}
 	var b bytes.Buffer
 	b.Write(bin)
 	d := gob.NewDecoder(&b)
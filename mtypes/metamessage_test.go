@@ -0,0 +1,23 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import "testing"
+
+func TestParseFeatures(t *testing.T) {
+	all := FeatureCompression | FeatureFEC | FeatureDuplicate | FeatureFragment | FeatureSequence | FeatureWireFormat | FeatureExtHeader | FeatureSourceAuth | FeatureE2E
+	if f, err := ParseFeatures([]string{"compression", "fec", "duplicate", "fragment", "sequence", "wire", "exthdr", "srcauth", "e2e"}); err != nil || f != all {
+		t.Errorf("got %v, %v, want %v", f.ToString(), err, all.ToString())
+	}
+	if f, err := ParseFeatures(nil); err != nil || f != 0 {
+		t.Errorf("got %v, %v, want none", f.ToString(), err)
+	}
+	for _, name := range []string{"none", "", "wire,fec"} {
+		if _, err := ParseFeatures([]string{name}); err == nil {
+			t.Errorf("%q parsed", name)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/* Wire format of control messages
+ *
+ * A message is a 3 bytes header followed by fields:
+ *
+ *   0xE6 | version | message type | field | field | ...
+ *
+ * 0xE6 never starts a gob stream, so older gob encoded messages are still told apart.
+ * The version is 1, it only changes if the format itself changes incompatibly.
+ * Message types: 1 RegisterMsg, 2 ServerUpdateMsg, 3 PingMsg, 4 PongMsg, 5 QueryPeerMsg, 6 BoardcastPeerMsg.
+ *
+ * Fields are encoded like protobuf: a uvarint key of field_number<<3 | wire_type, then the value.
+ *   wire type 0: uvarint. Signed integers are zigzag encoded.
+ *   wire type 1: 8 bytes little endian. Used for float64.
+ *   wire type 2: uvarint length, then that many bytes. Used for strings and keys.
+ * Field numbers are listed next to the struct fields. Fields with the zero value may be omitted,
+ * fields may come in any order, and receivers skip fields they don't know.
+ * New fields get new numbers, numbers of removed fields are never reused.
+ * A zero byte where a key is expected ends the message, the transport pads messages with zeros.
+ */
+
+const (
+	WireMagic   = 0xE6
+	WireVersion = 1
+
+	wireHeaderLen = 3
+)
+
+type WireType uint8
+
+const (
+	WireRegister WireType = iota + 1
+	WireServerUpdate
+	WirePing
+	WirePong
+	WireQueryPeer
+	WireBoardcastPeer
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+var ErrWireTruncated = errors.New("truncated wire message")
+
+// WireMessage is a control message with a wire format encoding.
+type WireMessage interface {
+	MarshalWire() []byte
+}
+
+// IsWireFormat reports whether bin is in the wire format rather than gob.
+func IsWireFormat(bin []byte) bool {
+	return len(bin) > 0 && bin[0] == WireMagic
+}
+
+type wireEncoder struct {
+	buf []byte
+}
+
+func newWireEncoder(t WireType) *wireEncoder {
+	return &wireEncoder{buf: []byte{WireMagic, WireVersion, byte(t)}}
+}
+
+func (e *wireEncoder) key(field int, wt int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wt))
+}
+
+func (e *wireEncoder) uint(field int, v uint64) {
+	if v != 0 {
+		e.key(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, v)
+	}
+}
+
+func (e *wireEncoder) int(field int, v int64) {
+	if v != 0 {
+		e.key(field, wireVarint)
+		e.buf = binary.AppendVarint(e.buf, v)
+	}
+}
+
+func (e *wireEncoder) float(field int, v float64) {
+	if v != 0 {
+		e.key(field, wireFixed64)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+	}
+}
+
+func (e *wireEncoder) bytes(field int, v []byte) {
+	if len(v) != 0 {
+		e.key(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// wireField is a decoded field. Only the value matching its wire type is set.
+type wireField struct {
+	num   int
+	wt    int
+	value uint64
+	bytes []byte
+}
+
+func (f *wireField) check(wt int) error {
+	if f.wt != wt {
+		return fmt.Errorf("wire field %v has wire type %v, want %v", f.num, f.wt, wt)
+	}
+	return nil
+}
+
+func (f *wireField) uint() (uint64, error) {
+	return f.value, f.check(wireVarint)
+}
+
+func (f *wireField) int() (int64, error) {
+	// zigzag
+	return int64(f.value>>1) ^ -int64(f.value&1), f.check(wireVarint)
+}
+
+func (f *wireField) vertex() (Vertex, error) {
+	if f.value > math.MaxUint16 {
+		return 0, fmt.Errorf("wire field %v: node ID %v out of range", f.num, f.value)
+	}
+	return Vertex(f.value), f.check(wireVarint)
+}
+
+func (f *wireField) uint32() (uint32, error) {
+	if f.value > math.MaxUint32 {
+		return 0, fmt.Errorf("wire field %v: %v out of range", f.num, f.value)
+	}
+	return uint32(f.value), f.check(wireVarint)
+}
+
+func (f *wireField) float() (float64, error) {
+	return math.Float64frombits(f.value), f.check(wireFixed64)
+}
+
+func (f *wireField) string() (string, error) {
+	return string(f.bytes), f.check(wireBytes)
+}
+
+// copyBytes returns a copy, the field points into the message.
+func (f *wireField) copyBytes() ([]byte, error) {
+	return append([]byte(nil), f.bytes...), f.check(wireBytes)
+}
+
+func (f *wireField) key(key *[32]byte) error {
+	if err := f.check(wireBytes); err != nil {
+		return err
+	}
+	if len(f.bytes) != len(key) {
+		return fmt.Errorf("wire field %v: key of %v bytes", f.num, len(f.bytes))
+	}
+	copy(key[:], f.bytes)
+	return nil
+}
+
+// decodeWire checks the header of a message of type t and calls fn for every field.
+// Fields with unknown numbers must be ignored by fn.
+func decodeWire(bin []byte, t WireType, fn func(f *wireField) error) error {
+	if len(bin) < wireHeaderLen {
+		return ErrWireTruncated
+	}
+	if bin[0] != WireMagic {
+		return errors.New("not a wire message")
+	}
+	if bin[1] != WireVersion {
+		return fmt.Errorf("unsupported wire version %v", bin[1])
+	}
+	if WireType(bin[2]) != t {
+		return fmt.Errorf("wire message type %v, want %v", bin[2], t)
+	}
+	bin = bin[wireHeaderLen:]
+	for len(bin) > 0 && bin[0] != 0 {
+		key, n := binary.Uvarint(bin)
+		if n <= 0 {
+			return ErrWireTruncated
+		}
+		bin = bin[n:]
+		if key>>3 == 0 || key>>3 > math.MaxInt32 {
+			return fmt.Errorf("invalid wire field number %v", key>>3)
+		}
+		f := wireField{num: int(key >> 3), wt: int(key & 7)}
+		switch f.wt {
+		case wireVarint:
+			f.value, n = binary.Uvarint(bin)
+			if n <= 0 {
+				return ErrWireTruncated
+			}
+			bin = bin[n:]
+		case wireFixed64:
+			if len(bin) < 8 {
+				return ErrWireTruncated
+			}
+			f.value = binary.LittleEndian.Uint64(bin)
+			bin = bin[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(bin)
+			if n <= 0 || size > uint64(len(bin)-n) {
+				return ErrWireTruncated
+			}
+			f.bytes = bin[n : n+int(size)]
+			bin = bin[n+int(size):]
+		default:
+			return fmt.Errorf("wire field %v has unknown wire type %v", f.num, f.wt)
+		}
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RegisterMsg) MarshalWire() []byte {
+	e := newWireEncoder(WireRegister)
+	e.uint(1, uint64(c.Node_id))
+	e.bytes(2, []byte(c.Version))
+	e.bytes(3, []byte(c.PeerStateHash))
+	e.bytes(4, []byte(c.NhStateHash))
+	e.bytes(5, []byte(c.SuperParamStateHash))
+	if c.JWTSecret != (JWTSecret{}) {
+		e.bytes(6, c.JWTSecret[:])
+	}
+	e.uint(7, c.HttpPostCount)
+	e.uint(8, uint64(c.Features))
+	e.uint(9, c.PSKVersion)
+	if c.PubKey != ([32]byte{}) {
+		e.bytes(10, c.PubKey[:])
+	}
+	if c.PubKeyAlt != ([32]byte{}) {
+		e.bytes(11, c.PubKeyAlt[:])
+	}
+	return e.buf
+}
+
+func (c *RegisterMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WireRegister, func(f *wireField) (err error) {
+		var u uint32
+		switch f.num {
+		case 1:
+			c.Node_id, err = f.vertex()
+		case 2:
+			c.Version, err = f.string()
+		case 3:
+			c.PeerStateHash, err = f.string()
+		case 4:
+			c.NhStateHash, err = f.string()
+		case 5:
+			c.SuperParamStateHash, err = f.string()
+		case 6:
+			err = f.key((*[32]byte)(&c.JWTSecret))
+		case 7:
+			c.HttpPostCount, err = f.uint()
+		case 8:
+			u, err = f.uint32()
+			c.Features = Features(u)
+		case 9:
+			c.PSKVersion, err = f.uint()
+		case 10:
+			err = f.key(&c.PubKey)
+		case 11:
+			err = f.key(&c.PubKeyAlt)
+		}
+		return
+	})
+}
+
+func (c *ServerUpdateMsg) MarshalWire() []byte {
+	e := newWireEncoder(WireServerUpdate)
+	e.uint(1, uint64(c.Node_id))
+	e.int(2, int64(c.Action))
+	e.int(3, int64(c.Code))
+	e.bytes(4, []byte(c.Params))
+	return e.buf
+}
+
+func (c *ServerUpdateMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WireServerUpdate, func(f *wireField) (err error) {
+		var v int64
+		switch f.num {
+		case 1:
+			c.Node_id, err = f.vertex()
+		case 2:
+			v, err = f.int()
+			c.Action = ServerCommand(v)
+		case 3:
+			v, err = f.int()
+			c.Code = int(v)
+		case 4:
+			c.Params, err = f.string()
+		}
+		return
+	})
+}
+
+func (c *PingMsg) MarshalWire() []byte {
+	e := newWireEncoder(WirePing)
+	e.uint(1, uint64(c.RequestID))
+	e.uint(2, uint64(c.Src_nodeID))
+	if !c.Time.IsZero() {
+		e.int(3, c.Time.UnixNano())
+	}
+	e.int(4, int64(c.RequestReply))
+	e.uint(5, uint64(c.Features))
+	e.float(6, c.LossRate)
+	e.bytes(7, c.Certificate)
+	return e.buf
+}
+
+func (c *PingMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WirePing, func(f *wireField) (err error) {
+		var v int64
+		var u uint32
+		switch f.num {
+		case 1:
+			c.RequestID, err = f.uint32()
+		case 2:
+			c.Src_nodeID, err = f.vertex()
+		case 3:
+			v, err = f.int()
+			c.Time = time.Unix(0, v)
+		case 4:
+			v, err = f.int()
+			c.RequestReply = int(v)
+		case 5:
+			u, err = f.uint32()
+			c.Features = Features(u)
+		case 6:
+			c.LossRate, err = f.float()
+		case 7:
+			c.Certificate, err = f.copyBytes()
+		}
+		return
+	})
+}
+
+func (c *PongMsg) MarshalWire() []byte {
+	e := newWireEncoder(WirePong)
+	e.uint(1, uint64(c.RequestID))
+	e.uint(2, uint64(c.Src_nodeID))
+	e.uint(3, uint64(c.Dst_nodeID))
+	e.float(4, c.Timediff)
+	e.float(5, c.TimeToAlive)
+	e.float(6, c.AdditionalCost)
+	e.uint(7, uint64(c.Features))
+	return e.buf
+}
+
+func (c *PongMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WirePong, func(f *wireField) (err error) {
+		var u uint32
+		switch f.num {
+		case 1:
+			c.RequestID, err = f.uint32()
+		case 2:
+			c.Src_nodeID, err = f.vertex()
+		case 3:
+			c.Dst_nodeID, err = f.vertex()
+		case 4:
+			c.Timediff, err = f.float()
+		case 5:
+			c.TimeToAlive, err = f.float()
+		case 6:
+			c.AdditionalCost, err = f.float()
+		case 7:
+			u, err = f.uint32()
+			c.Features = Features(u)
+		}
+		return
+	})
+}
+
+func (c *QueryPeerMsg) MarshalWire() []byte {
+	e := newWireEncoder(WireQueryPeer)
+	e.uint(1, uint64(c.Request_ID))
+	return e.buf
+}
+
+func (c *QueryPeerMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WireQueryPeer, func(f *wireField) (err error) {
+		switch f.num {
+		case 1:
+			c.Request_ID, err = f.uint32()
+		}
+		return
+	})
+}
+
+func (c *BoardcastPeerMsg) MarshalWire() []byte {
+	e := newWireEncoder(WireBoardcastPeer)
+	e.uint(1, uint64(c.Request_ID))
+	e.uint(2, uint64(c.NodeID))
+	if c.PubKey != ([32]byte{}) {
+		e.bytes(3, c.PubKey[:])
+	}
+	e.bytes(4, []byte(c.ConnURL))
+	e.bytes(5, c.Certificate)
+	return e.buf
+}
+
+func (c *BoardcastPeerMsg) unmarshalWire(bin []byte) error {
+	return decodeWire(bin, WireBoardcastPeer, func(f *wireField) (err error) {
+		switch f.num {
+		case 1:
+			c.Request_ID, err = f.uint32()
+		case 2:
+			c.NodeID, err = f.vertex()
+		case 3:
+			err = f.key(&c.PubKey)
+		case 4:
+			c.ConnURL, err = f.string()
+		case 5:
+			c.Certificate, err = f.copyBytes()
+		}
+		return
+	})
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func wireTestMessages() []WireMessage {
+	return []WireMessage{
+		&RegisterMsg{Node_id: 3, Version: "1.0", PeerStateHash: "a", NhStateHash: "b", SuperParamStateHash: "c", JWTSecret: JWTSecret{1, 2, 3}, HttpPostCount: 1 << 40, Features: FeatureSequence | FeatureWireFormat, PSKVersion: 3, PubKey: [32]byte{6}, PubKeyAlt: [32]byte{7}},
+		&ServerUpdateMsg{Node_id: NodeID_SuperNode, Action: UpdateSuperParams, Code: -1, Params: "{}"},
+		&PingMsg{RequestID: 7, Src_nodeID: 2, Time: time.Unix(0, time.Now().UnixNano()), RequestReply: 1, Features: FeatureCompression | FeatureWireFormat, LossRate: 0.25, Certificate: []byte{1, 2, 3}},
+		&PongMsg{RequestID: 7, Src_nodeID: 2, Dst_nodeID: 1, Timediff: 0.001, TimeToAlive: 15, AdditionalCost: -1, Features: FeatureFEC},
+		&QueryPeerMsg{Request_ID: 9},
+		&BoardcastPeerMsg{Request_ID: 9, NodeID: 4, PubKey: [32]byte{5}, ConnURL: "[::1]:3456", Certificate: []byte{4}},
+	}
+}
+
+// parseWireTest parses bin into the same type as msg.
+func parseWireTest(msg WireMessage, bin []byte) (WireMessage, error) {
+	switch msg.(type) {
+	case *RegisterMsg:
+		m, err := ParseRegisterMsg(bin)
+		return &m, err
+	case *ServerUpdateMsg:
+		m, err := ParseServerUpdateMsg(bin)
+		return &m, err
+	case *PingMsg:
+		m, err := ParsePingMsg(bin)
+		return &m, err
+	case *PongMsg:
+		m, err := ParsePongMsg(bin)
+		return &m, err
+	case *QueryPeerMsg:
+		m, err := ParseQueryPeerMsg(bin)
+		return &m, err
+	case *BoardcastPeerMsg:
+		m, err := ParseBoardcastPeerMsg(bin)
+		return &m, err
+	}
+	panic("unknown message")
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	for _, msg := range wireTestMessages() {
+		got, err := parseWireTest(msg, msg.MarshalWire())
+		if err != nil {
+			t.Errorf("%T: %v", msg, err)
+		} else if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T: got %+v, want %+v", msg, got, msg)
+		}
+		// messages of older nodes
+		gob, _ := GetByte(msg)
+		got, err = parseWireTest(msg, gob)
+		if err != nil {
+			t.Errorf("%T gob: %v", msg, err)
+		} else if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T gob: got %+v, want %+v", msg, got, msg)
+		}
+	}
+}
+
+func TestWireUnknownFields(t *testing.T) {
+	msg := &PongMsg{RequestID: 1, Src_nodeID: 2, Dst_nodeID: 3, Features: FeatureFEC}
+	bin := msg.MarshalWire()
+	// a newer node added fields 100, 101 and 102 of all wire types
+	bin = binary.AppendUvarint(bin, 100<<3|wireVarint)
+	bin = binary.AppendUvarint(bin, 12345)
+	bin = binary.AppendUvarint(bin, 101<<3|wireFixed64)
+	bin = append(bin, make([]byte, 8)...)
+	bin = binary.AppendUvarint(bin, 102<<3|wireBytes)
+	bin = binary.AppendUvarint(bin, 3)
+	bin = append(bin, "new"...)
+	bin = append(bin, (&PongMsg{TimeToAlive: 2}).MarshalWire()[wireHeaderLen:]...)
+	got, err := ParsePongMsg(bin)
+	msg.TimeToAlive = 2
+	if err != nil || got != *msg {
+		t.Errorf("got %+v, %v, want %+v", got, err, msg)
+	}
+	if got, err := ParsePongMsg(append(bin, make([]byte, 15)...)); err != nil || got != *msg {
+		t.Errorf("padded: got %+v, %v, want %+v", got, err, msg)
+	}
+
+	for _, bad := range [][]byte{
+		{WireMagic, WireVersion + 1, byte(WirePong)},
+		{WireMagic, WireVersion, byte(WirePing)},
+		{WireMagic, WireVersion},
+		bin[:len(bin)-1],
+		append(msg.MarshalWire(), 1<<3|wireBytes),
+		append(msg.MarshalWire(), 8<<3|7),
+	} {
+		if _, err := ParsePongMsg(bad); err == nil {
+			t.Errorf("%x parsed", bad)
+		}
+	}
+}
+
+// fuzzWire checks that parsing never panics, and that a parsed wire message encodes stably.
+func fuzzWire(f *testing.F, msg WireMessage) {
+	f.Add(msg.MarshalWire())
+	gob, _ := GetByte(msg)
+	f.Add(gob)
+	f.Fuzz(func(t *testing.T, bin []byte) {
+		parsed, err := parseWireTest(msg, bin)
+		if err != nil || !IsWireFormat(bin) {
+			return
+		}
+		bin1 := parsed.MarshalWire()
+		parsed1, err := parseWireTest(msg, bin1)
+		if err != nil {
+			t.Fatalf("%x: reencoded %x does not parse: %v", bin, bin1, err)
+		}
+		if bin2 := parsed1.MarshalWire(); !bytes.Equal(bin1, bin2) {
+			t.Fatalf("%x: reencoded %x, then %x", bin, bin1, bin2)
+		}
+	})
+}
+
+func FuzzParseRegisterMsg(f *testing.F)      { fuzzWire(f, wireTestMessages()[0]) }
+func FuzzParseServerUpdateMsg(f *testing.F)  { fuzzWire(f, wireTestMessages()[1]) }
+func FuzzParsePingMsg(f *testing.F)          { fuzzWire(f, wireTestMessages()[2]) }
+func FuzzParsePongMsg(f *testing.F)          { fuzzWire(f, wireTestMessages()[3]) }
+func FuzzParseQueryPeerMsg(f *testing.F)     { fuzzWire(f, wireTestMessages()[4]) }
+func FuzzParseBoardcastPeerMsg(f *testing.F) { fuzzWire(f, wireTestMessages()[5]) }
@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+var ErrNoDisjointPath = errors.New("no node-disjoint path")
+
+type arc struct {
+	from int
+	to   int
+}
+
+// Each vertex is split into an in and an out node joined by a single arc,
+// so that a vertex can be used by only one of the paths.
+func splitIn(i int) int  { return 2 * i }
+func splitOut(i int) int { return 2*i + 1 }
+
+// DisjointEdges returns the weighted edges used to compute disjoint paths.
+// Edges with a known latency use it, edges only known from the next hop table count as one.
+func (g *IG) DisjointEdges() map[mtypes.Vertex]map[mtypes.Vertex]float64 {
+	edges := make(map[mtypes.Vertex]map[mtypes.Vertex]float64)
+	add := func(u, v mtypes.Vertex, w float64) {
+		if u == v || u >= mtypes.NodeID_Special || v >= mtypes.NodeID_Special {
+			return
+		}
+		if _, ok := edges[u]; !ok {
+			edges[u] = make(map[mtypes.Vertex]float64)
+		}
+		if _, ok := edges[u][v]; !ok {
+			edges[u][v] = w
+		}
+	}
+	for u := range g.Vertices() {
+		for _, v := range g.Neighbors(u) {
+			if w := g.Weight(u, v, true); w < mtypes.Infinity {
+				add(u, v, w)
+			}
+		}
+	}
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	for u, nh := range g.nhTable {
+		for _, next := range nh {
+			add(u, next, 1)
+		}
+	}
+	return edges
+}
+
+// DisjointPaths returns the two node-disjoint paths from u to v with the lowest total weight,
+// the cheaper one first. Both paths start with u and end with v.
+// It uses Bhandari's algorithm on the graph with split vertices.
+func (g *IG) DisjointPaths(u, v mtypes.Vertex) (paths [2][]mtypes.Vertex, err error) {
+	return disjointPaths(g.DisjointEdges(), u, v)
+}
+
+func disjointPaths(edges map[mtypes.Vertex]map[mtypes.Vertex]float64, u, v mtypes.Vertex) (paths [2][]mtypes.Vertex, err error) {
+	if u == v {
+		return paths, ErrNoDisjointPath
+	}
+	vertSet := map[mtypes.Vertex]bool{u: true, v: true}
+	for a, tos := range edges {
+		vertSet[a] = true
+		for b := range tos {
+			vertSet[b] = true
+		}
+	}
+	vert := make([]mtypes.Vertex, 0, len(vertSet))
+	for x := range vertSet {
+		vert = append(vert, x)
+	}
+	sort.Slice(vert, func(i, j int) bool { return vert[i] < vert[j] })
+	index := make(map[mtypes.Vertex]int, len(vert))
+	for i, x := range vert {
+		index[x] = i
+	}
+
+	arcs := make(map[arc]float64)
+	for i, x := range vert {
+		if x != u && x != v {
+			arcs[arc{splitIn(i), splitOut(i)}] = 0
+		}
+	}
+	for a, tos := range edges {
+		for b, w := range tos {
+			arcs[arc{splitOut(index[a]), splitIn(index[b])}] = w
+		}
+	}
+	src, dst := splitOut(index[u]), splitIn(index[v])
+
+	first := shortestArcs(arcs, 2*len(vert), src, dst)
+	if first == nil {
+		return paths, ErrNoDisjointPath
+	}
+	for _, a := range first {
+		w := arcs[a]
+		delete(arcs, a)
+		arcs[arc{a.to, a.from}] = -w
+	}
+	second := shortestArcs(arcs, 2*len(vert), src, dst)
+	if second == nil {
+		return paths, ErrNoDisjointPath
+	}
+
+	// arcs used by both paths in opposite directions cancel out
+	used := make(map[arc]bool, len(first)+len(second))
+	for _, a := range first {
+		used[a] = true
+	}
+	for _, a := range second {
+		if used[arc{a.to, a.from}] {
+			delete(used, arc{a.to, a.from})
+		} else {
+			used[a] = true
+		}
+	}
+	next := make(map[int][]int)
+	for a := range used {
+		next[a.from] = append(next[a.from], a.to)
+	}
+	if len(next[src]) != 2 {
+		return paths, ErrNoDisjointPath
+	}
+	sort.Ints(next[src])
+	var cost [2]float64
+	for p, start := range next[src] {
+		paths[p] = []mtypes.Vertex{u}
+		prev := u
+		for node := start; ; {
+			x := vert[node/2]
+			if x != prev {
+				cost[p] += edges[prev][x]
+				paths[p] = append(paths[p], x)
+				prev = x
+			}
+			if node == dst {
+				break
+			}
+			if len(next[node]) != 1 || len(paths[p]) > len(vert) {
+				return paths, ErrNoDisjointPath
+			}
+			node = next[node][0]
+		}
+	}
+	if cost[1] < cost[0] {
+		paths[0], paths[1] = paths[1], paths[0]
+	}
+	return paths, nil
+}
+
+// shortestArcs returns the arcs of the shortest path from src to dst with Bellman-Ford,
+// which allows the negative arcs of the residual graph.
+func shortestArcs(arcs map[arc]float64, nodes int, src, dst int) []arc {
+	dist := make([]float64, nodes)
+	prev := make([]int, nodes)
+	for i := range dist {
+		dist[i] = mtypes.Infinity
+		prev[i] = -1
+	}
+	dist[src] = 0
+	for round := 0; round < nodes; round++ {
+		changed := false
+		for a, w := range arcs {
+			if dist[a.from] < mtypes.Infinity && dist[a.from]+w < dist[a.to] {
+				dist[a.to] = dist[a.from] + w
+				prev[a.to] = a.from
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	if dist[dst] >= mtypes.Infinity {
+		return nil
+	}
+	var ret []arc
+	for node := dst; node != src; node = prev[node] {
+		if prev[node] == -1 || len(ret) > nodes {
+			return nil
+		}
+		ret = append([]arc{{prev[node], node}}, ret...)
+	}
+	return ret
+}
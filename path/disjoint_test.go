@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func undirected(list [][3]float64) map[mtypes.Vertex]map[mtypes.Vertex]float64 {
+	edges := make(map[mtypes.Vertex]map[mtypes.Vertex]float64)
+	for _, e := range list {
+		u, v := mtypes.Vertex(e[0]), mtypes.Vertex(e[1])
+		for _, d := range [][2]mtypes.Vertex{{u, v}, {v, u}} {
+			if _, ok := edges[d[0]]; !ok {
+				edges[d[0]] = make(map[mtypes.Vertex]float64)
+			}
+			edges[d[0]][d[1]] = e[2]
+		}
+	}
+	return edges
+}
+
+func checkDisjoint(t *testing.T, paths [2][]mtypes.Vertex, u, v mtypes.Vertex) {
+	seen := make(map[mtypes.Vertex]bool)
+	for _, p := range paths {
+		if len(p) < 2 || p[0] != u || p[len(p)-1] != v {
+			t.Fatalf("path %v doesn't go from %v to %v", p, u, v)
+		}
+		for _, x := range p[1 : len(p)-1] {
+			if seen[x] {
+				t.Fatalf("paths %v share node %v", paths, x)
+			}
+			seen[x] = true
+		}
+	}
+}
+
+func TestDisjointPathsTrap(t *testing.T) {
+	// The shortest path 1-2-3-4 blocks both alternatives,
+	// the best disjoint pair is 1-2-4 and 1-3-4 instead.
+	edges := undirected([][3]float64{
+		{1, 2, 1}, {2, 3, 1}, {3, 4, 1},
+		{1, 3, 3}, {2, 4, 3},
+	})
+	paths, err := disjointPaths(edges, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDisjoint(t, paths, 1, 4)
+	if len(paths[0]) != 3 || len(paths[1]) != 3 {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+}
+
+func TestDisjointPathsDirect(t *testing.T) {
+	edges := undirected([][3]float64{
+		{1, 2, 1}, {1, 3, 1}, {3, 2, 1},
+	})
+	paths, err := disjointPaths(edges, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDisjoint(t, paths, 1, 2)
+	if len(paths[0]) != 2 {
+		t.Fatalf("the direct path should be first: %v", paths)
+	}
+}
+
+func TestDisjointPathsNone(t *testing.T) {
+	// every path goes through 2
+	edges := undirected([][3]float64{
+		{1, 2, 1}, {2, 3, 1}, {2, 4, 1}, {4, 3, 1},
+	})
+	if _, err := disjointPaths(edges, 1, 3); err != ErrNoDisjointPath {
+		t.Fatalf("expected ErrNoDisjointPath, got %v", err)
+	}
+}
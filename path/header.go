@@ -3,6 +3,8 @@ package path
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
@@ -30,8 +32,169 @@ const (
 	PongPacket //Send to everyone, include server
 	QueryPeer
 	BroadcastPeer
+
+	FECParity // Parity of transport packets, between direct peers only
+)
+
+// The high bits of the usage byte carry per-packet flags.
+// Old versions see a flagged packet as an invalid usage and drop it,
+// so flags must only be set when every node on the path supports them.
+type HeaderFlags uint8
+
+const (
+	FlagCompressed HeaderFlags = 1 << 7
+	FlagDuplicate  HeaderFlags = 1 << 6 // a DupHeader with the source route follows the EgHeader
+	FlagFragment   HeaderFlags = 1 << 5 // a FragHeader follows the EgHeader and the DupHeader
+	FlagSequenced  HeaderFlags = 1 << 4 // a SeqHeader follows the EgHeader, on broadcast and spread packets only
+
+	// Flags below only fit into an ExtHeader
+	FlagAuthenticated HeaderFlags = 1 << 0 // an AuthHeader follows the other headers
+	FlagEncrypted     HeaderFlags = 1 << 1 // an E2EHeader follows the other headers, the rest is encrypted for the destination
+
+	HeaderFlagsMask HeaderFlags = 0xF0
+
+	// All flags at once is never valid, it marks an ExtHeader after the EgHeader which carries the flags instead.
+	// Compare with ==, Has matches any flag.
+	FlagExtended HeaderFlags = HeaderFlagsMask
+)
+
+func SplitUsageFlags(b uint8) (Usage, HeaderFlags) {
+	return Usage(b &^ uint8(HeaderFlagsMask)), HeaderFlags(b) & HeaderFlagsMask
+}
+
+func JoinUsageFlags(v Usage, f HeaderFlags) uint8 {
+	return uint8(v) | uint8(f&HeaderFlagsMask)
+}
+
+func (f HeaderFlags) Has(flag HeaderFlags) bool {
+	return f&flag != 0
+}
+
+/* ExtHeader, between a direct peer pair which both support it
+ *
+ *   version | flags | options length (2 bytes, big endian) | options ...
+ *
+ * The flags are the HeaderFlags of the packet, the low 4 bits are reserved for flags
+ * that don't fit into the usage byte. Options are type | length | value.
+ * Receivers skip options they don't know, unless the type has ExtOptionCritical set,
+ * then they drop the packet. The DupHeader, FragHeader and SeqHeader follow the ExtHeader.
+ * The ExtHeader is only sent if a packet needs it, and every hop builds its own.
+ */
+
+const (
+	ExtHeaderVersion = 1
+	ExtHeaderMinLen  = 4
+
+	ExtFlagsKnown HeaderFlags = HeaderFlagsMask | FlagAuthenticated | FlagEncrypted
+)
+
+type ExtOptionType uint8
+
+const (
+	ExtOptionPad ExtOptionType = 0 // ignored, for alignment
+
+	ExtOptionCritical ExtOptionType = 1 << 7
 )
 
+type ExtOption struct {
+	Type  ExtOptionType
+	Value []byte
+}
+
+type ExtHeader struct {
+	Flags   HeaderFlags
+	Options []ExtOption
+}
+
+// Needed reports whether the flags and options can't be sent in the usage byte alone.
+func (h *ExtHeader) Needed() bool {
+	return h.Flags&^HeaderFlagsMask != 0 || h.Flags == FlagExtended || len(h.Options) != 0
+}
+
+func (h *ExtHeader) Len() int {
+	n := ExtHeaderMinLen
+	for _, o := range h.Options {
+		n += 2 + len(o.Value)
+	}
+	return n
+}
+
+// Marshal writes the header to buf, which must have h.Len() bytes.
+func (h *ExtHeader) Marshal(buf []byte) error {
+	if len(buf) != h.Len() || h.Len() > math.MaxUint16 {
+		return errors.New("invalid ExtHeader size")
+	}
+	buf[0] = ExtHeaderVersion
+	buf[1] = uint8(h.Flags)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-ExtHeaderMinLen))
+	buf = buf[ExtHeaderMinLen:]
+	for _, o := range h.Options {
+		if len(o.Value) > math.MaxUint8 {
+			return errors.New("ExtHeader option too large")
+		}
+		buf[0] = uint8(o.Type)
+		buf[1] = uint8(len(o.Value))
+		copy(buf[2:], o.Value)
+		buf = buf[2+len(o.Value):]
+	}
+	return nil
+}
+
+// Insert writes packet to buf with the header after its EgHeader.
+// buf must be h.Len() bytes longer than packet.
+func (h *ExtHeader) Insert(buf []byte, packet []byte) error {
+	n := h.Len()
+	if len(packet) < EgHeaderLen || len(buf) != len(packet)+n {
+		return errors.New("invalid packet size")
+	}
+	if err := h.Marshal(buf[EgHeaderLen : EgHeaderLen+n]); err != nil {
+		return err
+	}
+	copy(buf[:EgHeaderLen], packet[:EgHeaderLen])
+	copy(buf[EgHeaderLen+n:], packet[EgHeaderLen:])
+	return nil
+}
+
+// ParseExtHeader parses the ExtHeader at the start of body and returns its length.
+// Options of the types in known are returned, the others are skipped.
+func ParseExtHeader(body []byte, known ...ExtOptionType) (h ExtHeader, n int, err error) {
+	if len(body) < ExtHeaderMinLen {
+		return h, 0, errors.New("ExtHeader truncated")
+	}
+	if body[0] != ExtHeaderVersion {
+		return h, 0, fmt.Errorf("unsupported ExtHeader version %v", body[0])
+	}
+	h.Flags = HeaderFlags(body[1])
+	if h.Flags&^ExtFlagsKnown != 0 || h.Flags == FlagExtended {
+		return h, 0, fmt.Errorf("unsupported ExtHeader flags %#x", body[1])
+	}
+	n = ExtHeaderMinLen + int(binary.BigEndian.Uint16(body[2:4]))
+	if len(body) < n {
+		return h, 0, errors.New("ExtHeader truncated")
+	}
+options:
+	for opts := body[ExtHeaderMinLen:n]; len(opts) > 0; {
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return h, 0, errors.New("ExtHeader option truncated")
+		}
+		o := ExtOption{Type: ExtOptionType(opts[0]), Value: opts[2 : 2+opts[1]]}
+		opts = opts[2+len(o.Value):]
+		if o.Type == ExtOptionPad {
+			continue
+		}
+		for _, t := range known {
+			if o.Type == t {
+				h.Options = append(h.Options, o)
+				continue options
+			}
+		}
+		if o.Type&ExtOptionCritical != 0 {
+			return h, 0, fmt.Errorf("unknown critical ExtHeader option %v", o.Type)
+		}
+	}
+	return h, n, nil
+}
+
 func (v Usage) IsValid_EgType() bool {
 	if v >= NormalPacket && v <= BroadcastPeer {
 		return true
@@ -63,6 +226,8 @@ func (v Usage) ToString() string {
 		return "QueryPeer"
 	case BroadcastPeer:
 		return "BroadcastPeer"
+	case FECParity:
+		return "FECParity"
 	default:
 		return "Unknown:" + string(uint8(v))
 	}
@@ -0,0 +1,64 @@
+package path
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtHeader(t *testing.T) {
+	const optionFlow, optionNew = ExtOptionType(1), ExtOptionType(2)
+	h := ExtHeader{
+		Flags: FlagCompressed | FlagFragment,
+		Options: []ExtOption{
+			{Type: optionFlow, Value: []byte{1, 2, 3}},
+			{Type: ExtOptionPad, Value: make([]byte, 5)},
+			{Type: optionNew, Value: []byte("skipped")},
+		},
+	}
+	if !h.Needed() || (&ExtHeader{Flags: FlagCompressed}).Needed() || !(&ExtHeader{Flags: 1}).Needed() {
+		t.Error("Needed is wrong")
+	}
+	packet := []byte{0, 2, 0, 1, 'p', 'a', 'y', 'l', 'o', 'a', 'd'}
+	buf := make([]byte, len(packet)+h.Len())
+	if err := h.Insert(buf, packet); err != nil {
+		t.Fatal(err)
+	}
+	got, n, err := ParseExtHeader(buf[EgHeaderLen:], optionFlow)
+	if err != nil || n != h.Len() {
+		t.Fatalf("parse: %v, length %v, want %v", err, n, h.Len())
+	}
+	want := ExtHeader{Flags: h.Flags, Options: h.Options[:1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !bytes.Equal(buf[:EgHeaderLen], packet[:EgHeaderLen]) || !bytes.Equal(buf[EgHeaderLen+n:], packet[EgHeaderLen:]) {
+		t.Errorf("packet %x, want %x around the header", buf, packet)
+	}
+
+	critical := ExtHeader{Options: []ExtOption{{Type: ExtOptionCritical | optionNew}}}
+	buf = make([]byte, critical.Len())
+	critical.Marshal(buf)
+	if err := critical.Marshal(buf[1:]); err == nil {
+		t.Error("marshaled into a short buffer")
+	}
+	if _, _, err := ParseExtHeader(buf, optionFlow); err == nil {
+		t.Error("unknown critical option skipped")
+	}
+	if _, _, err := ParseExtHeader(buf, ExtOptionCritical|optionNew); err != nil {
+		t.Errorf("known critical option: %v", err)
+	}
+
+	for _, bad := range [][]byte{
+		{ExtHeaderVersion, 0, 0},
+		{ExtHeaderVersion + 1, 0, 0, 0},
+		{ExtHeaderVersion, 4, 0, 0},
+		{ExtHeaderVersion, uint8(FlagExtended), 0, 0},
+		{ExtHeaderVersion, 0, 0, 3, byte(optionFlow), 2, 0},
+		{ExtHeaderVersion, 0, 0, 1, byte(optionFlow)},
+	} {
+		if _, _, err := ParseExtHeader(bad); err == nil {
+			t.Errorf("%x parsed", bad)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package path
 
 import (
-	"fmt"
 	"sort"
 	"time"
 
@@ -28,8 +27,8 @@ func (g *IG) InitNTP() {
 		g.SyncTimeMultiple(-1)
 		go g.RoutineSyncTime()
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: NTP sync disabled")
+		if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+			g.log.Infof(mtypes.LogCatNTP, nil, "NTP sync disabled")
 		}
 	}
 }
@@ -87,8 +86,8 @@ func (g *IG) SyncTimeMultiple(count int) {
 			results = append(results, result.ClockOffset)
 		}
 	}
-	if g.loglevel.LogNTP {
-		fmt.Println("NTP: All done")
+	if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+		g.log.Infof(mtypes.LogCatNTP, nil, "All done")
 	}
 	sort.Sort(ByDuration(results))
 	if len(results) > 3 {
@@ -100,32 +99,32 @@ func (g *IG) SyncTimeMultiple(count int) {
 	}
 	if len(results) > 0 {
 		avgtime := totaltime / time.Duration(len(results))
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: Arvage offset: " + avgtime.String())
+		if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+			g.log.Infof(mtypes.LogCatNTP, nil, "Arvage offset: %v", avgtime.String())
 		}
 		g.ntp_offset = avgtime
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: All server failed, skip sync")
+		if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+			g.log.Infof(mtypes.LogCatNTP, nil, "All server failed, skip sync")
 		}
 	}
 
 }
 
 func (g *IG) SyncTime(url string, timeout time.Duration) {
-	if g.loglevel.LogNTP {
-		fmt.Println("NTP: Starting syncing with NTP server :" + url)
+	if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+		g.log.Infof(mtypes.LogCatNTP, mtypes.LogFields{"endpoint": url}, "Starting syncing with NTP server")
 	}
 	options := ntp.QueryOptions{Timeout: timeout}
 	response, err := ntp.QueryWithOptions(url, options)
 	if err == nil {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP:  NTP server :" + url + "\tResult:" + response.ClockOffset.String() + " RTT:" + response.RTT.String())
+		if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+			g.log.Infof(mtypes.LogCatNTP, mtypes.LogFields{"endpoint": url}, "Result:%v RTT:%v", response.ClockOffset.String(), response.RTT.String())
 		}
 		g.ntp_servers.Set(url, *response)
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP:  NTP server :" + url + "\tFailed :" + err.Error())
+		if g.log.Enabled(mtypes.LogCatNTP, mtypes.LogLevelInfo) {
+			g.log.Infof(mtypes.LogCatNTP, mtypes.LogFields{"endpoint": url}, "Failed :%v", err)
 		}
 		g.ntp_servers.Set(url, ntp.Response{
 			RTT: forever + time.Since(g.ntp_init_t),
@@ -7,6 +7,7 @@ import (
 	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
@@ -33,6 +34,7 @@ type Fullroute struct {
 
 // IG is a graph of integers that satisfies the Graph interface.
 type IG struct {
+	nhVersion            uint32 // accessed atomically, bumped whenever nhTable is replaced
 	Vert                 map[mtypes.Vertex]bool
 	edges                map[mtypes.Vertex]map[mtypes.Vertex]*Latency
 	edgelock             *sync.RWMutex
@@ -47,7 +49,7 @@ type IG struct {
 	changed              bool
 	NhTableExpire        time.Time
 	IsSuperMode          bool
-	loglevel             mtypes.LoggerInfo
+	log                  *mtypes.Logger
 
 	ntp_wg      sync.WaitGroup
 	ntp_info    mtypes.NTPInfo
@@ -56,7 +58,7 @@ type IG struct {
 	ntp_servers orderedmap.OrderedMap // serverurl:lentancy
 }
 
-func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting, ntpinfo mtypes.NTPInfo, loglevel mtypes.LoggerInfo) (*IG, error) {
+func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting, ntpinfo mtypes.NTPInfo, log *mtypes.Logger) (*IG, error) {
 	g := IG{
 		edgelock:             &sync.RWMutex{},
 		gsetting:             theconfig,
@@ -67,7 +69,7 @@ func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateS
 	g.Vert = make(map[mtypes.Vertex]bool, num_node)
 	g.edges = make(map[mtypes.Vertex]map[mtypes.Vertex]*Latency, num_node)
 	g.IsSuperMode = IsSuperMode
-	g.loglevel = loglevel
+	g.log = log
 	g.InitNTP()
 	return &g, nil
 }
@@ -150,6 +152,7 @@ func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
 		}
 	}
 	g.dlTable, g.dlTable_noAC, g.nhTable = dist, dist_noAC, next
+	atomic.AddUint32(&g.nhVersion, 1)
 	g.recalculateTime = time.Now()
 
 	return
@@ -342,8 +345,8 @@ func (g *IG) RemoveAllNegativeValue() {
 	for u := range vert {
 		for v := range vert {
 			if g.Weight(u, v, true) < 0 {
-				if g.loglevel.LogInternal {
-					fmt.Printf("Internal: Remove negative value : edge[%v][%v] = 0\n", u, v)
+				if g.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					g.log.Infof(mtypes.LogCatInternal, nil, "Remove negative value : edge[%v][%v] = 0", u.ToString(), v.ToString())
 				}
 				g.SetWeight(u, v, 0)
 			}
@@ -352,11 +355,11 @@ func (g *IG) RemoveAllNegativeValue() {
 }
 
 func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.DistTable, next mtypes.NextHopTable, err error) {
-	if g.loglevel.LogInternal {
+	if g.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
 		if !again {
-			fmt.Println("Internal: Start Floyd Warshall algorithm")
+			g.log.Infof(mtypes.LogCatInternal, nil, "Start Floyd Warshall algorithm")
 		} else {
-			fmt.Println("Internal: Start Floyd Warshall algorithm again")
+			g.log.Infof(mtypes.LogCatInternal, nil, "Start Floyd Warshall algorithm again")
 
 		}
 	}
@@ -402,8 +405,8 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 	for i := range dist {
 		if dist[i][i] < 0 {
 			if !again {
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected")
+				if g.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					g.log.Infof(mtypes.LogCatInternal, nil, "Error: Negative cycle detected")
 				}
 				g.RemoveAllNegativeValue()
 				err = errors.New("negative cycle detected")
@@ -414,8 +417,8 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 				dist_noAC = make(mtypes.DistTable)
 				next = make(mtypes.NextHopTable)
 				err = errors.New("negative cycle detected again")
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected again")
+				if g.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+					g.log.Infof(mtypes.LogCatInternal, nil, "Error: Negative cycle detected again")
 				}
 				return
 			}
@@ -450,10 +453,16 @@ func (g *IG) SetNHTable(nh mtypes.NextHopTable) { // set nhTable from supernode
 	g.edgelock.Lock()
 	defer g.edgelock.Unlock()
 	g.nhTable = nh
+	atomic.AddUint32(&g.nhVersion, 1)
 	g.changed = true
 	g.NhTableExpire = time.Now().Add(g.SuperNodeInfoTimeout)
 }
 
+// NhTableVersion changes whenever the next hop table is replaced, so that users can cache what they derived from it.
+func (g *IG) NhTableVersion() uint32 {
+	return atomic.LoadUint32(&g.nhVersion)
+}
+
 func (g *IG) GetNHTable(recalculate bool) mtypes.NextHopTable {
 	if recalculate && time.Now().After(g.NhTableExpire) {
 		g.RecalculateNhTable(false)
@@ -565,7 +574,7 @@ func Solve(filePath string, pe bool) error {
 		return nil
 	}
 
-	g, _ := NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
+	g, _ := NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 	inputb, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"encoding/binary"
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// virtioNetHdr is the struct virtio_net_hdr the kernel puts in front of every frame on a IFF_VNET_HDR tap
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+const (
+	virtioNetHdrLen = int(unsafe.Sizeof(virtioNetHdr{}))
+	tapOffloads     = unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+	maxGSOFrameSize = 1<<16 + 14 + 8 // an IP packet of 64KiB, ethernet header and two VLAN tags
+	maxGSOSegments  = 128            // a 64KiB segment with an MSS of 536 splits into 123 frames
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagCWR = 0x80
+)
+
+var errBadGSOFrame = errors.New("malformed GSO frame")
+
+func (hdr *virtioNetHdr) decode(b []byte) {
+	hdr.flags = b[0]
+	hdr.gsoType = b[1]
+	hdr.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	hdr.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	hdr.csumStart = binary.LittleEndian.Uint16(b[6:])
+	hdr.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+// checksumAdd adds b to the ones' complement sum
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// l3Offset returns the offset of the IP header, skipping VLAN tags
+func l3Offset(frame []byte) (offset int, ethType uint16) {
+	offset = 12
+	for offset+2 <= len(frame) {
+		ethType = binary.BigEndian.Uint16(frame[offset:])
+		offset += 2
+		if ethType != 0x8100 && ethType != 0x88a8 {
+			return
+		}
+		offset += 2
+	}
+	return -1, 0
+}
+
+// gsoSplit turns a frame read from a IFF_VNET_HDR tap into ordinary frames, written to bufs at offset.
+// The kernel leaves the transport checksum to us, and hands us TCP segments up to 64KiB which are cut to gsoSize here.
+func gsoSplit(frame []byte, hdr virtioNetHdr, bufs [][]byte, sizes []int, offset int) (int, error) {
+	if hdr.gsoType == unix.VIRTIO_NET_HDR_GSO_NONE {
+		if len(frame) > len(bufs[0])-offset {
+			return 0, errBadGSOFrame
+		}
+		out := bufs[0][offset : offset+len(frame)]
+		copy(out, frame)
+		if hdr.flags&unix.VIRTIO_NET_HDR_F_NEEDS_CSUM != 0 {
+			start, field := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+			if field+2 > len(out) {
+				return 0, errBadGSOFrame
+			}
+			// the field holds the pseudo header sum, which is included as is
+			binary.BigEndian.PutUint16(out[field:], checksumFold(checksumAdd(0, out[start:])))
+		}
+		sizes[0] = len(out)
+		return 1, nil
+	}
+
+	if hdr.gsoType&^unix.VIRTIO_NET_HDR_GSO_ECN != unix.VIRTIO_NET_HDR_GSO_TCPV4 && hdr.gsoType&^unix.VIRTIO_NET_HDR_GSO_ECN != unix.VIRTIO_NET_HDR_GSO_TCPV6 {
+		return 0, errBadGSOFrame
+	}
+	ipStart, ethType := l3Offset(frame)
+	l4Start := int(hdr.csumStart)
+	if ipStart < 0 || l4Start+20 > len(frame) || hdr.gsoSize == 0 {
+		return 0, errBadGSOFrame
+	}
+	hdrLen := l4Start + int(frame[l4Start+12]>>4)*4
+	if hdrLen > len(frame) {
+		return 0, errBadGSOFrame
+	}
+	isV4 := ethType == 0x0800
+	var ipHdrLen int
+	var srcDst []byte
+	if isV4 {
+		ipHdrLen = int(frame[ipStart]&0x0f) * 4
+		if ipStart+ipHdrLen > l4Start || frame[ipStart]>>4 != 4 {
+			return 0, errBadGSOFrame
+		}
+		srcDst = frame[ipStart+12 : ipStart+20]
+	} else if ethType == 0x86dd {
+		if ipStart+40 > l4Start || frame[ipStart]>>4 != 6 {
+			return 0, errBadGSOFrame
+		}
+		srcDst = frame[ipStart+8 : ipStart+40]
+	} else {
+		return 0, errBadGSOFrame
+	}
+	// pseudo header without the length, which differs per segment
+	pseudo := checksumAdd(0, srcDst) + unix.IPPROTO_TCP
+
+	payload := frame[hdrLen:]
+	segSize := int(hdr.gsoSize)
+	count := (len(payload) + segSize - 1) / segSize
+	if count > len(bufs) {
+		return 0, ErrTooManySegments
+	}
+	seq := binary.BigEndian.Uint32(frame[l4Start+4:])
+	for i := 0; i < count; i++ {
+		segment := payload[i*segSize:]
+		if len(segment) > segSize {
+			segment = segment[:segSize]
+		}
+		size := hdrLen + len(segment)
+		if size > len(bufs[i])-offset {
+			return 0, errBadGSOFrame
+		}
+		out := bufs[i][offset : offset+size]
+		copy(out, frame[:hdrLen])
+		copy(out[hdrLen:], segment)
+
+		ip := out[ipStart:]
+		if isV4 {
+			binary.BigEndian.PutUint16(ip[2:], uint16(size-ipStart))
+			binary.BigEndian.PutUint16(ip[4:], binary.BigEndian.Uint16(ip[4:])+uint16(i))
+			ip[10], ip[11] = 0, 0
+			binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip[:ipHdrLen])))
+		} else {
+			binary.BigEndian.PutUint16(ip[4:], uint16(size-ipStart-40))
+		}
+
+		tcp := out[l4Start:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i*segSize))
+		if i != 0 {
+			tcp[13] &^= tcpFlagCWR
+		}
+		if i != count-1 {
+			tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+		tcp[16], tcp[17] = 0, 0
+		binary.BigEndian.PutUint16(tcp[16:], checksumFold(checksumAdd(pseudo+uint32(len(tcp)), tcp)))
+		sizes[i] = size
+	}
+	return count, nil
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tsoFrame builds an ethernet frame holding a TCP segment of payload bytes, as a tap with TSO hands it over
+func tsoFrame(isV4 bool, payload int) (frame []byte, l4Start int) {
+	frame = make([]byte, 14)
+	var pseudo uint32
+	if isV4 {
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[4:], 1000)
+		ip[8], ip[9] = 64, unix.IPPROTO_TCP
+		copy(ip[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+		pseudo = checksumAdd(0, ip[12:20])
+		frame = append(frame, ip...)
+	} else {
+		binary.BigEndian.PutUint16(frame[12:], 0x86dd)
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		ip[6], ip[7] = unix.IPPROTO_TCP, 64
+		ip[23], ip[39] = 1, 2
+		pseudo = checksumAdd(0, ip[8:40])
+		frame = append(frame, ip...)
+	}
+	l4Start = len(frame)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint32(tcp[4:], 0xfffffff0) // wraps around
+	tcp[12] = 5 << 4
+	tcp[13] = tcpFlagCWR | tcpFlagPSH | tcpFlagFIN | 0x10
+	// like the kernel, leave the pseudo header sum in the checksum field
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(pseudo+unix.IPPROTO_TCP))
+	frame = append(frame, tcp...)
+	for i := 0; i < payload; i++ {
+		frame = append(frame, byte(i))
+	}
+	return
+}
+
+func checkSegment(t *testing.T, isV4 bool, segment []byte, l4Start int) {
+	ip := segment[14:l4Start]
+	var pseudo uint32
+	if isV4 {
+		if checksumFold(checksumAdd(0, ip)) != 0 {
+			t.Errorf("bad IPv4 header checksum")
+		}
+		if int(binary.BigEndian.Uint16(ip[2:])) != len(segment)-14 {
+			t.Errorf("bad IPv4 total length %v", binary.BigEndian.Uint16(ip[2:]))
+		}
+		pseudo = checksumAdd(0, ip[12:20])
+	} else {
+		if int(binary.BigEndian.Uint16(ip[4:])) != len(segment)-l4Start {
+			t.Errorf("bad IPv6 payload length %v", binary.BigEndian.Uint16(ip[4:]))
+		}
+		pseudo = checksumAdd(0, ip[8:40])
+	}
+	tcp := segment[l4Start:]
+	if checksumFold(checksumAdd(pseudo+unix.IPPROTO_TCP+uint32(len(tcp)), tcp)) != 0 {
+		t.Errorf("bad TCP checksum")
+	}
+}
+
+func TestGSOSplit(t *testing.T) {
+	const mss, payload = 1000, 4500
+	for _, isV4 := range []bool{true, false} {
+		frame, l4Start := tsoFrame(isV4, payload)
+		hdr := virtioNetHdr{
+			flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+			gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV6,
+			gsoSize:    mss,
+			csumStart:  uint16(l4Start),
+			csumOffset: 16,
+		}
+		if isV4 {
+			hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV4
+		}
+		const offset = 8
+		bufs := make([][]byte, 8)
+		for i := range bufs {
+			bufs[i] = make([]byte, 1500)
+		}
+		sizes := make([]int, len(bufs))
+		count, err := gsoSplit(frame, hdr, bufs, sizes, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 5 {
+			t.Fatalf("got %v segments, want 5", count)
+		}
+		for i := 0; i < count; i++ {
+			segment := bufs[i][offset : offset+sizes[i]]
+			want := mss
+			if i == count-1 {
+				want = payload % mss
+			}
+			if len(segment) != l4Start+20+want {
+				t.Fatalf("segment %v: size %v, want %v", i, len(segment), l4Start+20+want)
+			}
+			if !bytes.Equal(segment[l4Start+20:], frame[l4Start+20+i*mss:][:want]) {
+				t.Errorf("segment %v: payload mismatch", i)
+			}
+			if seq := binary.BigEndian.Uint32(segment[l4Start+4:]); seq != 0xfffffff0+uint32(i*mss) {
+				t.Errorf("segment %v: seq %x", i, seq)
+			}
+			flags := segment[l4Start+13]
+			if (flags&tcpFlagCWR != 0) != (i == 0) || (flags&(tcpFlagFIN|tcpFlagPSH) != 0) != (i == count-1) {
+				t.Errorf("segment %v: flags %x", i, flags)
+			}
+			if isV4 && binary.BigEndian.Uint16(segment[18:]) != 1000+uint16(i) {
+				t.Errorf("segment %v: IPv4 id %v", i, binary.BigEndian.Uint16(segment[18:]))
+			}
+			checkSegment(t, isV4, segment, l4Start)
+		}
+
+		if _, err := gsoSplit(frame, hdr, bufs[:4], sizes, offset); err != ErrTooManySegments {
+			t.Errorf("got %v, want ErrTooManySegments", err)
+		}
+	}
+}
+
+func TestGSONeedsChecksum(t *testing.T) {
+	frame, l4Start := tsoFrame(true, 333)
+	// a frame within the MTU is complete, except for the TCP checksum
+	ip, tcp := frame[14:l4Start], frame[l4Start:]
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(frame)-14))
+	binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip)))
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(0, ip[12:20])+unix.IPPROTO_TCP+uint32(len(tcp))))
+	hdr := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		csumStart:  uint16(l4Start),
+		csumOffset: 16,
+	}
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	count, err := gsoSplit(frame, hdr, bufs, sizes, 0)
+	if err != nil || count != 1 || sizes[0] != len(frame) {
+		t.Fatalf("got %v frames of %v bytes: %v", count, sizes[0], err)
+	}
+	checkSegment(t, true, bufs[0][:sizes[0]], l4Start)
+}
@@ -139,3 +139,14 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// ErrTooManySegments is returned by ReadBatch if a frame splits into more segments than bufs holds. The frame is dropped.
+var ErrTooManySegments = errors.New("too many segments")
+
+// BatchDevice is implemented by devices which have several queues, or may return several frames per read.
+// Each queue is read by a single goroutine.
+type BatchDevice interface {
+	Queues() int                                                              // number of queues to read
+	BatchSize() int                                                           // frames ReadBatch may return at once
+	ReadBatch(queue int, bufs [][]byte, sizes []int, offset int) (int, error) // reads frames from a queue into bufs at offset
+}
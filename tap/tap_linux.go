@@ -38,6 +38,9 @@ const (
 
 type NativeTap struct {
 	tapFile                 *os.File
+	queues                  []*os.File // one file per IFF_MULTI_QUEUE queue, the first is tapFile
+	vnetHdr                 bool       // the device was passed IFF_VNET_HDR
+	scratch                 [][]byte   // per queue buffer for frames with a virtio_net_hdr
 	index                   int32      // if index
 	errors                  chan error // async error handling
 	events                  chan Event // device related events
@@ -401,11 +404,24 @@ func (tap *NativeTap) nameSlow() (string, error) {
 }
 
 func (tap *NativeTap) Write(buf []byte, offset int) (int, error) {
+	if tap.vnetHdr {
+		// an all zero virtio_net_hdr: no offloads, checksums are complete
+		if offset >= virtioNetHdrLen {
+			offset -= virtioNetHdrLen
+			copy(buf[offset:offset+virtioNetHdrLen], make([]byte, virtioNetHdrLen))
+		} else {
+			buf = append(make([]byte, virtioNetHdrLen), buf[offset:]...)
+			offset = 0
+		}
+	}
 	buf = buf[offset:]
 	n, err := tap.tapFile.Write(buf)
 	if errors.Is(err, syscall.EBADFD) {
 		err = os.ErrClosed
 	}
+	if tap.vnetHdr && n >= virtioNetHdrLen {
+		n -= virtioNetHdrLen
+	}
 	return n, err
 }
 
@@ -415,14 +431,51 @@ func (tap *NativeTap) Flush() error {
 }
 
 func (tap *NativeTap) Read(buf []byte, offset int) (n int, err error) {
+	var sizes [1]int
+	_, err = tap.ReadBatch(0, [][]byte{buf}, sizes[:], offset)
+	return sizes[0], err
+}
+
+func (tap *NativeTap) Queues() int {
+	return len(tap.queues)
+}
+
+func (tap *NativeTap) BatchSize() int {
+	if tap.vnetHdr {
+		return maxGSOSegments
+	}
+	return 1
+}
+
+func (tap *NativeTap) ReadBatch(queue int, bufs [][]byte, sizes []int, offset int) (count int, err error) {
 	select {
 	case err = <-tap.errors:
+		return
 	default:
-		n, err = tap.tapFile.Read(buf[offset:])
+	}
+	if !tap.vnetHdr {
+		sizes[0], err = tap.queues[queue].Read(bufs[0][offset:])
 		if errors.Is(err, syscall.EBADFD) {
 			err = os.ErrClosed
 		}
-
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	scratch := tap.scratch[queue]
+	n, err := tap.queues[queue].Read(scratch)
+	if errors.Is(err, syscall.EBADFD) {
+		err = os.ErrClosed
+	}
+	if err != nil || n < virtioNetHdrLen {
+		return 0, err
+	}
+	var hdr virtioNetHdr
+	hdr.decode(scratch)
+	count, err = gsoSplit(scratch[virtioNetHdrLen:n], hdr, bufs, sizes, offset)
+	if err == errBadGSOFrame {
+		return 0, nil
 	}
 	return
 }
@@ -443,6 +496,9 @@ func (tap *NativeTap) Close() error {
 			close(tap.events)
 		}
 		err2 = tap.tapFile.Close()
+		for _, file := range tap.queues[1:] {
+			file.Close()
+		}
 	})
 	if err1 != nil {
 		return err1
@@ -450,24 +506,21 @@ func (tap *NativeTap) Close() error {
 	return err2
 }
 
-func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+// openQueue attaches a new queue to the tap named name, or creates it. It returns the name the kernel picked.
+func openQueue(name string, flags uint16) (*os.File, string, error) {
 	nfd, err := unix.Open(cloneDevicePath, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("CreateTAP(%q) failed; %s does not exist", iconfig.Name, cloneDevicePath)
+			return nil, "", fmt.Errorf("CreateTAP(%q) failed; %s does not exist", name, cloneDevicePath)
 		}
-		return nil, err
+		return nil, "", err
 	}
 
 	var ifr [ifReqSize]byte
-	var flags uint16 = unix.IFF_TAP | unix.IFF_NO_PI // (disabled for TUN status hack)
-	if err != nil {
-		fmt.Println("ERROR: Failed parse mac address:", iconfig.MacAddrPrefix)
-		return nil, err
-	}
-	nameBytes := []byte(iconfig.Name)
+	nameBytes := []byte(name)
 	if len(nameBytes) >= unix.IFNAMSIZ {
-		return nil, fmt.Errorf("interface name too long: %w", unix.ENAMETOOLONG)
+		unix.Close(nfd)
+		return nil, "", fmt.Errorf("interface name too long: %w", unix.ENAMETOOLONG)
 	}
 	copy(ifr[:], nameBytes)
 	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
@@ -479,28 +532,82 @@ func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, erro
 		uintptr(unsafe.Pointer(&ifr[0])),
 	)
 	if errno != 0 {
-		return nil, errno
+		unix.Close(nfd)
+		return nil, "", errno
+	}
+	if flags&unix.IFF_VNET_HDR != 0 {
+		// best effort, without offloads the kernel just sends empty headers
+		unix.Syscall(
+			unix.SYS_IOCTL,
+			uintptr(nfd),
+			uintptr(unix.TUNSETOFFLOAD),
+			uintptr(tapOffloads),
+		)
 	}
 	err = unix.SetNonblock(nfd, true)
+	if err != nil {
+		unix.Close(nfd)
+		return nil, "", err
+	}
 
 	// Note that the above -- open,ioctl,nonblock -- must happen prior to handing it to netpoll as below this line.
 
-	fd := os.NewFile(uintptr(nfd), cloneDevicePath)
-	if err != nil {
-		return nil, err
+	if i := bytes.IndexByte(ifr[:unix.IFNAMSIZ], 0); i != -1 {
+		name = string(ifr[:i])
 	}
+	return os.NewFile(uintptr(nfd), cloneDevicePath), name, nil
+}
 
-	return CreateTAPFromFile(fd, iconfig, NodeID)
+func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+	var flags uint16 = unix.IFF_TAP | unix.IFF_NO_PI // (disabled for TUN status hack)
+	queues := iconfig.Queues
+	if queues < 1 {
+		queues = 1
+	}
+	if queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	if iconfig.VnetHdr {
+		flags |= unix.IFF_VNET_HDR
+	}
+
+	files := make([]*os.File, 0, queues)
+	name := iconfig.Name
+	for i := 0; i < queues; i++ {
+		file, qname, err := openQueue(name, flags)
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+		name = qname
+	}
+
+	return createTAPFromQueues(files, iconfig.VnetHdr, iconfig, NodeID)
 }
 
 func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+	return createTAPFromQueues([]*os.File{file}, false, iconfig, NodeID)
+}
+
+func createTAPFromQueues(files []*os.File, vnetHdr bool, iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
 	tap := &NativeTap{
-		tapFile:                 file,
+		tapFile:                 files[0],
+		queues:                  files,
+		vnetHdr:                 vnetHdr,
 		events:                  make(chan Event, 5),
 		errors:                  make(chan error, 5),
 		statusListenersShutdown: make(chan struct{}),
 		nopi:                    false,
 	}
+	if vnetHdr {
+		tap.scratch = make([][]byte, len(files))
+		for i := range tap.scratch {
+			tap.scratch[i] = make([]byte, virtioNetHdrLen+maxGSOFrameSize)
+		}
+	}
 
 	name, err := tap.Name()
 	if err != nil {
@@ -603,6 +710,7 @@ func CreateUnmonitoredTUNFromFD(fd int) (Device, string, error) {
 	file := os.NewFile(uintptr(fd), "/dev/tap")
 	tap := &NativeTap{
 		tapFile: file,
+		queues:  []*os.File{file},
 		events:  make(chan Event, 5),
 		errors:  make(chan error, 5),
 		nopi:    true,
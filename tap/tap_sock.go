@@ -2,7 +2,6 @@ package tap
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"time"
 
@@ -17,14 +16,14 @@ type SockServerTap struct {
 	connRx   *net.Conn
 	connTx   *net.Conn
 	static   bool
-	loglevel mtypes.LoggerInfo
+	log      *mtypes.Logger
 
 	closed bool
 	events chan Event
 }
 
 // New creates and returns a new TUN interface for the application.
-func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.Vertex, loglevel mtypes.LoggerInfo) (tapdev Device, err error) {
+func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.Vertex, log *mtypes.Logger) (tapdev Device, err error) {
 	// Setup TUN Config
 
 	tap := &SockServerTap{
@@ -36,7 +35,7 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 		connTx:   nil,
 		static:   false,
 		closed:   false,
-		loglevel: loglevel,
+		log:      log,
 		events:   make(chan Event, 1<<5),
 	}
 
@@ -83,17 +82,17 @@ func (tap *SockServerTap) RoutineAcceptConnection() {
 			return
 		}
 		if err != nil {
-			if tap.loglevel.LogInternal {
-				fmt.Printf("Internal: Accept error %v\n", err)
+			if tap.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				tap.log.Infof(mtypes.LogCatInternal, nil, "Accept error %v", err)
 			}
 			continue
 		}
-		if tap.loglevel.LogInternal {
-			fmt.Printf("Internal: New connection accepted from %v\n", conn.RemoteAddr())
+		if tap.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			tap.log.Infof(mtypes.LogCatInternal, mtypes.LogFields{"endpoint": conn.RemoteAddr().String()}, "New connection accepted")
 		}
 		if tap.connRx != nil {
-			if tap.loglevel.LogInternal {
-				fmt.Printf("Internal: Old connection %v closed due to new connection\n", (*tap.connRx).RemoteAddr())
+			if tap.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+				tap.log.Infof(mtypes.LogCatInternal, mtypes.LogFields{"endpoint": (*tap.connRx).RemoteAddr().String()}, "Old connection closed due to new connection")
 			}
 			(*tap.connRx).Close()
 		}
@@ -118,8 +117,8 @@ func (tap *SockServerTap) Read(buf []byte, offset int) (size int, err error) {
 	}
 	size, err = (*tap.connRx).Read(buf[offset:])
 	if err != nil && tap.server != nil {
-		if tap.loglevel.LogInternal {
-			fmt.Printf("Internal: Connection closed: %v\n", (*tap.connRx).RemoteAddr())
+		if tap.log.Enabled(mtypes.LogCatInternal, mtypes.LogLevelInfo) {
+			tap.log.Infof(mtypes.LogCatInternal, mtypes.LogFields{"endpoint": (*tap.connRx).RemoteAddr().String()}, "Connection closed")
 		}
 		tap.connRx = nil
 		return 0, nil